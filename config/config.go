@@ -25,10 +25,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
@@ -46,6 +48,96 @@ type AuthCache struct {
 	InitialSyncDone bool   `yaml:"initial_sync_done"`
 }
 
+// ScheduledMessage is a message that is sent automatically at a later time.
+type ScheduledMessage struct {
+	ID        string            `json:"id"`
+	RoomID    id.RoomID         `json:"room_id"`
+	MsgType   event.MessageType `json:"msgtype"`
+	Text      string            `json:"text"`
+	SendAt    time.Time         `json:"send_at"`
+	TxnID     string            `json:"txn_id"`
+	LastError string            `json:"last_error,omitempty"`
+}
+
+// Draft is the unsent input of a room, including the reply or edit context.
+type Draft struct {
+	Text           string     `json:"text"`
+	Cursor         int        `json:"cursor"`
+	ReplyTo        id.EventID `json:"reply_to,omitempty"`
+	EditOf         id.EventID `json:"edit_of,omitempty"`
+	TextBeforeEdit string     `json:"text_before_edit,omitempty"`
+	// Unix timestamp in milliseconds, used to pick the latest draft when syncing between devices.
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// IsEmpty returns true if the draft has no text and no reply or edit context.
+func (draft *Draft) IsEmpty() bool {
+	return draft == nil || (len(draft.Text) == 0 && len(draft.ReplyTo) == 0 && len(draft.EditOf) == 0)
+}
+
+const (
+	InputHistoryGlobalSize = 1000
+	InputHistoryRoomSize   = 200
+)
+
+// InputHistory contains previously submitted input lines, oldest first.
+type InputHistory struct {
+	Global []string               `json:"global"`
+	Rooms  map[id.RoomID][]string `json:"rooms"`
+}
+
+// Add appends a submitted line to the global and room histories. Consecutive duplicates are only stored once,
+// and the oldest lines are dropped when the histories are full.
+func (ih *InputHistory) Add(roomID id.RoomID, line string) {
+	ih.Global = appendHistory(ih.Global, line, InputHistoryGlobalSize)
+	if ih.Rooms == nil {
+		ih.Rooms = make(map[id.RoomID][]string)
+	}
+	ih.Rooms[roomID] = appendHistory(ih.Rooms[roomID], line, InputHistoryRoomSize)
+}
+
+func appendHistory(history []string, line string, maxSize int) []string {
+	if len(history) > 0 && history[len(history)-1] == line {
+		return history
+	}
+	history = append(history, line)
+	if len(history) > maxSize {
+		history = append(history[:0], history[len(history)-maxSize:]...)
+	}
+	return history
+}
+
+// CommandAlias is a user-defined command that runs one or more other commands or messages.
+// In config.yaml, it can be written as a single line, a list of lines or a mapping with a description.
+type CommandAlias struct {
+	Description string   `yaml:"description,omitempty"`
+	Usage       string   `yaml:"usage,omitempty"`
+	Steps       []string `yaml:"steps"`
+}
+
+func (alias *CommandAlias) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		alias.Steps = []string{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		return node.Decode(&alias.Steps)
+	default:
+		type rawCommandAlias CommandAlias
+		return node.Decode((*rawCommandAlias)(alias))
+	}
+}
+
+// Hook configures when an executable in the hooks directory is run automatically.
+type Hook struct {
+	// On contains the triggers of the hook: message, highlight and/or invite.
+	On []string `yaml:"on"`
+	// Rooms limits the hook to the given rooms.
+	Rooms []id.RoomID `yaml:"rooms,omitempty"`
+	// Keywords limits message and highlight triggers to messages containing one of the given words.
+	Keywords []string `yaml:"keywords,omitempty"`
+}
+
 type UserPreferences struct {
 	HideUserList         bool `yaml:"hide_user_list"`
 	HideRoomList         bool `yaml:"hide_room_list"`
@@ -60,6 +152,9 @@ type UserPreferences struct {
 	DisableNotifications bool `yaml:"disable_notifications"`
 	DisableShowURLs      bool `yaml:"disable_show_urls"`
 	AltEnterToSend       bool `yaml:"alt_enter_to_send"`
+	SyncDrafts           bool `yaml:"sync_drafts"`
+	ViMode               bool `yaml:"vi_mode"`
+	ShowInputPreview     bool `yaml:"show_input_preview"`
 
 	InlineURLMode string `yaml:"inline_url_mode"`
 }
@@ -91,6 +186,7 @@ type ParsedKeybindings struct {
 	Room   map[Keybind]string
 	Modal  map[Keybind]string
 	Visual map[Keybind]string
+	Vi     map[Keybind]string
 }
 
 type RawKeybindings struct {
@@ -98,6 +194,7 @@ type RawKeybindings struct {
 	Room   map[string]string `yaml:"room,omitempty"`
 	Modal  map[string]string `yaml:"modal,omitempty"`
 	Visual map[string]string `yaml:"visual,omitempty"`
+	Vi     map[string]string `yaml:"vi,omitempty"`
 }
 
 // Config contains the main config of gomuks.
@@ -113,19 +210,37 @@ type Config struct {
 	NotifySound        bool `yaml:"notify_sound"`
 	SendToVerifiedOnly bool `yaml:"send_to_verified_only"`
 
+	NotifyBackend          string `yaml:"notify_backend"`
+	NotifyTerminalProtocol string `yaml:"notify_terminal_protocol"`
+
 	Backspace1RemovesWord bool `yaml:"backspace1_removes_word"`
 	Backspace2RemovesWord bool `yaml:"backspace2_removes_word"`
 
 	AlwaysClearScreen bool `yaml:"always_clear_screen"`
 
+	ChatLogs         bool   `yaml:"chat_logs"`
+	ChatLogFormat    string `yaml:"chat_log_format"`
+	ChatLogEncrypted bool   `yaml:"chat_log_encrypted"`
+
+	HistoryMaxEvents     int  `yaml:"history_max_events"`
+	HistoryMaxAgeDays    int  `yaml:"history_max_age_days"`
+	HistoryDropLeftRooms bool `yaml:"history_drop_left_rooms"`
+
+	CommandAliases map[string]*CommandAlias `yaml:"command_aliases,omitempty"`
+	Hooks          map[string]*Hook         `yaml:"hooks,omitempty"`
+
 	Dir          string `yaml:"-"`
 	DataDir      string `yaml:"data_dir"`
 	CacheDir     string `yaml:"cache_dir"`
 	HistoryPath  string `yaml:"history_path"`
+	HistoryDB    string `yaml:"history_db"`
 	RoomListPath string `yaml:"room_list_path"`
 	MediaDir     string `yaml:"media_dir"`
 	DownloadDir  string `yaml:"download_dir"`
 	StateDir     string `yaml:"state_dir"`
+	LogDir       string `yaml:"log_dir"`
+	HooksDir     string `yaml:"hooks_dir"`
+	SocketPath   string `yaml:"socket_path"`
 
 	Preferences UserPreferences        `yaml:"-"`
 	AuthCache   AuthCache              `yaml:"-"`
@@ -133,7 +248,13 @@ type Config struct {
 	PushRules   *pushrules.PushRuleset `yaml:"-"`
 	Keybindings ParsedKeybindings      `yaml:"-"`
 
-	nosave bool
+	VerifiedMasterKeys map[id.UserID]id.Ed25519 `yaml:"-"`
+	ScheduledMessages  []*ScheduledMessage      `yaml:"-"`
+	Drafts             map[id.RoomID]*Draft     `yaml:"-"`
+	InputHistory       InputHistory             `yaml:"-"`
+
+	nosave   bool
+	lockFile *os.File
 }
 
 // NewConfig creates a config that loads data from the given directory.
@@ -144,23 +265,33 @@ func NewConfig(configDir, dataDir, cacheDir, downloadDir string) *Config {
 		CacheDir:     cacheDir,
 		DownloadDir:  downloadDir,
 		HistoryPath:  filepath.Join(cacheDir, "history.db"),
+		HistoryDB:    filepath.Join(cacheDir, "history.sqlite"),
 		RoomListPath: filepath.Join(cacheDir, "rooms.gob.gz"),
 		StateDir:     filepath.Join(cacheDir, "state"),
 		MediaDir:     filepath.Join(cacheDir, "media"),
+		LogDir:       filepath.Join(dataDir, "logs"),
+		HooksDir:     filepath.Join(configDir, "hooks"),
+		SocketPath:   filepath.Join(dataDir, "gomuks.sock"),
 
 		RoomCacheSize: 32,
 		RoomCacheAge:  1 * 60,
 
-		NotifySound:           true,
-		SendToVerifiedOnly:    false,
-		Backspace1RemovesWord: true,
-		AlwaysClearScreen:     true,
+		NotifySound:            true,
+		NotifyBackend:          "auto",
+		NotifyTerminalProtocol: "auto",
+		SendToVerifiedOnly:     false,
+		Backspace1RemovesWord:  true,
+		AlwaysClearScreen:      true,
 	}
 }
 
 // Clear clears the session cache and removes all history.
 func (config *Config) Clear() {
 	_ = os.Remove(config.HistoryPath)
+	_ = os.Remove(config.HistoryDB)
+	// SQLite would replay a leftover write-ahead log into a new database with the same name.
+	_ = os.Remove(config.HistoryDB + "-wal")
+	_ = os.Remove(config.HistoryDB + "-shm")
 	_ = os.Remove(config.RoomListPath)
 	_ = os.RemoveAll(config.StateDir)
 	_ = os.RemoveAll(config.MediaDir)
@@ -168,9 +299,18 @@ func (config *Config) Clear() {
 	config.nosave = true
 }
 
-// ClearData clears non-temporary session data.
+// ClearData clears non-temporary session data. Chat logs are kept.
 func (config *Config) ClearData() {
-	_ = os.RemoveAll(config.DataDir)
+	entries, err := ioutil.ReadDir(config.DataDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(config.DataDir, entry.Name())
+		if path != filepath.Clean(config.LogDir) {
+			_ = os.RemoveAll(path)
+		}
+	}
 }
 
 func (config *Config) CreateCacheDirs() {
@@ -187,6 +327,10 @@ func (config *Config) DeleteSession() {
 	config.DeviceID = ""
 	config.Rooms = rooms.NewRoomCache(config.RoomListPath, config.StateDir, config.RoomCacheSize, config.RoomCacheAge, config.GetUserID)
 	config.PushRules = nil
+	config.VerifiedMasterKeys = make(map[id.UserID]id.Ed25519)
+	config.ScheduledMessages = nil
+	config.Drafts = make(map[id.RoomID]*Draft)
+	config.InputHistory = InputHistory{}
 
 	config.ClearData()
 	config.Clear()
@@ -201,6 +345,10 @@ func (config *Config) LoadAll() {
 	config.LoadPushRules()
 	config.LoadPreferences()
 	config.LoadKeybindings()
+	config.LoadVerifiedMasterKeys()
+	config.LoadScheduledMessages()
+	config.LoadDrafts()
+	config.LoadInputHistory()
 	err := config.Rooms.LoadList()
 	if err != nil {
 		panic(err)
@@ -221,6 +369,10 @@ func (config *Config) SaveAll() {
 	config.SaveAuthCache()
 	config.SavePushRules()
 	config.SavePreferences()
+	config.SaveVerifiedMasterKeys()
+	config.SaveScheduledMessages()
+	config.SaveDrafts()
+	config.SaveInputHistory()
 	err := config.Rooms.SaveList()
 	if err != nil {
 		panic(err)
@@ -278,6 +430,7 @@ func (config *Config) LoadKeybindings() {
 	config.Keybindings.Room = parseKeybindings(inputConfig.Room)
 	config.Keybindings.Modal = parseKeybindings(inputConfig.Modal)
 	config.Keybindings.Visual = parseKeybindings(inputConfig.Visual)
+	config.Keybindings.Vi = parseKeybindings(inputConfig.Vi)
 }
 
 func (config *Config) SaveKeybindings() {
@@ -307,6 +460,50 @@ func (config *Config) SavePushRules() {
 	config.save("push rules", config.CacheDir, "pushrules.json", &config.PushRules)
 }
 
+func (config *Config) LoadVerifiedMasterKeys() {
+	_ = config.load("verified master keys", config.DataDir, "verified-master-keys.json", &config.VerifiedMasterKeys)
+	if config.VerifiedMasterKeys == nil {
+		config.VerifiedMasterKeys = make(map[id.UserID]id.Ed25519)
+	}
+}
+
+func (config *Config) SaveVerifiedMasterKeys() {
+	if config.VerifiedMasterKeys == nil {
+		return
+	}
+	config.save("verified master keys", config.DataDir, "verified-master-keys.json", &config.VerifiedMasterKeys)
+}
+
+func (config *Config) LoadScheduledMessages() {
+	_ = config.load("scheduled messages", config.DataDir, "scheduled-messages.json", &config.ScheduledMessages)
+}
+
+func (config *Config) SaveScheduledMessages() {
+	config.save("scheduled messages", config.DataDir, "scheduled-messages.json", &config.ScheduledMessages)
+}
+
+func (config *Config) LoadDrafts() {
+	_ = config.load("drafts", config.DataDir, "drafts.json", &config.Drafts)
+	if config.Drafts == nil {
+		config.Drafts = make(map[id.RoomID]*Draft)
+	}
+}
+
+func (config *Config) SaveDrafts() {
+	if config.Drafts == nil {
+		return
+	}
+	config.save("drafts", config.DataDir, "drafts.json", &config.Drafts)
+}
+
+func (config *Config) LoadInputHistory() {
+	_ = config.load("input history", config.DataDir, "input-history.json", &config.InputHistory)
+}
+
+func (config *Config) SaveInputHistory() {
+	config.save("input history", config.DataDir, "input-history.json", &config.InputHistory)
+}
+
 func (config *Config) load(name, dir, file string, target interface{}) error {
 	err := os.MkdirAll(dir, 0700)
 	if err != nil {
@@ -369,7 +566,7 @@ func (config *Config) GetUserID() id.UserID {
 	return config.UserID
 }
 
-const FilterVersion = 1
+const FilterVersion = 2
 
 func (config *Config) SaveFilterID(_ id.UserID, filterID string) {
 	config.AuthCache.FilterID = filterID
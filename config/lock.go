@@ -0,0 +1,52 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrDataDirLocked is returned by Lock if another gomuks process is using the same data directory.
+var ErrDataDirLocked = errors.New("the data directory is in use by another gomuks instance")
+
+// Lock takes an exclusive lock on the data directory, which is held until the process exits.
+func (config *Config) Lock() error {
+	err := os.MkdirAll(config.DataDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(config.DataDir, "gomuks.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		_ = file.Close()
+		return ErrDataDirLocked
+	} else if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to lock data directory: %w", err)
+	}
+	config.lockFile = file
+	return nil
+}
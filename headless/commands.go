@@ -0,0 +1,258 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package headless
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// Command is a one-shot CLI action that is run with the stored session instead of starting the terminal interface.
+type Command struct {
+	Name string
+	Args []string
+
+	Room   string
+	File   string
+	Notice bool
+	Limit  int
+	Follow bool
+}
+
+var commands = map[string]func(ui *HeadlessUI, cmd *Command) error{
+	"send":  cmdSend,
+	"rooms": cmdRooms,
+	"tail":  cmdTail,
+}
+
+// IsCommand returns whether the given name is a CLI subcommand.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// NewCommandUI returns a UI provider that runs the given command and exits.
+func NewCommandUI(cmd *Command) ifc.UIProvider {
+	return func(gmx ifc.Gomuks) ifc.GomuksUI {
+		ui := New(gmx).(*HeadlessUI)
+		ui.command = cmd
+		return ui
+	}
+}
+
+func (ui *HeadlessUI) runCommand() error {
+	if len(ui.gmx.Config().AccessToken) == 0 {
+		return ErrNotLoggedIn
+	}
+	err := commands[ui.command.Name](ui, ui.command)
+	if crypt := ui.gmx.Matrix().Crypto(); crypt != nil {
+		if flushErr := crypt.FlushStore(); flushErr != nil {
+			debug.Print("Failed to flush crypto store:", flushErr)
+		}
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "gomuks %s: %v\n", ui.command.Name, err)
+		os.Exit(1)
+	}
+	if !ui.command.Follow {
+		// Saving isn't necessary, commands don't change anything that isn't saved immediately.
+		ui.gmx.Stop(false)
+	}
+	<-ui.stop
+	return nil
+}
+
+// resolveRoom finds a joined room by ID or alias.
+func resolveRoom(gmx ifc.Gomuks, roomIDOrAlias string) (*rooms.Room, error) {
+	if len(roomIDOrAlias) == 0 {
+		return nil, errors.New("no room specified")
+	}
+	var roomID id.RoomID
+	if roomIDOrAlias[0] == '#' {
+		alias := id.RoomAlias(roomIDOrAlias)
+		cache := gmx.Config().Rooms
+		cache.Lock()
+		for _, room := range cache.Map {
+			if room.CanonicalAliasCache == alias && !room.HasLeft {
+				roomID = room.ID
+				break
+			}
+		}
+		cache.Unlock()
+		if len(roomID) == 0 {
+			resp, err := gmx.Matrix().Client().ResolveAlias(alias)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s: %w", alias, err)
+			}
+			roomID = resp.RoomID
+		}
+	} else {
+		roomID = id.RoomID(roomIDOrAlias)
+	}
+	room := gmx.Matrix().GetRoom(roomID)
+	if room == nil || room.HasLeft {
+		return nil, fmt.Errorf("you're not in %s", roomIDOrAlias)
+	}
+	room.Load()
+	return room, nil
+}
+
+func cmdSend(ui *HeadlessUI, cmd *Command) error {
+	room, err := resolveRoom(ui.gmx, cmd.Room)
+	if err != nil {
+		return err
+	}
+	text, err := cmd.messageText()
+	if err != nil {
+		return err
+	}
+	if len(cmd.File) > 0 {
+		evt, err := ui.gmx.Matrix().PrepareMediaMessage(room, cmd.File, nil)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", cmd.File, err)
+		}
+		eventID, err := ui.gmx.Matrix().SendEvent(evt)
+		if err != nil {
+			return fmt.Errorf("failed to send %s: %w", cmd.File, err)
+		}
+		fmt.Println(eventID)
+	}
+	if len(text) > 0 {
+		msgtype := event.MsgText
+		if cmd.Notice {
+			msgtype = event.MsgNotice
+		}
+		evt := ui.gmx.Matrix().PrepareMarkdownMessage(room.ID, msgtype, text, "", nil)
+		eventID, err := ui.gmx.Matrix().SendEvent(evt)
+		if err != nil {
+			return fmt.Errorf("failed to send message: %w", err)
+		}
+		fmt.Println(eventID)
+	}
+	return nil
+}
+
+// messageText returns the message of the send command from the arguments, or from stdin if there's no message or file.
+func (cmd *Command) messageText() (string, error) {
+	text := strings.Join(cmd.Args, " ")
+	if len(text) == 0 && len(cmd.File) == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read message from stdin: %w", err)
+		}
+		text = strings.TrimRight(string(data), "\n")
+		if len(text) == 0 {
+			return "", errors.New("no message or file given")
+		}
+	}
+	return text, nil
+}
+
+func cmdRooms(ui *HeadlessUI, _ *Command) error {
+	cache := ui.gmx.Config().Rooms
+	cache.Lock()
+	roomList := make([]*rooms.Room, 0, len(cache.Map))
+	for _, room := range cache.Map {
+		if !room.HasLeft {
+			roomList = append(roomList, room)
+		}
+	}
+	cache.Unlock()
+	sort.Slice(roomList, func(i, j int) bool {
+		return roomList[i].LastReceivedMessage.After(roomList[j].LastReceivedMessage)
+	})
+	for _, room := range roomList {
+		fmt.Printf("%s\t%d\t%s\n", room.ID, room.UnreadCount(), room.GetTitle())
+	}
+	return nil
+}
+
+func cmdTail(ui *HeadlessUI, cmd *Command) error {
+	roomIDOrAlias := cmd.Room
+	if len(cmd.Args) > 0 {
+		roomIDOrAlias = cmd.Args[0]
+	}
+	room, err := resolveRoom(ui.gmx, roomIDOrAlias)
+	if err != nil {
+		return err
+	}
+	limit := cmd.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	history, _, err := ui.gmx.Matrix().GetHistory(room, limit, 0)
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+	for _, evt := range history {
+		printEvent(room, evt)
+	}
+	if cmd.Follow {
+		ui.tailRoom = room.ID
+		go ui.gmx.Matrix().Start()
+	}
+	return nil
+}
+
+// senderName returns the display name of the given user in the room, or the user ID if there's no display name.
+// The user ID is also used if the room isn't loaded, as getting the member list would load it.
+func senderName(room *rooms.Room, userID id.UserID) string {
+	if !room.Loaded() {
+		return string(userID)
+	} else if member := room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+		return member.Displayname
+	}
+	return string(userID)
+}
+
+func printEvent(room *rooms.Room, evt *muksevt.Event) {
+	printEventWithSender(senderName(room, evt.Sender), evt.Event)
+}
+
+func printEventWithSender(sender string, evt *event.Event) {
+	ts := time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*int64(time.Millisecond))
+	var text string
+	switch content := evt.Content.Parsed.(type) {
+	case *event.MessageEventContent:
+		switch content.MsgType {
+		case event.MsgEmote:
+			text = fmt.Sprintf("* %s %s", sender, content.Body)
+		case event.MsgNotice:
+			text = fmt.Sprintf("-%s- %s", sender, content.Body)
+		default:
+			text = fmt.Sprintf("<%s> %s", sender, content.Body)
+		}
+	case *event.EncryptedEventContent:
+		text = fmt.Sprintf("<%s> [failed to decrypt]", sender)
+	default:
+		text = fmt.Sprintf("%s sent %s", sender, evt.Type.Type)
+	}
+	fmt.Printf("[%s] %s\n", ts.Format("2006-01-02 15:04:05"), text)
+}
@@ -0,0 +1,265 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package headless
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+)
+
+var remoteCommands = map[string]func(client *remoteClient, cmd *Command) error{
+	"send":  remoteSend,
+	"rooms": remoteRooms,
+	"tail":  remoteTail,
+}
+
+// RunRemoteCommand runs the command through the JSON-RPC socket of a running headless instance,
+// so that the command doesn't use the same device and crypto state as the running instance concurrently.
+// It returns false if nothing is listening on the socket, in which case the command must be run locally.
+func RunRemoteCommand(cfg *config.Config, cmd *Command) (bool, error) {
+	run, ok := remoteCommands[cmd.Name]
+	if !ok {
+		return false, nil
+	}
+	conn, err := net.Dial("unix", GetSocketPath(cfg))
+	if err != nil {
+		return false, nil
+	}
+	defer conn.Close()
+	client := &remoteClient{conn: conn, scanner: bufio.NewScanner(conn)}
+	client.scanner.Buffer(make([]byte, 4096), maxLineSize)
+	return true, run(client, cmd)
+}
+
+// GetSocketPath returns the path of the JSON-RPC socket, either from the command-line flag or the config.
+func GetSocketPath(cfg *config.Config) string {
+	if len(SocketPath) > 0 {
+		return SocketPath
+	}
+	return cfg.SocketPath
+}
+
+type remoteClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	nextID  int
+
+	// pending contains the event notifications that were received while waiting for a response.
+	pending []*StreamEvent
+}
+
+type remoteMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func (client *remoteClient) read() (*remoteMessage, error) {
+	if !client.scanner.Scan() {
+		if err := client.scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read from socket: %w", err)
+		}
+		return nil, errors.New("gomuks closed the connection")
+	}
+	var msg remoteMessage
+	err := json.Unmarshal(client.scanner.Bytes(), &msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+	return &msg, nil
+}
+
+func (client *remoteClient) call(method string, params, result interface{}) error {
+	client.nextID++
+	reqID := json.RawMessage(strconv.Itoa(client.nextID))
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(client.conn).Encode(&request{JSONRPC: "2.0", ID: reqID, Method: method, Params: rawParams})
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	for {
+		msg, err := client.read()
+		if err != nil {
+			return err
+		} else if msg.Method == "event" {
+			var evt StreamEvent
+			if err = json.Unmarshal(msg.Params, &evt); err == nil {
+				client.pending = append(client.pending, &evt)
+			}
+			continue
+		} else if string(msg.ID) != string(reqID) {
+			continue
+		} else if msg.Error != nil {
+			return msg.Error
+		} else if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	}
+}
+
+// nextEvent returns the next event notification, waiting for one if none were received yet.
+func (client *remoteClient) nextEvent() (*StreamEvent, error) {
+	if len(client.pending) > 0 {
+		evt := client.pending[0]
+		client.pending = client.pending[1:]
+		return evt, nil
+	}
+	for {
+		msg, err := client.read()
+		if err != nil {
+			return nil, err
+		} else if msg.Method != "event" {
+			continue
+		}
+		var evt StreamEvent
+		err = json.Unmarshal(msg.Params, &evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse event: %w", err)
+		}
+		return &evt, nil
+	}
+}
+
+func (client *remoteClient) send(params *sendParams) (id.EventID, error) {
+	var resp struct {
+		EventID id.EventID `json:"event_id"`
+	}
+	err := client.call("messages.send", params, &resp)
+	return resp.EventID, err
+}
+
+func remoteSend(client *remoteClient, cmd *Command) error {
+	text, err := cmd.messageText()
+	if err != nil {
+		return err
+	}
+	if len(cmd.File) > 0 {
+		file, err := filepath.Abs(cmd.File)
+		if err != nil {
+			return err
+		}
+		eventID, err := client.send(&sendParams{RoomID: id.RoomID(cmd.Room), File: file})
+		if err != nil {
+			return fmt.Errorf("failed to send %s: %w", cmd.File, err)
+		}
+		fmt.Println(eventID)
+	}
+	if len(text) > 0 {
+		msgtype := event.MsgText
+		if cmd.Notice {
+			msgtype = event.MsgNotice
+		}
+		eventID, err := client.send(&sendParams{RoomID: id.RoomID(cmd.Room), Text: text, MsgType: msgtype})
+		if err != nil {
+			return fmt.Errorf("failed to send message: %w", err)
+		}
+		fmt.Println(eventID)
+	}
+	return nil
+}
+
+func remoteRooms(client *remoteClient, _ *Command) error {
+	var roomList []roomInfo
+	err := client.call("rooms.list", nil, &roomList)
+	if err != nil {
+		return err
+	}
+	sort.Slice(roomList, func(i, j int) bool {
+		return roomList[i].LastMessage > roomList[j].LastMessage
+	})
+	for _, room := range roomList {
+		fmt.Printf("%s\t%d\t%s\n", room.ID, room.Unread, room.Name)
+	}
+	return nil
+}
+
+func remoteTail(client *remoteClient, cmd *Command) error {
+	roomIDOrAlias := cmd.Room
+	if len(cmd.Args) > 0 {
+		roomIDOrAlias = cmd.Args[0]
+	}
+	limit := cmd.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	var history struct {
+		RoomID  id.RoomID            `json:"room_id"`
+		Events  []*event.Event       `json:"events"`
+		Senders map[id.UserID]string `json:"senders"`
+	}
+	err := client.call("rooms.history", &historyParams{RoomID: id.RoomID(roomIDOrAlias), Limit: limit}, &history)
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+	if cmd.Follow {
+		err = client.call("events.subscribe", &subscribeParams{RoomIDs: []id.RoomID{history.RoomID}}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to new messages: %w", err)
+		}
+	}
+	seen := make(map[id.EventID]struct{}, len(history.Events))
+	for _, evt := range history.Events {
+		seen[evt.ID] = struct{}{}
+		_ = evt.Content.ParseRaw(evt.Type)
+		sender, ok := history.Senders[evt.Sender]
+		if !ok {
+			sender = string(evt.Sender)
+		}
+		printEventWithSender(sender, evt)
+	}
+	for cmd.Follow {
+		streamEvt, err := client.nextEvent()
+		if err != nil {
+			return err
+		} else if streamEvt.Type != "message" || streamEvt.RoomID != history.RoomID {
+			continue
+		}
+		var evt event.Event
+		if data, err := json.Marshal(streamEvt.Data); err != nil {
+			continue
+		} else if err = json.Unmarshal(data, &evt); err != nil {
+			continue
+		} else if _, ok := seen[evt.ID]; ok {
+			// Sent while the history was being loaded
+			continue
+		}
+		_ = evt.Content.ParseRaw(evt.Type)
+		sender := streamEvt.SenderName
+		if len(sender) == 0 {
+			sender = string(evt.Sender)
+		}
+		printEventWithSender(sender, &evt)
+	}
+	return nil
+}
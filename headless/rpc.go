@@ -0,0 +1,492 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package headless
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+const (
+	ErrCodeParse          = -32700
+	ErrCodeInvalidRequest = -32600
+	ErrCodeMethodNotFound = -32601
+	ErrCodeInvalidParams  = -32602
+	ErrCodeServer         = -32000
+)
+
+const (
+	maxLineSize = 1024 * 1024
+	// sendQueueSize is the number of messages that can be waiting to be written to a connection.
+	// Subscribers that fall further behind are disconnected so that they can't block the sync loop.
+	sendQueueSize = 64
+	writeTimeout  = 10 * time.Second
+)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+func newError(code int, message string, args ...interface{}) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(message, args...)}
+}
+
+// StreamEvent is the params object of event notifications sent to subscribed connections.
+type StreamEvent struct {
+	Type   string      `json:"type"`
+	RoomID id.RoomID   `json:"room_id,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	// SenderName is the display name of the sender of message events.
+	SenderName string `json:"sender_name,omitempty"`
+}
+
+type rpcHandler func(conn *connection, params json.RawMessage) (interface{}, error)
+
+// Server is a JSON-RPC 2.0 server that reads newline-delimited requests from a Unix socket.
+type Server struct {
+	gmx      ifc.Gomuks
+	path     string
+	listener net.Listener
+	methods  map[string]rpcHandler
+
+	conns     map[*connection]struct{}
+	connsLock sync.Mutex
+}
+
+type connection struct {
+	server *Server
+	conn   net.Conn
+
+	outgoing  chan interface{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	subscribed bool
+	roomFilter map[id.RoomID]struct{}
+	subLock    sync.RWMutex
+}
+
+func NewServer(gmx ifc.Gomuks, path string) (*Server, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socket %s is already in use by another gomuks instance", path)
+	}
+	_ = os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	server := &Server{
+		gmx:      gmx,
+		path:     path,
+		listener: listener,
+		conns:    make(map[*connection]struct{}),
+	}
+	server.methods = map[string]rpcHandler{
+		"status":             server.status,
+		"rooms.list":         server.listRooms,
+		"rooms.history":      server.history,
+		"messages.send":      server.sendMessage,
+		"events.subscribe":   server.subscribe,
+		"events.unsubscribe": server.unsubscribe,
+	}
+	return server, nil
+}
+
+func (server *Server) Serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			debug.Print("Failed to accept JSON-RPC connection:", err)
+			continue
+		}
+		c := &connection{
+			server:   server,
+			conn:     conn,
+			outgoing: make(chan interface{}, sendQueueSize),
+			closed:   make(chan struct{}),
+		}
+		server.connsLock.Lock()
+		server.conns[c] = struct{}{}
+		server.connsLock.Unlock()
+		go c.writeLoop()
+		go c.serve()
+	}
+}
+
+func (server *Server) Close() {
+	_ = server.listener.Close()
+	server.connsLock.Lock()
+	for conn := range server.conns {
+		conn.close()
+	}
+	server.connsLock.Unlock()
+	_ = os.Remove(server.path)
+}
+
+// Publish queues an event notification to every connection subscribed to the room of the event.
+// It never blocks: connections whose send queue is full are disconnected.
+func (server *Server) Publish(evt *StreamEvent) {
+	server.connsLock.Lock()
+	conns := make([]*connection, 0, len(server.conns))
+	for conn := range server.conns {
+		if conn.wants(evt.RoomID) {
+			conns = append(conns, conn)
+		}
+	}
+	server.connsLock.Unlock()
+	for _, conn := range conns {
+		conn.tryQueue(&notification{JSONRPC: "2.0", Method: "event", Params: evt})
+	}
+}
+
+func (c *connection) serve() {
+	defer func() {
+		c.close()
+		c.server.connsLock.Lock()
+		delete(c.server.conns, c)
+		c.server.connsLock.Unlock()
+	}()
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		resp := c.handle(line)
+		if resp != nil {
+			c.queue(resp)
+		}
+	}
+}
+
+func (c *connection) handle(line []byte) *response {
+	var req request
+	err := json.Unmarshal(line, &req)
+	if err != nil {
+		return &response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: newError(ErrCodeParse, "parse error: %v", err)}
+	}
+	id := req.ID
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	if req.JSONRPC != "2.0" || len(req.Method) == 0 {
+		return &response{JSONRPC: "2.0", ID: id, Error: newError(ErrCodeInvalidRequest, "invalid request")}
+	}
+	handler, ok := c.server.methods[req.Method]
+	if !ok {
+		return &response{JSONRPC: "2.0", ID: id, Error: newError(ErrCodeMethodNotFound, "unknown method %s", req.Method)}
+	}
+	result, err := handler(c, req.Params)
+	if len(req.ID) == 0 {
+		// Requests without an ID are notifications and don't get a response.
+		return nil
+	}
+	resp := &response{JSONRPC: "2.0", ID: id}
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) {
+		resp.Error = rpcErr
+	} else if err != nil {
+		resp.Error = newError(ErrCodeServer, "%v", err)
+	} else if result == nil {
+		resp.Result = struct{}{}
+	} else {
+		resp.Result = result
+	}
+	return resp
+}
+
+func (c *connection) writeLoop() {
+	encoder := json.NewEncoder(c.conn)
+	for {
+		select {
+		case data := <-c.outgoing:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := encoder.Encode(data)
+			if err != nil {
+				debug.Print("Failed to write to JSON-RPC connection:", err)
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// queue waits until there's room in the send queue. It's only used for responses,
+// so a client that doesn't read its responses only blocks its own request handling.
+func (c *connection) queue(data interface{}) {
+	select {
+	case c.outgoing <- data:
+	case <-c.closed:
+	}
+}
+
+// tryQueue adds the given data to the send queue, or disconnects the client if the queue is full.
+func (c *connection) tryQueue(data interface{}) {
+	select {
+	case c.outgoing <- data:
+	case <-c.closed:
+	default:
+		debug.Print("JSON-RPC client isn't reading events fast enough, disconnecting")
+		c.close()
+	}
+}
+
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *connection) wants(roomID id.RoomID) bool {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+	if !c.subscribed {
+		return false
+	} else if len(c.roomFilter) == 0 || len(roomID) == 0 {
+		return true
+	}
+	_, ok := c.roomFilter[roomID]
+	return ok
+}
+
+func parseParams(raw json.RawMessage, into interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(raw, into)
+	if err != nil {
+		return newError(ErrCodeInvalidParams, "invalid params: %v", err)
+	}
+	return nil
+}
+
+func (server *Server) status(_ *connection, _ json.RawMessage) (interface{}, error) {
+	cfg := server.gmx.Config()
+	return map[string]interface{}{
+		"version":    server.gmx.Version(),
+		"user_id":    cfg.UserID,
+		"device_id":  cfg.DeviceID,
+		"homeserver": cfg.HS,
+		"syncing":    server.gmx.Matrix().Client() != nil,
+	}, nil
+}
+
+type roomInfo struct {
+	ID          id.RoomID `json:"id"`
+	Name        string    `json:"name"`
+	Topic       string    `json:"topic,omitempty"`
+	Unread      int       `json:"unread"`
+	Highlighted bool      `json:"highlighted"`
+	IsDirect    bool      `json:"is_direct"`
+	Tags        []string  `json:"tags,omitempty"`
+	LastMessage int64     `json:"last_message,omitempty"`
+}
+
+func (server *Server) listRooms(_ *connection, _ json.RawMessage) (interface{}, error) {
+	cache := server.gmx.Config().Rooms
+	cache.Lock()
+	roomIDs := make([]id.RoomID, 0, len(cache.Map))
+	for roomID := range cache.Map {
+		roomIDs = append(roomIDs, roomID)
+	}
+	cache.Unlock()
+	result := make([]roomInfo, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		room := server.gmx.Matrix().GetRoom(roomID)
+		if room == nil || room.HasLeft {
+			continue
+		}
+		info := roomInfo{
+			ID:          room.ID,
+			Name:        room.GetTitle(),
+			Topic:       room.GetTopic(),
+			Unread:      room.UnreadCount(),
+			Highlighted: room.Highlighted(),
+			IsDirect:    room.IsDirect,
+		}
+		if !room.LastReceivedMessage.IsZero() {
+			info.LastMessage = room.LastReceivedMessage.UnixNano() / int64(time.Millisecond)
+		}
+		for _, tag := range room.Tags() {
+			info.Tags = append(info.Tags, tag.Tag)
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+type historyParams struct {
+	RoomID id.RoomID `json:"room_id"`
+	Limit  int       `json:"limit"`
+	Before uint64    `json:"before"`
+}
+
+func (server *Server) history(_ *connection, raw json.RawMessage) (interface{}, error) {
+	var params historyParams
+	if err := parseParams(raw, &params); err != nil {
+		return nil, err
+	}
+	room, err := resolveRoom(server.gmx, string(params.RoomID))
+	if err != nil {
+		return nil, newError(ErrCodeInvalidParams, "%v", err)
+	}
+	if params.Limit <= 0 || params.Limit > 500 {
+		params.Limit = 50
+	}
+	history, next, err := server.gmx.Matrix().GetHistory(room, params.Limit, params.Before)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*event.Event, len(history))
+	senders := make(map[id.UserID]string)
+	for i, evt := range history {
+		events[i] = evt.Event
+		senders[evt.Sender] = senderName(room, evt.Sender)
+	}
+	return map[string]interface{}{
+		"room_id": room.ID,
+		"events":  events,
+		"senders": senders,
+		"next":    next,
+	}, nil
+}
+
+type sendParams struct {
+	RoomID  id.RoomID         `json:"room_id"`
+	Text    string            `json:"text"`
+	HTML    string            `json:"html"`
+	MsgType event.MessageType `json:"msgtype"`
+	File    string            `json:"file"`
+}
+
+func (server *Server) sendMessage(_ *connection, raw json.RawMessage) (interface{}, error) {
+	var params sendParams
+	if err := parseParams(raw, &params); err != nil {
+		return nil, err
+	}
+	if len(params.Text) == 0 && len(params.File) == 0 {
+		return nil, newError(ErrCodeInvalidParams, "text or file is required")
+	} else if len(params.Text) > 0 && len(params.File) > 0 {
+		return nil, newError(ErrCodeInvalidParams, "text and file can't be sent in the same message")
+	} else if len(params.File) > 0 && !filepath.IsAbs(params.File) {
+		return nil, newError(ErrCodeInvalidParams, "file path must be absolute")
+	}
+	room, err := resolveRoom(server.gmx, string(params.RoomID))
+	if err != nil {
+		return nil, newError(ErrCodeInvalidParams, "%v", err)
+	}
+	var evt *muksevt.Event
+	if len(params.File) > 0 {
+		evt, err = server.gmx.Matrix().PrepareMediaMessage(room, params.File, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s: %w", params.File, err)
+		}
+	} else {
+		if len(params.MsgType) == 0 {
+			params.MsgType = event.MsgText
+		}
+		evt = server.gmx.Matrix().PrepareMarkdownMessage(room.ID, params.MsgType, params.Text, params.HTML, nil)
+	}
+	eventID, err := server.gmx.Matrix().SendEvent(evt)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"event_id": eventID}, nil
+}
+
+type subscribeParams struct {
+	RoomIDs []id.RoomID `json:"room_ids"`
+}
+
+func (server *Server) subscribe(c *connection, raw json.RawMessage) (interface{}, error) {
+	var params subscribeParams
+	if err := parseParams(raw, &params); err != nil {
+		return nil, err
+	}
+	c.subLock.Lock()
+	c.subscribed = true
+	c.roomFilter = make(map[id.RoomID]struct{}, len(params.RoomIDs))
+	for _, roomID := range params.RoomIDs {
+		c.roomFilter[roomID] = struct{}{}
+	}
+	c.subLock.Unlock()
+	return nil, nil
+}
+
+func (server *Server) unsubscribe(c *connection, _ json.RawMessage) (interface{}, error) {
+	c.subLock.Lock()
+	c.subscribed = false
+	c.roomFilter = nil
+	c.subLock.Unlock()
+	return nil, nil
+}
@@ -0,0 +1,300 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package headless contains a GomuksUI implementation without a terminal interface. It keeps the session syncing
+// and exposes a JSON-RPC API on a Unix socket for scripts and status bars.
+package headless
+
+import (
+	"errors"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+var ErrNotLoggedIn = errors.New("not logged in, log in with the normal interface first")
+
+// SocketPath can be set to override the socket_path config option.
+var SocketPath string
+
+type HeadlessUI struct {
+	gmx      ifc.Gomuks
+	mainView *MainView
+	server   *Server
+	lock     sync.RWMutex
+	command  *Command
+	tailRoom id.RoomID
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(gmx ifc.Gomuks) ifc.GomuksUI {
+	ui := &HeadlessUI{
+		gmx:  gmx,
+		stop: make(chan struct{}),
+	}
+	ui.mainView = &MainView{
+		ui:    ui,
+		rooms: make(map[id.RoomID]*RoomView),
+	}
+	return ui
+}
+
+func (ui *HeadlessUI) Init() {}
+
+// Start starts the JSON-RPC server (or runs the CLI command) and blocks until Stop is called.
+func (ui *HeadlessUI) Start() error {
+	if ui.command != nil {
+		return ui.runCommand()
+	}
+	cfg := ui.gmx.Config()
+	if len(cfg.AccessToken) == 0 {
+		return ErrNotLoggedIn
+	}
+	path := GetSocketPath(cfg)
+	server, err := NewServer(ui.gmx, path)
+	if err != nil {
+		return err
+	}
+	ui.lock.Lock()
+	ui.server = server
+	ui.lock.Unlock()
+	debug.Print("Listening for JSON-RPC connections at", path)
+	go server.Serve()
+	<-ui.stop
+	return nil
+}
+
+func (ui *HeadlessUI) Stop() {
+	ui.stopOnce.Do(func() {
+		ui.lock.RLock()
+		if ui.server != nil {
+			ui.server.Close()
+		}
+		ui.lock.RUnlock()
+		close(ui.stop)
+	})
+}
+
+func (ui *HeadlessUI) Finish() {
+	ui.Stop()
+}
+
+func (ui *HeadlessUI) Render()               {}
+func (ui *HeadlessUI) HandleNewPreferences() {}
+func (ui *HeadlessUI) OnLogin()              {}
+
+func (ui *HeadlessUI) OnLogout() {
+	debug.Print("Logged out, stopping headless mode")
+	ui.gmx.Stop(true)
+}
+
+func (ui *HeadlessUI) MainView() ifc.MainView {
+	return ui.mainView
+}
+
+func (ui *HeadlessUI) publish(eventType string, roomID id.RoomID, data interface{}) {
+	ui.publishEvent(&StreamEvent{Type: eventType, RoomID: roomID, Data: data})
+}
+
+func (ui *HeadlessUI) publishEvent(evt *StreamEvent) {
+	ui.lock.RLock()
+	server := ui.server
+	ui.lock.RUnlock()
+	if server != nil {
+		server.Publish(evt)
+	}
+}
+
+type stubSyncingModal struct{}
+
+func (stubSyncingModal) SetIndeterminate() {}
+func (stubSyncingModal) SetMessage(string) {}
+func (stubSyncingModal) SetSteps(int)      {}
+func (stubSyncingModal) Step()             {}
+func (stubSyncingModal) Close()            {}
+
+// MainView tracks the rooms of the session and forwards changes to the event stream.
+type MainView struct {
+	ui    *HeadlessUI
+	rooms map[id.RoomID]*RoomView
+	lock  sync.Mutex
+}
+
+func (view *MainView) GetRoom(roomID id.RoomID) ifc.RoomView {
+	room := view.ui.gmx.Matrix().GetRoom(roomID)
+	if room == nil {
+		return nil
+	}
+	view.lock.Lock()
+	defer view.lock.Unlock()
+	roomView, ok := view.rooms[roomID]
+	if !ok {
+		roomView = &RoomView{parent: view, room: room}
+		view.rooms[roomID] = roomView
+	}
+	return roomView
+}
+
+// WantsAllEvents returns true, as JSON-RPC clients want the events of every room,
+// and loading every room to receive them would defeat the room cache.
+func (view *MainView) WantsAllEvents() bool {
+	return true
+}
+
+func (view *MainView) AddRoom(room *rooms.Room) {
+	view.ui.publish("room_added", room.ID, nil)
+}
+
+func (view *MainView) RemoveRoom(room *rooms.Room) {
+	view.lock.Lock()
+	delete(view.rooms, room.ID)
+	view.lock.Unlock()
+	view.ui.publish("room_removed", room.ID, nil)
+}
+
+func (view *MainView) SetRooms(rooms *rooms.RoomCache) {}
+func (view *MainView) Bump(room *rooms.Room)           {}
+func (view *MainView) UpdateTags(room *rooms.Room)     {}
+
+func (view *MainView) SetTyping(roomID id.RoomID, users []id.UserID) {
+	view.ui.publish("typing", roomID, map[string]interface{}{"user_ids": users})
+}
+
+func (view *MainView) OpenSyncingModal() ifc.SyncingModal {
+	return stubSyncingModal{}
+}
+
+func (view *MainView) NotifyMessage(room *rooms.Room, message ifc.Message, should pushrules.PushActionArrayShould) {
+	if !should.Notify {
+		return
+	}
+	view.ui.publish("notification", room.ID, map[string]interface{}{
+		"event_id":  message.ID(),
+		"sender":    message.NotificationSenderName(),
+		"body":      message.NotificationContent(),
+		"highlight": should.Highlight,
+	})
+}
+
+func (view *MainView) HandleInRoomVerification(evt *event.Event) {}
+
+func (view *MainView) NotifySecurityWarning(message string) {
+	debug.Print("Security warning:", message)
+	view.ui.publish("security_warning", "", map[string]interface{}{"message": message})
+}
+
+func (view *MainView) AskConfirmation(title, text, confirmLabel string, cancel <-chan struct{}) bool {
+	debug.Printf("Declining confirmation %q in headless mode", title)
+	return false
+}
+
+func (view *MainView) OpenMatrixURI(uri *id.MatrixURI)                   {}
+func (view *MainView) UpdateDraft(roomID id.RoomID, draft *config.Draft) {}
+
+// RoomView forwards the events of a single room to the event stream.
+type RoomView struct {
+	parent *MainView
+	room   *rooms.Room
+}
+
+func (view *RoomView) MxRoom() *rooms.Room {
+	return view.room
+}
+
+func (view *RoomView) SetCompletions(completions []string) {}
+func (view *RoomView) SetTyping(users []id.UserID)         {}
+func (view *RoomView) UpdateUserList()                     {}
+
+func (view *RoomView) AddEvent(evt *muksevt.Event) ifc.Message {
+	if view.room.ID == view.parent.ui.tailRoom {
+		printEvent(view.room, evt)
+	}
+	view.parent.ui.publishEvent(&StreamEvent{
+		Type:       "message",
+		RoomID:     view.room.ID,
+		Data:       evt.Event,
+		SenderName: senderName(view.room, evt.Sender),
+	})
+	return &Message{evt: evt, room: view.room}
+}
+
+func (view *RoomView) AddRedaction(evt *muksevt.Event) {
+	view.parent.ui.publish("redaction", view.room.ID, evt.Event)
+}
+
+func (view *RoomView) AddEdit(evt *muksevt.Event) {
+	view.parent.ui.publish("edit", view.room.ID, evt.Event)
+}
+
+func (view *RoomView) AddReaction(evt *muksevt.Event, key string) {
+	view.parent.ui.publish("reaction", view.room.ID, map[string]interface{}{
+		"event_id": evt.ID,
+		"key":      key,
+	})
+}
+
+func (view *RoomView) GetEvent(eventID id.EventID) ifc.Message {
+	return nil
+}
+
+func (view *RoomView) AddServiceMessage(message string) {
+	view.parent.ui.publish("service_message", view.room.ID, map[string]interface{}{"message": message})
+}
+
+// Message is the minimal ifc.Message used for notifications.
+type Message struct {
+	evt  *muksevt.Event
+	room *rooms.Room
+}
+
+func (msg *Message) ID() id.EventID {
+	return msg.evt.ID
+}
+
+func (msg *Message) Time() time.Time {
+	return time.Unix(msg.evt.Timestamp/1000, msg.evt.Timestamp%1000*int64(time.Millisecond))
+}
+
+func (msg *Message) NotificationSenderName() string {
+	if member := msg.room.GetMember(msg.evt.Sender); member != nil && len(member.Displayname) > 0 {
+		return member.Displayname
+	}
+	return string(msg.evt.Sender)
+}
+
+func (msg *Message) NotificationContent() string {
+	if content, ok := msg.evt.Content.Parsed.(*event.MessageEventContent); ok {
+		return content.Body
+	}
+	return ""
+}
+
+func (msg *Message) SetIsHighlight(highlight bool) {}
+
+func (msg *Message) SetID(id id.EventID) {
+	msg.evt.ID = id
+}
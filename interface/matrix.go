@@ -17,6 +17,8 @@
 package ifc
 
 import (
+	"time"
+
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
@@ -40,6 +42,27 @@ type UploadedMediaInfo struct {
 	Info           *event.FileInfo
 }
 
+type UserTrust int
+
+const (
+	// UserTrustUnknown means that the trust state can't be determined, e.g. because crypto is disabled or the user has no keys.
+	UserTrustUnknown UserTrust = iota
+	// UserTrustUnverified means that the user's master key has not been signed with our user-signing key.
+	UserTrustUnverified
+	// UserTrustUnverifiedDevices means that the user is verified, but has devices that are not cross-signed.
+	UserTrustUnverifiedDevices
+	// UserTrustVerified means that the user and all of their devices are verified.
+	UserTrustVerified
+)
+
+// HistoryRoomStats contains the size of the locally stored history of a single room.
+type HistoryRoomStats struct {
+	RoomID id.RoomID
+	Events int
+	// Approximate size of the room's history in bytes.
+	Size int64
+}
+
 type MatrixContainer interface {
 	Client() *mautrix.Client
 	Preferences() *config.UserPreferences
@@ -56,17 +79,32 @@ type MatrixContainer interface {
 	SendPreferencesToMatrix()
 	PrepareMarkdownMessage(roomID id.RoomID, msgtype event.MessageType, text, html string, relation *Relation) *muksevt.Event
 	PrepareMediaMessage(room *rooms.Room, path string, relation *Relation) (*muksevt.Event, error)
+	PrepareForwardedMessage(room *rooms.Room, evt *muksevt.Event) (*muksevt.Event, error)
 	SendEvent(evt *muksevt.Event) (id.EventID, error)
+	ScheduleMessage(roomID id.RoomID, msgtype event.MessageType, text string, sendAt time.Time) *config.ScheduledMessage
+	ScheduledMessages() []config.ScheduledMessage
+	EditScheduledMessage(msgID, text string, sendAt time.Time) error
+	CancelScheduledMessage(msgID string) error
+	GetDraft(roomID id.RoomID) *config.Draft
+	SaveDraft(roomID id.RoomID, draft *config.Draft)
 	Redact(roomID id.RoomID, eventID id.EventID, reason string) error
 	SendTyping(roomID id.RoomID, typing bool)
 	MarkRead(roomID id.RoomID, eventID id.EventID)
+	Hooks() []string
+	RunHook(roomID id.RoomID, name string, args []string) ([]string, error)
 	JoinRoom(roomID id.RoomID, server string) (*rooms.Room, error)
 	LeaveRoom(roomID id.RoomID) error
 	CreateRoom(req *mautrix.ReqCreateRoom) (*rooms.Room, error)
 
 	FetchMembers(room *rooms.Room) error
 	GetHistory(room *rooms.Room, limit int, dbPointer uint64) ([]*muksevt.Event, uint64, error)
+	FillTimelineGap(room *rooms.Room, gap *muksevt.Event, limit int) ([]*muksevt.Event, *muksevt.Event, error)
+	GetEventContext(room *rooms.Room, eventID id.EventID, limit int) (events []*muksevt.Event, start, end string, err error)
+	PaginateEventContext(room *rooms.Room, token string, backwards bool, limit int) ([]*muksevt.Event, string, error)
 	GetEvent(room *rooms.Room, eventID id.EventID) (*muksevt.Event, error)
+	HistoryStats() (stats []HistoryRoomStats, fileSize int64, err error)
+	PruneHistory() (int, error)
+	CompactHistory() (sizeBefore, sizeAfter int64, err error)
 	GetRoom(roomID id.RoomID) *rooms.Room
 	GetOrCreateRoom(roomID id.RoomID) *rooms.Room
 
@@ -75,6 +113,15 @@ type MatrixContainer interface {
 	DownloadToDisk(uri id.ContentURI, file *attachment.EncryptedFile, target string) (string, error)
 	GetDownloadURL(uri id.ContentURI) string
 	GetCachePath(uri id.ContentURI) string
+	GetThumbnailCachePath(uri id.ContentURI, width, height int) string
+	DownloadThumbnail(uri id.ContentURI, width, height int) (string, error)
+
+	UserTrust(userID id.UserID) UserTrust
+	RefreshUserTrust(userID id.UserID)
+	VerifiedUsers() []id.UserID
+	ShareGroupSession(room *rooms.Room) error
+	RequestSecrets(reply func(message string, args ...interface{})) error
+	CacheMegolmBackupKey(key []byte)
 
 	Crypto() Crypto
 }
@@ -19,8 +19,10 @@ package ifc
 import (
 	"time"
 
+	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/matrix/muksevt"
 	"maunium.net/go/gomuks/matrix/rooms"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 )
@@ -50,6 +52,8 @@ type SyncingModal interface {
 
 type MainView interface {
 	GetRoom(roomID id.RoomID) RoomView
+	// WantsAllEvents returns true if events in rooms that aren't loaded should be passed to the room views too.
+	WantsAllEvents() bool
 	AddRoom(room *rooms.Room)
 	RemoveRoom(room *rooms.Room)
 	SetRooms(rooms *rooms.RoomCache)
@@ -61,6 +65,13 @@ type MainView interface {
 	OpenSyncingModal() SyncingModal
 
 	NotifyMessage(room *rooms.Room, message Message, should pushrules.PushActionArrayShould)
+	HandleInRoomVerification(evt *event.Event)
+	NotifySecurityWarning(message string)
+	// AskConfirmation asks the user to confirm something. If the cancel channel is closed before the user answers,
+	// the question is dismissed and false is returned. The channel may be nil.
+	AskConfirmation(title, text, confirmLabel string, cancel <-chan struct{}) bool
+	OpenMatrixURI(uri *id.MatrixURI)
+	UpdateDraft(roomID id.RoomID, draft *config.Draft)
 }
 
 type RoomView interface {
@@ -0,0 +1,122 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package notification
+
+import (
+	"os"
+
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+const (
+	BackendAuto     = "auto"
+	BackendDesktop  = "desktop"
+	BackendTerminal = "terminal"
+	BackendNone     = "none"
+)
+
+// Backend is the notification backend used by Send and SendNotification.
+var Backend = BackendAuto
+
+// Notification is a desktop notification. Only Title and Text are required,
+// the other fields are used by platforms that support them.
+type Notification struct {
+	Title    string
+	Text     string
+	Critical bool
+	Sound    bool
+
+	// Tag groups notifications: a new notification replaces the previous one with the same tag.
+	Tag string
+	// Context is an opaque value (e.g. an event ID) that is passed back to the ActionHandler.
+	Context string
+	// Icon is the path to an image file to show in the notification.
+	Icon string
+	// Actions enables the open, mark read and reply actions.
+	Actions bool
+}
+
+// ActionHandler receives the actions the user invokes on notifications.
+type ActionHandler interface {
+	OnNotificationOpen(notif *Notification)
+	OnNotificationMarkRead(notif *Notification)
+	OnNotificationReply(notif *Notification, text string)
+}
+
+var actionHandler ActionHandler
+var actionHandlerLock sync.RWMutex
+
+// SetActionHandler sets the handler that is called when a notification action is invoked.
+func SetActionHandler(handler ActionHandler) {
+	actionHandlerLock.Lock()
+	actionHandler = handler
+	actionHandlerLock.Unlock()
+}
+
+func getActionHandler() ActionHandler {
+	actionHandlerLock.RLock()
+	defer actionHandlerLock.RUnlock()
+	return actionHandler
+}
+
+// Send sends a simple notification without actions.
+func Send(title, text string, critical, sound bool) error {
+	return SendNotification(&Notification{
+		Title:    title,
+		Text:     text,
+		Critical: critical,
+		Sound:    sound,
+	})
+}
+
+// SendNotification sends the given notification using the configured backend.
+func SendNotification(notif *Notification) error {
+	switch Backend {
+	case BackendNone:
+		return nil
+	case BackendTerminal:
+		return sendTerminal(notif)
+	case BackendDesktop:
+		return send(notif)
+	default:
+		if useTerminalBackend() {
+			return sendTerminal(notif)
+		}
+		return send(notif)
+	}
+}
+
+// SupportsIcons returns whether the backend that SendNotification would currently use shows Notification.Icon.
+func SupportsIcons() bool {
+	switch Backend {
+	case BackendNone, BackendTerminal:
+		return false
+	case BackendDesktop:
+		return iconsSupported
+	default:
+		return iconsSupported && !useTerminalBackend()
+	}
+}
+
+// useTerminalBackend returns whether the automatic backend selection should use terminal escape sequences,
+// which is the case in SSH sessions and when there's no desktop notification system available.
+func useTerminalBackend() bool {
+	if len(os.Getenv("SSH_CONNECTION")) > 0 || len(os.Getenv("SSH_TTY")) > 0 {
+		return true
+	}
+	return !desktopAvailable()
+}
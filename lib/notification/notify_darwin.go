@@ -34,15 +34,21 @@ const sendScript = `on run {notifText, notifTitle}
 	display notification notifText with title "gomuks" subtitle notifTitle
 end run`
 
-func Send(title, text string, critical, sound bool) error {
+// The notification icon is currently not supported on macOS.
+const iconsSupported = false
+
+func send(notif *Notification) error {
 	if terminalNotifierAvailable {
-		args := []string{"-title", "gomuks", "-subtitle", title, "-message", text}
-		if critical {
+		args := []string{"-title", "gomuks", "-subtitle", notif.Title, "-message", notif.Text}
+		if len(notif.Tag) > 0 {
+			args = append(args, "-group", notif.Tag)
+		}
+		if notif.Critical {
 			args = append(args, "-timeout", "15")
 		} else {
 			args = append(args, "-timeout", "4")
 		}
-		if sound {
+		if notif.Sound {
 			args = append(args, "-sound", "default")
 		}
 		//if len(iconPath) > 0 {
@@ -50,7 +56,7 @@ func Send(title, text string, critical, sound bool) error {
 		//}
 		return exec.Command("terminal-notifier", args...).Run()
 	}
-	cmd := exec.Command("osascript", "-", text, title)
+	cmd := exec.Command("osascript", "-", notif.Text, notif.Title)
 	if stdin, err := cmd.StdinPipe(); err != nil {
 		return fmt.Errorf("failed to get stdin pipe for osascript: %w", err)
 	} else if _, err = stdin.Write([]byte(sendScript)); err != nil {
@@ -63,3 +69,7 @@ func Send(title, text string, critical, sound bool) error {
 		return nil
 	}
 }
+
+func desktopAvailable() bool {
+	return true
+}
@@ -0,0 +1,150 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package notification
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"unicode"
+
+	sync "github.com/sasha-s/go-deadlock"
+	"golang.org/x/term"
+)
+
+const (
+	ProtocolAuto   = "auto"
+	ProtocolOSC9   = "osc9"
+	ProtocolOSC777 = "osc777"
+	ProtocolOSC99  = "osc99"
+	ProtocolBell   = "bell"
+)
+
+// TerminalProtocol is the escape sequence used by the terminal backend.
+var TerminalProtocol = ProtocolAuto
+
+var terminalOutput = os.Stdout
+
+var terminalWriter func(seq string)
+var terminalWriterLock sync.RWMutex
+
+// SetTerminalWriter sets the function that the terminal backend uses to output escape sequences.
+// UIs that draw on the terminal must set it, so that the sequences are written between screen updates
+// (using WriteTerminal) instead of in the middle of one.
+func SetTerminalWriter(writer func(seq string)) {
+	terminalWriterLock.Lock()
+	terminalWriter = writer
+	terminalWriterLock.Unlock()
+}
+
+func getTerminalWriter() func(seq string) {
+	terminalWriterLock.RLock()
+	defer terminalWriterLock.RUnlock()
+	return terminalWriter
+}
+
+// WriteTerminal writes the given escape sequence to the terminal. It does nothing if stdout isn't a terminal.
+func WriteTerminal(seq string) error {
+	if !term.IsTerminal(int(terminalOutput.Fd())) {
+		return nil
+	}
+	_, err := terminalOutput.WriteString(seq)
+	return err
+}
+
+// detectTerminalProtocol guesses which notification escape sequence the terminal emulator supports.
+// Over SSH, the environment variables of the local terminal are usually not forwarded, so the auto
+// detection falls back to OSC 9, which is the most widely supported one.
+func detectTerminalProtocol() string {
+	term := os.Getenv("TERM")
+	switch {
+	case len(os.Getenv("KITTY_WINDOW_ID")) > 0, term == "xterm-kitty":
+		return ProtocolOSC99
+	case len(os.Getenv("VTE_VERSION")) > 0, strings.HasPrefix(term, "foot"), strings.HasPrefix(term, "rxvt"):
+		return ProtocolOSC777
+	default:
+		return ProtocolOSC9
+	}
+}
+
+// sanitizeTerminalText removes control characters so that message content can't inject escape sequences.
+func sanitizeTerminalText(text string, removeSemicolons bool) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return ' '
+		} else if unicode.IsControl(r) || (removeSemicolons && r == ';') {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func kittyNotificationID(tag string) string {
+	if len(tag) == 0 {
+		return "gomuks"
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(tag))
+	return fmt.Sprintf("gomuks-%x", hash.Sum32())
+}
+
+func terminalSequence(protocol string, notif *Notification) string {
+	switch protocol {
+	case ProtocolOSC777:
+		return fmt.Sprintf("\x1b]777;notify;%s;%s\x07",
+			sanitizeTerminalText(notif.Title, true), sanitizeTerminalText(notif.Text, false))
+	case ProtocolOSC99:
+		notifID := kittyNotificationID(notif.Tag)
+		return fmt.Sprintf("\x1b]99;i=%s:d=0:p=title;%s\x1b\\\x1b]99;i=%s:d=1:p=body;%s\x1b\\",
+			notifID, sanitizeTerminalText(notif.Title, false), notifID, sanitizeTerminalText(notif.Text, false))
+	case ProtocolBell:
+		return ""
+	default:
+		return fmt.Sprintf("\x1b]9;%s: %s\x07",
+			sanitizeTerminalText(notif.Title, false), sanitizeTerminalText(notif.Text, false))
+	}
+}
+
+// wrapTmuxPassthrough wraps the escape sequence so that tmux passes it through to the outer terminal.
+// This requires `set -g allow-passthrough on` in tmux 3.3 and newer.
+func wrapTmuxPassthrough(seq string) string {
+	return "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+}
+
+func sendTerminal(notif *Notification) error {
+	protocol := TerminalProtocol
+	if protocol == ProtocolAuto || len(protocol) == 0 {
+		protocol = detectTerminalProtocol()
+	}
+	seq := terminalSequence(protocol, notif)
+	if len(seq) > 0 && len(os.Getenv("TMUX")) > 0 {
+		seq = wrapTmuxPassthrough(seq)
+	}
+	if notif.Sound || protocol == ProtocolBell {
+		// The bell is handled by tmux itself, so it's never wrapped.
+		seq += "\a"
+	}
+	if len(seq) == 0 {
+		return nil
+	}
+	if writer := getTerminalWriter(); writer != nil {
+		writer(seq)
+		return nil
+	}
+	return WriteTerminal(seq)
+}
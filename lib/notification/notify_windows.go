@@ -20,20 +20,27 @@ import (
 	"gopkg.in/toast.v1"
 )
 
-func Send(title, text string, critical, sound bool) error {
+// The notification icon is currently not supported on Windows.
+const iconsSupported = false
+
+func send(notif *Notification) error {
 	notification := toast.Notification{
 		AppID:    "gomuks",
-		Title:    title,
-		Message:  text,
+		Title:    notif.Title,
+		Message:  notif.Text,
 		Audio:    toast.Silent,
 		Duration: toast.Short,
 		// 		Icon: ...,
 	}
-	if sound {
+	if notif.Sound {
 		notification.Audio = toast.IM
 	}
-	if critical {
+	if notif.Critical {
 		notification.Duration = toast.Long
 	}
 	return notification.Push()
 }
+
+func desktopAvailable() bool {
+	return true
+}
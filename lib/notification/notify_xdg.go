@@ -19,11 +19,16 @@
 package notification
 
 import (
+	"fmt"
+	"html"
 	"os"
 	"os/exec"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	sync "github.com/sasha-s/go-deadlock"
 )
 
-var notifySendPath string
 var audioCommand string
 var tryAudioCommands = []string{"ogg123", "paplay"}
 var soundNormal = "/usr/share/sounds/freedesktop/stereo/message-new-instant.oga"
@@ -44,11 +49,6 @@ func getSoundPath(env, defaultPath string) string {
 
 func init() {
 	var err error
-
-	if notifySendPath, err = exec.LookPath("notify-send"); err != nil {
-		return
-	}
-
 	for _, cmd := range tryAudioCommands {
 		if audioCommand, err = exec.LookPath(cmd); err == nil {
 			break
@@ -58,27 +58,275 @@ func init() {
 	soundCritical = getSoundPath("GOMUKS_SOUND_CRITICAL", soundCritical)
 }
 
-func Send(title, text string, critical, sound bool) error {
-	if len(notifySendPath) == 0 {
+const (
+	dbusDestination = "org.freedesktop.Notifications"
+	dbusPath        = dbus.ObjectPath("/org/freedesktop/Notifications")
+	dbusInterface   = "org.freedesktop.Notifications"
+)
+
+const (
+	actionOpen     = "default"
+	actionMarkRead = "mark-read"
+	actionReply    = "inline-reply"
+)
+
+const (
+	urgencyLow    byte = 0
+	urgencyNormal byte = 1
+)
+
+// DBusNotifier sends notifications using the org.freedesktop.Notifications D-Bus interface.
+type DBusNotifier struct {
+	conn         *dbus.Conn
+	obj          dbus.BusObject
+	capabilities map[string]bool
+
+	active map[uint32]*Notification
+	tags   map[string]uint32
+	// serverName is the unique bus name of the current owner of the notification server name.
+	serverName string
+	lock       sync.Mutex
+}
+
+const iconsSupported = true
+
+// notifierRetryInterval is the minimum time between attempts to connect to the notification server.
+const notifierRetryInterval = 30 * time.Second
+
+var defaultNotifier *DBusNotifier
+var defaultNotifierLastAttempt time.Time
+var defaultNotifierLock sync.Mutex
+
+// NewDBusNotifier creates a notifier that uses the notification server on the given bus connection
+// and starts listening for the action signals of the server.
+func NewDBusNotifier(conn *dbus.Conn) (*DBusNotifier, error) {
+	notifier := &DBusNotifier{
+		conn:         conn,
+		obj:          conn.Object(dbusDestination, dbusPath),
+		capabilities: make(map[string]bool),
+		active:       make(map[uint32]*Notification),
+		tags:         make(map[string]uint32),
+	}
+	var capabilities []string
+	err := notifier.obj.Call(dbusInterface+".GetCapabilities", 0).Store(&capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notification server capabilities: %w", err)
+	}
+	for _, capability := range capabilities {
+		notifier.capabilities[capability] = true
+	}
+	err = conn.AddMatchSignal(dbus.WithMatchSender(dbusDestination), dbus.WithMatchObjectPath(dbusPath), dbus.WithMatchInterface(dbusInterface))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for notification signals: %w", err)
+	}
+	signals := make(chan *dbus.Signal, 32)
+	conn.Signal(signals)
+	go notifier.handleSignals(signals)
+	return notifier, nil
+}
+
+// getDefaultNotifier returns the notifier on the session bus. If connecting fails, or the connection is lost,
+// it's retried on later calls, so that a notification server that starts after gomuks is still used.
+func getDefaultNotifier() *DBusNotifier {
+	defaultNotifierLock.Lock()
+	defer defaultNotifierLock.Unlock()
+	if defaultNotifier != nil && defaultNotifier.conn.Connected() {
+		return defaultNotifier
+	} else if time.Since(defaultNotifierLastAttempt) < notifierRetryInterval {
+		return nil
+	}
+	defaultNotifier = nil
+	defaultNotifierLastAttempt = time.Now()
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
 		return nil
 	}
+	defaultNotifier, err = NewDBusNotifier(conn)
+	if err != nil {
+		_ = conn.Close()
+	}
+	return defaultNotifier
+}
 
-	args := []string{"-a", "gomuks"}
-	if !critical {
-		args = append(args, "-u", "low")
+// Send shows the given notification, replacing the previous notification with the same tag.
+func (notifier *DBusNotifier) Send(notif *Notification) error {
+	var replaces uint32
+	if len(notif.Tag) > 0 {
+		notifier.lock.Lock()
+		replaces = notifier.tags[notif.Tag]
+		notifier.lock.Unlock()
 	}
-	//if iconPath {
-	//	args = append(args, "-i", iconPath)
-	//}
-	args = append(args, title, text)
-	if sound && len(audioCommand) > 0 && len(soundNormal) > 0 {
-		audioFile := soundNormal
-		if critical && len(soundCritical) > 0 {
-			audioFile = soundCritical
+
+	var actions []string
+	if notif.Actions && notifier.capabilities["actions"] {
+		actions = []string{actionOpen, "Open", actionMarkRead, "Mark as read"}
+		if notifier.capabilities["inline-reply"] {
+			actions = append(actions, actionReply, "Reply")
 		}
-		go func() {
-			_ = exec.Command(audioCommand, audioFile).Run()
-		}()
 	}
-	return exec.Command(notifySendPath, args...).Run()
+	hints := map[string]dbus.Variant{
+		"desktop-entry": dbus.MakeVariant("gomuks"),
+		"category":      dbus.MakeVariant("im.received"),
+		"urgency":       dbus.MakeVariant(urgencyNormal),
+	}
+	if !notif.Critical {
+		hints["urgency"] = dbus.MakeVariant(urgencyLow)
+	}
+	if len(notif.Icon) > 0 {
+		hints["image-path"] = dbus.MakeVariant(notif.Icon)
+	}
+	body := notif.Text
+	if notifier.capabilities["body-markup"] {
+		body = html.EscapeString(body)
+	}
+
+	var notifID uint32
+	err := notifier.obj.Call(dbusInterface+".Notify", 0,
+		"gomuks", replaces, notif.Icon, notif.Title, body, actions, hints, int32(-1)).Store(&notifID)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+
+	notifier.lock.Lock()
+	if replaces != 0 {
+		delete(notifier.active, replaces)
+	}
+	notifier.active[notifID] = notif
+	if len(notif.Tag) > 0 {
+		notifier.tags[notif.Tag] = notifID
+	}
+	notifier.lock.Unlock()
+	return nil
+}
+
+// Close closes the currently shown notification with the given tag.
+func (notifier *DBusNotifier) Close(tag string) {
+	notifier.lock.Lock()
+	notifID, ok := notifier.tags[tag]
+	notifier.lock.Unlock()
+	if ok {
+		notifier.obj.Call(dbusInterface+".CloseNotification", dbus.FlagNoReplyExpected, notifID)
+	}
+}
+
+func (notifier *DBusNotifier) forget(notifID uint32) *Notification {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	notif, ok := notifier.active[notifID]
+	if !ok {
+		return nil
+	}
+	delete(notifier.active, notifID)
+	if len(notif.Tag) > 0 && notifier.tags[notif.Tag] == notifID {
+		delete(notifier.tags, notif.Tag)
+	}
+	return notif
+}
+
+func (notifier *DBusNotifier) get(notifID uint32) *Notification {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	return notifier.active[notifID]
+}
+
+// isFromServer returns whether or not the given unique bus name owns the notification server name,
+// so that other clients on the bus can't invoke actions by sending the same signals.
+func (notifier *DBusNotifier) isFromServer(sender string) bool {
+	notifier.lock.Lock()
+	serverName := notifier.serverName
+	notifier.lock.Unlock()
+	if len(sender) == 0 {
+		return false
+	} else if sender == serverName {
+		return true
+	}
+	// The server may have been restarted since the last signal.
+	err := notifier.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, dbusDestination).Store(&serverName)
+	if err != nil || sender != serverName {
+		return false
+	}
+	notifier.lock.Lock()
+	notifier.serverName = serverName
+	notifier.lock.Unlock()
+	return true
+}
+
+func (notifier *DBusNotifier) handleSignals(signals <-chan *dbus.Signal) {
+	for signal := range signals {
+		if signal.Path != dbusPath || len(signal.Body) < 2 || !notifier.isFromServer(signal.Sender) {
+			continue
+		}
+		notifID, ok := signal.Body[0].(uint32)
+		if !ok {
+			continue
+		}
+		switch signal.Name {
+		case dbusInterface + ".NotificationClosed":
+			notifier.forget(notifID)
+		case dbusInterface + ".ActionInvoked":
+			action, _ := signal.Body[1].(string)
+			notif := notifier.get(notifID)
+			handler := getActionHandler()
+			if notif == nil || handler == nil {
+				continue
+			}
+			switch action {
+			case actionOpen:
+				go focusTerminal()
+				go handler.OnNotificationOpen(notif)
+			case actionMarkRead:
+				go handler.OnNotificationMarkRead(notif)
+				notifier.Close(notif.Tag)
+			}
+		case dbusInterface + ".NotificationReplied":
+			text, _ := signal.Body[1].(string)
+			notif := notifier.get(notifID)
+			handler := getActionHandler()
+			if notif != nil && handler != nil && len(text) > 0 {
+				go handler.OnNotificationReply(notif, text)
+			}
+		}
+	}
+}
+
+// focusTerminal tries to raise the terminal window gomuks is running in. This only works on X11 with xdotool and a
+// terminal emulator that sets $WINDOWID.
+func focusTerminal() {
+	windowID := os.Getenv("WINDOWID")
+	if len(windowID) == 0 {
+		return
+	}
+	xdotool, err := exec.LookPath("xdotool")
+	if err != nil {
+		return
+	}
+	_ = exec.Command(xdotool, "windowactivate", windowID).Run()
+}
+
+func playSound(critical bool) {
+	if len(audioCommand) == 0 || len(soundNormal) == 0 {
+		return
+	}
+	audioFile := soundNormal
+	if critical && len(soundCritical) > 0 {
+		audioFile = soundCritical
+	}
+	go func() {
+		_ = exec.Command(audioCommand, audioFile).Run()
+	}()
+}
+
+func send(notif *Notification) error {
+	notifier := getDefaultNotifier()
+	if notifier == nil {
+		return nil
+	}
+	if notif.Sound {
+		playSound(notif.Critical)
+	}
+	return notifier.Send(notif)
+}
+
+func desktopAvailable() bool {
+	return getDefaultNotifier() != nil
 }
@@ -0,0 +1,218 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows && !darwin
+
+package notification
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type notifyCall struct {
+	ReplacesID uint32
+	Body       string
+	Actions    []string
+	Hints      map[string]dbus.Variant
+}
+
+type fakeNotificationServer struct {
+	capabilities []string
+	nextID       uint32
+	notified     chan notifyCall
+	closed       chan uint32
+}
+
+func (server *fakeNotificationServer) GetCapabilities() ([]string, *dbus.Error) {
+	return server.capabilities, nil
+}
+
+func (server *fakeNotificationServer) Notify(appName string, replacesID uint32, icon, summary, body string,
+	actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	server.notified <- notifyCall{ReplacesID: replacesID, Body: body, Actions: actions, Hints: hints}
+	if replacesID != 0 {
+		return replacesID, nil
+	}
+	server.nextID++
+	return server.nextID, nil
+}
+
+func (server *fakeNotificationServer) CloseNotification(id uint32) *dbus.Error {
+	server.closed <- id
+	return nil
+}
+
+type recordingHandler struct {
+	opened   chan *Notification
+	markRead chan *Notification
+	replied  chan string
+}
+
+func (handler *recordingHandler) OnNotificationOpen(notif *Notification) {
+	handler.opened <- notif
+}
+
+func (handler *recordingHandler) OnNotificationMarkRead(notif *Notification) {
+	handler.markRead <- notif
+}
+
+func (handler *recordingHandler) OnNotificationReply(notif *Notification, text string) {
+	handler.replied <- text
+}
+
+// startSessionBus starts a private dbus-daemon and returns its address.
+func startSessionBus(t *testing.T) string {
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Skip("failed to start dbus-daemon:", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Skip("failed to read dbus-daemon address:", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connectBus(t *testing.T, address string) *dbus.Conn {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal("failed to connect to bus:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case val := <-ch:
+		return val
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+func TestDBusNotifier(t *testing.T) {
+	t.Setenv("WINDOWID", "")
+	address := startSessionBus(t)
+
+	serverConn := connectBus(t, address)
+	server := &fakeNotificationServer{
+		capabilities: []string{"actions", "body-markup", "inline-reply"},
+		notified:     make(chan notifyCall, 8),
+		closed:       make(chan uint32, 8),
+	}
+	err := serverConn.Export(server, dbusPath, dbusInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := serverConn.RequestName(dbusDestination, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatal("failed to request notification server name:", reply, err)
+	}
+
+	notifier, err := NewDBusNotifier(connectBus(t, address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &recordingHandler{
+		opened:   make(chan *Notification, 1),
+		markRead: make(chan *Notification, 1),
+		replied:  make(chan string, 1),
+	}
+	SetActionHandler(handler)
+	defer SetActionHandler(nil)
+
+	err = notifier.Send(&Notification{Title: "Alice", Text: "<b>hi</b>", Tag: "!room", Icon: "/tmp/icon.png", Actions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := receive(t, server.notified)
+	if first.ReplacesID != 0 {
+		t.Errorf("first notification replaces %d", first.ReplacesID)
+	} else if first.Body != "&lt;b&gt;hi&lt;/b&gt;" {
+		t.Errorf("body wasn't escaped: %q", first.Body)
+	} else if len(first.Actions) != 6 {
+		t.Errorf("expected open, mark read and reply actions, got %v", first.Actions)
+	} else if first.Hints["image-path"].Value() != "/tmp/icon.png" {
+		t.Errorf("unexpected image-path hint %v", first.Hints["image-path"])
+	}
+
+	err = notifier.Send(&Notification{Title: "Alice", Text: "again", Tag: "!room", Context: "$event", Actions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := receive(t, server.notified)
+	if second.ReplacesID != 1 {
+		t.Errorf("second notification with the same tag should replace 1, replaced %d", second.ReplacesID)
+	}
+
+	_ = serverConn.Emit(dbusPath, dbusInterface+".ActionInvoked", uint32(1), actionOpen)
+	if notif := receive(t, handler.opened); notif.Context != "$event" {
+		t.Errorf("open action got notification with context %q", notif.Context)
+	}
+	// Signals from other clients on the bus must be ignored.
+	_ = connectBus(t, address).Emit(dbusPath, dbusInterface+".NotificationReplied", uint32(1), "spoofed")
+	_ = serverConn.Emit(dbusPath, dbusInterface+".NotificationReplied", uint32(1), "hello")
+	if text := receive(t, handler.replied); text != "hello" {
+		t.Errorf("unexpected reply text %q", text)
+	}
+	select {
+	case text := <-handler.replied:
+		t.Errorf("reply signal from another client was handled: %q", text)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = serverConn.Emit(dbusPath, dbusInterface+".ActionInvoked", uint32(1), actionMarkRead)
+	receive(t, handler.markRead)
+	if closedID := receive(t, server.closed); closedID != 1 {
+		t.Errorf("mark read closed notification %d", closedID)
+	}
+
+	_ = serverConn.Emit(dbusPath, dbusInterface+".NotificationClosed", uint32(1), uint32(2))
+	for deadline := time.Now().Add(5 * time.Second); notifier.get(1) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("closed notification wasn't forgotten")
+		}
+	}
+	err = notifier.Send(&Notification{Title: "Alice", Text: "new", Tag: "!room"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third := receive(t, server.notified); third.ReplacesID != 0 {
+		t.Errorf("notification after close shouldn't replace anything, replaced %d", third.ReplacesID)
+	}
+}
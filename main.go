@@ -28,7 +28,11 @@ import (
 
 	flag "maunium.net/go/mauflag"
 
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/headless"
 	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix"
 	"maunium.net/go/gomuks/ui"
@@ -40,12 +44,22 @@ var wantVersion = flag.MakeFull("v", "version", "Show the version of gomuks", "f
 var clearCache = flag.MakeFull("c", "clear-cache", "Clear the cache directory instead of starting", "false").Bool()
 var clearData = flag.Make().LongKey("clear-all-data").Usage("Clear all data instead of starting").Default("false").Bool()
 var skipVersionCheck = flag.MakeFull("s", "skip-version-check", "Skip the homeserver version checks at startup and login", "false").Bool()
+var headlessMode = flag.Make().LongKey("headless").Usage("Run without a terminal interface and expose a JSON-RPC API on a Unix socket").Default("false").Bool()
+var socketPath = flag.Make().LongKey("socket").Usage("Path of the JSON-RPC socket in headless mode, also used by the send command to reach a running instance").String()
+var cmdRoom = flag.MakeFull("r", "room", "Room ID or alias for the send and tail commands", "").UsageCategory("Command").String()
+var cmdFile = flag.Make().LongKey("file").Usage("File to upload with the send command").UsageCategory("Command").String()
+var cmdNotice = flag.Make().LongKey("notice").Usage("Send the message as a notice").UsageCategory("Command").Default("false").Bool()
+var cmdLimit = flag.MakeFull("n", "limit", "Number of messages to show with the tail command", "20").UsageCategory("Command").Int()
+var cmdFollow = flag.MakeFull("f", "follow", "Keep printing new messages with the tail command", "false").UsageCategory("Command").Bool()
 var wantHelp, _ = flag.MakeHelpFlag()
 
 func main() {
 	flag.SetHelpTitles(
 		"gomuks - A terminal Matrix client written in Go.",
-		"gomuks [-vch] [--clear-all-data]",
+		"gomuks [-vch] [--clear-all-data] [--headless [--socket path]] [matrix: URI or matrix.to link]\n"+
+			"  gomuks send --room <id|alias> [--file path] [--notice] [message]\n"+
+			"  gomuks rooms\n"+
+			"  gomuks tail [-f] [-n count] <id|alias>",
 	)
 	err := flag.Parse()
 	if err != nil {
@@ -100,6 +114,31 @@ func main() {
 	debug.Print("Download directory:", downloadDir)
 
 	matrix.SkipVersionCheck = *skipVersionCheck
+	isCommand := flag.NArg() > 0 && headless.IsCommand(flag.Arg(0))
+	var command *headless.Command
+	if isCommand {
+		matrix.ManualSync = true
+		command = &headless.Command{
+			Name:   flag.Arg(0),
+			Args:   flag.Args()[1:],
+			Room:   *cmdRoom,
+			File:   *cmdFile,
+			Notice: *cmdNotice,
+			Limit:  *cmdLimit,
+			Follow: *cmdFollow,
+		}
+		MainUIProvider = headless.NewCommandUI(command)
+	} else if len(flag.Args()) > 0 {
+		matrix.StartupURI, err = id.ParseMatrixURIOrMatrixToURL(flag.Arg(0))
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Failed to parse link:", err)
+			os.Exit(1)
+		}
+	}
+	headless.SocketPath = *socketPath
+	if *headlessMode && !isCommand {
+		MainUIProvider = headless.New
+	}
 	gmx := NewGomuks(MainUIProvider, configDir, dataDir, cacheDir, downloadDir)
 
 	if *clearCache {
@@ -114,6 +153,36 @@ func main() {
 		_ = os.RemoveAll(gmx.config.Dir)
 		fmt.Printf("Cleared cache at %s, data at %s and config at %s\n", gmx.config.CacheDir, gmx.config.DataDir, gmx.config.Dir)
 		return
+	} else if (*headlessMode || isCommand) && len(gmx.config.AccessToken) == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "This requires an existing session, log in with the normal interface first.")
+		os.Exit(1)
+	}
+
+	if isCommand {
+		var handled bool
+		handled, err = headless.RunRemoteCommand(gmx.config, command)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "gomuks %s: %v\n", command.Name, err)
+			os.Exit(1)
+		} else if handled {
+			return
+		}
+	}
+	if err = gmx.config.Lock(); errors.Is(err, config.ErrDataDirLocked) {
+		_, _ = fmt.Fprintln(os.Stderr, "gomuks is already running with the same data directory.")
+		if matrix.StartupURI != nil {
+			// The running instance has no way to receive links, so the link can only be opened there manually.
+			_, _ = fmt.Fprintf(os.Stderr, "Couldn't open %s, open it in the running instance instead.\n", flag.Arg(0))
+		} else if isCommand {
+			// Commands that can be forwarded were already tried through the socket above,
+			// so the instance holding the lock is either an interactive one or doesn't listen on the socket.
+			_, _ = fmt.Fprintln(os.Stderr, "It isn't listening on a command socket (only --headless instances do), so the command can't be passed to it.")
+			_, _ = fmt.Fprintln(os.Stderr, "Close the running instance and try again.")
+		}
+		os.Exit(1)
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
 	gmx.Start()
@@ -0,0 +1,285 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package chatlog implements irssi-style plaintext logs of the messages in each room.
+package chatlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// DefaultFormat is the line format used if chat_log_format is not set.
+const DefaultFormat = "{time} {nick} {text}{annotation}"
+
+// Line is a single message to be written to a chat log.
+type Line struct {
+	Time     time.Time
+	EventID  id.EventID
+	SenderID id.UserID
+	Sender   string
+	// Nick is the irssi-style sender column, e.g. <name> for messages, * for emotes and -!- for state events.
+	Nick string
+	Text string
+	// Annotation is appended to the line to mark edits and redactions.
+	Annotation string
+}
+
+// Logger appends messages to per-room, per-day log files.
+type Logger struct {
+	lock   sync.Mutex
+	config *config.Config
+}
+
+func New(cfg *config.Config) *Logger {
+	return &Logger{config: cfg}
+}
+
+// Enabled returns whether or not messages in the given room should be logged.
+func (logger *Logger) Enabled(room *rooms.Room) bool {
+	return room.IsChatLogEnabled(logger.config.ChatLogs)
+}
+
+// Path returns the path of the log file of the given room for the given day.
+func (logger *Logger) Path(room *rooms.Room, date time.Time) string {
+	return filepath.Join(logger.Dir(room), date.Format("2006-01-02")+".log")
+}
+
+// Dir returns the directory containing the log files of the given room.
+func (logger *Logger) Dir(room *rooms.Room) string {
+	escapedRoomID := strings.ReplaceAll(strings.ReplaceAll(string(room.ID), "%", "%25"), "/", "%2F")
+	return filepath.Join(logger.config.LogDir, escapedRoomID)
+}
+
+// LogMessage logs a new timeline event.
+func (logger *Logger) LogMessage(room *rooms.Room, evt *muksevt.Event) {
+	if !logger.Enabled(room) {
+		return
+	}
+	line := logger.newLine(room, evt.Event)
+	if !logger.fillContent(room, evt.Event, &line) {
+		return
+	}
+	logger.write(room, line)
+}
+
+// LogEdit logs an edit of a previous message. The line contains the new content of the message.
+func (logger *Logger) LogEdit(room *rooms.Room, orig, edit *muksevt.Event) {
+	if !logger.Enabled(room) {
+		return
+	}
+	line := logger.newLine(room, edit.Event)
+	content := edit.Content.AsMessage()
+	if content.NewContent != nil {
+		editCopy := *edit.Event
+		editCopy.Content = event.Content{Parsed: content.NewContent}
+		if !logger.fillContent(room, &editCopy, &line) {
+			return
+		}
+	} else if !logger.fillContent(room, edit.Event, &line) {
+		return
+	}
+	line.Annotation = fmt.Sprintf(" [edit of %s]", orig.ID)
+	logger.write(room, line)
+}
+
+// LogRedaction logs the redaction of a previous message.
+func (logger *Logger) LogRedaction(room *rooms.Room, redacted *muksevt.Event, redaction *event.Event) {
+	if !logger.Enabled(room) {
+		return
+	}
+	line := logger.newLine(room, redaction)
+	line.Nick = "-!-"
+	line.Text = fmt.Sprintf("%s redacted a message from %s", line.Sender, displayname(room, redacted.Sender))
+	if reason := redaction.Content.AsRedaction().Reason; len(reason) > 0 {
+		line.Text += ": " + reason
+	}
+	line.Annotation = fmt.Sprintf(" [redaction of %s]", redacted.ID)
+	logger.write(room, line)
+}
+
+func displayname(room *rooms.Room, userID id.UserID) string {
+	if member := room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+		return member.Displayname
+	}
+	return string(userID)
+}
+
+func (logger *Logger) newLine(room *rooms.Room, evt *event.Event) Line {
+	return Line{
+		Time:     time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*int64(time.Millisecond)),
+		EventID:  evt.ID,
+		SenderID: evt.Sender,
+		Sender:   displayname(room, evt.Sender),
+	}
+}
+
+// fillContent sets the nick and text of the line based on the event content.
+// It returns false if the event isn't something that is displayed in the timeline.
+func (logger *Logger) fillContent(room *rooms.Room, evt *event.Event, line *Line) bool {
+	if evt.Unsigned.RedactedBecause != nil {
+		line.Nick = fmt.Sprintf("<%s>", line.Sender)
+		line.Text = "[redacted]"
+		return true
+	}
+	switch content := evt.Content.Parsed.(type) {
+	case *event.MessageEventContent:
+		line.Nick = fmt.Sprintf("<%s>", line.Sender)
+		if room.Encrypted && !logger.config.ChatLogEncrypted {
+			line.Text = "[encrypted]"
+			return true
+		}
+		contentCopy := *content
+		if len(contentCopy.GetReplyTo()) > 0 {
+			contentCopy.RemoveReplyFallback()
+		}
+		line.Text = contentCopy.Body
+		switch contentCopy.MsgType {
+		case event.MsgEmote:
+			line.Nick = "*"
+			line.Text = fmt.Sprintf("%s %s", line.Sender, contentCopy.Body)
+		case event.MsgNotice:
+			line.Nick = fmt.Sprintf("-%s-", line.Sender)
+		case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+			url := contentCopy.URL
+			if contentCopy.File != nil {
+				url = contentCopy.File.URL
+			}
+			line.Text = fmt.Sprintf("%s: %s", contentCopy.Body, url)
+		}
+	case *muksevt.BadEncryptedContent:
+		line.Nick = fmt.Sprintf("<%s>", line.Sender)
+		line.Text = fmt.Sprintf("[failed to decrypt: %s]", content.Reason)
+	case *event.MemberEventContent:
+		line.Nick = "-!-"
+		line.Text = membershipText(room, evt, content)
+		return len(line.Text) > 0
+	case *event.TopicEventContent:
+		line.Nick = "-!-"
+		line.Text = fmt.Sprintf("%s changed the topic to: %s", line.Sender, content.Topic)
+	case *event.RoomNameEventContent:
+		line.Nick = "-!-"
+		line.Text = fmt.Sprintf("%s changed the room name to: %s", line.Sender, content.Name)
+	case *event.CanonicalAliasEventContent:
+		line.Nick = "-!-"
+		line.Text = fmt.Sprintf("%s changed the main address to: %s", line.Sender, content.Alias)
+	default:
+		return false
+	}
+	return true
+}
+
+func membershipText(room *rooms.Room, evt *event.Event, content *event.MemberEventContent) string {
+	target := content.Displayname
+	if len(target) == 0 {
+		target = evt.GetStateKey()
+	}
+	sender := displayname(room, evt.Sender)
+	prevMembership := event.MembershipLeave
+	prevDisplayname := evt.GetStateKey()
+	if evt.Unsigned.PrevContent != nil {
+		_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+		prevContent := evt.Unsigned.PrevContent.AsMember()
+		prevMembership = prevContent.Membership
+		if len(prevContent.Displayname) > 0 {
+			prevDisplayname = prevContent.Displayname
+		}
+	}
+	var reason string
+	if len(content.Reason) > 0 {
+		reason = ": " + content.Reason
+	}
+	if content.Membership == prevMembership {
+		if target != prevDisplayname {
+			return fmt.Sprintf("%s changed their display name to %s", prevDisplayname, target)
+		}
+		return ""
+	}
+	switch content.Membership {
+	case event.MembershipInvite:
+		return fmt.Sprintf("%s invited %s", sender, target)
+	case event.MembershipJoin:
+		return fmt.Sprintf("%s [%s] has joined", target, evt.GetStateKey())
+	case event.MembershipLeave:
+		if evt.Sender == id.UserID(evt.GetStateKey()) {
+			return fmt.Sprintf("%s [%s] has left%s", prevDisplayname, evt.GetStateKey(), reason)
+		} else if prevMembership == event.MembershipBan {
+			return fmt.Sprintf("%s unbanned %s", sender, prevDisplayname)
+		}
+		return fmt.Sprintf("%s was kicked by %s%s", prevDisplayname, sender, reason)
+	case event.MembershipBan:
+		return fmt.Sprintf("%s was banned by %s%s", prevDisplayname, sender, reason)
+	}
+	return ""
+}
+
+// Format formats the line according to the given format string. Multi-line messages are split into
+// multiple lines with the same prefix so that each line can be found with grep.
+func Format(format string, line Line) string {
+	if len(format) == 0 {
+		format = DefaultFormat
+	}
+	var buf strings.Builder
+	for _, text := range strings.Split(line.Text, "\n") {
+		strings.NewReplacer(
+			"{date}", line.Time.Format("2006-01-02"),
+			"{time}", line.Time.Format("15:04:05"),
+			"{timestamp}", line.Time.Format(time.RFC3339),
+			"{event_id}", string(line.EventID),
+			"{sender_id}", string(line.SenderID),
+			"{sender}", line.Sender,
+			"{nick}", line.Nick,
+			"{text}", text,
+			"{annotation}", line.Annotation,
+		).WriteString(&buf, format)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func (logger *Logger) write(room *rooms.Room, line Line) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	path := logger.Path(room, line.Time)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		debug.Printf("Failed to create chat log directory for %s: %v", room.ID, err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		debug.Printf("Failed to open chat log file for %s: %v", room.ID, err)
+		return
+	}
+	_, err = file.WriteString(Format(logger.config.ChatLogFormat, line))
+	if err != nil {
+		debug.Printf("Failed to write to chat log of %s: %v", room.ID, err)
+	}
+	_ = file.Close()
+}
@@ -23,12 +23,18 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
 
 	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
 )
 
 type cryptoLogger struct {
@@ -81,7 +87,8 @@ func (c *Container) initCrypto() error {
 		cryptoStore = sqlStore
 	}
 	crypt := crypto.NewOlmMachine(c.client, cryptoLogger{"Crypto"}, cryptoStore, c.config.Rooms)
-	crypt.AllowUnverifiedDevices = !c.config.SendToVerifiedOnly
+	// The send_to_verified_only option is applied per room in ShareGroupSession.
+	crypt.AllowUnverifiedDevices = true
 	c.crypto = crypt
 	err = c.crypto.Load()
 	if err != nil {
@@ -98,3 +105,251 @@ func (c *Container) cryptoOnLogin() {
 	sqlStore.DeviceID = c.config.DeviceID
 	sqlStore.AccountID = fmt.Sprintf("%s/%s", c.config.UserID.String(), c.config.DeviceID)
 }
+
+// ShareGroupSession shares the outbound megolm session of the given room, respecting the local encryption overrides
+// of the room.
+func (c *Container) ShareGroupSession(room *rooms.Room) error {
+	mach := c.crypto.(*crypto.OlmMachine)
+	// AllowUnverifiedDevices is global in the olm machine, but it's only used while sharing group sessions,
+	// so holding the lock makes it effectively per room.
+	c.shareGroupSessionLock.Lock()
+	defer c.shareGroupSessionLock.Unlock()
+	mach.AllowUnverifiedDevices = !room.IsSendToVerifiedOnly(c.config.SendToVerifiedOnly)
+	defer func() {
+		mach.AllowUnverifiedDevices = true
+	}()
+	return mach.ShareGroupSession(room.ID, room.GetKeyShareMemberList())
+}
+
+func (c *Container) processCryptoSync(resp *mautrix.RespSync, since string) bool {
+	var knownDevices map[id.UserID]map[id.DeviceID]*crypto.DeviceIdentity
+	if len(resp.DeviceLists.Changed) > 0 {
+		knownDevices = c.getVerifiedUserDevices(resp.DeviceLists.Changed)
+	}
+	c.handleSecretSharing(resp.ToDevice.Events)
+	ok := c.crypto.ProcessSyncResponse(resp, since)
+	if len(resp.DeviceLists.Changed) > 0 {
+		c.handleDeviceListChanges(resp.DeviceLists.Changed)
+		c.checkNewDevices(knownDevices)
+	}
+	return ok
+}
+
+func (c *Container) isVerifiedUser(userID id.UserID) bool {
+	c.trustCacheLock.RLock()
+	_, ok := c.config.VerifiedMasterKeys[userID]
+	c.trustCacheLock.RUnlock()
+	return ok
+}
+
+// getVerifiedUserDevices returns the currently stored devices of the given users who we have verified.
+func (c *Container) getVerifiedUserDevices(users []id.UserID) map[id.UserID]map[id.DeviceID]*crypto.DeviceIdentity {
+	mach := c.crypto.(*crypto.OlmMachine)
+	devices := make(map[id.UserID]map[id.DeviceID]*crypto.DeviceIdentity)
+	for _, userID := range users {
+		if userID == c.config.UserID || !c.isVerifiedUser(userID) {
+			continue
+		}
+		userDevices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			debug.Printf("Failed to get devices of %s before processing device list changes: %v", userID, err)
+			continue
+		}
+		devices[userID] = userDevices
+	}
+	return devices
+}
+
+// checkNewDevices warns about any new unverified devices of verified users.
+func (c *Container) checkNewDevices(knownDevices map[id.UserID]map[id.DeviceID]*crypto.DeviceIdentity) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	for userID, oldDevices := range knownDevices {
+		if !c.isVerifiedUser(userID) {
+			// The master key changed, which was already warned about
+			continue
+		}
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			debug.Printf("Failed to get devices of %s to check for new devices: %v", userID, err)
+			continue
+		}
+		var newDevices []string
+		for deviceID, device := range devices {
+			if _, ok := oldDevices[deviceID]; ok || device.Deleted || device.Trust == crypto.TrustStateBlacklisted || mach.IsDeviceTrusted(device) {
+				continue
+			}
+			newDevices = append(newDevices, fmt.Sprintf("%s (%s)", device.DeviceID, device.Name))
+		}
+		if len(newDevices) == 0 {
+			continue
+		}
+		sort.Strings(newDevices)
+		debug.Printf("Verified user %s has new unverified devices: %v", userID, newDevices)
+		var message string
+		if len(newDevices) == 1 {
+			message = fmt.Sprintf("%s added a new unverified device: %s.", userID, newDevices[0])
+		} else {
+			message = fmt.Sprintf("%s added new unverified devices: %s.", userID, strings.Join(newDevices, ", "))
+		}
+		for _, roomID := range c.config.Rooms.FindSharedRooms(userID) {
+			roomView := c.ui.MainView().GetRoom(roomID)
+			if roomView != nil {
+				roomView.AddServiceMessage(message + " Use /security to review it.")
+			}
+		}
+		c.ui.MainView().NotifySecurityWarning(message)
+		c.ui.Render()
+	}
+}
+
+// VerifiedUsers returns the list of users whose master key we have verified.
+func (c *Container) VerifiedUsers() []id.UserID {
+	c.trustCacheLock.RLock()
+	users := make([]id.UserID, 0, len(c.config.VerifiedMasterKeys))
+	for userID := range c.config.VerifiedMasterKeys {
+		users = append(users, userID)
+	}
+	c.trustCacheLock.RUnlock()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i] < users[j]
+	})
+	return users
+}
+
+func (c *Container) handleDeviceListChanges(changed []id.UserID) {
+	c.trustCacheLock.Lock()
+	for _, userID := range changed {
+		if userID == c.config.UserID {
+			// Our own cross-signing keys affect the trust of everyone else too
+			c.trustCache = make(map[id.UserID]ifc.UserTrust)
+			break
+		}
+		delete(c.trustCache, userID)
+	}
+	c.trustCacheLock.Unlock()
+
+	for _, userID := range changed {
+		c.checkMasterKeyChange(userID)
+		c.recordVerifiedMasterKey(userID)
+		for _, roomID := range c.config.Rooms.FindSharedRooms(userID) {
+			roomView := c.ui.MainView().GetRoom(roomID)
+			if roomView != nil {
+				roomView.UpdateUserList()
+			}
+		}
+	}
+	c.ui.Render()
+}
+
+func (c *Container) checkMasterKeyChange(userID id.UserID) {
+	c.trustCacheLock.RLock()
+	verifiedKey, ok := c.config.VerifiedMasterKeys[userID]
+	c.trustCacheLock.RUnlock()
+	if !ok {
+		return
+	}
+	mach := c.crypto.(*crypto.OlmMachine)
+	keys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		debug.Printf("Failed to get cross-signing keys of %s to check for master key changes: %v", userID, err)
+		return
+	}
+	newKey := keys[id.XSUsageMaster]
+	if newKey == verifiedKey || (len(newKey) > 0 && mach.IsUserTrusted(userID)) {
+		return
+	}
+	debug.Printf("Master key of verified user %s changed from %s to %s", userID, verifiedKey, newKey)
+	c.trustCacheLock.Lock()
+	delete(c.config.VerifiedMasterKeys, userID)
+	c.config.SaveVerifiedMasterKeys()
+	c.trustCacheLock.Unlock()
+	for _, roomID := range c.config.Rooms.FindSharedRooms(userID) {
+		roomView := c.ui.MainView().GetRoom(roomID)
+		if roomView != nil {
+			roomView.AddServiceMessage(fmt.Sprintf("Warning: the master key of %s has changed and they are no longer verified. Use /verify to verify them again.", userID))
+		}
+	}
+}
+
+// recordVerifiedMasterKey stores the master key of the given user if we've cross-signed it, so that changes to it
+// are warned about by checkMasterKeyChange. This is called whenever the keys or signatures of the user change,
+// e.g. right after a verification, so it doesn't depend on the trust of the user being shown in the UI.
+func (c *Container) recordVerifiedMasterKey(userID id.UserID) {
+	if userID == c.config.UserID {
+		return
+	}
+	mach := c.crypto.(*crypto.OlmMachine)
+	// Only check the local store: IsUserTrusted would query the server for our keys if they're not stored.
+	if ownKeys, err := mach.CryptoStore.GetCrossSigningKeys(c.config.UserID); err != nil || len(ownKeys[id.XSUsageMaster]) == 0 {
+		return
+	}
+	theirKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		debug.Printf("Failed to get cross-signing keys of %s to record verified master key: %v", userID, err)
+		return
+	}
+	masterKey, ok := theirKeys[id.XSUsageMaster]
+	if !ok || !mach.IsUserTrusted(userID) {
+		return
+	}
+	c.trustCacheLock.Lock()
+	if c.config.VerifiedMasterKeys[userID] != masterKey {
+		c.config.VerifiedMasterKeys[userID] = masterKey
+		c.config.SaveVerifiedMasterKeys()
+	}
+	c.trustCacheLock.Unlock()
+}
+
+// RefreshUserTrust drops the cached trust state of the given user and updates the UI accordingly.
+func (c *Container) RefreshUserTrust(userID id.UserID) {
+	c.handleDeviceListChanges([]id.UserID{userID})
+}
+
+// UserTrust returns the cross-signing trust state of the given user.
+//
+// The result is cached until the user's device list changes.
+func (c *Container) UserTrust(userID id.UserID) ifc.UserTrust {
+	if c.crypto == nil {
+		return ifc.UserTrustUnknown
+	}
+	c.trustCacheLock.RLock()
+	trust, ok := c.trustCache[userID]
+	c.trustCacheLock.RUnlock()
+	if ok {
+		return trust
+	}
+	trust = c.calculateUserTrust(userID)
+	c.trustCacheLock.Lock()
+	c.trustCache[userID] = trust
+	c.trustCacheLock.Unlock()
+	return trust
+}
+
+func (c *Container) calculateUserTrust(userID id.UserID) ifc.UserTrust {
+	mach := c.crypto.(*crypto.OlmMachine)
+	// Only check the local store: IsUserTrusted would query the server for our keys if they're not stored.
+	ownKeys, err := mach.CryptoStore.GetCrossSigningKeys(c.config.UserID)
+	if err != nil {
+		debug.Printf("Failed to get own cross-signing keys: %v", err)
+		return ifc.UserTrustUnknown
+	}
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		debug.Printf("Failed to get devices of %s: %v", userID, err)
+		return ifc.UserTrustUnknown
+	} else if len(devices) == 0 {
+		return ifc.UserTrustUnknown
+	} else if _, ok := ownKeys[id.XSUsageMaster]; !ok || !mach.IsUserTrusted(userID) {
+		return ifc.UserTrustUnverified
+	}
+
+	c.recordVerifiedMasterKey(userID)
+	for _, device := range devices {
+		if device.Deleted || device.Trust == crypto.TrustStateBlacklisted {
+			continue
+		} else if !mach.IsDeviceTrusted(device) {
+			return ifc.UserTrustUnverifiedDevices
+		}
+	}
+	return ifc.UserTrustVerified
+}
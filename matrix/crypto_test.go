@@ -0,0 +1,213 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+const (
+	testOwnUserID   = id.UserID("@me:example.com")
+	testOwnDeviceID = id.DeviceID("OWNDEVICE")
+	testOtherUserID = id.UserID("@alice:example.com")
+)
+
+// toDeviceRecorder is a fake homeserver that records the to-device messages sent to it.
+type toDeviceRecorder struct {
+	messages map[string]map[id.UserID]map[id.DeviceID]json.RawMessage
+	lock     sync.Mutex
+}
+
+func (rec *toDeviceRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if r.Method != http.MethodPut || len(parts) < 3 || parts[len(parts)-3] != "sendToDevice" {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Messages map[id.UserID]map[id.DeviceID]json.RawMessage `json:"messages"`
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.lock.Lock()
+	evtType := parts[len(parts)-2]
+	if rec.messages[evtType] == nil {
+		rec.messages[evtType] = make(map[id.UserID]map[id.DeviceID]json.RawMessage)
+	}
+	for userID, devices := range req.Messages {
+		if rec.messages[evtType][userID] == nil {
+			rec.messages[evtType][userID] = make(map[id.DeviceID]json.RawMessage)
+		}
+		for deviceID, content := range devices {
+			rec.messages[evtType][userID][deviceID] = content
+		}
+	}
+	rec.lock.Unlock()
+	_, _ = w.Write([]byte("{}"))
+}
+
+func (rec *toDeviceRecorder) receivers(evtType event.Type) map[id.DeviceID]bool {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	receivers := make(map[id.DeviceID]bool)
+	for deviceID := range rec.messages[evtType.Type][testOtherUserID] {
+		receivers[deviceID] = true
+	}
+	return receivers
+}
+
+func (rec *toDeviceRecorder) reset() {
+	rec.lock.Lock()
+	rec.messages = make(map[string]map[id.UserID]map[id.DeviceID]json.RawMessage)
+	rec.lock.Unlock()
+}
+
+// addTestDevice stores a device of the other user with an olm session to it, so that sharing doesn't need to
+// claim one-time keys.
+func addTestDevice(t *testing.T, store crypto.Store, devices map[id.DeviceID]*crypto.DeviceIdentity, deviceID id.DeviceID, trust crypto.TrustState) {
+	account := olm.NewAccount()
+	signingKey, identityKey := account.IdentityKeys()
+	account.GenOneTimeKeys(1)
+	var oneTimeKey id.Curve25519
+	for _, key := range account.OneTimeKeys() {
+		oneTimeKey = key
+	}
+	session, err := olm.NewAccount().NewOutboundSession(identityKey, oneTimeKey)
+	if err != nil {
+		t.Fatal("failed to create olm session:", err)
+	}
+	err = store.AddSession(identityKey, &crypto.OlmSession{Internal: *session})
+	if err != nil {
+		t.Fatal("failed to store olm session:", err)
+	}
+	devices[deviceID] = &crypto.DeviceIdentity{
+		UserID:      testOtherUserID,
+		DeviceID:    deviceID,
+		IdentityKey: identityKey,
+		SigningKey:  signingKey,
+		Trust:       trust,
+	}
+}
+
+func TestShareGroupSessionVerifiedOnly(t *testing.T) {
+	dir := t.TempDir()
+	recorder := &toDeviceRecorder{}
+	recorder.reset()
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	client, err := mautrix.NewClient(server.URL, testOwnUserID, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.DeviceID = testOwnDeviceID
+
+	cfg := config.NewConfig(dir, dir, dir, dir)
+	cfg.UserID = testOwnUserID
+	cfg.DeviceID = testOwnDeviceID
+	cfg.Rooms = rooms.NewRoomCache(filepath.Join(dir, "rooms.gob.gz"), filepath.Join(dir, "state"), 32, 60, cfg.GetUserID)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "crypto.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := crypto.NewSQLCryptoStore(db, "sqlite3", "test", testOwnDeviceID, []byte("test"), cryptoLogger{"Crypto/DB"})
+	if err = store.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	mach := crypto.NewOlmMachine(client, cryptoLogger{"Crypto"}, store, cfg.Rooms)
+	if err = mach.Load(); err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{client: client, config: cfg, crypto: mach}
+
+	devices := make(map[id.DeviceID]*crypto.DeviceIdentity)
+	addTestDevice(t, store, devices, "VERIFIED", crypto.TrustStateVerified)
+	addTestDevice(t, store, devices, "UNVERIFIED", crypto.TrustStateUnset)
+	if err = store.PutDevices(testOtherUserID, devices); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.PutDevices(testOwnUserID, map[id.DeviceID]*crypto.DeviceIdentity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	newRoom := func(roomID id.RoomID, verifiedOnly bool) *rooms.Room {
+		room := cfg.Rooms.GetOrCreate(roomID)
+		room.Encrypted = true
+		room.EncryptionOverrides.SendToVerifiedOnly = &verifiedOnly
+		for _, userID := range []id.UserID{testOwnUserID, testOtherUserID} {
+			stateKey := string(userID)
+			room.UpdateState(&event.Event{
+				Type:     event.StateMember,
+				StateKey: &stateKey,
+				Content:  event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipJoin}},
+			})
+		}
+		return room
+	}
+
+	if err = c.ShareGroupSession(newRoom("!verifiedonly:example.com", true)); err != nil {
+		t.Fatal("failed to share session in verified-only room:", err)
+	}
+	if received := recorder.receivers(event.ToDeviceEncrypted); !received["VERIFIED"] || received["UNVERIFIED"] {
+		t.Errorf("room key in verified-only room should only be sent to the verified device, was sent to %v", received)
+	}
+	if withheld := recorder.receivers(event.ToDeviceRoomKeyWithheld); !withheld["UNVERIFIED"] {
+		t.Errorf("room key should be withheld from the unverified device, was withheld from %v", withheld)
+	}
+	if !mach.AllowUnverifiedDevices {
+		t.Error("AllowUnverifiedDevices wasn't restored after sharing")
+	}
+
+	recorder.reset()
+	if err = c.ShareGroupSession(newRoom("!everyone:example.com", false)); err != nil {
+		t.Fatal("failed to share session in normal room:", err)
+	}
+	if received := recorder.receivers(event.ToDeviceEncrypted); !received["VERIFIED"] || !received["UNVERIFIED"] {
+		t.Errorf("room key in normal room should be sent to both devices, was sent to %v", received)
+	}
+
+	session, err := store.GetOutboundGroupSession("!verifiedonly:example.com")
+	if err != nil || session == nil || !session.Shared {
+		t.Errorf("shared session wasn't stored: %v %v", session, err)
+	}
+}
@@ -0,0 +1,111 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"reflect"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+)
+
+var AccountDataGomuksDraft = event.Type{
+	Type:  "net.maunium.gomuks.draft",
+	Class: event.AccountDataEventType,
+}
+
+func init() {
+	event.TypeMap[AccountDataGomuksDraft] = reflect.TypeOf(config.Draft{})
+}
+
+// GetDraft returns a copy of the saved draft of the given room, or nil if there isn't one.
+func (c *Container) GetDraft(roomID id.RoomID) *config.Draft {
+	c.draftLock.Lock()
+	defer c.draftLock.Unlock()
+	draft := c.config.Drafts[roomID]
+	if draft.IsEmpty() {
+		return nil
+	}
+	draftCopy := *draft
+	return &draftCopy
+}
+
+// SaveDraft stores the draft of the given room on disk, and in room account data if draft syncing is enabled
+// and the room isn't encrypted.
+//
+// Empty drafts are kept with only the timestamp, so that older drafts from other devices don't replace them.
+func (c *Container) SaveDraft(roomID id.RoomID, draft *config.Draft) {
+	if draft == nil {
+		draft = &config.Draft{}
+	}
+	c.draftLock.Lock()
+	existing, ok := c.config.Drafts[roomID]
+	if ok {
+		cmp := *draft
+		cmp.UpdatedAt = existing.UpdatedAt
+		if cmp == *existing {
+			c.draftLock.Unlock()
+			return
+		}
+	} else if draft.IsEmpty() {
+		c.draftLock.Unlock()
+		return
+	}
+	draftCopy := *draft
+	draftCopy.UpdatedAt = time.Now().UnixNano() / 1e6
+	c.config.Drafts[roomID] = &draftCopy
+	c.config.SaveDrafts()
+	c.draftLock.Unlock()
+
+	// Account data isn't encrypted, so drafts of encrypted rooms are never synced.
+	if room := c.GetRoom(roomID); c.config.Preferences.SyncDrafts && c.client != nil && room != nil && !room.Encrypted {
+		go c.sendDraft(roomID, &draftCopy)
+	}
+}
+
+func (c *Container) sendDraft(roomID id.RoomID, draft *config.Draft) {
+	defer debug.Recover()
+	err := c.client.SetRoomAccountData(roomID, AccountDataGomuksDraft.Type, draft)
+	if err != nil {
+		debug.Printf("Failed to sync draft of %s: %v", roomID, err)
+	}
+}
+
+// HandleDraft replaces the local draft of a room with one synced from another device if it's newer.
+func (c *Container) HandleDraft(_ mautrix.EventSource, evt *event.Event) {
+	draft, ok := evt.Content.Parsed.(*config.Draft)
+	if !ok || !c.config.Preferences.SyncDrafts {
+		return
+	}
+	c.draftLock.Lock()
+	if existing, ok := c.config.Drafts[evt.RoomID]; ok && existing.UpdatedAt >= draft.UpdatedAt {
+		c.draftLock.Unlock()
+		return
+	}
+	c.config.Drafts[evt.RoomID] = draft
+	c.config.SaveDrafts()
+	c.draftLock.Unlock()
+
+	if c.config.AuthCache.InitialSyncDone {
+		c.ui.MainView().UpdateDraft(evt.RoomID, draft)
+	}
+}
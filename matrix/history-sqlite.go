@@ -0,0 +1,655 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	sync "github.com/sasha-s/go-deadlock"
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// The stream order of the first event stored in a room. Appended events count up from here and prepended events
+// count down, so the orders stay positive and can be used as history pointers directly.
+const sqliteHistoryStartOrder = 1 << 62
+
+// The number of stream orders reserved for the missing events of each timeline gap.
+const sqliteHistoryGapSize = 1 << 32
+
+var sqliteHistoryUpgrades = []string{
+	`CREATE TABLE rooms (
+		room_id   TEXT    PRIMARY KEY,
+		min_order INTEGER NOT NULL,
+		max_order INTEGER NOT NULL
+	);
+	CREATE TABLE events (
+		room_id      TEXT    NOT NULL REFERENCES rooms(room_id) ON DELETE CASCADE,
+		stream_order INTEGER NOT NULL,
+		event_id     TEXT    NOT NULL,
+		sender       TEXT    NOT NULL,
+		type         TEXT    NOT NULL,
+		state_key    TEXT,
+		timestamp    BIGINT  NOT NULL,
+		body         TEXT,
+		redacted_by  TEXT,
+		content      BLOB    NOT NULL,
+		PRIMARY KEY (room_id, stream_order),
+		UNIQUE (room_id, event_id)
+	);
+	CREATE INDEX events_timestamp_idx ON events (room_id, timestamp);
+	CREATE TABLE relations (
+		room_id    TEXT NOT NULL,
+		event_id   TEXT NOT NULL,
+		relates_to TEXT NOT NULL,
+		rel_type   TEXT NOT NULL,
+		PRIMARY KEY (room_id, event_id),
+		FOREIGN KEY (room_id, event_id) REFERENCES events (room_id, event_id) ON DELETE CASCADE
+	);
+	CREATE INDEX relations_target_idx ON relations (room_id, relates_to);
+	CREATE TABLE gaps (
+		room_id      TEXT    NOT NULL REFERENCES rooms(room_id) ON DELETE CASCADE,
+		stream_order INTEGER NOT NULL,
+		prev_batch   TEXT    NOT NULL,
+		PRIMARY KEY (room_id, stream_order)
+	);`,
+}
+
+type sqliteHistoryManager struct {
+	sync.Mutex
+
+	db   *sql.DB
+	path string
+}
+
+// NewHistoryManager opens the SQLite history database, migrating the legacy bbolt database into it if one exists.
+func NewHistoryManager(cfg *config.Config) (HistoryManager, error) {
+	hm, err := newSQLiteHistoryManager(cfg.HistoryDB)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(cfg.HistoryPath); err == nil {
+		err = hm.migrateFromBolt(cfg.HistoryPath)
+		if err != nil {
+			_ = hm.Close()
+			return nil, fmt.Errorf("failed to migrate %s: %w", cfg.HistoryPath, err)
+		}
+	}
+	return hm, nil
+}
+
+func newSQLiteHistoryManager(dbPath string) (*sqliteHistoryManager, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_journal_mode=WAL&_busy_timeout=5000", dbPath))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	hm := &sqliteHistoryManager{db: db, path: dbPath}
+	if err = hm.upgrade(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to upgrade history database: %w", err)
+	}
+	return hm, nil
+}
+
+func (hm *sqliteHistoryManager) upgrade() error {
+	var version int
+	if err := hm.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteHistoryUpgrades); version++ {
+		tx, err := hm.db.Begin()
+		if err != nil {
+			return err
+		} else if _, err = tx.Exec(sqliteHistoryUpgrades[version]); err != nil {
+			_ = tx.Rollback()
+			return err
+		} else if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			_ = tx.Rollback()
+			return err
+		} else if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFromBolt copies all events from the legacy bbolt database in stream order and deletes the old file.
+func (hm *sqliteHistoryManager) migrateFromBolt(boltPath string) error {
+	debug.Print("Migrating history from", boltPath, "to", hm.path)
+	old, err := newBoltHistoryManager(boltPath)
+	if err != nil {
+		return err
+	}
+	var migrated int
+	err = old.db.View(func(boltTx *bolt.Tx) error {
+		return boltTx.Bucket(bucketRoomStreams).ForEach(func(rid, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			tx, err := hm.db.Begin()
+			if err != nil {
+				return err
+			}
+			roomID := id.RoomID(rid)
+			if _, err = tx.Exec("DELETE FROM rooms WHERE room_id=$1", roomID); err != nil {
+				_ = tx.Rollback()
+				return err
+			} else if _, _, err = hm.roomOrders(tx, roomID); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			order := int64(sqliteHistoryStartOrder)
+			err = boltTx.Bucket(bucketRoomStreams).Bucket(rid).ForEach(func(_, data []byte) error {
+				evt, err := unmarshalEvent(data)
+				if err != nil {
+					debug.Printf("Failed to unmarshal event in %s while migrating history: %v", roomID, err)
+					return nil
+				}
+				if inserted, err := hm.insertEvent(tx, roomID, order, evt); err != nil {
+					return err
+				} else if inserted {
+					order++
+				}
+				return nil
+			})
+			if err == nil {
+				_, err = tx.Exec("UPDATE rooms SET max_order=$1 WHERE room_id=$2", order-1, roomID)
+			}
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			migrated += int(order - sqliteHistoryStartOrder)
+			return tx.Commit()
+		})
+	})
+	if closeErr := old.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	debug.Printf("Migrated %d events to SQLite, removing %s", migrated, boltPath)
+	return os.Remove(boltPath)
+}
+
+func eventBody(evt *muksevt.Event) *string {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return nil
+	}
+	body := content.Body
+	if len(evt.Gomuks.Edits) > 0 {
+		if newContent := evt.Gomuks.Edits[len(evt.Gomuks.Edits)-1].Content.AsMessage().NewContent; newContent != nil {
+			body = newContent.Body
+		}
+	}
+	return &body
+}
+
+func redactedBy(evt *muksevt.Event) *id.EventID {
+	if evt.Unsigned.RedactedBecause != nil {
+		return &evt.Unsigned.RedactedBecause.ID
+	}
+	return nil
+}
+
+// insertEvent stores the event with the given stream order. Events that are already stored are skipped.
+func (hm *sqliteHistoryManager) insertEvent(tx *sql.Tx, roomID id.RoomID, order int64, evt *muksevt.Event) (bool, error) {
+	data, err := marshalEvent(evt)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`INSERT INTO events (room_id, stream_order, event_id, sender, type, state_key, timestamp, body, redacted_by, content)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (room_id, event_id) DO NOTHING`,
+		roomID, order, evt.ID, evt.Sender, evt.Type.Type, evt.StateKey, evt.Timestamp, eventBody(evt), redactedBy(evt), data)
+	if err != nil {
+		return false, err
+	} else if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+	if relatable, ok := evt.Content.Parsed.(event.Relatable); ok {
+		if rel := relatable.OptionalGetRelatesTo(); rel != nil && len(rel.EventID) > 0 {
+			_, err = tx.Exec("INSERT INTO relations (room_id, event_id, relates_to, rel_type) VALUES ($1, $2, $3, $4)",
+				roomID, evt.ID, rel.EventID, rel.Type)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// roomOrders returns the lowest and highest stream order of the room, creating the room if it doesn't exist yet.
+func (hm *sqliteHistoryManager) roomOrders(tx *sql.Tx, roomID id.RoomID) (minOrder, maxOrder int64, err error) {
+	err = tx.QueryRow("SELECT min_order, max_order FROM rooms WHERE room_id=$1", roomID).Scan(&minOrder, &maxOrder)
+	if errors.Is(err, sql.ErrNoRows) {
+		minOrder, maxOrder = sqliteHistoryStartOrder, sqliteHistoryStartOrder-1
+		_, err = tx.Exec("INSERT INTO rooms (room_id, min_order, max_order) VALUES ($1, $2, $3)", roomID, minOrder, maxOrder)
+	}
+	return
+}
+
+func (hm *sqliteHistoryManager) store(room *rooms.Room, events []*event.Event, isAppend bool) (newEvents []*muksevt.Event, newPtrStart uint64, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	tx, err := hm.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	minOrder, maxOrder, err := hm.roomOrders(tx, room.ID)
+	if err != nil {
+		return
+	}
+	newEvents = make([]*muksevt.Event, 0, len(events))
+	for _, evt := range events {
+		wrapped := muksevt.Wrap(evt)
+		var order int64
+		if isAppend {
+			order = maxOrder + 1
+		} else {
+			order = minOrder - 1
+		}
+		var inserted bool
+		inserted, err = hm.insertEvent(tx, room.ID, order, wrapped)
+		if err != nil {
+			return
+		} else if inserted {
+			if isAppend {
+				maxOrder = order
+			} else {
+				minOrder = order
+			}
+			newEvents = append(newEvents, wrapped)
+		} else if isAppend {
+			// Appended events are always returned so that the caller can display them.
+			newEvents = append(newEvents, wrapped)
+		}
+	}
+	_, err = tx.Exec("UPDATE rooms SET min_order=$1, max_order=$2 WHERE room_id=$3", minOrder, maxOrder, room.ID)
+	newPtrStart = uint64(minOrder)
+	return
+}
+
+func (hm *sqliteHistoryManager) Append(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, error) {
+	muksEvts, _, err := hm.store(room, events, true)
+	return muksEvts, err
+}
+
+// Prepend stores events from backwards pagination, which are ordered newest first.
+// The returned pointer is the pointer of the oldest event, so the next Load continues from there.
+func (hm *sqliteHistoryManager) Prepend(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, uint64, error) {
+	return hm.store(room, events, false)
+}
+
+func (hm *sqliteHistoryManager) Load(room *rooms.Room, num int, ptrStart uint64) (events []*muksevt.Event, newPtrStart uint64, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	upperBound := int64(ptrStart)
+	if ptrStart == 0 {
+		upperBound = math.MaxInt64
+	}
+	rows, err := hm.db.Query("SELECT stream_order, content FROM events WHERE room_id=$1 AND stream_order<$2 ORDER BY stream_order DESC LIMIT $3",
+		room.ID, upperBound, num)
+	if err != nil {
+		return
+	}
+	var orders []int64
+	for rows.Next() {
+		var order int64
+		var data []byte
+		var evt *muksevt.Event
+		if err = rows.Scan(&order, &data); err != nil {
+			break
+		} else if evt, err = unmarshalEvent(data); err != nil {
+			break
+		}
+		events = append(events, evt)
+		orders = append(orders, order)
+		newPtrStart = uint64(order)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil || len(events) == 0 {
+		return
+	}
+	events, err = hm.addGaps(room, events, orders, upperBound)
+	return
+}
+
+// addGaps inserts placeholders for the gaps between the given events, which are ordered newest first.
+// A gap is always right before the event with the same stream order, i.e. after it when going backwards.
+func (hm *sqliteHistoryManager) addGaps(room *rooms.Room, events []*muksevt.Event, orders []int64, upperBound int64) ([]*muksevt.Event, error) {
+	rows, err := hm.db.Query("SELECT stream_order, prev_batch FROM gaps WHERE room_id=$1 AND stream_order>=$2 AND stream_order<$3 ORDER BY stream_order DESC",
+		room.ID, orders[len(orders)-1], upperBound)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+	withGaps := make([]*muksevt.Event, 0, len(events))
+	i := 0
+	for rows.Next() {
+		var order int64
+		var prevBatch string
+		if err = rows.Scan(&order, &prevBatch); err != nil {
+			return events, err
+		}
+		for ; i < len(events) && orders[i] >= order; i++ {
+			withGaps = append(withGaps, events[i])
+		}
+		// Use the timestamp of the event right after the gap so that the gap is on the correct day.
+		timestamp := events[0].Timestamp
+		if i > 0 {
+			timestamp = events[i-1].Timestamp
+		}
+		withGaps = append(withGaps, muksevt.NewTimelineGap(room.ID, uint64(order), prevBatch, timestamp))
+	}
+	if err = rows.Err(); err != nil {
+		return events, err
+	}
+	return append(withGaps, events[i:]...), nil
+}
+
+// AddGap records that events before the next appended event are missing. The gap is placed after the newest stored
+// event with enough free stream orders to fill it, and is returned as a placeholder event. Nothing is recorded if the
+// room doesn't have any stored events yet.
+func (hm *sqliteHistoryManager) AddGap(room *rooms.Room, prevBatch string) (gap *muksevt.Event, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	tx, err := hm.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	var maxOrder, timestamp int64
+	err = tx.QueryRow("SELECT stream_order, timestamp FROM events WHERE room_id=$1 ORDER BY stream_order DESC LIMIT 1", room.ID).
+		Scan(&maxOrder, &timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	var order int64
+	err = tx.QueryRow("SELECT stream_order FROM gaps WHERE room_id=$1 AND stream_order>$2", room.ID, maxOrder).Scan(&order)
+	if errors.Is(err, sql.ErrNoRows) {
+		order = maxOrder + sqliteHistoryGapSize
+		if order < maxOrder {
+			return nil, fmt.Errorf("no stream orders left for a gap in %s", room.ID)
+		}
+		_, err = tx.Exec("INSERT INTO gaps (room_id, stream_order, prev_batch) VALUES ($1, $2, $3)", room.ID, order, prevBatch)
+		if err == nil {
+			_, err = tx.Exec("UPDATE rooms SET max_order=$1 WHERE room_id=$2", order-1, room.ID)
+		}
+	} else if err == nil {
+		// Nothing was appended after the previous gap, so the new token supersedes it.
+		_, err = tx.Exec("UPDATE gaps SET prev_batch=$1 WHERE room_id=$2 AND stream_order=$3", prevBatch, room.ID, order)
+	}
+	if err != nil {
+		return
+	}
+	return muksevt.NewTimelineGap(room.ID, uint64(order), prevBatch, timestamp), nil
+}
+
+// FillGap stores events fetched backwards from the token of the given gap. The events are inserted below the gap
+// until one of them is already stored, which means the gap is closed. If the gap isn't closed and prevBatch is set,
+// a new gap is recorded below the inserted events and returned.
+func (hm *sqliteHistoryManager) FillGap(room *rooms.Room, gapPtr uint64, events []*event.Event, prevBatch string) (newEvents []*muksevt.Event, newGap *muksevt.Event, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	tx, err := hm.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	gapOrder := int64(gapPtr)
+	res, err := tx.Exec("DELETE FROM gaps WHERE room_id=$1 AND stream_order=$2", room.ID, gapOrder)
+	if err != nil {
+		return
+	} else if affected, _ := res.RowsAffected(); affected == 0 {
+		return nil, nil, GapNotFoundError
+	}
+	var lowerBound sql.NullInt64
+	err = tx.QueryRow("SELECT MAX(stream_order) FROM events WHERE room_id=$1 AND stream_order<$2", room.ID, gapOrder).Scan(&lowerBound)
+	if err != nil {
+		return
+	}
+	minOrder, _, err := hm.roomOrders(tx, room.ID)
+	if err != nil {
+		return
+	}
+	order := gapOrder
+	closed := len(events) == 0 || len(prevBatch) == 0
+	newEvents = make([]*muksevt.Event, 0, len(events))
+	for _, evt := range events {
+		if lowerBound.Valid && order-1 <= lowerBound.Int64 {
+			return nil, nil, fmt.Errorf("no stream orders left in gap %d of %s", gapOrder, room.ID)
+		}
+		wrapped := muksevt.Wrap(evt)
+		var inserted bool
+		inserted, err = hm.insertEvent(tx, room.ID, order-1, wrapped)
+		if err != nil {
+			return
+		} else if !inserted {
+			closed = true
+			break
+		}
+		order--
+		newEvents = append(newEvents, wrapped)
+	}
+	if order < minOrder {
+		_, err = tx.Exec("UPDATE rooms SET min_order=$1 WHERE room_id=$2", order, room.ID)
+		if err != nil {
+			return
+		}
+	}
+	if !closed {
+		_, err = tx.Exec("INSERT INTO gaps (room_id, stream_order, prev_batch) VALUES ($1, $2, $3)", room.ID, order, prevBatch)
+		if err != nil {
+			return
+		}
+		newGap = muksevt.NewTimelineGap(room.ID, uint64(order), prevBatch, newEvents[len(newEvents)-1].Timestamp)
+	}
+	return
+}
+
+func (hm *sqliteHistoryManager) get(tx *sql.Tx, roomID id.RoomID, eventID id.EventID) (*muksevt.Event, error) {
+	var data []byte
+	err := tx.QueryRow("SELECT content FROM events WHERE room_id=$1 AND event_id=$2", roomID, eventID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, EventNotFoundError
+	} else if err != nil {
+		return nil, err
+	}
+	return unmarshalEvent(data)
+}
+
+func (hm *sqliteHistoryManager) Get(room *rooms.Room, eventID id.EventID) (*muksevt.Event, error) {
+	hm.Lock()
+	defer hm.Unlock()
+	tx, err := hm.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return hm.get(tx, room.ID, eventID)
+}
+
+func (hm *sqliteHistoryManager) Update(room *rooms.Room, eventID id.EventID, update func(evt *muksevt.Event) error) error {
+	hm.Lock()
+	defer hm.Unlock()
+	tx, err := hm.db.Begin()
+	if err != nil {
+		return err
+	}
+	evt, err := hm.get(tx, room.ID, eventID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	} else if err = update(evt); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	data, err := marshalEvent(evt)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("UPDATE events SET content=$1, body=$2, redacted_by=$3 WHERE room_id=$4 AND event_id=$5",
+		data, eventBody(evt), redactedBy(evt), room.ID, eventID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (hm *sqliteHistoryManager) Stats() (stats []ifc.HistoryRoomStats, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	rows, err := hm.db.Query("SELECT room_id, COUNT(*), SUM(LENGTH(content)) FROM events GROUP BY room_id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomStats ifc.HistoryRoomStats
+		if err = rows.Scan(&roomStats.RoomID, &roomStats.Events, &roomStats.Size); err != nil {
+			return
+		}
+		stats = append(stats, roomStats)
+	}
+	err = rows.Err()
+	return
+}
+
+func (hm *sqliteHistoryManager) Prune(room *rooms.Room, maxEvents int, olderThan time.Time) (int, error) {
+	hm.Lock()
+	defer hm.Unlock()
+	var removed int64
+	if maxEvents > 0 {
+		res, err := hm.db.Exec(`DELETE FROM events WHERE room_id=$1 AND stream_order <= (
+			SELECT stream_order FROM events WHERE room_id=$1 ORDER BY stream_order DESC LIMIT 1 OFFSET $2
+		)`, room.ID, maxEvents)
+		if err != nil {
+			return 0, err
+		}
+		affected, _ := res.RowsAffected()
+		removed += affected
+	}
+	if !olderThan.IsZero() {
+		res, err := hm.db.Exec("DELETE FROM events WHERE room_id=$1 AND timestamp<$2",
+			room.ID, olderThan.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return int(removed), err
+		}
+		affected, _ := res.RowsAffected()
+		removed += affected
+	}
+	if removed > 0 {
+		// Gaps below the oldest remaining event can't be filled anymore.
+		_, err := hm.db.Exec(`DELETE FROM gaps WHERE room_id=$1 AND stream_order <= COALESCE(
+			(SELECT MIN(stream_order) FROM events WHERE room_id=$1), $2
+		)`, room.ID, int64(math.MaxInt64))
+		if err != nil {
+			return int(removed), err
+		}
+	}
+	return int(removed), nil
+}
+
+func (hm *sqliteHistoryManager) DropRoom(roomID id.RoomID) error {
+	hm.Lock()
+	defer hm.Unlock()
+	_, err := hm.db.Exec("DELETE FROM rooms WHERE room_id=$1", roomID)
+	return err
+}
+
+// Compact runs VACUUM to rewrite the database file without the free pages left over by deleted events.
+func (hm *sqliteHistoryManager) Compact() (sizeBefore, sizeAfter int64, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	if _, err = hm.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return
+	}
+	sizeBefore = hm.size()
+	if _, err = hm.db.Exec("VACUUM"); err != nil {
+		return
+	}
+	if _, err = hm.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return
+	}
+	sizeAfter = hm.size()
+	return
+}
+
+func (hm *sqliteHistoryManager) size() int64 {
+	var size int64
+	for _, suffix := range []string{"", "-wal"} {
+		if info, err := os.Stat(hm.path + suffix); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (hm *sqliteHistoryManager) Size() int64 {
+	hm.Lock()
+	defer hm.Unlock()
+	return hm.size()
+}
+
+func (hm *sqliteHistoryManager) Close() error {
+	return hm.db.Close()
+}
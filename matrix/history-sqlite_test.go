@@ -0,0 +1,112 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+func makeTestEvents(roomID id.RoomID, from, to int) []*event.Event {
+	events := make([]*event.Event, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		events = append(events, &event.Event{
+			ID:        id.EventID(fmt.Sprintf("$event%d", i)),
+			RoomID:    roomID,
+			Sender:    testOtherUserID,
+			Type:      event.EventMessage,
+			Timestamp: int64(i) * 1000,
+			Content: event.Content{Parsed: &event.MessageEventContent{
+				MsgType: event.MsgText,
+				Body:    fmt.Sprintf("message %d", i),
+			}},
+		})
+	}
+	return events
+}
+
+func TestMigrateHistoryFromBolt(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.NewConfig(dir, dir, dir, dir)
+	cfg.Rooms = rooms.NewRoomCache(filepath.Join(dir, "rooms.gob.gz"), filepath.Join(dir, "state"), 32, 60, cfg.GetUserID)
+	room := rooms.NewRoom("!room:example.com", cfg.Rooms)
+	otherRoom := rooms.NewRoom("!other:example.com", cfg.Rooms)
+
+	old, err := newBoltHistoryManager(cfg.HistoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = old.Append(room, makeTestEvents(room.ID, 1, 3)); err != nil {
+		t.Fatal(err)
+	} else if _, err = old.Append(room, makeTestEvents(room.ID, 4, 6)); err != nil {
+		t.Fatal(err)
+	} else if _, err = old.Append(otherRoom, makeTestEvents(otherRoom.ID, 1, 2)); err != nil {
+		t.Fatal(err)
+	} else if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hm, err := NewHistoryManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Close()
+	if _, err = os.Stat(cfg.HistoryPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the bolt database to be removed after migrating, got %v", err)
+	}
+
+	events, ptr, err := hm.Load(room, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 4 {
+		t.Fatalf("Expected 4 events in the first batch, got %d", len(events))
+	}
+	rest, _, err := hm.Load(room, 10, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = append(events, rest...)
+	if len(events) != 6 {
+		t.Fatalf("Expected 6 migrated events, got %d", len(events))
+	}
+	for i, evt := range events {
+		expected := id.EventID(fmt.Sprintf("$event%d", 6-i))
+		if evt.ID != expected {
+			t.Errorf("Expected event #%d to be %s, got %s", i, expected, evt.ID)
+		}
+	}
+	if content, ok := events[0].Content.Parsed.(*event.MessageEventContent); !ok || content.Body != "message 6" {
+		t.Errorf("Expected the content of the newest event to be migrated, got %+v", events[0].Content.Parsed)
+	}
+
+	otherEvents, _, err := hm.Load(otherRoom, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(otherEvents) != 2 || otherEvents[0].ID != "$event2" || otherEvents[1].ID != "$event1" {
+		t.Errorf("Expected the other room to have $event2 and $event1, got %d events", len(otherEvents))
+	}
+}
@@ -22,6 +22,8 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"os"
+	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
 	bolt "go.etcd.io/bbolt"
@@ -29,11 +31,38 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix/muksevt"
 	"maunium.net/go/gomuks/matrix/rooms"
 )
 
-type HistoryManager struct {
+// HistoryManager stores the timeline events of rooms.
+//
+// Events are ordered by stream pointers. Load returns events before the given pointer (or the newest events if the
+// pointer is zero) and the pointer to pass to the next call to continue loading older events.
+//
+// When a sync skips over events, AddGap records a gap after the newest stored event. Load returns gaps as
+// muksevt.EventTimelineGap placeholder events, and FillGap inserts the missing events in the middle of the stream.
+type HistoryManager interface {
+	Get(room *rooms.Room, eventID id.EventID) (*muksevt.Event, error)
+	Update(room *rooms.Room, eventID id.EventID, update func(evt *muksevt.Event) error) error
+	Append(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, error)
+	Prepend(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, uint64, error)
+	Load(room *rooms.Room, num int, ptrStart uint64) ([]*muksevt.Event, uint64, error)
+	AddGap(room *rooms.Room, prevBatch string) (*muksevt.Event, error)
+	FillGap(room *rooms.Room, gapPtr uint64, events []*event.Event, prevBatch string) ([]*muksevt.Event, *muksevt.Event, error)
+
+	Stats() ([]ifc.HistoryRoomStats, error)
+	Prune(room *rooms.Room, maxEvents int, olderThan time.Time) (int, error)
+	DropRoom(roomID id.RoomID) error
+	Compact() (sizeBefore, sizeAfter int64, err error)
+	Size() int64
+	Close() error
+}
+
+// boltHistoryManager is the legacy history store that keeps gob-encoded events in bbolt buckets.
+// It is still used in builds without cgo, and for migrating old databases to SQLite.
+type boltHistoryManager struct {
 	sync.Mutex
 
 	db *bolt.DB
@@ -47,15 +76,11 @@ var bucketStreamPointers = []byte("room_stream_pointers")
 
 const halfUint64 = ^uint64(0) >> 1
 
-func NewHistoryManager(dbPath string) (*HistoryManager, error) {
-	hm := &HistoryManager{
+func newBoltHistoryManager(dbPath string) (*boltHistoryManager, error) {
+	hm := &boltHistoryManager{
 		historyEndPtr: make(map[*rooms.Room]uint64),
 	}
-	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
-		Timeout:      1,
-		NoGrowSync:   false,
-		FreelistType: bolt.FreelistArrayType,
-	})
+	db, err := openHistoryDB(dbPath)
 	if err != nil {
 		return nil, err
 	}
@@ -81,16 +106,32 @@ func NewHistoryManager(dbPath string) (*HistoryManager, error) {
 	return hm, nil
 }
 
-func (hm *HistoryManager) Close() error {
+func openHistoryDB(dbPath string) (*bolt.DB, error) {
+	return bolt.Open(dbPath, 0600, &bolt.Options{
+		Timeout:      1,
+		NoGrowSync:   false,
+		FreelistType: bolt.FreelistArrayType,
+	})
+}
+
+func (hm *boltHistoryManager) Size() int64 {
+	if info, err := os.Stat(hm.db.Path()); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func (hm *boltHistoryManager) Close() error {
 	return hm.db.Close()
 }
 
 var (
 	EventNotFoundError = errors.New("event not found")
 	RoomNotFoundError  = errors.New("room not found")
+	GapNotFoundError   = errors.New("timeline gap not found")
 )
 
-func (hm *HistoryManager) getStreamIndex(tx *bolt.Tx, roomID []byte, eventID []byte) (*bolt.Bucket, []byte, error) {
+func (hm *boltHistoryManager) getStreamIndex(tx *bolt.Tx, roomID []byte, eventID []byte) (*bolt.Bucket, []byte, error) {
 	eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket(roomID)
 	if eventIDs == nil {
 		return nil, nil, RoomNotFoundError
@@ -103,7 +144,7 @@ func (hm *HistoryManager) getStreamIndex(tx *bolt.Tx, roomID []byte, eventID []b
 	return stream, index, nil
 }
 
-func (hm *HistoryManager) getEvent(tx *bolt.Tx, stream *bolt.Bucket, index []byte) (*muksevt.Event, error) {
+func (hm *boltHistoryManager) getEvent(tx *bolt.Tx, stream *bolt.Bucket, index []byte) (*muksevt.Event, error) {
 	eventData := stream.Get(index)
 	if eventData == nil || len(eventData) == 0 {
 		return nil, EventNotFoundError
@@ -111,7 +152,9 @@ func (hm *HistoryManager) getEvent(tx *bolt.Tx, stream *bolt.Bucket, index []byt
 	return unmarshalEvent(eventData)
 }
 
-func (hm *HistoryManager) Get(room *rooms.Room, eventID id.EventID) (evt *muksevt.Event, err error) {
+func (hm *boltHistoryManager) Get(room *rooms.Room, eventID id.EventID) (evt *muksevt.Event, err error) {
+	hm.Lock()
+	defer hm.Unlock()
 	err = hm.db.View(func(tx *bolt.Tx) error {
 		if stream, index, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(eventID)); err != nil {
 			return err
@@ -123,7 +166,9 @@ func (hm *HistoryManager) Get(room *rooms.Room, eventID id.EventID) (evt *muksev
 	return
 }
 
-func (hm *HistoryManager) Update(room *rooms.Room, eventID id.EventID, update func(evt *muksevt.Event) error) error {
+func (hm *boltHistoryManager) Update(room *rooms.Room, eventID id.EventID, update func(evt *muksevt.Event) error) error {
+	hm.Lock()
+	defer hm.Unlock()
 	return hm.db.Update(func(tx *bolt.Tx) error {
 		if stream, index, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(eventID)); err != nil {
 			return err
@@ -140,16 +185,16 @@ func (hm *HistoryManager) Update(room *rooms.Room, eventID id.EventID, update fu
 	})
 }
 
-func (hm *HistoryManager) Append(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, error) {
+func (hm *boltHistoryManager) Append(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, error) {
 	muksEvts, _, err := hm.store(room, events, true)
 	return muksEvts, err
 }
 
-func (hm *HistoryManager) Prepend(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, uint64, error) {
+func (hm *boltHistoryManager) Prepend(room *rooms.Room, events []*event.Event) ([]*muksevt.Event, uint64, error) {
 	return hm.store(room, events, false)
 }
 
-func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append bool) (newEvents []*muksevt.Event, newPtrStart uint64, err error) {
+func (hm *boltHistoryManager) store(room *rooms.Room, events []*event.Event, append bool) (newEvents []*muksevt.Event, newPtrStart uint64, err error) {
 	hm.Lock()
 	defer hm.Unlock()
 	newEvents = make([]*muksevt.Event, len(events))
@@ -197,16 +242,25 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append
 					ptrStart = halfUint64 - 1
 				}
 			}
-			eventCount := uint64(len(events))
-			for i, evt := range events {
-				newEvents[i] = muksevt.Wrap(evt)
+			// Skip events that are already stored, e.g. when re-fetching history after it was pruned.
+			eventCount := uint64(0)
+			for _, evt := range events {
+				if eventIDs.Get([]byte(evt.ID)) == nil {
+					newEvents[eventCount] = muksevt.Wrap(evt)
+					eventCount++
+				}
+			}
+			newEvents = newEvents[:eventCount]
+			for i := range newEvents {
 				if err := put(stream, eventIDs, newEvents[i], -ptrStart-uint64(i)); err != nil {
 					return err
 				}
 			}
 			hm.historyEndPtr[room] = ptrStart + eventCount
-			// TODO this is not the correct value for newPtrStart, figure out what the f*ck is going on here
-			newPtrStart = ptrStart + eventCount
+			if eventCount > 0 {
+				// The pointer of the oldest prepended event, which is where the next Load should continue from.
+				newPtrStart = -ptrStart - (eventCount - 1)
+			}
 			err := streamPointers.Put(rid, itob(ptrStart+eventCount))
 			if err != nil {
 				return err
@@ -218,7 +272,7 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append
 	return
 }
 
-func (hm *HistoryManager) Load(room *rooms.Room, num int, ptrStart uint64) (events []*muksevt.Event, newPtrStart uint64, err error) {
+func (hm *boltHistoryManager) Load(room *rooms.Room, num int, ptrStart uint64) (events []*muksevt.Event, newPtrStart uint64, err error) {
 	hm.Lock()
 	defer hm.Unlock()
 	err = hm.db.View(func(tx *bolt.Tx) error {
@@ -256,6 +310,142 @@ func (hm *HistoryManager) Load(room *rooms.Room, num int, ptrStart uint64) (even
 	return
 }
 
+// AddGap does nothing, as the bolt history store can't insert events in the middle of a stream.
+// Skipped events can still be seen by clearing the cache.
+func (hm *boltHistoryManager) AddGap(_ *rooms.Room, _ string) (*muksevt.Event, error) {
+	return nil, nil
+}
+
+func (hm *boltHistoryManager) FillGap(_ *rooms.Room, _ uint64, _ []*event.Event, _ string) ([]*muksevt.Event, *muksevt.Event, error) {
+	return nil, nil, GapNotFoundError
+}
+
+// Stats returns the number of stored events and the approximate size of the history of each room.
+func (hm *boltHistoryManager) Stats() (stats []ifc.HistoryRoomStats, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.db.View(func(tx *bolt.Tx) error {
+		eventIDs := tx.Bucket(bucketRoomEventIDs)
+		return tx.Bucket(bucketRoomStreams).ForEach(func(rid, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			streamStats := tx.Bucket(bucketRoomStreams).Bucket(rid).Stats()
+			roomStats := ifc.HistoryRoomStats{
+				RoomID: id.RoomID(rid),
+				Events: streamStats.KeyN,
+				Size:   int64(streamStats.BranchInuse + streamStats.LeafInuse),
+			}
+			if idBucket := eventIDs.Bucket(rid); idBucket != nil {
+				idStats := idBucket.Stats()
+				roomStats.Size += int64(idStats.BranchInuse + idStats.LeafInuse)
+			}
+			stats = append(stats, roomStats)
+			return nil
+		})
+	})
+	return
+}
+
+// Prune removes the oldest events of the room until there are at most maxEvents events left
+// and none of them are older than the given time. Zero values disable the respective limit.
+func (hm *boltHistoryManager) Prune(room *rooms.Room, maxEvents int, olderThan time.Time) (removed int, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.db.Update(func(tx *bolt.Tx) error {
+		rid := []byte(room.ID)
+		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
+		eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket(rid)
+		if stream == nil || eventIDs == nil {
+			return nil
+		}
+		remaining := stream.Stats().KeyN
+		var keys, ids [][]byte
+		c := stream.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			evt, err := unmarshalEvent(v)
+			if err != nil {
+				return err
+			}
+			tooMany := maxEvents > 0 && remaining > maxEvents
+			tooOld := !olderThan.IsZero() && evt.Timestamp < olderThan.UnixNano()/int64(time.Millisecond)
+			if !tooMany && !tooOld {
+				break
+			}
+			keys = append(keys, append([]byte{}, k...))
+			ids = append(ids, []byte(evt.ID))
+			remaining--
+		}
+		for i, key := range keys {
+			if err := stream.Delete(key); err != nil {
+				return err
+			} else if err = eventIDs.Delete(ids[i]); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return
+}
+
+// DropRoom removes all stored history of the given room.
+func (hm *boltHistoryManager) DropRoom(roomID id.RoomID) error {
+	hm.Lock()
+	defer hm.Unlock()
+	for room := range hm.historyEndPtr {
+		if room.ID == roomID {
+			delete(hm.historyEndPtr, room)
+		}
+	}
+	return hm.db.Update(func(tx *bolt.Tx) error {
+		rid := []byte(roomID)
+		for _, bucket := range [][]byte{bucketRoomStreams, bucketRoomEventIDs} {
+			if err := tx.Bucket(bucket).DeleteBucket(rid); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return tx.Bucket(bucketStreamPointers).Delete(rid)
+	})
+}
+
+// Compact copies the database into a fresh file to release the space left over by deleted events.
+// Bucket sequences and stream pointers are copied as-is, so existing history pointers stay valid.
+func (hm *boltHistoryManager) Compact() (sizeBefore, sizeAfter int64, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	dbPath := hm.db.Path()
+	compactPath := dbPath + ".compact"
+	if info, statErr := os.Stat(dbPath); statErr == nil {
+		sizeBefore = info.Size()
+	}
+	_ = os.Remove(compactPath)
+	dst, err := openHistoryDB(compactPath)
+	if err != nil {
+		return
+	}
+	err = bolt.Compact(dst, hm.db, 64*1024*1024)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(compactPath)
+		return
+	}
+	if err = hm.db.Close(); err != nil {
+		return
+	}
+	renameErr := os.Rename(compactPath, dbPath)
+	hm.db, err = openHistoryDB(dbPath)
+	if err == nil {
+		err = renameErr
+	}
+	if info, statErr := os.Stat(dbPath); statErr == nil {
+		sizeAfter = info.Size()
+	}
+	return
+}
+
 func itob(v uint64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, v)
@@ -0,0 +1,305 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package hooks runs user-provided executables from the hooks directory when events are received or when
+// requested with /run. Hooks get the event as JSON on stdin and can print actions as JSON lines on stdout.
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/variationselector"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+type Trigger string
+
+const (
+	TriggerMessage   Trigger = "message"
+	TriggerHighlight Trigger = "highlight"
+	TriggerInvite    Trigger = "invite"
+	TriggerCommand   Trigger = "command"
+)
+
+// Timeout is how long a hook may run before it's killed.
+const Timeout = 30 * time.Second
+
+var ErrInvalidName = errors.New("invalid hook name")
+
+// Input is the JSON object written to the stdin of a hook.
+type Input struct {
+	Trigger  Trigger      `json:"trigger"`
+	Hook     string       `json:"hook"`
+	UserID   id.UserID    `json:"user_id"`
+	RoomID   id.RoomID    `json:"room_id,omitempty"`
+	RoomName string       `json:"room_name,omitempty"`
+	Args     []string     `json:"args,omitempty"`
+	Event    *event.Event `json:"event,omitempty"`
+}
+
+// Action is a single JSON line printed by a hook. The room and event default to the ones the hook was run for.
+type Action struct {
+	Action  string            `json:"action"`
+	RoomID  id.RoomID         `json:"room_id,omitempty"`
+	EventID id.EventID        `json:"event_id,omitempty"`
+	MsgType event.MessageType `json:"msgtype,omitempty"`
+	Text    string            `json:"text,omitempty"`
+	HTML    string            `json:"html,omitempty"`
+	Key     string            `json:"key,omitempty"`
+}
+
+type Runner struct {
+	config *config.Config
+	matrix ifc.MatrixContainer
+}
+
+func New(cfg *config.Config, matrix ifc.MatrixContainer) *Runner {
+	return &Runner{config: cfg, matrix: matrix}
+}
+
+// List returns the names of the executables in the hooks directory.
+func (runner *Runner) List() []string {
+	entries, err := ioutil.ReadDir(runner.config.HooksDir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if isExecutable(entry) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isExecutable(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && (runtime.GOOS == "windows" || info.Mode().Perm()&0111 != 0)
+}
+
+func (runner *Runner) path(name string) (string, error) {
+	if len(name) == 0 || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", ErrInvalidName
+	}
+	path := filepath.Join(runner.config.HooksDir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	} else if !isExecutable(info) {
+		return "", fmt.Errorf("%s is not executable", path)
+	}
+	return path, nil
+}
+
+func matches(hook *config.Hook, trigger Trigger, roomID id.RoomID, body string) bool {
+	found := false
+	for _, on := range hook.On {
+		if Trigger(on) == trigger {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if len(hook.Rooms) > 0 {
+		found = false
+		for _, hookRoomID := range hook.Rooms {
+			if hookRoomID == roomID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(hook.Keywords) > 0 && (trigger == TriggerMessage || trigger == TriggerHighlight) {
+		body = strings.ToLower(body)
+		for _, keyword := range hook.Keywords {
+			if strings.Contains(body, strings.ToLower(keyword)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// HandleMessage runs the hooks configured for the message and highlight triggers.
+// Hooks that listen to both only get the highlight trigger for highlighted messages.
+func (runner *Runner) HandleMessage(room *rooms.Room, evt *muksevt.Event, highlight bool) {
+	var body string
+	if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok {
+		body = content.Body
+	}
+	for name, hook := range runner.config.Hooks {
+		if hook == nil {
+			continue
+		}
+		if highlight && matches(hook, TriggerHighlight, room.ID, body) {
+			go runner.runTriggered(name, TriggerHighlight, room, evt.Event)
+		} else if matches(hook, TriggerMessage, room.ID, body) {
+			go runner.runTriggered(name, TriggerMessage, room, evt.Event)
+		}
+	}
+}
+
+// HandleInvite runs the hooks configured for the invite trigger.
+func (runner *Runner) HandleInvite(room *rooms.Room, evt *event.Event) {
+	for name, hook := range runner.config.Hooks {
+		if hook != nil && matches(hook, TriggerInvite, room.ID, "") {
+			go runner.runTriggered(name, TriggerInvite, room, evt)
+		}
+	}
+}
+
+func (runner *Runner) runTriggered(name string, trigger Trigger, room *rooms.Room, evt *event.Event) {
+	defer debug.Recover()
+	output, err := runner.Run(name, Input{
+		Trigger:  trigger,
+		RoomID:   room.ID,
+		RoomName: room.GetTitle(),
+		Event:    evt,
+	})
+	if err != nil {
+		debug.Printf("Failed to run %s hook %s: %v", trigger, name, err)
+	}
+	for _, line := range output {
+		debug.Printf("Output from hook %s: %s", name, line)
+	}
+}
+
+// Run runs the named hook with the given input and executes the actions it prints.
+// Lines of output that aren't actions are returned.
+func (runner *Runner) Run(name string, input Input) ([]string, error) {
+	path, err := runner.path(name)
+	if err != nil {
+		return nil, err
+	}
+	input.Hook = name
+	input.UserID = runner.config.UserID
+	data, err := json.Marshal(&input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal input: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, input.Args...)
+	cmd.Dir = runner.config.HooksDir
+	cmd.Env = append(os.Environ(),
+		"GOMUKS_HOOK_TRIGGER="+string(input.Trigger),
+		"GOMUKS_USER_ID="+string(input.UserID),
+		"GOMUKS_ROOM_ID="+string(input.RoomID))
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if stderr.Len() > 0 {
+		debug.Printf("Stderr from hook %s: %s", name, strings.TrimSpace(stderr.String()))
+	}
+
+	var output []string
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		} else if line[0] != '{' {
+			output = append(output, line)
+			continue
+		}
+		var action Action
+		if jsonErr := json.Unmarshal([]byte(line), &action); jsonErr != nil {
+			output = append(output, fmt.Sprintf("Invalid action %s: %v", line, jsonErr))
+		} else if actionErr := runner.execute(&action, &input); actionErr != nil {
+			output = append(output, fmt.Sprintf("Failed to %s: %v", action.Action, actionErr))
+		}
+	}
+	if err != nil {
+		return output, fmt.Errorf("hook exited with error: %w", err)
+	}
+	return output, nil
+}
+
+func (runner *Runner) execute(action *Action, input *Input) error {
+	if len(action.RoomID) == 0 {
+		action.RoomID = input.RoomID
+	}
+	if len(action.EventID) == 0 && input.Event != nil {
+		action.EventID = input.Event.ID
+	}
+	if len(action.RoomID) == 0 {
+		return errors.New("no room ID")
+	}
+	switch action.Action {
+	case "send":
+		if len(action.Text) == 0 {
+			return errors.New("no text")
+		}
+		if len(action.MsgType) == 0 {
+			action.MsgType = event.MsgText
+		}
+		evt := runner.matrix.PrepareMarkdownMessage(action.RoomID, action.MsgType, action.Text, action.HTML, nil)
+		_, err := runner.matrix.SendEvent(evt)
+		return err
+	case "react":
+		if len(action.EventID) == 0 || len(action.Key) == 0 {
+			return errors.New("no event ID or reaction key")
+		}
+		_, err := runner.matrix.SendEvent(&muksevt.Event{
+			Event: &event.Event{
+				Type:   event.EventReaction,
+				RoomID: action.RoomID,
+				Content: event.Content{Parsed: &event.ReactionEventContent{RelatesTo: event.RelatesTo{
+					Type:    event.RelAnnotation,
+					EventID: action.EventID,
+					Key:     variationselector.Add(action.Key),
+				}}},
+			},
+		})
+		return err
+	case "read":
+		if len(action.EventID) == 0 {
+			return errors.New("no event ID")
+		}
+		runner.matrix.MarkRead(action.RoomID, action.EventID)
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q", action.Action)
+	}
+}
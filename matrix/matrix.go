@@ -32,8 +32,12 @@ import (
 	"reflect"
 	"runtime"
 	dbg "runtime/debug"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	sync "github.com/sasha-s/go-deadlock"
+
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
@@ -45,6 +49,8 @@ import (
 	"maunium.net/go/gomuks/debug"
 	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/lib/open"
+	"maunium.net/go/gomuks/matrix/chatlog"
+	"maunium.net/go/gomuks/matrix/hooks"
 	"maunium.net/go/gomuks/matrix/muksevt"
 	"maunium.net/go/gomuks/matrix/rooms"
 )
@@ -59,11 +65,43 @@ type Container struct {
 	gmx     ifc.Gomuks
 	ui      ifc.GomuksUI
 	config  *config.Config
-	history *HistoryManager
+	history HistoryManager
+	chatLog *chatlog.Logger
+	hooks   *hooks.Runner
 	running bool
 	stop    chan bool
 
+	retentionLoopRunning int32
+	schedulerLoopRunning int32
+	scheduleLock         sync.Mutex
+	sendingScheduled     map[string]struct{}
+	draftLock            sync.Mutex
+
 	typing int64
+
+	trustCache     map[id.UserID]ifc.UserTrust
+	trustCacheLock sync.RWMutex
+
+	shareGroupSessionLock sync.Mutex
+
+	secretLock            sync.Mutex
+	secretRequests        map[string]*secretRequest
+	receivedSecrets       map[string][]byte
+	megolmBackupKey       []byte
+	pendingSecretRequests map[id.DeviceID]*pendingSecretRequests
+	secretPromptLock      sync.Mutex
+}
+
+type secretRequest struct {
+	name  string
+	reply func(message string, args ...interface{})
+}
+
+// pendingSecretRequests contains the unanswered secret requests from one of our other devices.
+type pendingSecretRequests struct {
+	requests map[string]*muksevt.SecretRequestEventContent
+	// changed is closed when requests are added or cancelled while the user is being asked about them.
+	changed chan struct{}
 }
 
 // NewContainer creates a new Container for the given Gomuks instance.
@@ -72,7 +110,18 @@ func NewContainer(gmx ifc.Gomuks) *Container {
 		config: gmx.Config(),
 		ui:     gmx.UI(),
 		gmx:    gmx,
+
+		chatLog: chatlog.New(gmx.Config()),
+
+		trustCache: make(map[id.UserID]ifc.UserTrust),
+
+		sendingScheduled: make(map[string]struct{}),
+
+		secretRequests:        make(map[string]*secretRequest),
+		receivedSecrets:       make(map[string][]byte),
+		pendingSecretRequests: make(map[id.DeviceID]*pendingSecretRequests),
 	}
+	c.hooks = hooks.New(c.config, c)
 
 	return c
 }
@@ -100,6 +149,13 @@ var (
 var MinSpecVersion = mautrix.SpecV11
 var SkipVersionCheck = false
 
+// StartupURI is a matrix: URI or matrix.to link that is opened after the first sync.
+var StartupURI *id.MatrixURI
+
+// ManualSync is set by one-shot CLI commands. It stops InitClient from starting the sync loop,
+// and stops Start from running the scheduled message and history retention loops or hooks.
+var ManualSync = false
+
 // InitClient initializes the mautrix client and connects to the homeserver specified in the config.
 func (c *Container) InitClient(isStartup bool) error {
 	if len(c.config.HS) == 0 {
@@ -137,7 +193,7 @@ func (c *Container) InitClient(isStartup bool) error {
 	}
 
 	if c.history == nil {
-		c.history, err = NewHistoryManager(c.config.HistoryPath)
+		c.history, err = NewHistoryManager(c.config)
 		if err != nil {
 			return fmt.Errorf("failed to initialize history: %w", err)
 		}
@@ -174,7 +230,7 @@ func (c *Container) InitClient(isStartup bool) error {
 
 	c.stop = make(chan bool, 1)
 
-	if len(accessToken) > 0 {
+	if len(accessToken) > 0 && !ManualSync {
 		go c.Start()
 	}
 	return nil
@@ -391,7 +447,7 @@ func (c *Container) OnLogin() {
 	debug.Print("Initializing syncer")
 	c.syncer = NewGomuksSyncer(c.config.Rooms)
 	if c.crypto != nil {
-		c.syncer.OnSync(c.crypto.ProcessSyncResponse)
+		c.syncer.OnSync(c.processCryptoSync)
 		c.syncer.OnEventType(event.StateMember, func(source mautrix.EventSource, evt *event.Event) {
 			// Don't spam the crypto module with member events of an initial sync
 			// TODO invalidate all group sessions when clearing cache?
@@ -403,6 +459,7 @@ func (c *Container) OnLogin() {
 	} else {
 		c.syncer.OnEventType(event.EventEncrypted, c.HandleEncryptedUnsupported)
 	}
+	c.syncer.LimitedCallback = c.HandleLimitedTimeline
 	c.syncer.OnEventType(event.EventMessage, c.HandleMessage)
 	c.syncer.OnEventType(event.EventSticker, c.HandleMessage)
 	c.syncer.OnEventType(event.EventReaction, c.HandleMessage)
@@ -418,6 +475,7 @@ func (c *Container) OnLogin() {
 	c.syncer.OnEventType(event.AccountDataPushRules, c.HandlePushRules)
 	c.syncer.OnEventType(event.AccountDataRoomTags, c.HandleTag)
 	c.syncer.OnEventType(AccountDataGomuksPreferences, c.HandlePreferences)
+	c.syncer.OnEventType(AccountDataGomuksDraft, c.HandleDraft)
 	if len(c.config.AuthCache.NextBatch) == 0 {
 		c.syncer.Progress = c.ui.MainView().OpenSyncingModal()
 		c.syncer.Progress.SetMessage("Waiting for /sync response from server")
@@ -426,7 +484,10 @@ func (c *Container) OnLogin() {
 			c.syncer.Progress.Close()
 			c.syncer.Progress = StubSyncingModal{}
 			c.syncer.FirstDoneCallback = nil
+			c.openStartupURI()
 		}
+	} else {
+		c.syncer.FirstDoneCallback = c.openStartupURI
 	}
 	c.syncer.InitDoneCallback = func() {
 		debug.Print("Initial sync done")
@@ -456,6 +517,16 @@ func (c *Container) OnLogin() {
 	debug.Print("OnLogin() done.")
 }
 
+func (c *Container) openStartupURI() {
+	if StartupURI == nil {
+		return
+	}
+	uri := StartupURI
+	StartupURI = nil
+	debug.Print("Opening", uri, "from command line")
+	go c.ui.MainView().OpenMatrixURI(uri)
+}
+
 // Start moves the UI to the main view, calls OnLogin() and runs the syncer forever until stopped with Stop()
 func (c *Container) Start() {
 	defer debug.Recover()
@@ -469,6 +540,15 @@ func (c *Container) Start() {
 	debug.Print("Starting sync...")
 	c.running = true
 	c.client.StreamSyncMinAge = 30 * time.Minute
+	// One-shot commands only need the syncer.
+	if !ManualSync {
+		if atomic.CompareAndSwapInt32(&c.retentionLoopRunning, 0, 1) {
+			go c.historyRetentionLoop()
+		}
+		if atomic.CompareAndSwapInt32(&c.schedulerLoopRunning, 0, 1) {
+			go c.scheduledMessageLoop()
+		}
+	}
 	for {
 		select {
 		case <-c.stop:
@@ -531,7 +611,11 @@ func (c *Container) HandleRedaction(source mautrix.EventSource, evt *event.Event
 	if err != nil {
 		debug.Print("Failed to mark", evt.Redacts, "as redacted:", err)
 		return
-	} else if !c.config.AuthCache.InitialSyncDone || !room.Loaded() {
+	} else if !c.config.AuthCache.InitialSyncDone {
+		return
+	}
+	c.chatLog.LogRedaction(room, redactedEvt, evt)
+	if !c.viewWantsEvents(room) {
 		return
 	}
 
@@ -547,6 +631,11 @@ func (c *Container) HandleRedaction(source mautrix.EventSource, evt *event.Event
 	}
 }
 
+// viewWantsEvents returns whether or not changes to the events of the given room should be passed to its room view.
+func (c *Container) viewWantsEvents(room *rooms.Room) bool {
+	return room.Loaded() || c.ui.MainView().WantsAllEvents()
+}
+
 var ErrCantEditOthersMessage = errors.New("can't edit message sent by someone else")
 
 func (c *Container) HandleEdit(room *rooms.Room, editsID id.EventID, editEvent *muksevt.Event) {
@@ -565,7 +654,11 @@ func (c *Container) HandleEdit(room *rooms.Room, editsID id.EventID, editEvent *
 	} else if err != nil {
 		debug.Print("Failed to store edit in history db:", err)
 		return
-	} else if !c.config.AuthCache.InitialSyncDone || !room.Loaded() {
+	} else if !c.config.AuthCache.InitialSyncDone {
+		return
+	}
+	c.chatLog.LogEdit(room, origEvt, editEvent)
+	if !c.viewWantsEvents(room) {
 		return
 	}
 
@@ -596,7 +689,7 @@ func (c *Container) HandleReaction(room *rooms.Room, reactsTo id.EventID, reactE
 	if err != nil {
 		debug.Print("Failed to store reaction in history db:", err)
 		return
-	} else if !c.config.AuthCache.InitialSyncDone || !room.Loaded() {
+	} else if !c.config.AuthCache.InitialSyncDone || !c.viewWantsEvents(room) {
 		return
 	}
 
@@ -632,18 +725,25 @@ func (c *Container) HandleEncrypted(source mautrix.EventSource, mxEvent *event.E
 		c.HandleMessage(source, mxEvent)
 		return
 	}
-	if evt.Type.IsInRoomVerification() {
-		err := c.crypto.ProcessInRoomVerification(evt)
-		if err != nil {
-			debug.Printf("[Crypto/Error] Failed to process in-room verification event %s of type %s: %v", evt.ID, evt.Type.String(), err)
-		} else {
-			debug.Printf("[Crypto/Debug] Processed in-room verification event %s of type %s", evt.ID, evt.Type.String())
-		}
+	if evt.Type.IsInRoomVerification() || evt.Type == muksevt.InRoomVerificationDone {
+		c.handleInRoomVerification(source, evt)
 	} else {
+		if evt.Type == event.EventMessage && evt.Content.AsMessage().MsgType == event.MsgVerificationRequest {
+			c.handleInRoomVerification(source, evt)
+		}
 		c.HandleMessage(source, evt)
 	}
 }
 
+func (c *Container) handleInRoomVerification(source mautrix.EventSource, evt *event.Event) {
+	// Verification events from the initial sync or from backfilled state are never relevant
+	if !c.config.AuthCache.InitialSyncDone || source&mautrix.EventSourceTimeline == 0 {
+		return
+	}
+	debug.Printf("[Crypto/Debug] Received in-room verification event %s of type %s", evt.ID, evt.Type.String())
+	c.ui.MainView().HandleInRoomVerification(evt)
+}
+
 // HandleMessage is the event handler for the m.room.message timeline event.
 func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Event) {
 	room := c.GetOrCreateRoom(mxEvent.RoomID)
@@ -669,6 +769,10 @@ func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Eve
 	events, err := c.history.Append(room, []*event.Event{mxEvent})
 	if err != nil {
 		debug.Printf("Failed to add event %s to history: %v", mxEvent.ID, err)
+		return
+	} else if len(events) == 0 || events[0] == nil {
+		debug.Printf("Failed to add event %s to history: no event returned", mxEvent.ID)
+		return
 	}
 	evt := events[0]
 
@@ -676,6 +780,10 @@ func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Eve
 		room.LastReceivedMessage = time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*1000)
 		return
 	}
+	c.chatLog.LogMessage(room, evt)
+	if c.syncer.FirstSyncDone && !ManualSync && evt.Sender != c.config.UserID && (evt.Type == event.EventMessage || evt.Type == event.EventSticker) {
+		c.hooks.HandleMessage(room, evt, c.PushRules().GetActions(room, evt.Event).Should().Highlight)
+	}
 
 	mainView := c.ui.MainView()
 
@@ -691,7 +799,9 @@ func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Eve
 			room.LastReceivedMessage = time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*1000)
 			room.AddUnread(evt.ID, pushRules.Notify, pushRules.Highlight)
 			mainView.Bump(room)
-			return
+			if !mainView.WantsAllEvents() {
+				return
+			}
 		}
 	}
 
@@ -708,6 +818,21 @@ func (c *Container) HandleMessage(source mautrix.EventSource, mxEvent *event.Eve
 	}
 }
 
+// HandleLimitedTimeline records a gap in the history of the room when a sync response skipped over some events.
+func (c *Container) HandleLimitedTimeline(room *rooms.Room, prevBatch string) {
+	gap, err := c.history.AddGap(room, prevBatch)
+	if err != nil {
+		debug.Printf("Failed to add timeline gap in %s: %v", room.ID, err)
+		return
+	} else if gap == nil || !c.config.AuthCache.InitialSyncDone || !room.Loaded() {
+		return
+	}
+	debug.Printf("Sync skipped events in %s, added timeline gap", room.ID)
+	if roomView := c.ui.MainView().GetRoom(room.ID); roomView != nil {
+		roomView.AddEvent(gap)
+	}
+}
+
 // HandleMembership is the event handler for the m.room.member state event.
 func (c *Container) HandleMembership(source mautrix.EventSource, evt *event.Event) {
 	isLeave := source&mautrix.EventSourceLeave != 0
@@ -749,6 +874,9 @@ func (c *Container) processOwnMembershipChange(evt *event.Event) {
 	case "invite":
 		if c.config.AuthCache.InitialSyncDone {
 			c.ui.MainView().AddRoom(room)
+			if membership == event.MembershipInvite && !ManualSync {
+				c.hooks.HandleInvite(room, evt)
+			}
 		}
 	case "leave":
 	case "ban":
@@ -906,6 +1034,76 @@ func (c *Container) PrepareMediaMessage(room *rooms.Room, path string, rel *ifc.
 	return c.prepareEvent(room.ID, &content, rel), nil
 }
 
+// PrepareForwardedMessage copies the content of the given message into a new event in the given room.
+//
+// Media is reused as-is unless the original is encrypted and the target room isn't,
+// in which case the file is decrypted and uploaded again to avoid leaking the keys of the original.
+func (c *Container) PrepareForwardedMessage(room *rooms.Room, evt *muksevt.Event) (*muksevt.Event, error) {
+	original, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || (evt.Type != event.EventMessage && evt.Type != event.EventSticker) {
+		return nil, fmt.Errorf("only messages can be forwarded")
+	}
+	if len(evt.Gomuks.Edits) > 0 {
+		if newContent := evt.Gomuks.Edits[len(evt.Gomuks.Edits)-1].Content.AsMessage().NewContent; newContent != nil {
+			original = newContent
+		}
+	}
+	content := *original
+	content.RemoveReplyFallback()
+	content.RelatesTo = nil
+	content.NewContent = nil
+	if content.Info != nil {
+		info := *content.Info
+		content.Info = &info
+	}
+
+	if content.File != nil && !room.Encrypted {
+		var err error
+		content.URL, err = c.reuploadDecrypted(content.File, content.Info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reupload media: %w", err)
+		}
+		content.File = nil
+	}
+	if content.Info != nil && content.Info.ThumbnailFile != nil && !room.Encrypted {
+		thumbnailURL, err := c.reuploadDecrypted(content.Info.ThumbnailFile, content.Info.ThumbnailInfo)
+		if err != nil {
+			debug.Printf("Failed to reupload thumbnail of %s: %v", evt.ID, err)
+			content.Info.ThumbnailInfo = nil
+		} else {
+			content.Info.ThumbnailURL = thumbnailURL
+		}
+		content.Info.ThumbnailFile = nil
+	}
+
+	localEcho := c.prepareEvent(room.ID, &content, nil)
+	localEcho.Type = evt.Type
+	return localEcho, nil
+}
+
+func (c *Container) reuploadDecrypted(file *event.EncryptedFileInfo, info *event.FileInfo) (id.ContentURIString, error) {
+	uri, err := file.URL.Parse()
+	if err != nil {
+		return "", err
+	}
+	data, err := c.Download(uri, &file.EncryptedFile)
+	if err != nil {
+		return "", err
+	}
+	mimeType := "application/octet-stream"
+	if info != nil && len(info.MimeType) > 0 {
+		mimeType = info.MimeType
+	}
+	resp, err := c.client.UploadMedia(mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  mimeType,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.ContentURI.CUString(), nil
+}
+
 func (c *Container) PrepareMarkdownMessage(roomID id.RoomID, msgtype event.MessageType, text, html string, rel *ifc.Relation) *muksevt.Event {
 	var content event.MessageEventContent
 	if html != "" {
@@ -977,7 +1175,7 @@ func (c *Container) SendEvent(evt *muksevt.Event) (id.EventID, error) {
 				return "", err
 			}
 			debug.Print("Got", err, "while trying to encrypt message, sharing group session and trying again...")
-			err = c.crypto.ShareGroupSession(room.ID, room.GetMemberList())
+			err = c.ShareGroupSession(room)
 			if err != nil {
 				return "", err
 			}
@@ -1142,7 +1340,28 @@ func (c *Container) GetHistory(room *rooms.Room, limit int, dbPointer uint64) ([
 		return nil, dbPointer, err
 	}
 	debug.Printf("Loaded %d events for %s from server from %s to %s", len(resp.Chunk), room.ID, resp.Start, resp.End)
-	for i, evt := range resp.Chunk {
+	c.parseHistoryEvents(resp.Chunk)
+	for _, evt := range resp.State {
+		room.UpdateState(evt)
+	}
+	room.PrevBatch = resp.End
+	c.config.Rooms.Put(room)
+	if len(resp.Chunk) == 0 {
+		return []*muksevt.Event{}, dbPointer, nil
+	}
+	events, newDBPointer, err = c.history.Prepend(room, resp.Chunk)
+	if err != nil {
+		return nil, dbPointer, err
+	} else if len(events) == 0 {
+		// Everything in the chunk was already stored locally, keep paginating.
+		return c.GetHistory(room, limit, dbPointer)
+	}
+	return events, newDBPointer, nil
+}
+
+// parseHistoryEvents parses and decrypts events fetched from the server outside of /sync.
+func (c *Container) parseHistoryEvents(chunk []*event.Event) {
+	for i, evt := range chunk {
 		err := evt.Content.ParseRaw(evt.Type)
 		if err != nil {
 			debug.Printf("Failed to unmarshal content of event %s (type %s) by %s in %s: %v\n%s", evt.ID, evt.Type.Repr(), evt.Sender, evt.RoomID, err, string(evt.Content.VeryRaw))
@@ -1164,25 +1383,102 @@ func (c *Container) GetHistory(room *rooms.Room, limit int, dbPointer uint64) ([
 						Reason:   err.Error(),
 					}
 				} else {
-					resp.Chunk[i] = decrypted
+					chunk[i] = decrypted
 				}
 			}
 		}
 	}
+}
+
+// FillTimelineGap fetches events that were skipped by a sync and inserts them in the history.
+// It returns the inserted events newest first, and a new gap if the missing events didn't fit in one batch.
+func (c *Container) FillTimelineGap(room *rooms.Room, gap *muksevt.Event, limit int) ([]*muksevt.Event, *muksevt.Event, error) {
+	content, ok := gap.Content.Parsed.(*muksevt.TimelineGapContent)
+	if !ok {
+		return nil, nil, GapNotFoundError
+	}
+	resp, err := c.client.Messages(room.ID, content.PrevBatch, "", 'b', nil, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	debug.Printf("Loaded %d events for gap %d in %s from server from %s to %s", len(resp.Chunk), content.Pointer, room.ID, resp.Start, resp.End)
+	c.parseHistoryEvents(resp.Chunk)
 	for _, evt := range resp.State {
 		room.UpdateState(evt)
 	}
-	room.PrevBatch = resp.End
-	c.config.Rooms.Put(room)
-	if len(resp.Chunk) == 0 {
-		return []*muksevt.Event{}, dbPointer, nil
+	return c.history.FillGap(room, content.Pointer, resp.Chunk, resp.End)
+}
+
+// GetEventContext fetches the events around the given event from the server without storing them, for showing parts
+// of the timeline that can't be reached by paginating the local history. The events are returned in chronological
+// order along with the tokens for paginating backwards and forwards from the ends of the window.
+func (c *Container) GetEventContext(room *rooms.Room, eventID id.EventID, limit int) (events []*muksevt.Event, start, end string, err error) {
+	resp, err := c.client.Context(room.ID, eventID, nil, limit)
+	if err != nil {
+		return
 	}
-	// TODO newDBPointer isn't accurate in this case yet, fix later
-	events, newDBPointer, err = c.history.Prepend(room, resp.Chunk)
+	debug.Printf("Loaded context of %s in %s with %d events before and %d after", eventID, room.ID, len(resp.EventsBefore), len(resp.EventsAfter))
+	for _, evt := range resp.State {
+		room.UpdateState(evt)
+	}
+	chunk := make([]*event.Event, 0, len(resp.EventsBefore)+1+len(resp.EventsAfter))
+	for i := len(resp.EventsBefore) - 1; i >= 0; i-- {
+		chunk = append(chunk, resp.EventsBefore[i])
+	}
+	chunk = append(chunk, resp.Event)
+	chunk = append(chunk, resp.EventsAfter...)
+	return c.wrapRemoteEvents(room, chunk), resp.Start, resp.End, nil
+}
+
+// PaginateEventContext continues loading events from a token returned by GetEventContext. The events are ordered
+// in the direction of pagination, i.e. newest first when paginating backwards. An empty list means the end of the
+// timeline in that direction was reached.
+func (c *Container) PaginateEventContext(room *rooms.Room, token string, backwards bool, limit int) ([]*muksevt.Event, string, error) {
+	dir := 'f'
+	if backwards {
+		dir = 'b'
+	}
+	resp, err := c.client.Messages(room.ID, token, "", dir, nil, limit)
 	if err != nil {
-		return nil, dbPointer, err
+		return nil, token, err
 	}
-	return events, dbPointer, nil
+	debug.Printf("Loaded %d context events for %s from server from %s to %s", len(resp.Chunk), room.ID, resp.Start, resp.End)
+	for _, evt := range resp.State {
+		room.UpdateState(evt)
+	}
+	if len(resp.Chunk) == 0 {
+		return []*muksevt.Event{}, resp.End, nil
+	}
+	events := c.wrapRemoteEvents(room, resp.Chunk)
+	if len(events) == 0 {
+		// The chunk only had edits and reactions, keep going.
+		return c.PaginateEventContext(room, resp.End, backwards, limit)
+	}
+	return events, resp.End, nil
+}
+
+// wrapRemoteEvents parses and decrypts events fetched from the server. Edits and reactions are dropped, and events
+// that are stored locally are replaced with the stored copy, which has the edits and reactions applied.
+func (c *Container) wrapRemoteEvents(room *rooms.Room, chunk []*event.Event) []*muksevt.Event {
+	for _, evt := range chunk {
+		evt.RoomID = room.ID
+	}
+	c.parseHistoryEvents(chunk)
+	events := make([]*muksevt.Event, 0, len(chunk))
+	for _, evt := range chunk {
+		if relatable, ok := evt.Content.Parsed.(event.Relatable); ok {
+			rel := relatable.OptionalGetRelatesTo()
+			if rel != nil && (rel.Type == event.RelReplace || rel.Type == event.RelAnnotation) {
+				continue
+			}
+		}
+		if stored, _ := c.history.Get(room, evt.ID); stored != nil {
+			events = append(events, stored)
+		} else {
+			events = append(events, muksevt.Wrap(evt))
+		}
+	}
+	return events
 }
 
 func (c *Container) GetEvent(room *rooms.Room, eventID id.EventID) (*muksevt.Event, error) {
@@ -1340,3 +1636,74 @@ func (c *Container) GetCachePath(uri id.ContentURI) string {
 
 	return filepath.Join(dir, uri.FileID)
 }
+
+// GetThumbnailCachePath gets the path to the cached thumbnail of the given size of the given homeserver:fileID combination.
+// The file may or may not exist, use DownloadThumbnail() to ensure it has been cached.
+func (c *Container) GetThumbnailCachePath(uri id.ContentURI, width, height int) string {
+	cachePath := c.GetCachePath(uri)
+	if len(cachePath) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s.%dx%d", cachePath, width, height)
+}
+
+// DownloadThumbnail fetches a cropped thumbnail of the given Matrix content (mxc) URL into the media cache
+// and returns the path to the cached file.
+func (c *Container) DownloadThumbnail(uri id.ContentURI, width, height int) (string, error) {
+	cacheFile := c.GetThumbnailCachePath(uri, width, height)
+	if len(cacheFile) == 0 {
+		return "", fmt.Errorf("failed to create media cache directory")
+	} else if info, err := os.Stat(cacheFile); err == nil && !info.IsDir() {
+		return cacheFile, nil
+	}
+	thumbnailURL := c.client.BuildURLWithQuery(mautrix.MediaURLPath{"v3", "thumbnail", uri.Homeserver, uri.FileID}, map[string]string{
+		"width":  strconv.Itoa(width),
+		"height": strconv.Itoa(height),
+		"method": "crop",
+	})
+	resp, err := c.client.Client.Get(thumbnailURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned HTTP %d", resp.StatusCode)
+	}
+	// Write to a temporary file first, so that a partially written thumbnail is never read from the cache,
+	// e.g. by the notification server while another notification is downloading the same avatar.
+	tempFile, err := ioutil.TempFile(filepath.Dir(cacheFile), filepath.Base(cacheFile)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tempFile, resp.Body)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), cacheFile)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return "", err
+	}
+	return cacheFile, nil
+}
+
+// Hooks returns the names of the executables in the hooks directory.
+func (c *Container) Hooks() []string {
+	return c.hooks.List()
+}
+
+// RunHook runs the named hook for the given room with the command trigger.
+// Output lines that aren't actions are returned so they can be shown to the user.
+func (c *Container) RunHook(roomID id.RoomID, name string, args []string) ([]string, error) {
+	input := hooks.Input{
+		Trigger: hooks.TriggerCommand,
+		RoomID:  roomID,
+		Args:    args,
+	}
+	if room := c.GetRoom(roomID); room != nil {
+		input.RoomName = room.GetTitle()
+	}
+	return c.hooks.Run(name, input)
+}
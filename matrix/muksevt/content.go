@@ -21,11 +21,38 @@ import (
 	"reflect"
 
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 var EventBadEncrypted = event.Type{Type: "net.maunium.gomuks.bad_encrypted", Class: event.MessageEventType}
 var EventEncryptionUnsupported = event.Type{Type: "net.maunium.gomuks.encryption_unsupported", Class: event.MessageEventType}
 
+// EventTimelineGap is the type of placeholder events that mark missing events in the locally stored timeline.
+// They're never sent to or received from the server.
+var EventTimelineGap = event.Type{Type: "net.maunium.gomuks.timeline_gap", Class: event.MessageEventType}
+
+// InRoomVerificationDone is the m.key.verification.done event type, which isn't defined in mautrix yet.
+var InRoomVerificationDone = event.Type{Type: "m.key.verification.done", Class: event.MessageEventType}
+
+// Secret sharing event types (m.secret.request and m.secret.send), which aren't defined in mautrix yet.
+var (
+	ToDeviceSecretRequest = event.Type{Type: "m.secret.request", Class: event.ToDeviceEventType}
+	ToDeviceSecretSend    = event.Type{Type: "m.secret.send", Class: event.ToDeviceEventType}
+)
+
+// Names of secrets that can be requested with m.secret.request.
+const (
+	SecretCrossSigningMaster      = "m.cross_signing.master"
+	SecretCrossSigningSelfSigning = "m.cross_signing.self_signing"
+	SecretCrossSigningUserSigning = "m.cross_signing.user_signing"
+	SecretMegolmBackup            = "m.megolm_backup.v1"
+)
+
+const (
+	SecretRequestActionRequest = "request"
+	SecretRequestActionCancel  = "request_cancellation"
+)
+
 type BadEncryptedContent struct {
 	Original *event.EncryptedEventContent `json:"-"`
 
@@ -36,9 +63,51 @@ type EncryptionUnsupportedContent struct {
 	Original *event.EncryptedEventContent `json:"-"`
 }
 
+// TimelineGapContent is the content of EventTimelineGap events.
+type TimelineGapContent struct {
+	// Pointer is the history pointer of the gap, which is needed to fill it.
+	Pointer uint64 `json:"-"`
+	// PrevBatch is the pagination token for fetching the missing events with /messages.
+	PrevBatch string `json:"-"`
+}
+
+type VerificationDoneEventContent struct {
+	RelatesTo *event.RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func (content *VerificationDoneEventContent) GetRelatesTo() *event.RelatesTo {
+	if content.RelatesTo == nil {
+		content.RelatesTo = &event.RelatesTo{}
+	}
+	return content.RelatesTo
+}
+
+func (content *VerificationDoneEventContent) OptionalGetRelatesTo() *event.RelatesTo {
+	return content.RelatesTo
+}
+
+func (content *VerificationDoneEventContent) SetRelatesTo(rel *event.RelatesTo) {
+	content.RelatesTo = rel
+}
+
+type SecretRequestEventContent struct {
+	Name               string      `json:"name,omitempty"`
+	Action             string      `json:"action"`
+	RequestingDeviceID id.DeviceID `json:"requesting_device_id"`
+	RequestID          string      `json:"request_id"`
+}
+
+type SecretSendEventContent struct {
+	RequestID string `json:"request_id"`
+	Secret    string `json:"secret"`
+}
+
 func init() {
 	gob.Register(&BadEncryptedContent{})
 	gob.Register(&EncryptionUnsupportedContent{})
 	event.TypeMap[EventBadEncrypted] = reflect.TypeOf(&BadEncryptedContent{})
 	event.TypeMap[EventEncryptionUnsupported] = reflect.TypeOf(&EncryptionUnsupportedContent{})
+	event.TypeMap[InRoomVerificationDone] = reflect.TypeOf(VerificationDoneEventContent{})
+	event.TypeMap[ToDeviceSecretRequest] = reflect.TypeOf(SecretRequestEventContent{})
+	event.TypeMap[ToDeviceSecretSend] = reflect.TypeOf(SecretSendEventContent{})
 }
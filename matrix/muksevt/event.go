@@ -17,7 +17,10 @@
 package muksevt
 
 import (
+	"fmt"
+
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type Event struct {
@@ -39,6 +42,20 @@ func Wrap(event *event.Event) *Event {
 	return &Event{Event: event}
 }
 
+// NewTimelineGap creates a placeholder event for a gap in the locally stored timeline of a room.
+func NewTimelineGap(roomID id.RoomID, ptr uint64, prevBatch string, timestamp int64) *Event {
+	return &Event{Event: &event.Event{
+		ID:        id.EventID(fmt.Sprintf("net.maunium.gomuks.timeline_gap.%d", ptr)),
+		RoomID:    roomID,
+		Type:      EventTimelineGap,
+		Timestamp: timestamp,
+		Content: event.Content{Parsed: &TimelineGapContent{
+			Pointer:   ptr,
+			PrevBatch: prevBatch,
+		}},
+	}}
+}
+
 type OutgoingState int
 
 const (
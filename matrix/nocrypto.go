@@ -4,6 +4,14 @@
 
 package matrix
 
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
 func isBadEncryptError(err error) bool {
 	return false
 }
@@ -13,3 +21,27 @@ func (c *Container) initCrypto() error {
 }
 
 func (c *Container) cryptoOnLogin() {}
+
+func (c *Container) ShareGroupSession(room *rooms.Room) error {
+	return nil
+}
+
+func (c *Container) processCryptoSync(resp *mautrix.RespSync, since string) bool {
+	return true
+}
+
+func (c *Container) UserTrust(userID id.UserID) ifc.UserTrust {
+	return ifc.UserTrustUnknown
+}
+
+func (c *Container) RefreshUserTrust(userID id.UserID) {}
+
+func (c *Container) VerifiedUsers() []id.UserID {
+	return nil
+}
+
+func (c *Container) RequestSecrets(reply func(message string, args ...interface{})) error {
+	return nil
+}
+
+func (c *Container) CacheMegolmBackupKey(key []byte) {}
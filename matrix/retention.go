@@ -0,0 +1,122 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+const historyRetentionInterval = 1 * time.Hour
+
+var ErrHistoryNotInitialized = errors.New("history database is not initialized")
+
+func (c *Container) historyRetentionEnabled() bool {
+	return c.config.HistoryMaxEvents > 0 || c.config.HistoryMaxAgeDays > 0 || c.config.HistoryDropLeftRooms
+}
+
+// historyRetentionLoop periodically enforces the history retention policies while the sync loop is running.
+func (c *Container) historyRetentionLoop() {
+	defer debug.Recover()
+	defer atomic.StoreInt32(&c.retentionLoopRunning, 0)
+	ticker := time.NewTicker(historyRetentionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.running {
+			return
+		} else if !c.config.AuthCache.InitialSyncDone || !c.historyRetentionEnabled() {
+			continue
+		}
+		removed, err := c.PruneHistory()
+		if err != nil {
+			debug.Print("Failed to prune history:", err)
+		} else if removed > 0 {
+			debug.Printf("Pruned %d events from history", removed)
+		}
+	}
+}
+
+// HistoryStats returns the stored event counts and sizes of each room, largest first, and the size of the database file.
+func (c *Container) HistoryStats() ([]ifc.HistoryRoomStats, int64, error) {
+	if c.history == nil {
+		return nil, 0, ErrHistoryNotInitialized
+	}
+	stats, err := c.history.Stats()
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Size > stats[j].Size
+	})
+	return stats, c.history.Size(), nil
+}
+
+// PruneHistory removes events from the history database according to the configured retention policies
+// and returns the number of removed events.
+func (c *Container) PruneHistory() (removed int, err error) {
+	history := c.history
+	if history == nil {
+		return 0, ErrHistoryNotInitialized
+	}
+	var olderThan time.Time
+	if c.config.HistoryMaxAgeDays > 0 {
+		olderThan = time.Now().AddDate(0, 0, -c.config.HistoryMaxAgeDays)
+	}
+	stats, err := history.Stats()
+	if err != nil {
+		return 0, err
+	}
+	for _, roomStats := range stats {
+		room := c.config.Rooms.Get(roomStats.RoomID)
+		if c.config.HistoryDropLeftRooms && (room == nil || room.HasLeft) {
+			if err = history.DropRoom(roomStats.RoomID); err != nil {
+				return
+			}
+			removed += roomStats.Events
+			continue
+		} else if room == nil || (c.config.HistoryMaxEvents <= 0 && olderThan.IsZero()) {
+			continue
+		}
+		var roomRemoved int
+		roomRemoved, err = history.Prune(room, c.config.HistoryMaxEvents, olderThan)
+		if err != nil {
+			return
+		} else if roomRemoved > 0 && len(room.LastPrevBatch) > 0 {
+			// The old pagination token would skip over the pruned events,
+			// so start paginating from the latest sync again.
+			room.PrevBatch = room.LastPrevBatch
+		}
+		removed += roomRemoved
+	}
+	if removed > 0 {
+		err = c.config.Rooms.SaveList()
+	}
+	return
+}
+
+// CompactHistory rewrites the history database into a fresh file and returns the file size before and after.
+func (c *Container) CompactHistory() (sizeBefore, sizeAfter int64, err error) {
+	if c.history == nil {
+		return 0, 0, ErrHistoryNotInitialized
+	}
+	return c.history.Compact()
+}
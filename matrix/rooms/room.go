@@ -21,7 +21,10 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	sync "github.com/sasha-s/go-deadlock"
@@ -55,6 +58,19 @@ type RoomTag struct {
 	Order json.Number
 }
 
+// EncryptionOverrides contains local per-room overrides for encryption settings.
+type EncryptionOverrides struct {
+	// Whether or not megolm sessions should only be shared with verified devices.
+	// If nil, the global send_to_verified_only setting is used.
+	SendToVerifiedOnly *bool
+	// Megolm session rotation period. If zero, the value from the m.room.encryption event is used.
+	RotationPeriod time.Duration
+	// Maximum number of messages per megolm session. If zero, the value from the m.room.encryption event is used.
+	RotationMessages int
+	// Whether or not megolm sessions should be shared with invited users. If nil, keys are shared.
+	ShareWithInvited *bool
+}
+
 type UnreadMessage struct {
 	EventID   id.EventID
 	Counted   bool
@@ -77,6 +93,10 @@ type Room struct {
 	HasLeft bool
 	// Whether or not the room is encrypted.
 	Encrypted bool
+	// Local overrides for encryption settings.
+	EncryptionOverrides EncryptionOverrides
+	// Local override for chat logging. If nil, the global chat_logs setting is used.
+	ChatLog *bool
 
 	// The first batch of events that has been fetched for this room.
 	// Used for fetching additional history.
@@ -663,6 +683,99 @@ func (room *Room) GetMemberList() []id.UserID {
 	return memberList
 }
 
+// GetKeyShareMemberList returns the list of users megolm sessions should be shared with,
+// taking the local encryption overrides into account.
+func (room *Room) GetKeyShareMemberList() []id.UserID {
+	if room.EncryptionOverrides.ShareWithInvited == nil || *room.EncryptionOverrides.ShareWithInvited {
+		return room.GetMemberList()
+	}
+	members := room.GetMembers()
+	memberList := make([]id.UserID, 0, len(members))
+	for userID, member := range members {
+		if member.Membership == event.MembershipJoin {
+			memberList = append(memberList, userID)
+		}
+	}
+	return memberList
+}
+
+// GetViaServers returns up to three server names that can be used to route to this room in links.
+//
+// The server of the highest power level user is listed first, followed by the servers with the most joined members.
+// Servers that are IP literals are never used, as they can't be used to route to the room after the IP changes.
+func (room *Room) GetViaServers() []string {
+	counts := make(map[string]int)
+	var highestUser id.UserID
+	highestLevel := 0
+	var pl *event.PowerLevelsEventContent
+	if evt := room.GetStateEvent(event.StatePowerLevels, ""); evt != nil {
+		pl = evt.Content.AsPowerLevels()
+	}
+	for userID, member := range room.GetMembers() {
+		if member.Membership != event.MembershipJoin {
+			continue
+		}
+		_, server, err := userID.Parse()
+		if err != nil || isIPLiteral(server) {
+			continue
+		}
+		counts[server]++
+		if pl != nil {
+			if level := pl.GetUserLevel(userID); level >= 50 && level > highestLevel {
+				highestLevel = level
+				highestUser = userID
+			}
+		}
+	}
+	servers := make([]string, 0, len(counts))
+	for server := range counts {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if counts[servers[i]] == counts[servers[j]] {
+			return servers[i] < servers[j]
+		}
+		return counts[servers[i]] > counts[servers[j]]
+	})
+	via := make([]string, 0, 3)
+	if len(highestUser) > 0 {
+		_, server, _ := highestUser.Parse()
+		via = append(via, server)
+	}
+	for _, server := range servers {
+		if len(via) >= 3 {
+			break
+		} else if len(via) == 0 || via[0] != server {
+			via = append(via, server)
+		}
+	}
+	return via
+}
+
+func isIPLiteral(server string) bool {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	return net.ParseIP(strings.Trim(host, "[]")) != nil
+}
+
+// IsSendToVerifiedOnly returns whether megolm sessions in this room should only be shared with verified devices.
+func (room *Room) IsSendToVerifiedOnly(globalDefault bool) bool {
+	if room.EncryptionOverrides.SendToVerifiedOnly != nil {
+		return *room.EncryptionOverrides.SendToVerifiedOnly
+	}
+	return globalDefault
+}
+
+// IsChatLogEnabled returns whether or not messages in this room should be written to the chat log.
+func (room *Room) IsChatLogEnabled(globalDefault bool) bool {
+	if room.ChatLog != nil {
+		return *room.ChatLog
+	}
+	return globalDefault
+}
+
 // GetMember returns the member with the given MXID.
 // If the member doesn't exist, nil is returned.
 func (room *Room) GetMember(userID id.UserID) *Member {
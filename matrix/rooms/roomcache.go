@@ -78,14 +78,26 @@ func (cache *RoomCache) IsEncrypted(roomID id.RoomID) bool {
 func (cache *RoomCache) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
 	room := cache.Get(roomID)
 	evt := room.GetStateEvent(event.StateEncryption, "")
-	if evt == nil {
-		return nil
+	var content *event.EncryptionEventContent
+	if evt != nil {
+		content, _ = evt.Content.Parsed.(*event.EncryptionEventContent)
 	}
-	content, ok := evt.Content.Parsed.(*event.EncryptionEventContent)
-	if !ok {
-		return nil
+	overrides := room.EncryptionOverrides
+	if overrides.RotationPeriod == 0 && overrides.RotationMessages == 0 {
+		return content
+	}
+	// Copy the content so the overrides don't end up in the actual state event
+	overridden := event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	if content != nil {
+		overridden = *content
+	}
+	if overrides.RotationPeriod != 0 {
+		overridden.RotationPeriodMillis = overrides.RotationPeriod.Milliseconds()
+	}
+	if overrides.RotationMessages != 0 {
+		overridden.RotationPeriodMessages = overrides.RotationMessages
 	}
-	return content
+	return &overridden
 }
 
 func (cache *RoomCache) FindSharedRooms(userID id.UserID) (shared []id.RoomID) {
@@ -0,0 +1,187 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+)
+
+const scheduledMessageInterval = 15 * time.Second
+
+var ErrScheduledMessageNotFound = errors.New("scheduled message not found")
+var ErrScheduledMessageSending = errors.New("scheduled message is already being sent")
+
+// scheduledMessageLoop periodically sends scheduled messages that are due while the sync loop is running.
+func (c *Container) scheduledMessageLoop() {
+	defer debug.Recover()
+	defer atomic.StoreInt32(&c.schedulerLoopRunning, 0)
+	ticker := time.NewTicker(scheduledMessageInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.running {
+			return
+		} else if !c.config.AuthCache.InitialSyncDone {
+			continue
+		}
+		c.sendDueScheduledMessages()
+	}
+}
+
+func (c *Container) sendDueScheduledMessages() {
+	now := time.Now()
+	var due []config.ScheduledMessage
+	c.scheduleLock.Lock()
+	for _, msg := range c.config.ScheduledMessages {
+		if _, sending := c.sendingScheduled[msg.ID]; !sending && !msg.SendAt.After(now) && len(msg.LastError) == 0 {
+			// Mark the message as being sent so that it can't be edited or cancelled while it's being sent.
+			c.sendingScheduled[msg.ID] = struct{}{}
+			due = append(due, *msg)
+		}
+	}
+	c.scheduleLock.Unlock()
+
+	for i := range due {
+		msg := &due[i]
+		err := c.sendScheduledMessage(msg)
+		c.scheduleLock.Lock()
+		delete(c.sendingScheduled, msg.ID)
+		if err != nil {
+			debug.Printf("Failed to send scheduled message %s to %s: %v", msg.ID, msg.RoomID, err)
+			if stored := c.getScheduledMessage(msg.ID); stored != nil {
+				stored.LastError = err.Error()
+			}
+		} else {
+			c.removeScheduledMessage(msg.ID)
+		}
+		c.config.SaveScheduledMessages()
+		c.scheduleLock.Unlock()
+		if err != nil {
+			roomView := c.ui.MainView().GetRoom(msg.RoomID)
+			if roomView != nil {
+				roomView.AddServiceMessage(fmt.Sprintf("Failed to send scheduled message: %v", err))
+				c.ui.Render()
+			}
+		}
+	}
+}
+
+func (c *Container) sendScheduledMessage(msg *config.ScheduledMessage) error {
+	room := c.GetRoom(msg.RoomID)
+	if room == nil || room.HasLeft {
+		return fmt.Errorf("not in room %s", msg.RoomID)
+	}
+	evt := c.PrepareMarkdownMessage(msg.RoomID, msg.MsgType, msg.Text, "", nil)
+	// Reuse the same transaction ID so that a retry after a crash doesn't send the message twice.
+	evt.ID = id.EventID(msg.TxnID)
+	evt.Unsigned.TransactionID = msg.TxnID
+	_, err := c.SendEvent(evt)
+	return err
+}
+
+func (c *Container) getScheduledMessage(msgID string) *config.ScheduledMessage {
+	for _, msg := range c.config.ScheduledMessages {
+		if msg.ID == msgID {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (c *Container) removeScheduledMessage(msgID string) bool {
+	for i, msg := range c.config.ScheduledMessages {
+		if msg.ID == msgID {
+			c.config.ScheduledMessages = append(c.config.ScheduledMessages[:i], c.config.ScheduledMessages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleMessage queues a message to be sent to the given room at the given time.
+func (c *Container) ScheduleMessage(roomID id.RoomID, msgtype event.MessageType, text string, sendAt time.Time) *config.ScheduledMessage {
+	msg := &config.ScheduledMessage{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		RoomID:  roomID,
+		MsgType: msgtype,
+		Text:    text,
+		SendAt:  sendAt,
+		TxnID:   c.client.TxnID(),
+	}
+	c.scheduleLock.Lock()
+	c.config.ScheduledMessages = append(c.config.ScheduledMessages, msg)
+	c.config.SaveScheduledMessages()
+	c.scheduleLock.Unlock()
+	return msg
+}
+
+// ScheduledMessages returns copies of all queued messages, earliest first.
+func (c *Container) ScheduledMessages() []config.ScheduledMessage {
+	c.scheduleLock.Lock()
+	msgs := make([]config.ScheduledMessage, len(c.config.ScheduledMessages))
+	for i, msg := range c.config.ScheduledMessages {
+		msgs[i] = *msg
+	}
+	c.scheduleLock.Unlock()
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].SendAt.Before(msgs[j].SendAt)
+	})
+	return msgs
+}
+
+// EditScheduledMessage changes the text and send time of a queued message. Failed messages will be retried.
+func (c *Container) EditScheduledMessage(msgID, text string, sendAt time.Time) error {
+	c.scheduleLock.Lock()
+	defer c.scheduleLock.Unlock()
+	if _, sending := c.sendingScheduled[msgID]; sending {
+		return ErrScheduledMessageSending
+	}
+	msg := c.getScheduledMessage(msgID)
+	if msg == nil {
+		return ErrScheduledMessageNotFound
+	}
+	msg.Text = text
+	msg.SendAt = sendAt
+	msg.LastError = ""
+	// The old transaction ID may have already been used to send the old text.
+	msg.TxnID = c.client.TxnID()
+	c.config.SaveScheduledMessages()
+	return nil
+}
+
+// CancelScheduledMessage removes a message from the queue.
+func (c *Container) CancelScheduledMessage(msgID string) error {
+	c.scheduleLock.Lock()
+	defer c.scheduleLock.Unlock()
+	if _, sending := c.sendingScheduled[msgID]; sending {
+		return ErrScheduledMessageSending
+	} else if !c.removeScheduledMessage(msgID) {
+		return ErrScheduledMessageNotFound
+	}
+	c.config.SaveScheduledMessages()
+	return nil
+}
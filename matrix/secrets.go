@@ -0,0 +1,466 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package matrix
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+// The olm machine doesn't expose decrypted to-device events that it doesn't understand itself, so secret sharing
+// events are decrypted separately with copies of the olm sessions before the sync response is given to the machine.
+// The copies are thrown away afterwards, so the actual sessions aren't affected.
+var peekPickleKey = []byte("fi.mau.gomuks.peek")
+
+var crossSigningSecrets = []string{
+	muksevt.SecretCrossSigningMaster,
+	muksevt.SecretCrossSigningSelfSigning,
+	muksevt.SecretCrossSigningUserSigning,
+}
+
+var secretDescriptions = map[string]string{
+	muksevt.SecretCrossSigningMaster:      "master key",
+	muksevt.SecretCrossSigningSelfSigning: "self-signing key",
+	muksevt.SecretCrossSigningUserSigning: "user-signing key",
+	muksevt.SecretMegolmBackup:            "key backup key",
+}
+
+// RequestSecrets asks our other devices to send the cross-signing private keys and the key backup key.
+//
+// The reply function is called when the secrets have been received and handled.
+func (c *Container) RequestSecrets(reply func(message string, args ...interface{})) error {
+	names := []string{
+		muksevt.SecretCrossSigningMaster, muksevt.SecretCrossSigningSelfSigning,
+		muksevt.SecretCrossSigningUserSigning, muksevt.SecretMegolmBackup,
+	}
+	messages := make(map[id.DeviceID]*event.Content, 1)
+	for _, name := range names {
+		requestID := c.client.TxnID()
+		c.secretLock.Lock()
+		c.secretRequests[requestID] = &secretRequest{name: name, reply: reply}
+		c.secretLock.Unlock()
+		messages["*"] = &event.Content{Parsed: &muksevt.SecretRequestEventContent{
+			Name:               name,
+			Action:             muksevt.SecretRequestActionRequest,
+			RequestingDeviceID: c.config.DeviceID,
+			RequestID:          requestID,
+		}}
+		_, err := c.client.SendToDevice(muksevt.ToDeviceSecretRequest, &mautrix.ReqSendToDevice{
+			Messages: map[id.UserID]map[id.DeviceID]*event.Content{c.config.UserID: messages},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to request %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Container) cancelSecretRequest(requestID string) {
+	_, err := c.client.SendToDevice(muksevt.ToDeviceSecretRequest, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{c.config.UserID: {
+			"*": &event.Content{Parsed: &muksevt.SecretRequestEventContent{
+				Action:             muksevt.SecretRequestActionCancel,
+				RequestingDeviceID: c.config.DeviceID,
+				RequestID:          requestID,
+			}},
+		}},
+	})
+	if err != nil {
+		debug.Printf("Failed to cancel secret request %s: %v", requestID, err)
+	}
+}
+
+// CacheMegolmBackupKey stores the key backup private key in memory so it can be shared with our other devices.
+func (c *Container) CacheMegolmBackupKey(key []byte) {
+	c.secretLock.Lock()
+	c.megolmBackupKey = key
+	c.secretLock.Unlock()
+}
+
+func (c *Container) getSecret(name string) string {
+	mach := c.crypto.(*crypto.OlmMachine)
+	switch name {
+	case muksevt.SecretCrossSigningMaster, muksevt.SecretCrossSigningSelfSigning, muksevt.SecretCrossSigningUserSigning:
+		if mach.CrossSigningKeys == nil {
+			return ""
+		}
+		seeds := mach.ExportCrossSigningKeys()
+		switch name {
+		case muksevt.SecretCrossSigningMaster:
+			return base64.StdEncoding.EncodeToString(seeds.MasterKey)
+		case muksevt.SecretCrossSigningSelfSigning:
+			return base64.StdEncoding.EncodeToString(seeds.SelfSigningKey)
+		default:
+			return base64.StdEncoding.EncodeToString(seeds.UserSigningKey)
+		}
+	case muksevt.SecretMegolmBackup:
+		c.secretLock.Lock()
+		defer c.secretLock.Unlock()
+		if c.megolmBackupKey == nil {
+			return ""
+		}
+		return base64.StdEncoding.EncodeToString(c.megolmBackupKey)
+	default:
+		return ""
+	}
+}
+
+// handleSecretSharing processes secret requests and responses from our own devices in the given to-device events.
+func (c *Container) handleSecretSharing(events []*event.Event) {
+	requests := make(map[id.DeviceID][]*muksevt.SecretRequestEventContent)
+	for _, evt := range events {
+		if evt.Sender != c.config.UserID {
+			continue
+		}
+		switch evt.Type.Type {
+		case muksevt.ToDeviceSecretRequest.Type:
+			var content muksevt.SecretRequestEventContent
+			err := json.Unmarshal(evt.Content.VeryRaw, &content)
+			if err != nil {
+				debug.Printf("Failed to parse secret request: %v", err)
+			} else if content.RequestingDeviceID != c.config.DeviceID {
+				requests[content.RequestingDeviceID] = append(requests[content.RequestingDeviceID], &content)
+			}
+		case event.ToDeviceEncrypted.Type:
+			decrypted, err := c.peekOlmEvent(evt)
+			if err != nil {
+				debug.Printf("Failed to decrypt to-device event from own device to check for secrets: %v", err)
+				continue
+			}
+			switch content := decrypted.Content.Parsed.(type) {
+			case *muksevt.SecretRequestEventContent:
+				if content.RequestingDeviceID != c.config.DeviceID {
+					requests[content.RequestingDeviceID] = append(requests[content.RequestingDeviceID], content)
+				}
+			case *muksevt.SecretSendEventContent:
+				c.handleSecretSend(decrypted, content)
+			}
+		}
+	}
+	for deviceID, deviceRequests := range requests {
+		c.queueSecretRequests(deviceID, deviceRequests)
+	}
+}
+
+func (c *Container) peekOlmEvent(evt *event.Event) (*crypto.DecryptedOlmEvent, error) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	var content event.EncryptedEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted content: %w", err)
+	} else if content.Algorithm != id.AlgorithmOlmV1 {
+		return nil, crypto.UnsupportedAlgorithm
+	}
+	ownIdentity := mach.OwnIdentity()
+	ciphertext, ok := content.OlmCiphertext[ownIdentity.IdentityKey]
+	if !ok {
+		return nil, crypto.NotEncryptedForMe
+	}
+	plaintext, err := c.peekOlmCiphertext(content.SenderKey, ciphertext.Type, ciphertext.Body)
+	if err != nil {
+		return nil, err
+	}
+	var olmEvt crypto.DecryptedOlmEvent
+	err = json.Unmarshal(plaintext, &olmEvt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse olm payload: %w", err)
+	} else if olmEvt.Sender != evt.Sender {
+		return nil, crypto.SenderMismatch
+	} else if olmEvt.Recipient != c.config.UserID {
+		return nil, crypto.RecipientMismatch
+	} else if olmEvt.RecipientKeys.Ed25519 != ownIdentity.SigningKey {
+		return nil, crypto.RecipientKeyMismatch
+	}
+	olmEvt.Type.Class = event.ToDeviceEventType
+	err = olmEvt.Content.ParseRaw(olmEvt.Type)
+	if err != nil && !event.IsUnsupportedContentType(err) {
+		return nil, fmt.Errorf("failed to parse content of olm payload: %w", err)
+	}
+	olmEvt.Source = evt
+	olmEvt.SenderKey = content.SenderKey
+	return &olmEvt, nil
+}
+
+func (c *Container) peekOlmCiphertext(senderKey id.SenderKey, olmType id.OlmMsgType, ciphertext string) ([]byte, error) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	sessions, err := mach.CryptoStore.GetSessions(senderKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	for _, session := range sessions {
+		if olmType == id.OlmMsgTypePreKey {
+			if matches, err := session.Internal.MatchesInboundSession(ciphertext); err != nil || !matches {
+				continue
+			}
+		}
+		sessionCopy, err := olm.SessionFromPickled(session.Internal.Pickle(peekPickleKey), peekPickleKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy session: %w", err)
+		}
+		plaintext, err := sessionCopy.Decrypt(ciphertext, olmType)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	if olmType != id.OlmMsgTypePreKey {
+		return nil, crypto.DecryptionFailedForNormalMessage
+	}
+	account, err := mach.CryptoStore.GetAccount()
+	if err != nil || account == nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	accountCopy, err := olm.AccountFromPickled(account.Internal.Pickle(peekPickleKey), peekPickleKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy account: %w", err)
+	}
+	session, err := accountCopy.NewInboundSessionFrom(senderKey, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound session: %w", err)
+	}
+	return session.Decrypt(ciphertext, olmType)
+}
+
+func (c *Container) getOwnDeviceByKey(senderKey id.SenderKey, deviceID id.DeviceID, signingKey id.Ed25519) (*crypto.DeviceIdentity, error) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	device, err := mach.CryptoStore.FindDeviceByKey(c.config.UserID, senderKey)
+	if err != nil {
+		return nil, err
+	} else if device == nil {
+		return nil, errors.New("unknown device")
+	} else if device.DeviceID != deviceID || device.SigningKey != signingKey {
+		return nil, errors.New("mismatching device keys")
+	} else if device.Trust == crypto.TrustStateBlacklisted || !mach.IsDeviceTrusted(device) {
+		return nil, fmt.Errorf("device %s is not verified", device.DeviceID)
+	}
+	return device, nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+func (c *Container) handleSecretSend(evt *crypto.DecryptedOlmEvent, content *muksevt.SecretSendEventContent) {
+	c.secretLock.Lock()
+	request, ok := c.secretRequests[content.RequestID]
+	c.secretLock.Unlock()
+	if !ok {
+		debug.Printf("Ignoring secret with unknown request ID %s from %s", content.RequestID, evt.SenderDevice)
+		return
+	}
+	_, err := c.getOwnDeviceByKey(evt.SenderKey, evt.SenderDevice, evt.Keys.Ed25519)
+	if err != nil {
+		debug.Printf("Ignoring secret %s from %s: %v", request.name, evt.SenderDevice, err)
+		return
+	}
+	secret, err := decodeSecret(content.Secret)
+	if err != nil {
+		debug.Printf("Failed to decode secret %s from %s: %v", request.name, evt.SenderDevice, err)
+		return
+	}
+	debug.Printf("Received secret %s from %s", request.name, evt.SenderDevice)
+	c.secretLock.Lock()
+	delete(c.secretRequests, content.RequestID)
+	c.receivedSecrets[request.name] = secret
+	c.secretLock.Unlock()
+	go c.cancelSecretRequest(content.RequestID)
+
+	if request.name == muksevt.SecretMegolmBackup {
+		c.CacheMegolmBackupKey(secret)
+		request.reply("Received key backup key from %s", evt.SenderDevice)
+	} else {
+		c.importReceivedCrossSigningKeys(request.reply)
+	}
+}
+
+func (c *Container) importReceivedCrossSigningKeys(reply func(message string, args ...interface{})) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	c.secretLock.Lock()
+	seeds := crypto.CrossSigningSeeds{
+		MasterKey:      c.receivedSecrets[muksevt.SecretCrossSigningMaster],
+		SelfSigningKey: c.receivedSecrets[muksevt.SecretCrossSigningSelfSigning],
+		UserSigningKey: c.receivedSecrets[muksevt.SecretCrossSigningUserSigning],
+	}
+	c.secretLock.Unlock()
+	if seeds.MasterKey == nil || seeds.SelfSigningKey == nil || seeds.UserSigningKey == nil {
+		return
+	}
+	publishedKeys := mach.GetOwnCrossSigningPublicKeys()
+	if publishedKeys == nil {
+		reply("Received cross-signing keys, but couldn't find published keys to compare them to")
+		return
+	}
+	for _, check := range []struct {
+		seed     []byte
+		expected id.Ed25519
+	}{
+		{seeds.MasterKey, publishedKeys.MasterKey},
+		{seeds.SelfSigningKey, publishedKeys.SelfSigningKey},
+		{seeds.UserSigningKey, publishedKeys.UserSigningKey},
+	} {
+		key, err := olm.NewPkSigningFromSeed(check.seed)
+		if err != nil || key.PublicKey != check.expected {
+			reply("Received cross-signing keys don't match the published keys")
+			return
+		}
+	}
+	err := mach.ImportCrossSigningKeys(seeds)
+	if err != nil {
+		reply("Failed to import received cross-signing keys: %v", err)
+		return
+	}
+	c.secretLock.Lock()
+	for _, name := range crossSigningSecrets {
+		delete(c.receivedSecrets, name)
+	}
+	c.secretLock.Unlock()
+	err = mach.SignOwnDevice(mach.OwnIdentity())
+	if err != nil {
+		reply("Received cross-signing keys, but failed to cross-sign this device: %v", err)
+	} else {
+		reply("Received cross-signing keys and cross-signed this device")
+	}
+	c.RefreshUserTrust(c.config.UserID)
+}
+
+// queueSecretRequests adds the given requests and cancellations from one of our other devices to the pending
+// requests of the device. If the user is already being asked about the requests of the device, the prompt is closed
+// so that it can be shown again with the updated requests. Otherwise a new prompt is started.
+func (c *Container) queueSecretRequests(deviceID id.DeviceID, requests []*muksevt.SecretRequestEventContent) {
+	c.secretLock.Lock()
+	defer c.secretLock.Unlock()
+	pending, alreadyPending := c.pendingSecretRequests[deviceID]
+	if !alreadyPending {
+		pending = &pendingSecretRequests{requests: make(map[string]*muksevt.SecretRequestEventContent)}
+	}
+	changed := false
+	for _, request := range requests {
+		switch request.Action {
+		case muksevt.SecretRequestActionRequest:
+			pending.requests[request.RequestID] = request
+			changed = true
+		case muksevt.SecretRequestActionCancel:
+			if _, ok := pending.requests[request.RequestID]; ok {
+				delete(pending.requests, request.RequestID)
+				changed = true
+			}
+		}
+	}
+	if alreadyPending {
+		if changed && pending.changed != nil {
+			close(pending.changed)
+			pending.changed = nil
+		}
+	} else if len(pending.requests) > 0 {
+		c.pendingSecretRequests[deviceID] = pending
+		go c.answerSecretRequests(deviceID, pending)
+	}
+}
+
+// answerSecretRequests asks the user whether the pending secret requests of the given device should be answered
+// with one prompt per device, and sends the secrets if the user agrees. The prompt is shown again if the requests
+// change while it's open.
+func (c *Container) answerSecretRequests(deviceID id.DeviceID, pending *pendingSecretRequests) {
+	mach := c.crypto.(*crypto.OlmMachine)
+	device, err := mach.GetOrFetchDevice(c.config.UserID, deviceID)
+	trusted := err == nil && device.Trust != crypto.TrustStateBlacklisted && mach.IsDeviceTrusted(device)
+	if err != nil {
+		debug.Printf("Failed to get device %s to answer secret requests: %v", deviceID, err)
+	} else if !trusted {
+		debug.Printf("Ignoring secret requests from unverified device %s", deviceID)
+	}
+
+	c.secretPromptLock.Lock()
+	defer c.secretPromptLock.Unlock()
+	for {
+		c.secretLock.Lock()
+		if !trusted || len(pending.requests) == 0 {
+			delete(c.pendingSecretRequests, deviceID)
+			c.secretLock.Unlock()
+			return
+		}
+		requests := make([]*muksevt.SecretRequestEventContent, 0, len(pending.requests))
+		for _, request := range pending.requests {
+			requests = append(requests, request)
+		}
+		changed := make(chan struct{})
+		pending.changed = changed
+		c.secretLock.Unlock()
+
+		secrets := make(map[string]string)
+		var descriptions []string
+		for _, request := range requests {
+			secret := c.getSecret(request.Name)
+			if len(secret) == 0 {
+				debug.Printf("Can't answer request for secret %s from %s: secret not available", request.Name, deviceID)
+				continue
+			}
+			secrets[request.RequestID] = secret
+			descriptions = append(descriptions, secretDescriptions[request.Name])
+		}
+		sort.Strings(descriptions)
+
+		confirmed := false
+		if len(secrets) > 0 {
+			confirmed = c.ui.MainView().AskConfirmation("Secret request",
+				fmt.Sprintf("Your device %s (%s) is requesting your %s. Only share them if you just logged in on that device.",
+					device.DeviceID, device.Name, strings.Join(descriptions, ", ")), "Share", changed)
+		}
+
+		c.secretLock.Lock()
+		wasChanged := pending.changed == nil
+		pending.changed = nil
+		if !wasChanged {
+			for _, request := range requests {
+				delete(pending.requests, request.RequestID)
+			}
+		}
+		c.secretLock.Unlock()
+		if wasChanged {
+			debug.Printf("Secret requests from %s changed while asking the user, asking again", deviceID)
+			continue
+		} else if !confirmed {
+			if len(secrets) > 0 {
+				debug.Printf("User declined secret requests from %s", deviceID)
+			}
+			continue
+		}
+		for requestID, secret := range secrets {
+			err = mach.SendEncryptedToDevice(device, muksevt.ToDeviceSecretSend, event.Content{Parsed: &muksevt.SecretSendEventContent{
+				RequestID: requestID,
+				Secret:    secret,
+			}})
+			if err != nil {
+				debug.Printf("Failed to send secret for request %s to %s: %v", requestID, deviceID, err)
+			}
+		}
+	}
+}
@@ -38,6 +38,7 @@ type GomuksSyncer struct {
 	FirstSyncDone     bool
 	InitDoneCallback  func()
 	FirstDoneCallback func()
+	LimitedCallback   func(room *rooms.Room, prevBatch string)
 	Progress          ifc.SyncingModal
 }
 
@@ -118,6 +119,9 @@ func (s *GomuksSyncer) processJoinedRoom(roomID id.RoomID, roomData mautrix.Sync
 	room := s.rooms.GetOrCreate(roomID)
 	room.UpdateSummary(roomData.Summary)
 	s.processSyncEvents(room, roomData.State.Events, mautrix.EventSourceJoin|mautrix.EventSourceState)
+	if roomData.Timeline.Limited && s.LimitedCallback != nil {
+		s.LimitedCallback(room, roomData.Timeline.PrevBatch)
+	}
 	s.processSyncEvents(room, roomData.Timeline.Events, mautrix.EventSourceJoin|mautrix.EventSourceTimeline)
 	s.processSyncEvents(room, roomData.Ephemeral.Events, mautrix.EventSourceJoin|mautrix.EventSourceEphemeral)
 	s.processSyncEvents(room, roomData.AccountData.Events, mautrix.EventSourceJoin|mautrix.EventSourceAccountData)
@@ -254,7 +258,7 @@ func (s *GomuksSyncer) GetFilterJSON(_ id.UserID) *mautrix.Filter {
 				Types: []event.Type{event.EphemeralEventTyping, event.EphemeralEventReceipt},
 			},
 			AccountData: mautrix.FilterPart{
-				Types: []event.Type{event.AccountDataRoomTags},
+				Types: []event.Type{event.AccountDataRoomTags, AccountDataGomuksDraft},
 			},
 		},
 		AccountData: mautrix.FilterPart{
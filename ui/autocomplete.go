@@ -70,6 +70,21 @@ func autocompleteToggle(cmd *CommandAutocomplete) (completions []string, newText
 	return
 }
 
+func autocompleteHook(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) > 1 {
+		return
+	}
+	for _, name := range cmd.Matrix.Hooks() {
+		if strings.HasPrefix(name, cmd.RawArgs) {
+			completions = append(completions, name)
+		}
+	}
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s ", cmd.OrigCommand, completions[0])
+	}
+	return
+}
+
 var staticPowerLevelKeys = []string{"ban", "kick", "redact", "invite", "state_default", "events_default", "users_default"}
 
 func autocompletePowerLevel(cmd *CommandAutocomplete) (completions []string, newText string) {
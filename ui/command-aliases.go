@@ -0,0 +1,166 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/ui/messages"
+)
+
+var aliasVariableRegex = regexp.MustCompile(`\$(\$|\*|[1-9]|room|selected_event)`)
+
+func aliasUsesVariable(alias *config.CommandAlias, check func(name string) bool) bool {
+	for _, step := range alias.Steps {
+		for _, match := range aliasVariableRegex.FindAllStringSubmatch(step, -1) {
+			if check(match[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isArgumentVariable(name string) bool {
+	return name == "*" || (name[0] >= '1' && name[0] <= '9')
+}
+
+func isSelectedEventVariable(name string) bool {
+	return name == "selected_event"
+}
+
+func expandAliasStep(step string, args []string, roomID id.RoomID, eventID id.EventID) string {
+	return aliasVariableRegex.ReplaceAllStringFunc(step, func(match string) string {
+		switch name := match[1:]; name {
+		case "$":
+			return "$"
+		case "*":
+			return strings.Join(args, " ")
+		case "room":
+			return string(roomID)
+		case "selected_event":
+			return string(eventID)
+		default:
+			index, _ := strconv.Atoi(name)
+			if index <= len(args) {
+				return args[index-1]
+			}
+			return ""
+		}
+	})
+}
+
+// RunAlias runs a user-defined command from config.yaml. If any step refers to $selected_event, the user is
+// asked to select a message first, and that message stays selected for the steps, so commands like /react
+// apply to it.
+func (ch *CommandProcessor) RunAlias(cmd *Command, alias *config.CommandAlias) {
+	if aliasUsesVariable(alias, isSelectedEventVariable) {
+		cmd.Room.pendingAlias = cmd
+		cmd.Room.StartSelecting(SelectRunAlias, "")
+		return
+	}
+	ch.runAliasSteps(cmd, alias, nil)
+}
+
+func (ch *CommandProcessor) runAliasSteps(cmd *Command, alias *config.CommandAlias, message *messages.UIMessage) {
+	defer debug.Recover()
+	var eventID id.EventID
+	if message != nil {
+		eventID = message.EventID
+	}
+	appendArgs := len(cmd.Args) > 0 && !aliasUsesVariable(alias, isArgumentVariable)
+	for i, step := range alias.Steps {
+		line := expandAliasStep(step, cmd.Args, cmd.Room.Room.ID, eventID)
+		if appendArgs && i == len(alias.Steps)-1 {
+			// Simple aliases without argument variables get the arguments appended to the last step.
+			line = line + " " + strings.Join(cmd.Args, " ")
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if message != nil {
+			cmd.Room.MessageView().SetSelected(message)
+		}
+		if stepCmd := ch.ParseCommand(cmd.Room, line); stepCmd != nil {
+			// Steps can only run built-in commands, which also prevents aliases from recursing.
+			ch.handleBuiltinCommand(stepCmd)
+		} else {
+			cmd.Room.SendMessage(event.MsgText, line)
+		}
+	}
+	if message != nil {
+		cmd.Room.MessageView().SetSelected(nil)
+	}
+	cmd.UI.Render()
+}
+
+func (view *RoomView) runPendingAlias(message *messages.UIMessage) {
+	cmd := view.pendingAlias
+	view.pendingAlias = nil
+	if cmd == nil {
+		return
+	}
+	alias, ok := view.config.CommandAliases[cmd.Command]
+	if !ok || alias == nil {
+		return
+	}
+	go cmd.Handler.runAliasSteps(cmd, alias, message)
+}
+
+// aliasHelpText returns the help section listing the user-defined commands.
+func aliasHelpText(aliases map[string]*config.CommandAlias) string {
+	if len(aliases) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(aliases))
+	usageWidth := 0
+	for name, alias := range aliases {
+		names = append(names, name)
+		if width := len(aliasUsage(name, alias)); width > usageWidth {
+			usageWidth = width
+		}
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	buf.WriteString("\n\n# Custom commands")
+	for _, name := range names {
+		alias := aliases[name]
+		description := alias.Description
+		if len(description) == 0 {
+			description = strings.Join(alias.Steps, "; ")
+		}
+		_, _ = fmt.Fprintf(&buf, "\n%-*s - %s", usageWidth, aliasUsage(name, alias), description)
+	}
+	return buf.String()
+}
+
+func aliasUsage(name string, alias *config.CommandAlias) string {
+	if len(alias.Usage) > 0 {
+		return "/" + name + " " + alias.Usage
+	}
+	return "/" + name
+}
@@ -115,66 +115,79 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 			"pl":         {"powerlevel"},
 		},
 		autocompleters: map[string]CommandAutocompleter{
-			"devices":       autocompleteUser,
-			"device":        autocompleteDevice,
-			"verify":        autocompleteUser,
-			"verify-device": autocompleteDevice,
-			"unverify":      autocompleteDevice,
-			"blacklist":     autocompleteDevice,
-			"upload":        autocompleteFile,
-			"download":      autocompleteFile,
-			"open":          autocompleteFile,
-			"import":        autocompleteFile,
-			"export":        autocompleteFile,
-			"export-room":   autocompleteFile,
-			"toggle":        autocompleteToggle,
-			"powerlevel":    autocompletePowerLevel,
+			"devices":        autocompleteUser,
+			"device":         autocompleteDevice,
+			"verify":         autocompleteUser,
+			"verify-device":  autocompleteDevice,
+			"unverify":       autocompleteDevice,
+			"blacklist":      autocompleteDevice,
+			"upload":         autocompleteFile,
+			"download":       autocompleteFile,
+			"open":           autocompleteFile,
+			"import":         autocompleteFile,
+			"export":         autocompleteFile,
+			"export-room":    autocompleteFile,
+			"export-history": autocompleteExportHistory,
+			"toggle":         autocompleteToggle,
+			"powerlevel":     autocompletePowerLevel,
+			"run":            autocompleteHook,
 		},
 		commands: map[string]CommandHandler{
 			"unknown-command": cmdUnknownCommand,
 
-			"id":         cmdID,
-			"help":       cmdHelp,
-			"me":         cmdMe,
-			"quit":       cmdQuit,
-			"clearcache": cmdClearCache,
-			"leave":      cmdLeave,
-			"create":     cmdCreateRoom,
-			"pm":         cmdPrivateMessage,
-			"join":       cmdJoin,
-			"kick":       cmdKick,
-			"ban":        cmdBan,
-			"unban":      cmdUnban,
-			"powerlevel": cmdPowerLevel,
-			"toggle":     cmdToggle,
-			"logout":     cmdLogout,
-			"accept":     cmdAccept,
-			"reject":     cmdReject,
-			"reply":      cmdReply,
-			"redact":     cmdRedact,
-			"react":      cmdReact,
-			"edit":       cmdEdit,
-			"external":   cmdExternalEditor,
-			"download":   cmdDownload,
-			"upload":     cmdUpload,
-			"open":       cmdOpen,
-			"copy":       cmdCopy,
-			"sendevent":  cmdSendEvent,
-			"msendevent": cmdMSendEvent,
-			"setstate":   cmdSetState,
-			"msetstate":  cmdMSetState,
-			"roomnick":   cmdRoomNick,
-			"rainbow":    cmdRainbow,
-			"rainbowme":  cmdRainbowMe,
-			"notice":     cmdNotice,
-			"alias":      cmdAlias,
-			"tags":       cmdTags,
-			"tag":        cmdTag,
-			"untag":      cmdUntag,
-			"invite":     cmdInvite,
-			"hprof":      cmdHeapProfile,
-			"cprof":      cmdCPUProfile,
-			"trace":      cmdTrace,
+			"id":             cmdID,
+			"help":           cmdHelp,
+			"me":             cmdMe,
+			"quit":           cmdQuit,
+			"clearcache":     cmdClearCache,
+			"leave":          cmdLeave,
+			"create":         cmdCreateRoom,
+			"pm":             cmdPrivateMessage,
+			"join":           cmdJoin,
+			"kick":           cmdKick,
+			"ban":            cmdBan,
+			"unban":          cmdUnban,
+			"powerlevel":     cmdPowerLevel,
+			"toggle":         cmdToggle,
+			"logout":         cmdLogout,
+			"accept":         cmdAccept,
+			"reject":         cmdReject,
+			"reply":          cmdReply,
+			"redact":         cmdRedact,
+			"react":          cmdReact,
+			"edit":           cmdEdit,
+			"external":       cmdExternalEditor,
+			"download":       cmdDownload,
+			"upload":         cmdUpload,
+			"open":           cmdOpen,
+			"copy":           cmdCopy,
+			"jump":           cmdJump,
+			"live":           cmdLive,
+			"permalink":      cmdPermalink,
+			"quote":          cmdQuote,
+			"forward":        cmdForward,
+			"schedule":       cmdSchedule,
+			"scheduled":      cmdScheduled,
+			"run":            cmdRun,
+			"sendevent":      cmdSendEvent,
+			"msendevent":     cmdMSendEvent,
+			"setstate":       cmdSetState,
+			"msetstate":      cmdMSetState,
+			"roomnick":       cmdRoomNick,
+			"rainbow":        cmdRainbow,
+			"rainbowme":      cmdRainbowMe,
+			"notice":         cmdNotice,
+			"alias":          cmdAlias,
+			"tags":           cmdTags,
+			"tag":            cmdTag,
+			"untag":          cmdUntag,
+			"invite":         cmdInvite,
+			"hprof":          cmdHeapProfile,
+			"cprof":          cmdCPUProfile,
+			"trace":          cmdTrace,
+			"export-history": cmdExportHistory,
+			"chatlog":        cmdChatLog,
+			"history-db":     cmdHistoryDB,
 			"panic": func(cmd *Command) {
 				panic("hello world")
 			},
@@ -194,6 +207,9 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 			"export-room":   cmdExportRoomKeys,
 			"ssss":          cmdSSSS,
 			"cross-signing": cmdCrossSigning,
+			"security":      cmdSecurity,
+			"encrypt":       cmdEncrypt,
+			"room-crypto":   cmdRoomCrypto,
 		},
 	}
 }
@@ -232,6 +248,8 @@ func (ch *CommandProcessor) Autocomplete(roomView *RoomView, text string, cursor
 	var cmd *Command
 	if cmd = ch.ParseCommand(roomView, text); cmd == nil {
 		return completions, text, false
+	} else if _, ok := ch.Config.CommandAliases[cmd.Command]; ok {
+		return completions, text, false
 	} else if alias, ok := ch.aliases[cmd.Command]; ok {
 		cmd = alias.Process(cmd)
 	}
@@ -268,6 +286,14 @@ func (ch *CommandProcessor) AutocompleteCommand(word string) (completions []stri
 			completions = append(completions, "/"+command)
 		}
 	}
+	for command := range ch.Config.CommandAliases {
+		if command == word {
+			return []string{"/" + command}
+		}
+		if strings.HasPrefix(command, word) {
+			completions = append(completions, "/"+command)
+		}
+	}
 	return
 }
 
@@ -276,6 +302,14 @@ func (ch *CommandProcessor) HandleCommand(cmd *Command) {
 	if cmd == nil {
 		return
 	}
+	if alias, ok := ch.Config.CommandAliases[cmd.Command]; ok && alias != nil {
+		ch.RunAlias(cmd, alias)
+		return
+	}
+	ch.handleBuiltinCommand(cmd)
+}
+
+func (ch *CommandProcessor) handleBuiltinCommand(cmd *Command) {
 	if alias, ok := ch.aliases[cmd.Command]; ok {
 		cmd = alias.Process(cmd)
 	}
@@ -36,6 +36,7 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/kyokomi/emoji/v2"
 	"github.com/lucasb-eyer/go-colorful"
 	"github.com/yuin/goldmark"
 
@@ -46,6 +47,7 @@ import (
 
 	"maunium.net/go/gomuks/debug"
 	"maunium.net/go/gomuks/lib/filepicker"
+	"maunium.net/go/gomuks/matrix/chatlog"
 )
 
 func cmdMe(cmd *Command) {
@@ -90,8 +92,11 @@ var rainbowMark = goldmark.New(format.Extensions, format.HTMLOptions, goldmark.W
 
 // TODO this command definitely belongs in a plugin once we have a plugin system.
 func makeRainbow(cmd *Command, msgtype event.MessageType) {
-	text := strings.Join(cmd.Args, " ")
+	text, htmlBody := renderRainbow(strings.Join(cmd.Args, " "))
+	go cmd.Room.SendMessageHTML(msgtype, text, htmlBody)
+}
 
+func renderRainbow(text string) (string, string) {
 	var buf strings.Builder
 	_ = rainbowMark.Convert([]byte(text), &buf)
 
@@ -105,8 +110,7 @@ func makeRainbow(cmd *Command, msgtype event.MessageType) {
 		i++
 		return rainbow.GetInterpolatedColorFor(float64(i) / float64(count)).Hex()
 	})
-
-	go cmd.Room.SendMessageHTML(msgtype, text, htmlBody)
+	return text, htmlBody
 }
 
 func cmdRainbow(cmd *Command) {
@@ -164,13 +168,18 @@ func cmdID(cmd *Command) {
 type SelectReason string
 
 const (
-	SelectReply    SelectReason = "reply to"
-	SelectReact                 = "react to"
-	SelectRedact                = "redact"
-	SelectEdit                  = "edit"
-	SelectDownload              = "download"
-	SelectOpen                  = "open"
-	SelectCopy                  = "copy"
+	SelectReply     SelectReason = "reply to"
+	SelectReact                  = "react to"
+	SelectRedact                 = "redact"
+	SelectEdit                   = "edit"
+	SelectDownload               = "download"
+	SelectOpen                   = "open"
+	SelectCopy                   = "copy"
+	SelectJump                   = "jump to the reply target of"
+	SelectPermalink              = "copy a link to"
+	SelectQuote                  = "quote"
+	SelectForward                = "forward"
+	SelectRunAlias               = "run a custom command on"
 )
 
 func cmdReply(cmd *Command) {
@@ -302,6 +311,119 @@ func cmdCopy(cmd *Command) {
 	}
 }
 
+func cmdPermalink(cmd *Command) {
+	register := strings.Join(cmd.Args, " ")
+	if len(register) == 0 {
+		register = "clipboard"
+	}
+	if register == "clipboard" || register == "primary" {
+		cmd.Room.StartSelecting(SelectPermalink, register)
+	} else {
+		cmd.Reply("Usage: /permalink [register], where register is either \"clipboard\" or \"primary\". Defaults to \"clipboard\".")
+	}
+}
+
+func cmdQuote(cmd *Command) {
+	cmd.Room.StartSelecting(SelectQuote, "")
+}
+
+func cmdForward(cmd *Command) {
+	cmd.Room.StartSelecting(SelectForward, strings.Join(cmd.Args, " "))
+}
+
+func cmdSchedule(cmd *Command) {
+	if len(cmd.Args) < 2 {
+		cmd.Reply("Usage: /schedule <time|+duration> <message>")
+		return
+	}
+	sendAt, err := parseScheduleTime(cmd.Args[0], time.Now())
+	if err != nil {
+		cmd.Reply("%v", err)
+		return
+	} else if !sendAt.After(time.Now()) {
+		cmd.Reply("%s is in the past", sendAt.Format("Mon, 2 Jan 2006 15:04"))
+		return
+	}
+	// Take the message from the raw arguments to preserve its whitespace.
+	text := strings.TrimLeft(strings.TrimPrefix(strings.TrimLeft(cmd.RawArgs, " "), cmd.Args[0]), " ")
+	if !cmd.Config.Preferences.DisableEmojis {
+		text = emoji.Sprint(text)
+	}
+	cmd.Matrix.ScheduleMessage(cmd.Room.MxRoom().ID, event.MsgText, text, sendAt)
+	cmd.Reply("Message scheduled for %s (in %s)", sendAt.Format("Mon, 2 Jan 2006 15:04"), time.Until(sendAt).Round(time.Minute))
+}
+
+func cmdScheduled(cmd *Command) {
+	cmd.MainView.ShowModal(NewScheduledModal(cmd.MainView))
+}
+
+func cmdRun(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		hooks := cmd.Matrix.Hooks()
+		if len(hooks) == 0 {
+			cmd.Reply("Usage: /run <hook> [args...]\n\nNo hooks found in %s", cmd.Config.HooksDir)
+		} else {
+			cmd.Reply("Usage: /run <hook> [args...]\n\nAvailable hooks: %s", strings.Join(hooks, ", "))
+		}
+		return
+	}
+	output, err := cmd.Matrix.RunHook(cmd.Room.MxRoom().ID, cmd.Args[0], cmd.Args[1:])
+	if len(output) > 0 {
+		cmd.Reply(strings.Join(output, "\n"))
+	}
+	if err != nil {
+		cmd.Reply("Failed to run hook %s: %v", cmd.Args[0], err)
+	}
+}
+
+// parseEventLink parses an event ID, a matrix.to link or a matrix: URI pointing to an event.
+// Plain event IDs refer to the current room.
+func parseEventLink(cmd *Command, link string) (id.RoomID, id.EventID, error) {
+	if strings.HasPrefix(link, "$") {
+		return cmd.Room.MxRoom().ID, id.EventID(link), nil
+	}
+	uri, err := id.ParseMatrixURIOrMatrixToURL(link)
+	if err != nil {
+		return "", "", err
+	} else if uri.Sigil2 != '$' {
+		return "", "", fmt.Errorf("link doesn't point to an event")
+	} else if uri.Sigil1 == '!' {
+		return uri.RoomID(), uri.EventID(), nil
+	}
+	resp, err := cmd.Matrix.Client().ResolveAlias(uri.RoomAlias())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve %s: %w", uri.RoomAlias(), err)
+	}
+	return resp.RoomID, uri.EventID(), nil
+}
+
+func cmdJump(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Room.StartSelecting(SelectJump, "")
+		return
+	}
+	roomID, eventID, err := parseEventLink(cmd, cmd.Args[0])
+	if err != nil {
+		cmd.Reply("Usage: /jump [event ID or link] (%v)", err)
+		return
+	} else if cmd.Matrix.GetRoom(roomID) == nil {
+		cmd.Reply("You're not in %s", roomID)
+		return
+	}
+	err = cmd.MainView.JumpToEvent(roomID, eventID)
+	if err != nil {
+		cmd.Reply("Failed to jump to %s: %v", eventID, err)
+	}
+}
+
+func cmdLive(cmd *Command) {
+	if !cmd.Room.MessageView().IsDetached() {
+		cmd.Reply("Already viewing the latest messages")
+		return
+	}
+	cmd.MainView.ReturnToLiveTimeline(cmd.Room)
+}
+
 func cmdReact(cmd *Command) {
 	if len(cmd.Args) == 0 {
 		cmd.Reply("Usage: /react <reaction>")
@@ -467,6 +589,119 @@ func cmdRoomNick(cmd *Command) {
 	}
 }
 
+func cmdChatLog(cmd *Command) {
+	room := cmd.Room.MxRoom()
+	if len(cmd.Args) == 0 {
+		status := "disabled"
+		if room.IsChatLogEnabled(cmd.Config.ChatLogs) {
+			status = "enabled"
+		}
+		source := "global default"
+		if room.ChatLog != nil {
+			source = "room override"
+		}
+		cmd.Reply("Chat logging is %s in this room (%s).\nLogs are written to %s", status, source, chatlog.New(cmd.Config).Dir(room))
+		return
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "on", "enable", "true":
+		enabled := true
+		room.ChatLog = &enabled
+	case "off", "disable", "false":
+		enabled := false
+		room.ChatLog = &enabled
+	case "default":
+		room.ChatLog = nil
+	default:
+		cmd.Reply("Usage: /chatlog [on|off|default]")
+		return
+	}
+	err := cmd.Config.Rooms.SaveList()
+	if err != nil {
+		cmd.Reply("Failed to save room list: %v", err)
+		return
+	}
+	if room.IsChatLogEnabled(cmd.Config.ChatLogs) {
+		cmd.Reply("Chat logging enabled in this room")
+	} else {
+		cmd.Reply("Chat logging disabled in this room")
+	}
+}
+
+const historyDBHelp = `Usage: /history-db <subcommand>
+
+Subcommands:
+  stats   - Show the size of the stored history of each room.
+  prune   - Apply the history retention policies now.
+  compact - Rewrite the database file to release unused space.`
+
+func formatByteSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GiB", float64(size)/1024/1024/1024)
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+func cmdHistoryDB(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply(historyDBHelp)
+		return
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "stats":
+		stats, fileSize, err := cmd.Matrix.HistoryStats()
+		if err != nil {
+			cmd.Reply("Failed to get history stats: %v", err)
+			return
+		}
+		var resp strings.Builder
+		var totalEvents int
+		var totalSize int64
+		for _, roomStats := range stats {
+			totalEvents += roomStats.Events
+			totalSize += roomStats.Size
+		}
+		_, _ = fmt.Fprintf(&resp, "%d events in %d rooms, %s in use, %s on disk\n",
+			totalEvents, len(stats), formatByteSize(totalSize), formatByteSize(fileSize))
+		for _, roomStats := range stats {
+			name := string(roomStats.RoomID)
+			if room := cmd.Matrix.GetRoom(roomStats.RoomID); room != nil {
+				name = fmt.Sprintf("%s (%s)", room.GetTitle(), room.ID)
+			}
+			_, _ = fmt.Fprintf(&resp, "%10s %8d events  %s\n", formatByteSize(roomStats.Size), roomStats.Events, name)
+		}
+		cmd.Reply(strings.TrimSpace(resp.String()))
+	case "prune":
+		removed, err := cmd.Matrix.PruneHistory()
+		if err != nil {
+			cmd.Reply("Failed to prune history: %v", err)
+		} else if removed == 0 {
+			cmd.Reply("Nothing to prune. Set history_max_events, history_max_age_days or history_drop_left_rooms in the config to enable pruning.")
+		} else {
+			cmd.Reply("Removed %d events. Use /history-db compact to shrink the database file.", removed)
+		}
+	case "compact":
+		modal := cmd.MainView.OpenProgressModal("Compacting history")
+		modal.SetMessage("Compacting history database...")
+		modal.SetIndeterminate()
+		sizeBefore, sizeAfter, err := cmd.Matrix.CompactHistory()
+		modal.Close()
+		if err != nil {
+			cmd.Reply("Failed to compact history database: %v", err)
+		} else {
+			cmd.Reply("Compacted history database from %s to %s", formatByteSize(sizeBefore), formatByteSize(sizeAfter))
+		}
+	default:
+		cmd.Reply(historyDBHelp)
+	}
+}
+
 func cmdFingerprint(cmd *Command) {
 	c := cmd.Matrix.Crypto()
 	if c == nil {
@@ -984,6 +1219,9 @@ var toggleMsg = map[string]ToggleMessage{
 	"showurls":      SimpleToggleMessage("show URLs in text format"),
 	"inlineurls":    InvertedToggleMessage("use fancy terminal features to render URLs inside text"),
 	"newline":       NewlineKeybindMessage("should <alt+enter> make a new line or send the message"),
+	"syncdrafts":    InvertedToggleMessage("syncing unsent drafts between devices"),
+	"vimode":        InvertedToggleMessage("vi-style modal editing in the message input"),
+	"preview":       InvertedToggleMessage("live preview of formatted messages above the input"),
 }
 
 func makeUsage() string {
@@ -1042,6 +1280,12 @@ func cmdToggle(cmd *Command) {
 			continue
 		case "newline":
 			val = &cmd.Config.Preferences.AltEnterToSend
+		case "syncdrafts":
+			val = &cmd.Config.Preferences.SyncDrafts
+		case "vimode":
+			val = &cmd.Config.Preferences.ViMode
+		case "preview":
+			val = &cmd.Config.Preferences.ShowInputPreview
 		default:
 			cmd.Reply("Unknown toggle %s. Use /toggle without arguments for a list of togglable things.", thing)
 			return
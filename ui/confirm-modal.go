@@ -0,0 +1,102 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"go.mau.fi/mauview"
+)
+
+type ConfirmModal struct {
+	mauview.Component
+
+	outputChan chan bool
+
+	form *mauview.Form
+	text *mauview.TextView
+
+	cancel  *mauview.Button
+	confirm *mauview.Button
+
+	parent *MainView
+}
+
+// AskConfirmation shows a modal with the given text and waits until the user either confirms or cancels.
+// If the cancel channel is closed first, the modal is hidden and false is returned.
+func (view *MainView) AskConfirmation(title, text, confirmLabel string, cancel <-chan struct{}) bool {
+	cm := NewConfirmModal(view, title, text, confirmLabel)
+	view.ShowModal(cm)
+	view.parent.Render()
+	select {
+	case confirmed := <-cm.outputChan:
+		return confirmed
+	case <-cancel:
+		if view.modal == cm {
+			view.HideModal()
+			view.parent.Render()
+		}
+		return false
+	}
+}
+
+func NewConfirmModal(parent *MainView, title, text, confirmLabel string) *ConfirmModal {
+	if confirmLabel == "" {
+		confirmLabel = "Confirm"
+	}
+	cm := &ConfirmModal{
+		parent:     parent,
+		form:       mauview.NewForm(),
+		outputChan: make(chan bool, 1),
+	}
+
+	width := 45
+	textHeight := 4
+
+	cm.form.
+		SetColumns([]int{1, 20, 1, 20, 1}).
+		SetRows([]int{1, textHeight, 1, 1, 1})
+
+	cm.text = mauview.NewTextView().SetWordWrap(true).SetText(text)
+	cm.form.AddComponent(cm.text, 1, 1, 3, 1)
+
+	cm.cancel = mauview.NewButton("Cancel").SetOnClick(cm.ClickCancel)
+	cm.confirm = mauview.NewButton(confirmLabel).SetOnClick(cm.ClickConfirm)
+
+	cm.form.AddFormItem(cm.confirm, 3, 3, 1, 1)
+	cm.form.AddFormItem(cm.cancel, 1, 3, 1, 1)
+
+	box := mauview.NewBox(cm.form).SetTitle(title)
+	center := mauview.Center(box, width, textHeight+6).SetAlwaysFocusChild(true)
+	center.Focus()
+	cm.form.FocusNextItem()
+	cm.Component = center
+
+	return cm
+}
+
+func (cm *ConfirmModal) ClickCancel() {
+	cm.parent.HideModal()
+	cm.outputChan <- false
+}
+
+func (cm *ConfirmModal) ClickConfirm() {
+	cm.parent.HideModal()
+	cm.outputChan <- true
+}
+
+func (cm *ConfirmModal) Wait() bool {
+	return <-cm.outputChan
+}
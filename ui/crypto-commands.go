@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -30,9 +32,12 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"maunium.net/go/gomuks/debug"
 	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/muksevt"
 )
 
 func autocompleteDeviceUserID(cmd *CommandAutocomplete) (completions []string, newText string) {
@@ -121,6 +126,7 @@ func putDevice(cmd *Command, device *crypto.DeviceIdentity, action string) {
 		cmd.Reply("Successfully %s %s/%s (%s)", action, device.UserID, device.DeviceID, device.Name)
 	}
 	mach.OnDevicesChanged(device.UserID)
+	cmd.Matrix.RefreshUserTrust(device.UserID)
 }
 
 func cmdDevices(cmd *Command) {
@@ -198,64 +204,186 @@ func cmdVerifyDevice(cmd *Command) {
 		mach.DefaultSASTimeout = 120 * time.Second
 		modal := NewVerificationModal(cmd.MainView, device, mach.DefaultSASTimeout)
 		cmd.MainView.ShowModal(modal)
-		_, err := mach.NewSimpleSASVerificationWith(device, modal)
+		transactionID, err := mach.NewSimpleSASVerificationWith(device, modal)
 		if err != nil {
 			cmd.Reply("Failed to start interactive verification: %v", err)
 			return
 		}
+		modal.SetCancelFunc(func() {
+			_ = mach.CancelSASVerification(device.UserID, transactionID, "Cancelled by user")
+		})
 	} else {
 		fingerprint := strings.Join(cmd.Args[2:], "")
 		if string(device.SigningKey) != fingerprint {
 			cmd.Reply("Mismatching fingerprint")
 			return
 		}
-		action := "verified"
-		if device.Trust == crypto.TrustStateBlacklisted {
-			action = "unblacklisted and verified"
+		markDeviceVerified(cmd, device)
+	}
+}
+
+func markDeviceVerified(cmd *Command, device *crypto.DeviceIdentity) {
+	action := "verified"
+	if device.Trust == crypto.TrustStateBlacklisted {
+		action = "unblacklisted and verified"
+	}
+	device.Trust = crypto.TrustStateVerified
+	if device.UserID == cmd.Matrix.Client().UserID {
+		crossSignDevice(cmd, device)
+		putDevice(cmd, device, action)
+	} else {
+		putDevice(cmd, device, action)
+		cmd.Reply("Warning: verifying individual devices of other users is not synced with cross-signing")
+	}
+}
+
+func markDeviceBlacklisted(cmd *Command, device *crypto.DeviceIdentity) {
+	action := "blacklisted"
+	if device.Trust == crypto.TrustStateVerified {
+		action = "unverified and blacklisted"
+	}
+	device.Trust = crypto.TrustStateBlacklisted
+	putDevice(cmd, device, action)
+}
+
+// getUntrustedDevicesOfVerifiedUsers finds all devices that aren't verified or blacklisted, but belong to ourselves
+// or to users whose identity we have verified.
+func getUntrustedDevicesOfVerifiedUsers(cmd *Command) []*crypto.DeviceIdentity {
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	users := cmd.Matrix.VerifiedUsers()
+	if mach.GetOwnCrossSigningPublicKeys() != nil {
+		users = append([]id.UserID{cmd.Matrix.Client().UserID}, users...)
+	}
+	var untrusted []*crypto.DeviceIdentity
+	for _, userID := range users {
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			cmd.Reply("Failed to get devices of %s: %v", userID, err)
+			continue
 		}
-		if device.UserID == cmd.Matrix.Client().UserID {
-			crossSignDevice(cmd, device)
-			device.Trust = crypto.TrustStateVerified
-			putDevice(cmd, device, action)
-		} else {
-			putDevice(cmd, device, action)
-			cmd.Reply("Warning: verifying individual devices of other users is not synced with cross-signing")
+		var userUntrusted []*crypto.DeviceIdentity
+		for _, device := range devices {
+			if device.Deleted || device.Trust == crypto.TrustStateBlacklisted || mach.IsDeviceTrusted(device) ||
+				(device.UserID == mach.Client.UserID && device.DeviceID == mach.Client.DeviceID) {
+				continue
+			}
+			userUntrusted = append(userUntrusted, device)
 		}
+		sort.Slice(userUntrusted, func(i, j int) bool {
+			return userUntrusted[i].DeviceID < userUntrusted[j].DeviceID
+		})
+		untrusted = append(untrusted, userUntrusted...)
 	}
+	return untrusted
+}
+
+func cmdSecurity(cmd *Command) {
+	devices := getUntrustedDevicesOfVerifiedUsers(cmd)
+	if len(devices) == 0 {
+		cmd.Reply("All devices of verified users are verified")
+		return
+	}
+	cmd.MainView.ShowModal(NewSecurityModal(cmd, devices))
 }
 
 func cmdVerify(cmd *Command) {
 	if len(cmd.Args) < 1 {
-		cmd.Reply("Usage: /%s <user ID> [--force]", cmd.OrigCommand)
+		cmd.Reply("Usage: /%s <user ID> [--force] or /%[1]s <accept|decline>", cmd.OrigCommand)
 		return
 	}
-	force := len(cmd.Args) >= 2 && strings.ToLower(cmd.Args[1]) == "--force"
-	userID := id.UserID(cmd.Args[0])
 	room := cmd.Room.Room
 	if !room.Encrypted {
 		cmd.Reply("In-room verification is only supported in encrypted rooms")
 		return
 	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "accept":
+		cmdVerifyAccept(cmd)
+		return
+	case "decline", "cancel":
+		cmdVerifyDecline(cmd)
+		return
+	}
+	force := len(cmd.Args) >= 2 && strings.ToLower(cmd.Args[1]) == "--force"
+	userID := id.UserID(cmd.Args[0])
 	if (!room.IsDirect || room.OtherUser != userID) && !force {
 		cmd.Reply("This doesn't seem to be a direct chat. Either switch to a direct chat with %s, "+
 			"or use `--force` to start the verification anyway.", userID)
 		return
 	}
 	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
-	if mach.CrossSigningKeys == nil && !force {
-		cmd.Reply("Cross-signing private keys not cached. Generate or fetch cross-signing keys with `/cross-signing`, " +
-			"or use `--force` to start the verification anyway")
+	if !unlockCrossSigningKeys(cmd, mach) && !force {
+		cmd.Reply("Cross-signing private keys not cached, so the verification couldn't be cross-signed. " +
+			"Generate or fetch cross-signing keys with `/cross-signing`, or use `--force` to start the verification anyway")
 		return
 	}
-	modal := NewVerificationModal(cmd.MainView, &crypto.DeviceIdentity{UserID: userID}, mach.DefaultSASTimeout)
-	_, err := mach.NewInRoomSASVerificationWith(cmd.Room.Room.ID, userID, modal, 120*time.Second)
+	modal := NewVerificationModal(cmd.MainView, &crypto.DeviceIdentity{UserID: userID}, inRoomVerificationTimeout)
+	verification, err := cmd.MainView.StartInRoomVerification(room.ID, userID, modal)
 	if err != nil {
 		cmd.Reply("Failed to start in-room verification: %v", err)
 		return
 	}
+	modal.SetCancelFunc(func() {
+		verification.Cancel("Cancelled by user", event.VerificationCancelByUser)
+	})
 	cmd.MainView.ShowModal(modal)
 }
 
+// unlockCrossSigningKeys tries to fetch the cross-signing private keys from SSSS if they're not already cached.
+func unlockCrossSigningKeys(cmd *Command, mach *crypto.OlmMachine) bool {
+	if mach.CrossSigningKeys != nil {
+		return true
+	} else if mach.GetOwnCrossSigningPublicKeys() == nil {
+		return false
+	}
+	cmd.Reply("Cross-signing private keys not cached, trying to fetch them from SSSS")
+	key := getSSSS(cmd, mach)
+	if key == nil {
+		return false
+	}
+	err := mach.FetchCrossSigningKeysFromSSSS(key)
+	if err != nil {
+		cmd.Reply("Error fetching cross-signing keys: %v", err)
+		return false
+	}
+	fetchMegolmBackupKey(cmd, mach, key)
+	cmd.Reply("Successfully unlocked cross-signing keys")
+	return true
+}
+
+func cmdVerifyAccept(cmd *Command) {
+	verification := cmd.MainView.GetPendingVerificationRequest(cmd.Room.Room.ID)
+	if verification == nil {
+		cmd.Reply("There are no pending verification requests in this room")
+		return
+	}
+	mach := cmd.Matrix.Crypto().(*crypto.OlmMachine)
+	if !unlockCrossSigningKeys(cmd, mach) {
+		cmd.Reply("Cross-signing private keys not cached, the verification will only apply to the other user's device")
+	}
+	// The device of the request is filled in when the request is accepted.
+	modal := NewVerificationModal(cmd.MainView, &crypto.DeviceIdentity{UserID: verification.OtherUser}, inRoomVerificationTimeout)
+	modal.SetCancelFunc(func() {
+		verification.Cancel("Cancelled by user", event.VerificationCancelByUser)
+	})
+	cmd.MainView.ShowModal(modal)
+	err := verification.Accept(modal)
+	if err != nil {
+		cmd.Reply("Failed to accept verification request: %v", err)
+		verification.Cancel("Failed to accept request", event.VerificationCancelUnexpectedMessage)
+	}
+}
+
+func cmdVerifyDecline(cmd *Command) {
+	verification := cmd.MainView.GetPendingVerificationRequest(cmd.Room.Room.ID)
+	if verification == nil {
+		cmd.Reply("There are no pending verification requests in this room")
+		return
+	}
+	verification.Cancel("Declined by user", event.VerificationCancelByUser)
+	cmd.Reply("Declined verification request from %s", verification.OtherUser)
+}
+
 func cmdUnverify(cmd *Command) {
 	device := getDevice(cmd)
 	if device == nil {
@@ -282,12 +410,7 @@ func cmdBlacklist(cmd *Command) {
 		cmd.Reply("That device is already blacklisted")
 		return
 	}
-	action := "blacklisted"
-	if device.Trust == crypto.TrustStateVerified {
-		action = "unverified and blacklisted"
-	}
-	device.Trust = crypto.TrustStateBlacklisted
-	putDevice(cmd, device, action)
+	markDeviceBlacklisted(cmd, device)
 }
 
 func cmdResetSession(cmd *Command) {
@@ -493,6 +616,9 @@ Subcommands:
 * fetch [--save-to-disk]
     Fetch your cross-signing keys from SSSS and decrypt them.
     If --save-to-disk is specified, the keys are saved to disk.
+* request
+    Request your cross-signing keys and key backup key from
+    your other verified devices.
 * upload
     Upload your cross-signing keys to SSSS.`
 
@@ -518,6 +644,8 @@ func cmdCrossSigning(cmd *Command) {
 		cmdCrossSigningUpload(cmd, mach)
 	case "self-sign":
 		cmdCrossSigningSelfSign(cmd, mach)
+	case "request":
+		cmdCrossSigningRequest(cmd)
 	default:
 		cmd.Reply(crossSigningHelp, cmd.OrigCommand)
 	}
@@ -554,12 +682,40 @@ func cmdCrossSigningFetch(cmd *Command, mach *crypto.OlmMachine, saveToDisk bool
 		cmd.Reply("Error fetching cross-signing keys: %v", err)
 		return
 	}
+	fetchMegolmBackupKey(cmd, mach, key)
 	if saveToDisk {
 		cmd.Reply("Saving keys to disk is not yet implemented")
 	}
 	cmd.Reply("Successfully unlocked cross-signing keys")
 }
 
+// fetchMegolmBackupKey fetches the key backup key from SSSS so it can be shared with other devices.
+func fetchMegolmBackupKey(cmd *Command, mach *crypto.OlmMachine, key *ssss.Key) {
+	var encData ssss.EncryptedAccountDataEventContent
+	err := mach.Client.GetAccountData(muksevt.SecretMegolmBackup, &encData)
+	if err != nil {
+		if !errors.Is(err, mautrix.MNotFound) {
+			debug.Printf("Failed to fetch key backup key from SSSS: %v", err)
+		}
+		return
+	}
+	decrypted, err := encData.Decrypt(muksevt.SecretMegolmBackup, key)
+	if err != nil {
+		debug.Printf("Failed to decrypt key backup key from SSSS: %v", err)
+		return
+	}
+	cmd.Matrix.CacheMegolmBackupKey(decrypted)
+}
+
+func cmdCrossSigningRequest(cmd *Command) {
+	err := cmd.Matrix.RequestSecrets(cmd.Reply)
+	if err != nil {
+		cmd.Reply("Failed to request secrets: %v", err)
+	} else {
+		cmd.Reply("Requested cross-signing keys from your other devices. Confirm the request on a verified device.")
+	}
+}
+
 func cmdCrossSigningGenerate(cmd *Command, container ifc.MatrixContainer, mach *crypto.OlmMachine, client *mautrix.Client, force bool) {
 	if !force {
 		existingKeys := mach.GetOwnCrossSigningPublicKeys()
@@ -696,3 +852,150 @@ func cmdCrossSigningSelfSign(cmd *Command, mach *crypto.OlmMachine) {
 		cmd.Reply("Successfully self-signed. This device is now trusted by other devices")
 	}
 }
+
+func cmdEncrypt(cmd *Command) {
+	room := cmd.Room.Room
+	if room.Encrypted {
+		cmd.Reply("This room is already encrypted")
+		return
+	}
+	confirmed := cmd.MainView.AskConfirmation("Enable encryption",
+		"Encryption can't be disabled after it's enabled. Some bots and bridges may not work in encrypted rooms. "+
+			"Enable end-to-end encryption in this room?", "Enable", nil)
+	if !confirmed {
+		cmd.Reply("Cancelled enabling encryption")
+		return
+	}
+	_, err := cmd.Matrix.Client().SendStateEvent(room.ID, event.StateEncryption, "", &event.EncryptionEventContent{
+		Algorithm: id.AlgorithmMegolmV1,
+	})
+	if err != nil {
+		cmd.Reply("Failed to enable encryption: %v", err)
+	} else {
+		cmd.Reply("Enabled encryption in this room")
+	}
+}
+
+const roomCryptoHelp = `Usage: /%s <setting> [value]
+
+Settings (use "default" as the value to remove the override):
+* verified-only <on|off>
+    Only share room keys with verified devices.
+* rotation-period <duration>
+    Rotate the megolm session after the given time, e.g. 24h.
+* rotation-messages <count>
+    Rotate the megolm session after the given number of messages.
+* share-invited <on|off>
+    Share room keys with invited users.
+
+Run with "status" to view the current settings.`
+
+func formatBoolOverride(value *bool, defaultValue bool) string {
+	if value == nil {
+		return fmt.Sprintf("%t (default)", defaultValue)
+	}
+	return strconv.FormatBool(*value)
+}
+
+func cmdRoomCryptoStatus(cmd *Command) {
+	room := cmd.Room.Room
+	overrides := room.EncryptionOverrides
+	encryptionEvent := cmd.Config.Rooms.GetEncryptionEvent(room.ID)
+	rotationPeriod := "1 week (default)"
+	rotationMessages := "100 (default)"
+	if encryptionEvent != nil && encryptionEvent.RotationPeriodMillis != 0 {
+		rotationPeriod = (time.Duration(encryptionEvent.RotationPeriodMillis) * time.Millisecond).String()
+	}
+	if encryptionEvent != nil && encryptionEvent.RotationPeriodMessages != 0 {
+		rotationMessages = strconv.Itoa(encryptionEvent.RotationPeriodMessages)
+	}
+	if overrides.RotationPeriod != 0 {
+		rotationPeriod += " (overridden)"
+	}
+	if overrides.RotationMessages != 0 {
+		rotationMessages += " (overridden)"
+	}
+	cmd.Reply("Encryption settings for this room:\n"+
+		"Send to verified devices only: %s\n"+
+		"Megolm rotation period: %s\n"+
+		"Megolm rotation messages: %s\n"+
+		"Share keys with invited users: %s",
+		formatBoolOverride(overrides.SendToVerifiedOnly, cmd.Config.SendToVerifiedOnly),
+		rotationPeriod, rotationMessages,
+		formatBoolOverride(overrides.ShareWithInvited, true))
+}
+
+func parseBoolOverride(value string) (*bool, bool) {
+	switch strings.ToLower(value) {
+	case "default":
+		return nil, true
+	case "on", "true", "yes", "1":
+		val := true
+		return &val, true
+	case "off", "false", "no", "0":
+		val := false
+		return &val, true
+	default:
+		return nil, false
+	}
+}
+
+func cmdRoomCrypto(cmd *Command) {
+	if len(cmd.Args) == 0 || strings.ToLower(cmd.Args[0]) == "status" {
+		cmdRoomCryptoStatus(cmd)
+		return
+	} else if len(cmd.Args) < 2 {
+		cmd.Reply(roomCryptoHelp, cmd.OrigCommand)
+		return
+	}
+	room := cmd.Room.Room
+	overrides := &room.EncryptionOverrides
+	value := strings.ToLower(cmd.Args[1])
+	switch strings.ToLower(cmd.Args[0]) {
+	case "verified-only":
+		val, ok := parseBoolOverride(value)
+		if !ok {
+			cmd.Reply("Usage: /%s verified-only <on|off|default>", cmd.OrigCommand)
+			return
+		}
+		overrides.SendToVerifiedOnly = val
+	case "share-invited":
+		val, ok := parseBoolOverride(value)
+		if !ok {
+			cmd.Reply("Usage: /%s share-invited <on|off|default>", cmd.OrigCommand)
+			return
+		}
+		overrides.ShareWithInvited = val
+	case "rotation-period":
+		if value == "default" {
+			overrides.RotationPeriod = 0
+		} else if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			cmd.Reply("Usage: /%s rotation-period <duration|default>", cmd.OrigCommand)
+			return
+		} else {
+			overrides.RotationPeriod = duration
+		}
+	case "rotation-messages":
+		if value == "default" {
+			overrides.RotationMessages = 0
+		} else if count, err := strconv.Atoi(value); err != nil || count <= 0 {
+			cmd.Reply("Usage: /%s rotation-messages <count|default>", cmd.OrigCommand)
+			return
+		} else {
+			overrides.RotationMessages = count
+		}
+	default:
+		cmd.Reply(roomCryptoHelp, cmd.OrigCommand)
+		return
+	}
+	err := cmd.Config.Rooms.SaveList()
+	if err != nil {
+		debug.Printf("Failed to save room list after changing encryption overrides: %v", err)
+	}
+	// Make sure the new settings are used for the next message
+	err = cmd.Matrix.Crypto().(*crypto.OlmMachine).CryptoStore.RemoveOutboundGroupSession(room.ID)
+	if err != nil {
+		cmd.Reply("Failed to remove outbound group session: %v", err)
+	}
+	cmdRoomCryptoStatus(cmd)
+}
@@ -0,0 +1,432 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/matrix/rooms"
+	"maunium.net/go/gomuks/ui/messages"
+)
+
+const exportHistoryHelp = `Usage: /export-history <html|jsonl|irssi> <path> [--since date] [--until date] [--media]
+
+Dates can be either YYYY-MM-DD (local time) or RFC 3339 timestamps.
+--media downloads attachments into a directory next to the HTML file.`
+
+const exportBatchSize = 100
+
+type historyExport struct {
+	cmd  *Command
+	room *rooms.Room
+
+	format string
+	path   string
+	since  time.Time
+	until  time.Time
+	media  bool
+
+	modal *SyncingModal
+}
+
+func parseExportDate(val string, endOfDay bool) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", val, time.Local)
+	if err == nil {
+		if endOfDay {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+func autocompleteExportHistory(cmd *CommandAutocomplete) (completions []string, newText string) {
+	if len(cmd.Args) > 1 || (len(cmd.Args) == 1 && strings.HasSuffix(cmd.RawArgs, " ")) {
+		format := cmd.Args[0]
+		fileCmd := *cmd
+		fileCmd.RawArgs = strings.TrimLeft(strings.TrimPrefix(strings.TrimLeft(cmd.RawArgs, " "), format), " ")
+		fileCmd.OrigCommand = fmt.Sprintf("%s %s", cmd.OrigCommand, format)
+		return autocompleteFile(&fileCmd)
+	}
+	for _, format := range []string{"html", "jsonl", "irssi"} {
+		if strings.HasPrefix(format, cmd.RawArgs) {
+			completions = append(completions, format)
+		}
+	}
+	if len(completions) == 1 {
+		newText = fmt.Sprintf("/%s %s ", cmd.OrigCommand, completions[0])
+	}
+	return
+}
+
+func cmdExportHistory(cmd *Command) {
+	if len(cmd.Args) < 2 {
+		cmd.Reply(exportHistoryHelp)
+		return
+	}
+	export := &historyExport{
+		cmd:    cmd,
+		room:   cmd.Room.Room,
+		format: strings.ToLower(cmd.Args[0]),
+	}
+	switch export.format {
+	case "html", "jsonl", "irssi":
+	default:
+		cmd.Reply("Unknown export format %s. Supported formats are html, jsonl and irssi.", export.format)
+		return
+	}
+	var err error
+	export.path, err = filepath.Abs(cmd.Args[1])
+	if err != nil {
+		cmd.Reply("Failed to get absolute path: %v", err)
+		return
+	}
+	args := cmd.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--since", "--until":
+			if i+1 >= len(args) {
+				cmd.Reply(exportHistoryHelp)
+				return
+			}
+			date, err := parseExportDate(args[i+1], args[i] == "--until")
+			if err != nil {
+				cmd.Reply("Invalid date %s: %v", args[i+1], err)
+				return
+			}
+			if args[i] == "--since" {
+				export.since = date
+			} else {
+				export.until = date
+			}
+			i++
+		case "--media":
+			export.media = true
+		default:
+			cmd.Reply(exportHistoryHelp)
+			return
+		}
+	}
+	if export.media && export.format != "html" {
+		cmd.Reply("--media is only supported for HTML exports")
+		return
+	}
+	export.Run()
+}
+
+func (export *historyExport) Run() {
+	export.modal = export.cmd.MainView.OpenProgressModal("Exporting history")
+	export.modal.SetMessage("Fetching history...")
+	export.modal.SetIndeterminate()
+	events, err := export.fetch()
+	if err != nil {
+		export.modal.Close()
+		export.cmd.Reply("Failed to fetch history: %v", err)
+		return
+	}
+	export.modal.SetMessage(fmt.Sprintf("Writing %d events...", len(events)))
+	export.modal.SetSteps(len(events))
+	err = export.write(events)
+	export.modal.Close()
+	if err != nil {
+		export.cmd.Reply("Failed to export history: %v", err)
+		return
+	}
+	export.cmd.Reply("Exported %d events to %s", len(events), export.path)
+}
+
+// fetch loads the history of the room from the local database, backfilling from the server when the local
+// history runs out, and returns the events that match the date filters in chronological order.
+func (export *historyExport) fetch() ([]*muksevt.Event, error) {
+	var events []*muksevt.Event
+	seen := make(map[id.EventID]struct{})
+	var ptr uint64
+	for {
+		batch, newPtr, err := export.cmd.Matrix.GetHistory(export.room, exportBatchSize, ptr)
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		reachedStart := false
+		// Batches are ordered newest first, and GetHistory may return events we've already seen
+		// if it had to backfill from the server.
+		for _, evt := range batch {
+			if _, ok := seen[evt.ID]; ok || evt.Type == muksevt.EventTimelineGap {
+				continue
+			}
+			seen[evt.ID] = struct{}{}
+			added++
+			ts := unixMilliToTime(evt.Timestamp)
+			if !export.since.IsZero() && ts.Before(export.since) {
+				reachedStart = true
+				continue
+			} else if !export.until.IsZero() && !ts.Before(export.until) {
+				continue
+			}
+			events = append(events, evt)
+		}
+		export.modal.SetMessage(fmt.Sprintf("Fetched %d events", len(seen)))
+		if len(batch) == 0 || reachedStart || (added == 0 && newPtr == ptr) {
+			break
+		}
+		ptr = newPtr
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+func unixMilliToTime(ts int64) time.Time {
+	return time.Unix(ts/1000, ts%1000*int64(time.Millisecond))
+}
+
+func (export *historyExport) write(events []*muksevt.Event) error {
+	file, err := os.OpenFile(export.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	switch export.format {
+	case "jsonl":
+		err = export.writeJSONL(writer, events)
+	case "irssi":
+		err = export.writeIrssi(writer, events)
+	case "html":
+		err = export.writeHTML(writer, events)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (export *historyExport) step(i int) {
+	export.modal.Step()
+	if i%exportBatchSize == 0 {
+		export.cmd.UI.Render()
+	}
+}
+
+// parse converts the event into a UI message for the human-readable formats.
+// Edits are skipped, as they're already applied to the original message.
+func (export *historyExport) parse(evt *muksevt.Event) *messages.UIMessage {
+	if relatable, ok := evt.Content.Parsed.(event.Relatable); ok && len(relatable.GetRelatesTo().GetReplaceID()) > 0 {
+		return nil
+	}
+	return messages.ParseEvent(export.cmd.Matrix, export.cmd.MainView, export.room, evt)
+}
+
+// plainTextMessage returns the sender and plaintext content of the message in the form used by text logs.
+// Emotes have a blank sender and the "* name" prefix in the text.
+func plainTextMessage(msg *messages.UIMessage) (sender, text string) {
+	text = msg.PlainText()
+	if msg.Type == event.MsgEmote {
+		text = strings.TrimPrefix(text, fmt.Sprintf("* %s ", msg.SenderName))
+		return "", fmt.Sprintf("* %s %s", msg.SenderName, text)
+	}
+	return msg.Sender(), text
+}
+
+func (export *historyExport) writeJSONL(writer io.Writer, events []*muksevt.Event) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	for i, evt := range events {
+		if err := encoder.Encode(evt.Event); err != nil {
+			return err
+		}
+		export.step(i)
+	}
+	return nil
+}
+
+func (export *historyExport) writeIrssi(writer io.Writer, events []*muksevt.Event) error {
+	_, err := fmt.Fprintf(writer, "--- Log opened %s\n", time.Now().Format("Mon Jan 02 15:04:05 2006"))
+	if err != nil {
+		return err
+	}
+	var prevDate string
+	for i, evt := range events {
+		export.step(i)
+		msg := export.parse(evt)
+		if msg == nil {
+			continue
+		}
+		if date := msg.Timestamp.Format("Mon Jan 02 2006"); date != prevDate {
+			if len(prevDate) > 0 {
+				_, err = fmt.Fprintf(writer, "--- Day changed %s\n", date)
+				if err != nil {
+					return err
+				}
+			}
+			prevDate = date
+		}
+		sender, text := plainTextMessage(msg)
+		var prefix string
+		if evt.StateKey != nil {
+			prefix = "-!-"
+		} else if len(sender) == 0 {
+			prefix = ""
+		} else {
+			prefix = fmt.Sprintf("<%s>", sender)
+		}
+		for _, line := range strings.Split(text, "\n") {
+			_, err = fmt.Fprintf(writer, "%s %s %s\n", msg.FormatTime(), prefix, line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fmt.Fprintf(writer, "--- Log closed %s\n", time.Now().Format("Mon Jan 02 15:04:05 2006"))
+	return err
+}
+
+const exportHTMLHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%[1]s</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 0 auto; padding: 1em; background: #fff; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0; }
+.meta { color: #888; font-size: .9em; }
+.day { text-align: center; color: #888; margin: 1em 0 .5em; border-bottom: 1px solid #ddd; }
+.message { display: flex; gap: .5em; padding: .1em 0; }
+.time { color: #888; flex: none; }
+.sender { font-weight: bold; flex: none; }
+.body { white-space: pre-wrap; word-break: break-word; }
+.state .body, .redacted .body { color: #888; font-style: italic; }
+blockquote { margin: 0 0 .2em; padding-left: .5em; border-left: 2px solid #ccc; color: #666; }
+img { max-width: 100%%; max-height: 20em; display: block; }
+</style>
+</head>
+<body>
+<h1>%[1]s</h1>
+<p class="meta">%[2]s &middot; exported from gomuks on %[3]s</p>
+`
+
+func htmlColor(msg *messages.UIMessage) string {
+	if hex := msg.SenderColor().Hex(); hex >= 0 {
+		return fmt.Sprintf("#%06x", hex)
+	}
+	return "inherit"
+}
+
+func (export *historyExport) mediaDir() string {
+	return strings.TrimSuffix(export.path, filepath.Ext(export.path)) + "_files"
+}
+
+// downloadMedia downloads the attachment of the given message next to the export and returns the relative link to it.
+func (export *historyExport) downloadMedia(index int, file *messages.FileMessage) (string, error) {
+	name := filepath.Base(file.Body)
+	if name == "." || name == "/" {
+		name = file.URL.FileID
+	}
+	name = fmt.Sprintf("%d-%s", index, name)
+	_, err := export.cmd.Matrix.DownloadToDisk(file.URL, file.File, filepath.Join(export.mediaDir(), name))
+	if err != nil {
+		return "", err
+	}
+	link := url.URL{Path: filepath.Base(export.mediaDir()) + "/" + name}
+	return link.String(), nil
+}
+
+func (export *historyExport) htmlBody(index int, msg *messages.UIMessage) string {
+	file, isFile := msg.Renderer.(*messages.FileMessage)
+	if !isFile || file.URL.IsEmpty() {
+		_, text := plainTextMessage(msg)
+		return html.EscapeString(text)
+	}
+	link := export.cmd.Matrix.GetDownloadURL(file.URL)
+	if export.media {
+		var err error
+		link, err = export.downloadMedia(index, file)
+		if err != nil {
+			return html.EscapeString(fmt.Sprintf("%s (failed to download: %v)", file.Body, err))
+		}
+	}
+	if file.Type == event.MsgImage && export.media {
+		return fmt.Sprintf(`<a href="%[1]s"><img src="%[1]s" alt="%[2]s"></a>`, html.EscapeString(link), html.EscapeString(file.Body))
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(file.Body))
+}
+
+func (export *historyExport) writeHTML(writer io.Writer, events []*muksevt.Event) error {
+	name := export.room.GetTitle()
+	_, err := fmt.Fprintf(writer, exportHTMLHeader, html.EscapeString(name), html.EscapeString(string(export.room.ID)),
+		html.EscapeString(time.Now().Format("2006-01-02 15:04")))
+	if err != nil {
+		return err
+	}
+	var prevDate string
+	for i, evt := range events {
+		export.step(i)
+		msg := export.parse(evt)
+		if msg == nil {
+			continue
+		}
+		if date := msg.FormatDate(); date != prevDate {
+			_, err = fmt.Fprintf(writer, "<div class=\"day\">%s</div>\n", html.EscapeString(date))
+			if err != nil {
+				return err
+			}
+			prevDate = date
+		}
+		class := "message"
+		if evt.StateKey != nil {
+			class += " state"
+		} else if evt.Unsigned.RedactedBecause != nil {
+			class += " redacted"
+		}
+		sender, _ := plainTextMessage(msg)
+		var reply string
+		if msg.ReplyTo != nil {
+			replySender, replyText := plainTextMessage(msg.ReplyTo)
+			if len(replySender) > 0 {
+				replyText = fmt.Sprintf("%s: %s", replySender, replyText)
+			}
+			reply = fmt.Sprintf("<blockquote>%s</blockquote>", html.EscapeString(replyText))
+		}
+		_, err = fmt.Fprintf(writer, `<div class="%s" id="%s"><span class="time" title="%s">%s</span> `+
+			`<span class="sender" style="color: %s">%s</span> <div class="body">%s%s</div></div>`+"\n",
+			class, html.EscapeString(string(evt.ID)), html.EscapeString(msg.Timestamp.Format(time.RFC1123)),
+			msg.FormatTime(), htmlColor(msg), html.EscapeString(sender), reply, export.htmlBody(i, msg))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(writer, "</body>\n</html>\n")
+	return err
+}
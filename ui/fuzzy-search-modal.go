@@ -47,6 +47,8 @@ type FuzzySearchModal struct {
 	roomList   []*rooms.Room
 	roomTitles []string
 
+	onSelect func(room *rooms.Room)
+
 	parent *MainView
 }
 
@@ -82,6 +84,18 @@ func NewFuzzySearchModal(mainView *MainView, width int, height int) *FuzzySearch
 	return fs
 }
 
+// NewRoomPickerModal creates a fuzzy room search modal that passes the chosen room to onSelect instead of switching to it.
+func NewRoomPickerModal(mainView *MainView, width, height int, title, query string, onSelect func(room *rooms.Room)) *FuzzySearchModal {
+	fs := NewFuzzySearchModal(mainView, width, height)
+	fs.container.SetTitle(title)
+	fs.onSelect = onSelect
+	if len(query) > 0 {
+		fs.search.SetTextAndMoveCursor(query)
+		fs.changeHandler(query)
+	}
+	return fs
+}
+
 func (fs *FuzzySearchModal) Focus() {
 	fs.container.Focus()
 }
@@ -153,8 +167,13 @@ func (fs *FuzzySearchModal) OnKeyEvent(event mauview.KeyEvent) bool {
 	case "confirm":
 		// Switch room to currently selected room
 		if len(highlights) > 0 {
-			debug.Print("Fuzzy Selected Room:", fs.roomList[fs.matches[fs.selected].OriginalIndex].GetTitle())
-			fs.parent.SwitchRoom(fs.roomList[fs.matches[fs.selected].OriginalIndex].Tags()[0].Tag, fs.roomList[fs.matches[fs.selected].OriginalIndex])
+			room := fs.roomList[fs.matches[fs.selected].OriginalIndex]
+			debug.Print("Fuzzy Selected Room:", room.GetTitle())
+			if fs.onSelect != nil {
+				fs.onSelect(room)
+			} else {
+				fs.parent.SwitchRoom(room.Tags()[0].Tag, room)
+			}
 		}
 		fs.parent.HideModal()
 		fs.results.Clear()
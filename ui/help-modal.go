@@ -11,9 +11,14 @@ const helpText = `# General
 /help           - Show this help dialog.
 /quit           - Quit gomuks.
 /clearcache     - Clear cache and quit gomuks.
+/history-db <stats|prune|compact>
+                - Inspect, prune or compact the local history database.
 /logout         - Log out of Matrix.
 /toggle <thing> - Temporary command to toggle various UI features.
                   Run /toggle without arguments to see the list of toggles.
+/run <hook> [args...]
+                - Run an executable from the hooks directory. Actions it
+                  prints as JSON lines are executed, other output is shown.
 
 # Media
 /download [path] - Downloads file from selected message.
@@ -29,6 +34,20 @@ const helpText = `# General
 /react <reaction>    - React to the selected message.
 /redact [reason]     - Redact the selected message.
 /edit                - Edit the selected message.
+/quote               - Quote the selected message in the input.
+/forward [room]      - Forward the selected message to another room.
+/schedule <time> <message>
+                     - Send a message later. The time can be relative
+                       (+1h30m, +2d), a time of day (09:00) or a date
+                       and time (2006-01-02T15:04).
+/scheduled           - List, edit and cancel scheduled messages.
+
+# History
+/jump [event ID|link] - Jump to an event, or to the message that
+                        the selected message replies to.
+/live                 - Return to the latest messages after jumping.
+/permalink [register] - Copy a link to the selected message to the
+                        clipboard or primary selection.
 
 # Encryption
 /fingerprint - View the fingerprint of your device.
@@ -37,11 +56,19 @@ const helpText = `# General
 /device <user id> <device id>    - Show info about a specific device.
 /unverify <user id> <device id>  - Un-verify a device.
 /blacklist <user id> <device id> - Blacklist a device.
-/verify <user id> - Verify a user with in-room verification. Probably broken.
+/verify <user id> [--force]
+    - Verify a user with in-room verification in the current room.
+/verify <accept|decline>
+    - Accept or decline a verification request in the current room.
 /verify-device <user id> <device id> [fingerprint]
     - Verify a device. If the fingerprint is not provided,
       interactive emoji verification will be started.
 /reset-session - Reset the outbound Megolm session in the current room.
+/security      - Review unverified devices of verified users.
+/encrypt       - Enable encryption in the current room.
+/room-crypto <setting> [value]
+    - Local encryption settings for the current room.
+      Run without arguments to view the current settings.
 
 /import <file> - Import encryption keys
 /export <file> - Export encryption keys
@@ -68,6 +95,9 @@ const helpText = `# General
 /untag <tag>          - Remove the room from <tag>.
 /tags                 - List the tags the room is in.
 /alias <act> <name>   - Add or remove local addresses.
+/export-history <html|jsonl|irssi> <path> [--since date] [--until date] [--media]
+    - Export the history of the current room.
+/chatlog [on|off|default] - Control the chat log of the current room.
 
 /leave                     - Leave the current room.
 /kick   <user id> [reason] - Kick a user.
@@ -83,7 +113,7 @@ func NewHelpModal(parent *MainView) *HelpModal {
 	hm := &HelpModal{parent: parent}
 
 	text := mauview.NewTextView().
-		SetText(helpText).
+		SetText(helpText + aliasHelpText(parent.config.CommandAliases)).
 		SetScrollable(true).
 		SetWrap(false).
 		SetTextColor(tcell.ColorDefault)
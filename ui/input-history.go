@@ -0,0 +1,163 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"strings"
+
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/config"
+)
+
+// inputHistorySearch is the state of an incremental reverse search through the global input history.
+type inputHistorySearch struct {
+	query        string
+	index        int
+	originalText string
+}
+
+// addToInputHistory stores a submitted line. Like in most shells, lines starting with a space aren't stored.
+func (view *RoomView) addToInputHistory(text string) {
+	view.historyIndex = -1
+	if strings.HasPrefix(text, " ") {
+		return
+	}
+	view.config.InputHistory.Add(view.Room.ID, text)
+	view.config.SaveInputHistory()
+}
+
+func (view *RoomView) setInputFromHistory(text string) {
+	view.input.SetText(text)
+	view.input.SetCursorOffset(-1)
+}
+
+// HistoryPrevious replaces the input with the previous submitted line in this room.
+func (view *RoomView) HistoryPrevious() {
+	history := view.config.InputHistory.Rooms[view.Room.ID]
+	if view.historyIndex+1 >= len(history) {
+		return
+	} else if view.historyIndex < 0 {
+		view.historyStash = view.input.GetText()
+	}
+	view.historyIndex++
+	view.setInputFromHistory(history[len(history)-1-view.historyIndex])
+}
+
+// HistoryNext replaces the input with the next submitted line in this room,
+// or the text that was in the input before browsing the history.
+func (view *RoomView) HistoryNext() {
+	if view.historyIndex < 0 {
+		return
+	}
+	view.historyIndex--
+	if view.historyIndex < 0 {
+		view.setInputFromHistory(view.historyStash)
+		view.historyStash = ""
+		return
+	}
+	history := view.config.InputHistory.Rooms[view.Room.ID]
+	view.setInputFromHistory(history[len(history)-1-view.historyIndex])
+}
+
+// StartHistorySearch starts an incremental reverse search through the input history of all rooms.
+func (view *RoomView) StartHistorySearch() {
+	view.historySearch = &inputHistorySearch{
+		index:        -1,
+		originalText: view.input.GetText(),
+	}
+	view.status.SetText(view.GetStatus())
+}
+
+func (view *RoomView) findInHistory(from int) int {
+	history := view.config.InputHistory.Global
+	if from >= len(history) {
+		from = len(history) - 1
+	}
+	for i := from; i >= 0; i-- {
+		if strings.Contains(history[i], view.historySearch.query) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (view *RoomView) updateHistorySearch(from int) {
+	search := view.historySearch
+	if len(search.query) == 0 {
+		search.index = -1
+		view.setInputFromHistory(search.originalText)
+	} else if index := view.findInHistory(from); index >= 0 {
+		search.index = index
+		view.setInputFromHistory(view.config.InputHistory.Global[index])
+	} else if from == len(view.config.InputHistory.Global)-1 {
+		search.index = -1
+	}
+	view.status.SetText(view.GetStatus())
+}
+
+func (view *RoomView) stopHistorySearch(restore bool) {
+	if restore {
+		view.setInputFromHistory(view.historySearch.originalText)
+	}
+	view.historySearch = nil
+	view.status.SetText(view.GetStatus())
+}
+
+func (view *RoomView) onHistorySearchKeyEvent(event mauview.KeyEvent) bool {
+	search := view.historySearch
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	newest := len(view.config.InputHistory.Global) - 1
+	if view.config.Keybindings.Room[kb] == "search_history" {
+		if search.index > 0 {
+			view.updateHistorySearch(search.index - 1)
+		}
+		return true
+	}
+	switch event.Key() {
+	case tcell.KeyEscape:
+		view.stopHistorySearch(true)
+	case tcell.KeyEnter:
+		view.stopHistorySearch(false)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(search.query) > 0 {
+			runes := []rune(search.query)
+			search.query = string(runes[:len(runes)-1])
+			view.updateHistorySearch(newest)
+		}
+	case tcell.KeyRune:
+		if event.Modifiers()&(tcell.ModCtrl|tcell.ModAlt) != 0 {
+			view.stopHistorySearch(false)
+			return view.OnKeyEvent(event)
+		}
+		search.query += string(event.Rune())
+		from := newest
+		if search.index >= 0 {
+			from = search.index
+		}
+		view.updateHistorySearch(from)
+	default:
+		view.stopHistorySearch(false)
+		return view.OnKeyEvent(event)
+	}
+	return true
+}
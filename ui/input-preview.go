@@ -0,0 +1,159 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kyokomi/emoji/v2"
+
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+
+	"maunium.net/go/gomuks/matrix/muksevt"
+	"maunium.net/go/gomuks/ui/messages"
+	"maunium.net/go/gomuks/ui/widget"
+)
+
+const MaxPreviewHeight = 8
+
+// inputPreview caches the rendered preview of the input so it's only re-rendered when the text or width changes.
+type inputPreview struct {
+	text    string
+	editing *muksevt.Event
+	width   int
+	message *messages.UIMessage
+}
+
+// renderPreviewContent renders the input text into message content the same way it would be when sent.
+// Nil is returned if the input doesn't produce formatted output.
+func (view *RoomView) renderPreviewContent(text string) *event.MessageEventContent {
+	msgtype := event.MsgText
+	var htmlBody string
+	if cmd := view.parent.cmdProcessor.ParseCommand(view, text); cmd != nil {
+		if alias, ok := view.parent.cmdProcessor.aliases[cmd.Command]; ok {
+			cmd = alias.Process(cmd)
+		}
+		text = strings.Join(cmd.Args, " ")
+		switch cmd.Command {
+		case "me":
+			msgtype = event.MsgEmote
+		case "notice":
+			msgtype = event.MsgNotice
+		case "rainbow":
+			text, htmlBody = renderRainbow(text)
+		case "rainbowme":
+			msgtype = event.MsgEmote
+			text, htmlBody = renderRainbow(text)
+		case "rainbownotice":
+			msgtype = event.MsgNotice
+			text, htmlBody = renderRainbow(text)
+		default:
+			return nil
+		}
+	}
+	if !view.config.Preferences.DisableEmojis {
+		text = emoji.Sprint(text)
+	}
+	var content event.MessageEventContent
+	if len(htmlBody) > 0 {
+		content = event.MessageEventContent{
+			FormattedBody: htmlBody,
+			Format:        event.FormatHTML,
+			Body:          text,
+		}
+	} else {
+		content = format.RenderMarkdown(text, !view.config.Preferences.DisableMarkdown, !view.config.Preferences.DisableHTML)
+	}
+	if len(content.FormattedBody) == 0 {
+		return nil
+	}
+	content.MsgType = msgtype
+	return &content
+}
+
+func (view *RoomView) renderPreview(text string, width int) *messages.UIMessage {
+	content := view.renderPreviewContent(text)
+	if content == nil {
+		return nil
+	}
+	userID := view.parent.matrix.Client().UserID
+	evt := muksevt.Wrap(&event.Event{
+		Sender:    userID,
+		Type:      event.EventMessage,
+		Timestamp: time.Now().UnixNano() / 1e6,
+		RoomID:    view.Room.ID,
+		Content:   event.Content{Parsed: content},
+	})
+	displayname := string(userID)
+	if member := view.Room.GetMember(userID); member != nil {
+		displayname = member.Displayname
+	}
+	msg := messages.ParseMessage(view.parent.matrix, view.Room, evt, displayname)
+	if msg != nil {
+		msg.CalculateBuffer(view.config.Preferences, width)
+	}
+	return msg
+}
+
+// PreviewHeight returns the height of the markdown preview pane, or zero if there's nothing to preview.
+func (view *RoomView) PreviewHeight(width int) int {
+	text := view.input.GetText()
+	if !view.config.Preferences.ShowInputPreview || len(text) == 0 {
+		return 0
+	}
+	preview := &view.preview
+	if preview.text != text || preview.editing != view.editing {
+		preview.text = text
+		preview.editing = view.editing
+		preview.width = width
+		preview.message = view.renderPreview(text, width)
+	} else if preview.width != width && preview.message != nil {
+		preview.width = width
+		preview.message.CalculateBuffer(view.config.Preferences, width)
+	}
+	if preview.message == nil {
+		return 0
+	}
+	height := preview.message.Height() + 1
+	if height > MaxPreviewHeight {
+		height = MaxPreviewHeight
+	}
+	return height
+}
+
+func (view *RoomView) drawPreview(screen mauview.Screen) {
+	if view.preview.message == nil {
+		return
+	}
+	width, height := screen.Size()
+	title := "Preview"
+	if view.editing != nil {
+		title = "Preview of edit"
+	}
+	widget.WriteLineSimpleColor(screen, title, 0, 0, tcell.ColorGray)
+	view.preview.message.Draw(mauview.NewProxyScreen(screen, 0, 1, width, height-1))
+}
+
+func (view *RoomView) TogglePreview() {
+	view.config.Preferences.ShowInputPreview = !view.config.Preferences.ShowInputPreview
+	go view.parent.matrix.SendPreferencesToMatrix()
+}
@@ -29,12 +29,14 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/widget"
 )
 
 type MemberList struct {
-	list roomMemberList
+	list      roomMemberList
+	roomTrust ifc.UserTrust
 }
 
 func NewMemberList() *MemberList {
@@ -47,6 +49,7 @@ type memberListItem struct {
 	Sigil      rune
 	UserID     id.UserID
 	Color      tcell.Color
+	Trust      ifc.UserTrust
 }
 
 type roomMemberList []*memberListItem
@@ -66,8 +69,12 @@ func (rml roomMemberList) Swap(i, j int) {
 	rml[i], rml[j] = rml[j], rml[i]
 }
 
-func (ml *MemberList) Update(data map[id.UserID]*rooms.Member, levels *event.PowerLevelsEventContent) *MemberList {
+// Update replaces the list contents with the given members.
+//
+// If getTrust is not nil, it's used to find the cross-signing trust state of each joined member.
+func (ml *MemberList) Update(data map[id.UserID]*rooms.Member, levels *event.PowerLevelsEventContent, getTrust func(id.UserID) ifc.UserTrust) *MemberList {
 	ml.list = make(roomMemberList, len(data))
+	ml.roomTrust = ifc.UserTrustUnknown
 	i := 0
 	highestLevel := math.MinInt32
 	count := 0
@@ -93,12 +100,18 @@ func (ml *MemberList) Update(data map[id.UserID]*rooms.Member, levels *event.Pow
 		} else if level > levels.UsersDefault {
 			sigil = '+'
 		}
+		trust := ifc.UserTrustUnknown
+		if getTrust != nil && member.Membership == event.MembershipJoin {
+			trust = getTrust(userID)
+			ml.updateRoomTrust(trust)
+		}
 		ml.list[i] = &memberListItem{
 			Member:     *member,
 			UserID:     userID,
 			PowerLevel: level,
 			Sigil:      sigil,
 			Color:      widget.GetHashColor(userID),
+			Trust:      trust,
 		}
 		i++
 	}
@@ -106,23 +119,51 @@ func (ml *MemberList) Update(data map[id.UserID]*rooms.Member, levels *event.Pow
 	return ml
 }
 
+// updateRoomTrust folds the trust state of a single member into the overall room trust state.
+//
+// A room is verified if all members are verified. If any verified member has unverified devices,
+// the whole room is marked as such, since that's the case that most likely needs attention.
+func (ml *MemberList) updateRoomTrust(trust ifc.UserTrust) {
+	switch {
+	case trust == ifc.UserTrustUnknown:
+	case ml.roomTrust == ifc.UserTrustUnknown:
+		ml.roomTrust = trust
+	case trust == ifc.UserTrustUnverifiedDevices, ml.roomTrust == ifc.UserTrustUnverifiedDevices:
+		ml.roomTrust = ifc.UserTrustUnverifiedDevices
+	case trust == ifc.UserTrustUnverified:
+		ml.roomTrust = ifc.UserTrustUnverified
+	}
+}
+
+// RoomTrust returns the overall cross-signing trust state of the members in the list.
+func (ml *MemberList) RoomTrust() ifc.UserTrust {
+	return ml.roomTrust
+}
+
 func (ml *MemberList) Draw(screen mauview.Screen) {
 	width, _ := screen.Size()
 	sigilStyle := tcell.StyleDefault.Background(tcell.ColorGreen).Foreground(tcell.ColorDefault)
+	nameX := 1
+	if ml.roomTrust != ifc.UserTrustUnknown {
+		nameX = 2
+	}
 	for y, member := range ml.list {
 		if member.Sigil != ' ' {
 			screen.SetCell(0, y, sigilStyle, member.Sigil)
 		}
+		if marker, color := widget.GetTrustMarker(member.Trust); marker != 0 {
+			screen.SetCell(1, y, tcell.StyleDefault.Foreground(color), marker)
+		}
 		if member.Membership == "invite" {
-			widget.WriteLineSimpleColor(screen, member.Displayname, 2, y, member.Color)
-			screen.SetCell(1, y, tcell.StyleDefault, '(')
-			if sw := runewidth.StringWidth(member.Displayname); sw+2 < width {
-				screen.SetCell(sw+2, y, tcell.StyleDefault, ')')
+			widget.WriteLineSimpleColor(screen, member.Displayname, nameX+1, y, member.Color)
+			screen.SetCell(nameX, y, tcell.StyleDefault, '(')
+			if sw := runewidth.StringWidth(member.Displayname); sw+nameX+1 < width {
+				screen.SetCell(sw+nameX+1, y, tcell.StyleDefault, ')')
 			} else {
 				screen.SetCell(width-1, y, tcell.StyleDefault, ')')
 			}
 		} else {
-			widget.WriteLineSimpleColor(screen, member.Displayname, 1, y, member.Color)
+			widget.WriteLineSimpleColor(screen, member.Displayname, nameX, y, member.Color)
 		}
 	}
 }
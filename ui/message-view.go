@@ -52,6 +52,10 @@ type MessageView struct {
 	// Used for locking
 	loadingMessages int32
 	historyLoadPtr  uint64
+	fillingGap      int32
+	// detached is set when the view shows a window of the timeline fetched around an older event
+	// instead of the live timeline. It's protected by messagesLock.
+	detached *detachedWindow
 
 	_widestSender     uint32
 	_prevWidestSender uint32
@@ -98,6 +102,60 @@ func NewMessageView(parent *RoomView) *MessageView {
 	}
 }
 
+// detachedWindow contains the pagination tokens of a timeline window that isn't connected to the live timeline.
+type detachedWindow struct {
+	start        string
+	end          string
+	reachedStart bool
+}
+
+// IsDetached returns whether or not the view is showing a detached window of older history.
+func (view *MessageView) IsDetached() bool {
+	return view.getDetached() != nil
+}
+
+func (view *MessageView) getDetached() *detachedWindow {
+	view.messagesLock.RLock()
+	defer view.messagesLock.RUnlock()
+	return view.detached
+}
+
+// setDetached replaces the contents of the view with the given messages, which are in chronological order.
+func (view *MessageView) setDetached(msgs []*messages.UIMessage, start, end string) {
+	view.Unload()
+	view.messagesLock.Lock()
+	view.initialHistoryLoaded = true
+	view.detached = &detachedWindow{start: start, end: end}
+	view.messagesLock.Unlock()
+	for _, msg := range msgs {
+		view.AddMessage(msg, AppendMessage)
+	}
+}
+
+// ScrollToMessage scrolls the view so that the given message is in the middle of the screen if possible.
+func (view *MessageView) ScrollToMessage(target *messages.UIMessage) {
+	view.messagesLock.RLock()
+	offset := 0
+	found := false
+	for i := len(view.messages) - 1; i >= 0; i-- {
+		if view.messages[i] == target {
+			found = true
+			break
+		}
+		offset += view.messages[i].Height()
+	}
+	view.messagesLock.RUnlock()
+	if !found {
+		return
+	}
+	offset -= (view.Height() - target.Height()) / 2
+	if offset < 0 {
+		offset = 0
+	}
+	view.ScrollOffset = 0
+	view.AddScrollOffset(offset)
+}
+
 func (view *MessageView) Unload() {
 	debug.Print("Unloading message view", view.parent.Room.ID)
 	view.messagesLock.Lock()
@@ -111,6 +169,7 @@ func (view *MessageView) Unload() {
 	view._widestSender = 5
 	view.prevMsgCount = -1
 	view.historyLoadPtr = 0
+	view.detached = nil
 	view.messagesLock.Unlock()
 	view.msgBufferLock.Unlock()
 	view.messageIDLock.Unlock()
@@ -161,9 +220,7 @@ func (view *MessageView) AddMessage(ifcMessage ifc.Message, direction MessageDir
 	bare := view.config.Preferences.BareMessageView
 	if !bare {
 		width -= view.widestSender() + SenderMessageGap
-		if !view.config.Preferences.HideTimestamp {
-			width -= view.TimestampWidth + TimestampSenderGap
-		}
+		width -= view.senderX()
 	}
 	message.CalculateBuffer(view.config.Preferences, width)
 
@@ -205,6 +262,78 @@ func (view *MessageView) AddMessage(ifcMessage ifc.Message, direction MessageDir
 	if len(message.ID()) > 0 {
 		view.setMessageID(message)
 	}
+	if message.IsTimelineGap() {
+		view.fillVisibleGaps()
+	}
+}
+
+// replaceGap replaces a timeline gap with the given messages, which are in chronological order.
+// The date change lines around the gap are recalculated.
+func (view *MessageView) replaceGap(gap *messages.UIMessage, newMessages []*messages.UIMessage) {
+	width := view.width()
+	if !view.config.Preferences.BareMessageView {
+		width -= view.widestSender() + SenderMessageGap
+		width -= view.senderX()
+	}
+	view.messagesLock.Lock()
+	index := -1
+	for i, msg := range view.messages {
+		if msg == gap {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		view.messagesLock.Unlock()
+		return
+	}
+	start, end := index, index+1
+	if start > 0 && view.messages[start-1].Type == messages.MsgDateChange {
+		start--
+	}
+	if end < len(view.messages) && view.messages[end].Type == messages.MsgDateChange {
+		end++
+	}
+	var prev *messages.UIMessage
+	for i := start - 1; i >= 0 && prev == nil; i-- {
+		if !view.messages[i].IsService || view.messages[i].IsTimelineGap() {
+			prev = view.messages[i]
+		}
+	}
+	replacement := make([]*messages.UIMessage, 0, len(newMessages)*2+1)
+	addWithDateChange := func(msg *messages.UIMessage) {
+		if prev != nil && !prev.SameDate(msg) {
+			dateChange := messages.NewDateChangeMessage(fmt.Sprintf("Date changed to %s", msg.FormatDate()))
+			dateChange.CalculateBuffer(view.config.Preferences, width)
+			replacement = append(replacement, dateChange)
+		}
+		replacement = append(replacement, msg)
+		prev = msg
+	}
+	for _, msg := range newMessages {
+		if len(msg.ID()) > 0 && view.getMessageByID(msg.ID()) != nil {
+			continue
+		}
+		view.updateWidestSender(msg.Sender())
+		msg.CalculateBuffer(view.config.Preferences, width)
+		addWithDateChange(msg)
+		view.setMessageID(msg)
+	}
+	if end < len(view.messages) {
+		next := view.messages[end]
+		if prev != nil && !prev.SameDate(next) {
+			dateChange := messages.NewDateChangeMessage(fmt.Sprintf("Date changed to %s", next.FormatDate()))
+			dateChange.CalculateBuffer(view.config.Preferences, width)
+			replacement = append(replacement, dateChange)
+		}
+	}
+	view.messages = append(view.messages[:start], append(replacement, view.messages[end:]...)...)
+	view.messagesLock.Unlock()
+	view.deleteMessageID(gap.ID())
+	// Force the line buffer to be rebuilt, the number of messages might not have changed.
+	view.msgBufferLock.Lock()
+	view.prevMsgCount = -1
+	view.msgBufferLock.Unlock()
 }
 
 func (view *MessageView) replaceMessage(original *messages.UIMessage, new *messages.UIMessage) {
@@ -327,9 +456,7 @@ func (view *MessageView) recalculateBuffers() {
 		width := view.width()
 		if !prefs.BareMessageView {
 			width -= view.widestSender() + SenderMessageGap
-			if !prefs.HideTimestamp {
-				width -= view.TimestampWidth + TimestampSenderGap
-			}
+			width -= view.senderX()
 		}
 		view.msgBuffer = []*messages.UIMessage{}
 		view.prevMsgCount = 0
@@ -365,6 +492,13 @@ func (view *MessageView) SetSelected(message *messages.UIMessage) {
 }
 
 func (view *MessageView) handleMessageClick(message *messages.UIMessage, mod tcell.ModMask) bool {
+	if gap, ok := message.Renderer.(*messages.TimelineGapMessage); ok {
+		if gap.State() == messages.TimelineGapFailed {
+			gap.SetState(messages.TimelineGapIdle)
+		}
+		go view.parent.parent.FillTimelineGap(view.parent.Room.ID, message)
+		return true
+	}
 	if msg, ok := message.Renderer.(*messages.FileMessage); ok && mod > 0 && !msg.Thumbnail.IsEmpty() {
 		debug.Print("Opening thumbnail", msg.ThumbnailPath())
 		open.Open(msg.ThumbnailPath())
@@ -423,6 +557,9 @@ func (view *MessageView) OnMouseEvent(event mauview.MouseEvent) bool {
 			return true
 		}
 	case tcell.WheelDown:
+		if view.ScrollOffset == 0 && view.IsDetached() {
+			go view.parent.parent.LoadDetachedFuture(view.parent.Room.ID)
+		}
 		view.AddScrollOffset(-WheelScrollOffsetDiff)
 		view.parent.parent.MarkRead(view.parent)
 		return true
@@ -439,15 +576,24 @@ func (view *MessageView) OnMouseEvent(event mauview.MouseEvent) bool {
 		if y != 0 && line > 0 {
 			prevMessage = view.msgBuffer[line-1]
 		}
+		lineInMessage := 0
+		for i := line - 1; i >= 0 && view.msgBuffer[i] == message; i-- {
+			lineInMessage++
+		}
 		view.msgBufferLock.RUnlock()
 
-		usernameX := 0
-		if !view.config.Preferences.HideTimestamp {
-			usernameX += view.TimestampWidth + TimestampSenderGap
-		}
+		usernameX := view.senderX()
 		messageX := usernameX + view.widestSender() + SenderMessageGap
 
-		if x >= messageX {
+		if x >= messageX && message.ReplyTo != nil && lineInMessage <= message.ReplyTo.Height() {
+			// Clicking the reply quote jumps to the message that was replied to.
+			go view.parent.JumpToReplyTarget(message)
+			return false
+		} else if x >= messageX {
+			if uri := message.MatrixLinkAt(x-messageX, lineInMessage); uri != nil {
+				go view.parent.parent.OpenMatrixURI(uri)
+				return false
+			}
 			return view.handleMessageClick(message, event.Modifiers())
 		} else if x >= usernameX {
 			return view.handleUsernameClick(message, prevMessage)
@@ -473,11 +619,34 @@ func (view *MessageView) AddScrollOffset(diff int) {
 	if view.ScrollOffset < 0 {
 		view.ScrollOffset = 0
 	}
+	view.fillVisibleGaps()
 }
 
 func (view *MessageView) setSize(width, height int) {
 	atomic.StoreUint32(&view._width, uint32(width))
-	atomic.StoreUint32(&view._height, uint32(height))
+	if atomic.SwapUint32(&view._height, uint32(height)) != uint32(height) {
+		view.fillVisibleGaps()
+	}
+}
+
+// fillVisibleGaps starts loading the timeline gaps that are currently scrolled into view.
+func (view *MessageView) fillVisibleGaps() {
+	bottom := view.ScrollOffset
+	top := bottom + view.Height()
+	var gaps []*messages.UIMessage
+	view.messagesLock.RLock()
+	offset := 0
+	for i := len(view.messages) - 1; i >= 0 && offset < top; i-- {
+		msg := view.messages[i]
+		offset += msg.Height()
+		if gap, ok := msg.Renderer.(*messages.TimelineGapMessage); ok && offset > bottom && gap.State() == messages.TimelineGapIdle {
+			gaps = append(gaps, msg)
+		}
+	}
+	view.messagesLock.RUnlock()
+	for _, gap := range gaps {
+		go view.parent.parent.FillTimelineGap(view.parent.Room.ID, gap)
+	}
 }
 
 func (view *MessageView) updatePrevSize() {
@@ -498,6 +667,17 @@ func (view *MessageView) prevWidestSender() int {
 	return int(atomic.LoadUint32(&view._prevWidestSender))
 }
 
+// senderX returns the x position of the sender column. If timestamps are hidden in an encrypted room,
+// one column is reserved for the trust marker.
+func (view *MessageView) senderX() int {
+	if !view.config.Preferences.HideTimestamp {
+		return view.TimestampWidth + TimestampSenderGap
+	} else if view.parent.Room.Encrypted && !view.config.Preferences.BareMessageView {
+		return 1
+	}
+	return 0
+}
+
 func (view *MessageView) widestSender() int {
 	return int(atomic.LoadUint32(&view._widestSender))
 }
@@ -600,6 +780,33 @@ func (view *MessageView) CapturePlaintext(height int) string {
 	return buf.String()
 }
 
+func (view *MessageView) drawSenderTrust(screen mauview.Screen, msg *messages.UIMessage, usernameX, line int) {
+	sender := msg.Sender()
+	if len(sender) == 0 || len(msg.SenderID) == 0 || msg.IsService || msg.Type == "m.room.member" {
+		return
+	}
+	marker, color := widget.GetTrustMarker(msg.SenderTrust)
+	if marker == 0 {
+		return
+	}
+	x := usernameX + view.widestSender() - runewidth.StringWidth(sender) - 1
+	if x < usernameX-1 {
+		x = usernameX - 1
+	}
+	screen.SetCell(x, line, tcell.StyleDefault.Foreground(color), marker)
+}
+
+// updateSenderTrust refreshes the cached sender trust of all messages, e.g. after device lists change.
+func (view *MessageView) updateSenderTrust(getTrust func(id.UserID) ifc.UserTrust) {
+	view.messagesLock.RLock()
+	for _, msg := range view.messages {
+		if len(msg.SenderID) > 0 {
+			msg.SenderTrust = getTrust(msg.SenderID)
+		}
+	}
+	view.messagesLock.RUnlock()
+}
+
 func (view *MessageView) Draw(screen mauview.Screen) {
 	view.setSize(screen.Size())
 	view.recalculateBuffers()
@@ -610,10 +817,7 @@ func (view *MessageView) Draw(screen mauview.Screen) {
 		return
 	}
 
-	usernameX := 0
-	if !view.config.Preferences.HideTimestamp {
-		usernameX += view.TimestampWidth + TimestampSenderGap
-	}
+	usernameX := view.senderX()
 	messageX := usernameX + view.widestSender() + SenderMessageGap
 
 	bareMode := view.config.Preferences.BareMessageView
@@ -665,6 +869,9 @@ func (view *MessageView) Draw(screen mauview.Screen) {
 			usernameX, line, view.widestSender(),
 			msg.SenderColor())
 		//}
+		if view.parent.Room.Encrypted && !bareMode {
+			view.drawSenderTrust(screen, msg, usernameX, line)
+		}
 		if msg.Edited {
 			// TODO add better indicator for edits
 			screen.SetCell(usernameX+view.widestSender(), line, tcell.StyleDefault.Foreground(tcell.ColorDarkRed), '*')
@@ -28,6 +28,7 @@ import (
 	"go.mau.fi/tcell"
 
 	"maunium.net/go/gomuks/config"
+	ifc "maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix/muksevt"
 
 	"maunium.net/go/gomuks/ui/widget"
@@ -76,6 +77,7 @@ type UIMessage struct {
 	DefaultSenderColor tcell.Color
 	Timestamp          time.Time
 	State              muksevt.OutgoingState
+	SenderTrust        ifc.UserTrust
 	IsHighlight        bool
 	IsService          bool
 	IsSelected         bool
@@ -377,6 +379,17 @@ func (msg *UIMessage) DrawReply(screen mauview.Screen) mauview.Screen {
 	return mauview.NewProxyScreen(screen, 0, replyHeight+1, width, height-replyHeight-1)
 }
 
+// MatrixLinkAt returns the matrix link at the given position relative to the top left corner of the message.
+func (msg *UIMessage) MatrixLinkAt(x, y int) *id.MatrixURI {
+	if msg.ReplyTo != nil {
+		y -= msg.ReplyTo.Height() + 1
+	}
+	if htmlMsg, ok := msg.Renderer.(*HTMLMessage); ok {
+		return htmlMsg.MatrixLinkAt(x, y)
+	}
+	return nil
+}
+
 func (msg *UIMessage) String() string {
 	return fmt.Sprintf(`&messages.UIMessage{
     ID="%s", TxnID="%s",
@@ -23,6 +23,8 @@ import (
 	"go.mau.fi/mauview"
 	"go.mau.fi/tcell"
 
+	"maunium.net/go/mautrix/event"
+
 	"maunium.net/go/gomuks/matrix/muksevt"
 
 	"maunium.net/go/gomuks/config"
@@ -53,6 +55,9 @@ func NewServiceMessage(text string) *UIMessage {
 	}
 }
 
+// MsgDateChange is the type of the date change lines between messages.
+const MsgDateChange event.MessageType = "net.maunium.gomuks.date_change"
+
 func NewDateChangeMessage(text string) *UIMessage {
 	midnight := time.Now()
 	midnight = time.Date(midnight.Year(), midnight.Month(), midnight.Day(),
@@ -62,6 +67,7 @@ func NewDateChangeMessage(text string) *UIMessage {
 		SenderID:   "*",
 		SenderName: "*",
 		Timestamp:  midnight,
+		Type:       MsgDateChange,
 		IsService:  true,
 		Renderer: &ExpandedTextMessage{
 			Text: tstring.NewColorTString(text, tcell.ColorGreen),
@@ -0,0 +1,106 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"sync/atomic"
+
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/matrix/muksevt"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/ui/widget"
+)
+
+// TimelineGapState is the loading state of a timeline gap.
+type TimelineGapState int32
+
+const (
+	TimelineGapIdle TimelineGapState = iota
+	TimelineGapLoading
+	TimelineGapFailed
+)
+
+// TimelineGapMessage is the line shown in place of events that were skipped by a sync.
+type TimelineGapMessage struct {
+	// state is loaded and stored atomically, as it's changed by the goroutine filling the gap while the UI draws it.
+	state int32
+}
+
+func NewTimelineGapMessage(evt *muksevt.Event) *UIMessage {
+	return &UIMessage{
+		EventID:    evt.ID,
+		SenderID:   "*",
+		SenderName: "*",
+		Timestamp:  unixToTime(evt.Timestamp),
+		IsService:  true,
+		Event:      evt,
+		Renderer:   &TimelineGapMessage{},
+	}
+}
+
+// IsTimelineGap returns whether or not the message is a placeholder for missing events.
+func (msg *UIMessage) IsTimelineGap() bool {
+	_, ok := msg.Renderer.(*TimelineGapMessage)
+	return ok
+}
+
+// State returns the current loading state of the gap.
+func (msg *TimelineGapMessage) State() TimelineGapState {
+	return TimelineGapState(atomic.LoadInt32(&msg.state))
+}
+
+// SetState changes the loading state of the gap.
+func (msg *TimelineGapMessage) SetState(state TimelineGapState) {
+	atomic.StoreInt32(&msg.state, int32(state))
+}
+
+func (msg *TimelineGapMessage) Clone() MessageRenderer {
+	return &TimelineGapMessage{state: int32(msg.State())}
+}
+
+func (msg *TimelineGapMessage) NotificationContent() string {
+	return ""
+}
+
+func (msg *TimelineGapMessage) PlainText() string {
+	return "[missing messages]"
+}
+
+func (msg *TimelineGapMessage) String() string {
+	return "&messages.TimelineGapMessage{}"
+}
+
+func (msg *TimelineGapMessage) CalculateBuffer(prefs config.UserPreferences, width int, uiMsg *UIMessage) {
+}
+
+func (msg *TimelineGapMessage) Height() int {
+	return 1
+}
+
+func (msg *TimelineGapMessage) Draw(screen mauview.Screen, _ *UIMessage) {
+	switch msg.State() {
+	case TimelineGapLoading:
+		widget.WriteLineSimpleColor(screen, "Loading missing messages...", 0, 0, tcell.ColorGreen)
+	case TimelineGapFailed:
+		widget.WriteLineSimpleColor(screen, "Failed to load missing messages. Click here to retry.", 0, 0, tcell.ColorRed)
+	default:
+		widget.WriteLineSimpleColor(screen, "Some messages are missing here. Click or scroll here to load them.", 0, 0, tcell.ColorGreen)
+	}
+}
@@ -32,6 +32,10 @@ type ContainerEntity struct {
 	Indent int
 }
 
+func (ce *ContainerEntity) getChildren() []Entity {
+	return ce.Children
+}
+
 func (ce *ContainerEntity) IsEmpty() bool {
 	return len(ce.Children) == 0
 }
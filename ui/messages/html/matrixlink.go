@@ -0,0 +1,80 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package html
+
+import (
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// MatrixLinkEntity is a matrix.to link or a matrix: URI. Instead of letting the terminal open them in a browser,
+// the cells of the link are marked with a link ID without an URL, and clicks are handled by gomuks.
+type MatrixLinkEntity struct {
+	*ContainerEntity
+	URI    *id.MatrixURI
+	LinkID string
+}
+
+func NewMatrixLinkEntity(uri *id.MatrixURI, linkID string, children []Entity) *MatrixLinkEntity {
+	entity := &MatrixLinkEntity{
+		ContainerEntity: &ContainerEntity{
+			BaseEntity: &BaseEntity{Tag: "a"},
+			Children:   children,
+		},
+		URI:    uri,
+		LinkID: linkID,
+	}
+	entity.AdjustStyle(func(style tcell.Style) tcell.Style {
+		return style.UrlId(linkID)
+	}, AdjustStyleReasonNormal)
+	return entity
+}
+
+func (le *MatrixLinkEntity) AdjustStyle(fn AdjustStyleFunc, reason AdjustStyleReason) Entity {
+	le.ContainerEntity.AdjustStyle(fn, reason)
+	return le
+}
+
+func (le *MatrixLinkEntity) Clone() Entity {
+	return &MatrixLinkEntity{
+		ContainerEntity: le.ContainerEntity.Clone().(*ContainerEntity),
+		URI:             le.URI,
+		LinkID:          le.LinkID,
+	}
+}
+
+// MatchesStyle returns whether or not a cell drawn with the given style is a part of this link.
+func (le *MatrixLinkEntity) MatchesStyle(style tcell.Style) bool {
+	return style.UrlId(le.LinkID) == style
+}
+
+// FindMatrixLinks returns all matrix links in the given entity and its children.
+func FindMatrixLinks(entity Entity) (links []*MatrixLinkEntity) {
+	switch typed := entity.(type) {
+	case *MatrixLinkEntity:
+		links = append(links, typed)
+		for _, child := range typed.Children {
+			links = append(links, FindMatrixLinks(child)...)
+		}
+	case interface{ getChildren() []Entity }:
+		for _, child := range typed.getChildren() {
+			links = append(links, FindMatrixLinks(child)...)
+		}
+	}
+	return
+}
@@ -19,6 +19,7 @@ package html
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -223,17 +224,22 @@ func (parser *htmlParser) linkToEntity(node *html.Node) Entity {
 	}
 
 	matrixURI, _ := id.ParseMatrixURIOrMatrixToURL(href)
-	if matrixURI != nil && (matrixURI.Sigil1 == '@' || matrixURI.Sigil1 == '#') && matrixURI.Sigil2 == 0 {
-		text := NewTextEntity(matrixURI.PrimaryIdentifier())
-		if matrixURI.Sigil1 == '@' {
-			if member := parser.room.GetMember(matrixURI.UserID()); member != nil {
-				text.Text = member.Displayname
-				text.Style = text.Style.Foreground(widget.GetHashColor(matrixURI.UserID()))
+	if matrixURI != nil {
+		if (matrixURI.Sigil1 == '@' || matrixURI.Sigil1 == '#') && matrixURI.Sigil2 == 0 {
+			text := NewTextEntity(matrixURI.PrimaryIdentifier())
+			if matrixURI.Sigil1 == '@' {
+				if member := parser.room.GetMember(matrixURI.UserID()); member != nil {
+					text.Text = member.Displayname
+					text.Style = text.Style.Foreground(widget.GetHashColor(matrixURI.UserID()))
+				}
 			}
 			entity.Children = []Entity{text}
-		} else if matrixURI.Sigil1 == '#' {
-			entity.Children = []Entity{text}
+		} else {
+			entity.AdjustStyle(AdjustStyleUnderline, AdjustStyleReasonNormal)
 		}
+		linkID := fmt.Sprintf("%s-%d", parser.evt.ID, parser.linkIDCounter)
+		parser.linkIDCounter++
+		return NewMatrixLinkEntity(matrixURI, linkID, entity.Children)
 	} else if parser.prefs.EnableInlineURLs() {
 		linkID := fmt.Sprintf("%s-%d", parser.evt.ID, parser.linkIDCounter)
 		parser.linkIDCounter++
@@ -412,14 +418,23 @@ func textToHTMLEntities(text string) []Entity {
 	return entities
 }
 
+var matrixURIPattern, _ = xurls.StrictMatchingScheme("matrix:")
+
+func findLinks(text string) [][]int {
+	indices := append(xurls.Strict().FindAllStringIndex(text, -1), matrixURIPattern.FindAllStringIndex(text, -1)...)
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i][0] < indices[j][0]
+	})
+	return indices
+}
+
+// TextToEntity converts plain text into an entity. Matrix links are always made clickable,
+// other links only if linkify is true.
 func TextToEntity(text string, eventID id.EventID, linkify bool) Entity {
 	if len(text) == 0 {
 		return nil
 	}
-	if !linkify {
-		return textToHTMLEntity(text)
-	}
-	indices := xurls.Strict().FindAllStringIndex(text, -1)
+	indices := findLinks(text)
 	if len(indices) == 0 {
 		return textToHTMLEntity(text)
 	}
@@ -429,15 +444,25 @@ func TextToEntity(text string, eventID id.EventID, linkify bool) Entity {
 	var lastEnd int
 	for i, item := range indices {
 		start, end := item[0], item[1]
+		link := text[start:end]
+		linkID := fmt.Sprintf("%s-%d", eventID, i)
+		var linkEntity Entity
+		if matrixURI, _ := id.ParseMatrixURIOrMatrixToURL(link); matrixURI != nil {
+			linkEntity = NewMatrixLinkEntity(matrixURI, linkID, []Entity{NewTextEntity(link).AdjustStyle(AdjustStyleUnderline, AdjustStyleReasonNormal)})
+		} else if linkify {
+			linkEntity = NewTextEntity(link).AdjustStyle(AdjustStyleLink(link, linkID), AdjustStyleReasonNormal)
+		} else {
+			continue
+		}
 		if start > lastEnd {
 			ent.Children = append(ent.Children, textToHTMLEntities(text[lastEnd:start])...)
 		}
-		link := text[start:end]
-		linkID := fmt.Sprintf("%s-%d", eventID, i)
-		ent.Children = append(ent.Children, NewTextEntity(link).AdjustStyle(AdjustStyleLink(link, linkID), AdjustStyleReasonNormal))
+		ent.Children = append(ent.Children, linkEntity)
 		lastEnd = end
 	}
-	if lastEnd < len(text) {
+	if lastEnd == 0 {
+		return textToHTMLEntity(text)
+	} else if lastEnd < len(text) {
 		ent.Children = append(ent.Children, textToHTMLEntities(text[lastEnd:])...)
 	}
 	return ent
@@ -20,6 +20,8 @@ import (
 	"go.mau.fi/mauview"
 	"go.mau.fi/tcell"
 
+	"maunium.net/go/mautrix/id"
+
 	"maunium.net/go/gomuks/matrix/muksevt"
 
 	"maunium.net/go/gomuks/config"
@@ -29,6 +31,8 @@ import (
 type HTMLMessage struct {
 	Root      html.Entity
 	TextColor tcell.Color
+
+	width int
 }
 
 func NewHTMLMessage(evt *muksevt.Event, displayname string, root html.Entity) *UIMessage {
@@ -76,12 +80,72 @@ func (hw *HTMLMessage) CalculateBuffer(preferences config.UserPreferences, width
 	// TODO account for bare messages in initial startX
 	startX := 0
 	hw.TextColor = msg.TextColor()
+	hw.width = width
 	hw.Root.CalculateBuffer(width, startX, html.DrawContext{
 		IsSelected:   msg.IsSelected,
 		BareMessages: preferences.BareMessageView,
 	})
 }
 
+// MatrixLinkAt returns the matrix link drawn at the given position in the message, or nil if there's no link there.
+func (hw *HTMLMessage) MatrixLinkAt(x, y int) *id.MatrixURI {
+	links := html.FindMatrixLinks(hw.Root)
+	if len(links) == 0 || x < 0 || y < 0 || x >= hw.width || y >= hw.Height() {
+		return nil
+	}
+	probe := &styleProbe{width: hw.width, height: hw.Height(), x: x, y: y}
+	hw.Root.Draw(probe, html.DrawContext{})
+	if !probe.found {
+		return nil
+	}
+	for _, link := range links {
+		if link.MatchesStyle(probe.style) {
+			return link.URI
+		}
+	}
+	return nil
+}
+
+// styleProbe is a fake screen that only remembers the style drawn at a single position.
+type styleProbe struct {
+	width, height int
+	x, y          int
+	style         tcell.Style
+	found         bool
+}
+
+func (sp *styleProbe) SetContent(x, y int, _ rune, _ []rune, style tcell.Style) {
+	if x == sp.x && y == sp.y {
+		sp.style = style
+		sp.found = true
+	}
+}
+
+func (sp *styleProbe) SetCell(x, y int, style tcell.Style, _ ...rune) {
+	sp.SetContent(x, y, 0, nil, style)
+}
+
+func (sp *styleProbe) GetContent(x, y int) (rune, []rune, tcell.Style, int) {
+	if x == sp.x && y == sp.y {
+		return ' ', nil, sp.style, 1
+	}
+	return ' ', nil, tcell.StyleDefault, 1
+}
+
+func (sp *styleProbe) Clear() {
+	sp.found = false
+}
+
+func (sp *styleProbe) Size() (int, int)           { return sp.width, sp.height }
+func (sp *styleProbe) Fill(rune, tcell.Style)     {}
+func (sp *styleProbe) SetStyle(tcell.Style)       {}
+func (sp *styleProbe) ShowCursor(int, int)        {}
+func (sp *styleProbe) HideCursor()                {}
+func (sp *styleProbe) Colors() int                { return 256 }
+func (sp *styleProbe) CharacterSet() string       { return "UTF-8" }
+func (sp *styleProbe) CanDisplay(rune, bool) bool { return true }
+func (sp *styleProbe) HasKey(tcell.Key) bool      { return false }
+
 func (hw *HTMLMessage) Height() int {
 	return hw.Root.Height()
 }
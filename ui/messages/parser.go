@@ -50,6 +50,9 @@ func ParseEvent(matrix ifc.MatrixContainer, mainView ifc.MainView, room *rooms.R
 	if msg == nil {
 		return nil
 	}
+	if room.Encrypted && len(msg.SenderID) > 0 {
+		msg.SenderTrust = matrix.UserTrust(msg.SenderID)
+	}
 	if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok && len(content.GetReplyTo()) > 0 {
 		if replyToMsg := getCachedEvent(mainView, room.ID, content.GetReplyTo()); replyToMsg != nil {
 			msg.ReplyTo = replyToMsg.Clone()
@@ -86,6 +89,8 @@ func directParseEvent(matrix ifc.MatrixContainer, room *rooms.Room, evt *muksevt
 		return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString(content.Reason, tcell.StyleDefault.Italic(true)))
 	case *muksevt.EncryptionUnsupportedContent:
 		return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString("gomuks not built with encryption support", tcell.StyleDefault.Italic(true)))
+	case *muksevt.TimelineGapContent:
+		return NewTimelineGapMessage(evt)
 	case *event.TopicEventContent, *event.RoomNameEventContent, *event.CanonicalAliasEventContent:
 		return ParseStateEvent(evt, displayname)
 	case *event.MemberEventContent:
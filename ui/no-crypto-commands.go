@@ -18,6 +18,14 @@
 
 package ui
 
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+type InRoomVerification struct{}
+
+func (view *MainView) HandleInRoomVerification(evt *event.Event) {}
+
 func autocompleteDevice(cmd *CommandAutocomplete) ([]string, string) {
 	return []string{}, ""
 }
@@ -43,4 +51,7 @@ var (
 	cmdExportRoomKeys = cmdNoCrypto
 	cmdSSSS           = cmdNoCrypto
 	cmdCrossSigning   = cmdNoCrypto
+	cmdSecurity       = cmdNoCrypto
+	cmdEncrypt        = cmdNoCrypto
+	cmdRoomCrypto     = cmdNoCrypto
 )
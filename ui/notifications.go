@@ -0,0 +1,139 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kyokomi/emoji/v2"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/lib/notification"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+func (view *MainView) sendNotification(room *rooms.Room, senderID id.UserID, message ifc.Message, critical, sound bool) {
+	sender := message.NotificationSenderName()
+	text := message.NotificationContent()
+	if room.GetTitle() != sender {
+		sender = fmt.Sprintf("%s (%s)", sender, room.GetTitle())
+	}
+	debug.Printf("Sending notification with body \"%s\" from %s in room ID %s (critical=%v, sound=%v)", text, sender, room.ID, critical, sound)
+	err := notification.SendNotification(&notification.Notification{
+		Title:    sender,
+		Text:     text,
+		Critical: critical,
+		Sound:    sound,
+		Tag:      string(room.ID),
+		Context:  string(message.ID()),
+		Icon:     view.notificationIcon(room, senderID),
+		Actions:  true,
+	})
+	if err != nil {
+		debug.Print("Failed to send notification:", err)
+	}
+}
+
+const notificationIconSize = 96
+
+// notificationIcon returns the path to the cached avatar thumbnail of the room, or of the sender if the room
+// doesn't have an avatar. If the thumbnail isn't cached yet, it's fetched in the background for later notifications,
+// so that notifications are never delayed by downloads.
+func (view *MainView) notificationIcon(room *rooms.Room, senderID id.UserID) string {
+	if !notification.SupportsIcons() {
+		return ""
+	}
+	var uri id.ContentURI
+	if evt := room.GetStateEvent(event.StateRoomAvatar, ""); evt != nil {
+		uri = evt.Content.AsRoomAvatar().URL
+	}
+	if uri.IsEmpty() && len(senderID) > 0 {
+		if member := room.GetMember(senderID); member != nil {
+			uri = member.AvatarURL.ParseOrIgnore()
+		}
+	}
+	if uri.IsEmpty() {
+		return ""
+	}
+	path := view.matrix.GetThumbnailCachePath(uri, notificationIconSize, notificationIconSize)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return path
+	}
+	go func() {
+		defer debug.Recover()
+		_, err := view.matrix.DownloadThumbnail(uri, notificationIconSize, notificationIconSize)
+		if err != nil {
+			debug.Printf("Failed to download notification icon %s: %v", uri, err)
+		}
+	}()
+	return ""
+}
+
+func (view *MainView) OnNotificationOpen(notif *notification.Notification) {
+	defer debug.Recover()
+	room := view.matrix.GetRoom(id.RoomID(notif.Tag))
+	if room == nil {
+		return
+	}
+	view.SwitchRoom("", room)
+	view.parent.Render()
+}
+
+func (view *MainView) OnNotificationMarkRead(notif *notification.Notification) {
+	defer debug.Recover()
+	room := view.matrix.GetRoom(id.RoomID(notif.Tag))
+	if room == nil {
+		return
+	}
+	eventID := id.EventID(notif.Context)
+	if room.MarkRead(eventID) {
+		view.matrix.MarkRead(room.ID, eventID)
+	}
+	view.parent.Render()
+}
+
+func (view *MainView) OnNotificationReply(notif *notification.Notification, text string) {
+	defer debug.Recover()
+	room := view.matrix.GetRoom(id.RoomID(notif.Tag))
+	if room == nil {
+		return
+	}
+	if !view.config.Preferences.DisableEmojis {
+		text = emoji.Sprint(text)
+	}
+	var rel *ifc.Relation
+	if evt, err := view.matrix.GetEvent(room, id.EventID(notif.Context)); err == nil && evt != nil {
+		rel = &ifc.Relation{Type: event.RelReply, Event: evt}
+	}
+	// The reply is sent directly instead of through the room view to avoid clearing a reply or edit the user has
+	// in progress in the input field. The message will show up in the room view when it comes back from sync.
+	evt := view.matrix.PrepareMarkdownMessage(room.ID, event.MsgText, text, "", rel)
+	_, err := view.matrix.SendEvent(evt)
+	if err != nil {
+		view.reportError(fmt.Sprintf("Failed to send reply from notification: %v", err))
+		return
+	}
+	if room.MarkRead(id.EventID(notif.Context)) {
+		view.matrix.MarkRead(room.ID, id.EventID(notif.Context))
+	}
+	view.parent.Render()
+}
@@ -60,6 +60,7 @@ type RoomView struct {
 	topicScreen    *mauview.ProxyScreen
 	contentScreen  *mauview.ProxyScreen
 	statusScreen   *mauview.ProxyScreen
+	previewScreen  *mauview.ProxyScreen
 	inputScreen    *mauview.ProxyScreen
 	ulBorderScreen *mauview.ProxyScreen
 	ulScreen       *mauview.ProxyScreen
@@ -82,6 +83,18 @@ type RoomView struct {
 	editing      *muksevt.Event
 	editMoveText string
 
+	restoringDraft bool
+
+	historyIndex  int
+	historyStash  string
+	historySearch *inputHistorySearch
+
+	vi viMode
+
+	preview inputPreview
+
+	pendingAlias *Command
+
 	completions struct {
 		list      []string
 		textCache string
@@ -101,12 +114,15 @@ func NewRoomView(parent *MainView, room *rooms.Room) *RoomView {
 		topicScreen:    &mauview.ProxyScreen{OffsetX: 0, OffsetY: 0, Height: TopicBarHeight},
 		contentScreen:  &mauview.ProxyScreen{OffsetX: 0, OffsetY: StatusBarHeight},
 		statusScreen:   &mauview.ProxyScreen{OffsetX: 0, Height: StatusBarHeight},
+		previewScreen:  &mauview.ProxyScreen{OffsetX: 0},
 		inputScreen:    &mauview.ProxyScreen{OffsetX: 0},
 		ulBorderScreen: &mauview.ProxyScreen{OffsetY: StatusBarHeight, Width: UserListBorderWidth},
 		ulScreen:       &mauview.ProxyScreen{OffsetY: StatusBarHeight, Width: UserListWidth},
 
 		parent: parent,
 		config: parent.config,
+
+		historyIndex: -1,
 	}
 	view.content = NewMessageView(view)
 	view.Room.SetPreUnload(func() bool {
@@ -137,9 +153,67 @@ func NewRoomView(parent *MainView, room *rooms.Room) *RoomView {
 
 	view.status.SetBackgroundColor(tcell.ColorDimGray)
 
+	if draft := parent.matrix.GetDraft(room.ID); draft != nil {
+		view.RestoreDraft(draft)
+	}
+
 	return view
 }
 
+// Draft returns the current unsent input and reply or edit context, or nil if there's nothing to save.
+func (view *RoomView) Draft() *config.Draft {
+	draft := &config.Draft{
+		Text:   view.input.GetText(),
+		Cursor: view.input.GetCursorOffset(),
+	}
+	if view.editing != nil {
+		draft.EditOf = view.editing.ID
+		draft.TextBeforeEdit = view.editMoveText
+	} else if view.replying != nil {
+		draft.ReplyTo = view.replying.ID
+	}
+	if draft.IsEmpty() {
+		return nil
+	}
+	return draft
+}
+
+// RestoreDraft replaces the input and reply or edit context with the given draft.
+// The events being replied to or edited are fetched in the background.
+func (view *RoomView) RestoreDraft(draft *config.Draft) {
+	view.restoringDraft = true
+	view.replying = nil
+	view.editing = nil
+	view.editMoveText = draft.TextBeforeEdit
+	view.input.SetText(draft.Text)
+	view.input.SetCursorOffset(draft.Cursor)
+	view.restoringDraft = false
+	if len(draft.ReplyTo) > 0 || len(draft.EditOf) > 0 {
+		go view.restoreDraftContext(draft.ReplyTo, draft.EditOf)
+	}
+	view.status.SetText(view.GetStatus())
+}
+
+func (view *RoomView) restoreDraftContext(replyTo, editOf id.EventID) {
+	defer debug.Recover()
+	eventID := replyTo
+	if len(editOf) > 0 {
+		eventID = editOf
+	}
+	evt, err := view.parent.matrix.GetEvent(view.Room, eventID)
+	if err != nil {
+		debug.Printf("Failed to get %s to restore draft in %s: %v", eventID, view.Room.ID, err)
+		return
+	}
+	if len(editOf) > 0 {
+		view.editing = evt
+	} else {
+		view.replying = evt
+	}
+	view.status.SetText(view.GetStatus())
+	view.parent.parent.Render()
+}
+
 func (view *RoomView) SetInputChangedFunc(fn func(room *RoomView, text string)) *RoomView {
 	view.input.SetChangedFunc(func(text string) {
 		fn(view, text)
@@ -213,16 +287,48 @@ func (view *RoomView) OnSelect(message *messages.UIMessage) {
 		}
 	case SelectCopy:
 		go view.CopyToClipboard(message.Renderer.PlainText(), view.selectContent)
+	case SelectJump:
+		go view.JumpToReplyTarget(message)
+	case SelectPermalink:
+		if len(message.EventID) == 0 || message.EventID[0] != '$' {
+			view.AddServiceMessage("That message hasn't been sent yet")
+		} else {
+			go view.CopyToClipboard(view.Permalink(message.EventID), view.selectContent)
+		}
+	case SelectQuote:
+		view.Quote(message)
+	case SelectForward:
+		view.Forward(message.Event, view.selectContent)
+	case SelectRunAlias:
+		// The alias steps select the message again, so they must run after the selection is cleared below.
+		defer view.runPendingAlias(message)
 	}
 	view.selecting = false
 	view.selectContent = ""
 	view.MessageView().SetSelected(nil)
 	view.input.Focus()
+	view.parent.queueDraftSave(view)
 }
 
 func (view *RoomView) GetStatus() string {
 	var buf strings.Builder
 
+	if view.config.Preferences.ViMode {
+		buf.WriteString(view.vi.Status())
+		buf.WriteString(" - ")
+	}
+	if view.historySearch != nil {
+		buf.WriteString("Searching input history for \"")
+		buf.WriteString(view.historySearch.query)
+		buf.WriteString("\"")
+		if len(view.historySearch.query) > 0 && view.historySearch.index < 0 {
+			buf.WriteString(" (no match)")
+		}
+		buf.WriteString(" - ")
+	}
+	if view.content.IsDetached() {
+		buf.WriteString("Viewing older messages, use /live to return - ")
+	}
 	if view.editing != nil {
 		buf.WriteString("Editing message - ")
 	} else if view.replying != nil {
@@ -285,6 +391,7 @@ func (view *RoomView) Draw(screen mauview.Screen) {
 		view.topicScreen.Parent = screen
 		view.contentScreen.Parent = screen
 		view.statusScreen.Parent = screen
+		view.previewScreen.Parent = screen
 		view.inputScreen.Parent = screen
 		view.ulBorderScreen.Parent = screen
 		view.ulScreen.Parent = screen
@@ -299,6 +406,11 @@ func (view *RoomView) Draw(screen mauview.Screen) {
 		inputHeight = 1
 	}
 	contentHeight := height - inputHeight - TopicBarHeight - StatusBarHeight
+	previewHeight := view.PreviewHeight(width)
+	if contentHeight-previewHeight < MaxPreviewHeight {
+		previewHeight = 0
+	}
+	contentHeight -= previewHeight
 	contentWidth := width - StaticHorizontalSpace
 	if view.config.Preferences.HideUserList {
 		contentWidth = width
@@ -307,7 +419,10 @@ func (view *RoomView) Draw(screen mauview.Screen) {
 	view.topicScreen.Width = width
 	view.contentScreen.Width = contentWidth
 	view.contentScreen.Height = contentHeight
-	view.statusScreen.OffsetY = view.contentScreen.YEnd()
+	view.previewScreen.OffsetY = view.contentScreen.YEnd()
+	view.previewScreen.Width = width
+	view.previewScreen.Height = previewHeight
+	view.statusScreen.OffsetY = view.previewScreen.YEnd()
 	view.statusScreen.Width = width
 	view.inputScreen.Width = width
 	view.inputScreen.OffsetY = view.statusScreen.YEnd()
@@ -319,7 +434,11 @@ func (view *RoomView) Draw(screen mauview.Screen) {
 
 	// Draw everything
 	view.topic.Draw(view.topicScreen)
+	view.drawRoomShield(view.topicScreen)
 	view.content.Draw(view.contentScreen)
+	if previewHeight > 0 {
+		view.drawPreview(view.previewScreen)
+	}
 	view.status.SetText(view.GetStatus())
 	view.status.Draw(view.statusScreen)
 	view.input.Draw(view.inputScreen)
@@ -329,6 +448,15 @@ func (view *RoomView) Draw(screen mauview.Screen) {
 	}
 }
 
+func (view *RoomView) drawRoomShield(screen mauview.Screen) {
+	marker, color := widget.GetTrustMarker(view.userList.RoomTrust())
+	if marker == 0 {
+		return
+	}
+	width, _ := screen.Size()
+	screen.SetCell(width-2, 0, tcell.StyleDefault.Foreground(color).Background(tcell.ColorDarkGreen), marker)
+}
+
 func (view *RoomView) ClearAllContext() {
 	view.SetEditing(nil)
 	view.StopSelecting()
@@ -344,6 +472,10 @@ func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 		Mod: event.Modifiers(),
 	}
 
+	if view.historySearch != nil {
+		return view.onHistorySearchKeyEvent(event)
+	}
+
 	if view.selecting {
 		switch view.config.Keybindings.Visual[kb] {
 		case "clear":
@@ -354,12 +486,20 @@ func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 			view.SelectNext()
 		case "confirm":
 			view.OnSelect(msgView.selected)
+		case "forward":
+			view.selectReason = SelectForward
+			view.selectContent = ""
+			view.OnSelect(msgView.selected)
 		default:
 			return false
 		}
 		return true
 	}
 
+	if view.config.Preferences.ViMode && view.onViKeyEvent(event, kb) {
+		return true
+	}
+
 	switch view.config.Keybindings.Room[kb] {
 	case "clear":
 		view.ClearAllContext()
@@ -371,11 +511,26 @@ func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 		msgView.AddScrollOffset(+msgView.Height() / 2)
 		return true
 	case "scroll_down":
+		if msgView.ScrollOffset == 0 && msgView.IsDetached() {
+			go view.parent.LoadDetachedFuture(view.Room.ID)
+		}
 		msgView.AddScrollOffset(-msgView.Height() / 2)
 		return true
 	case "send":
 		view.InputSubmit(view.input.GetText())
 		return true
+	case "history_prev":
+		view.HistoryPrevious()
+		return true
+	case "history_next":
+		view.HistoryNext()
+		return true
+	case "search_history":
+		view.StartHistorySearch()
+		return true
+	case "toggle_preview":
+		view.TogglePreview()
+		return true
 	}
 	return view.input.OnKeyEvent(event)
 }
@@ -697,7 +852,9 @@ func (view *RoomView) InputTabComplete(text string, cursorOffset int) {
 func (view *RoomView) InputSubmit(text string) {
 	if len(text) == 0 {
 		return
-	} else if cmd := view.parent.cmdProcessor.ParseCommand(view, text); cmd != nil {
+	}
+	view.addToInputHistory(text)
+	if cmd := view.parent.cmdProcessor.ParseCommand(view, text); cmd != nil {
 		go view.parent.cmdProcessor.HandleCommand(cmd)
 	} else {
 		go view.SendMessage(event.MsgText, text)
@@ -706,6 +863,106 @@ func (view *RoomView) InputSubmit(text string) {
 	view.SetInputText("")
 }
 
+func (view *RoomView) JumpToReplyTarget(message *messages.UIMessage) {
+	defer debug.Recover()
+	content, ok := message.Event.Content.Parsed.(*event.MessageEventContent)
+	if !ok || len(content.GetReplyTo()) == 0 {
+		view.AddServiceMessage("That message isn't a reply")
+		view.parent.parent.Render()
+		return
+	}
+	err := view.parent.JumpToEvent(view.Room.ID, content.GetReplyTo())
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to jump to %s: %v", content.GetReplyTo(), err))
+		view.parent.parent.Render()
+	}
+}
+
+// Permalink returns a matrix.to link to the given event in this room.
+func (view *RoomView) Permalink(eventID id.EventID) string {
+	uri := &id.MatrixURI{
+		Sigil1: '!',
+		MXID1:  string(view.Room.ID)[1:],
+		Sigil2: '$',
+		MXID2:  string(eventID)[1:],
+		Via:    view.Room.GetViaServers(),
+	}
+	return uri.MatrixToURL()
+}
+
+// Forward sends a copy of the given event to another room. The target can be a room ID or alias,
+// otherwise it's used as the initial query of a room picker.
+func (view *RoomView) Forward(evt *muksevt.Event, target string) {
+	if strings.HasPrefix(target, "!") || strings.HasPrefix(target, "#") {
+		go view.forwardToRoomIdentifier(evt, target)
+		return
+	}
+	picker := NewRoomPickerModal(view.parent, 42, 12, "Forward to", target, func(room *rooms.Room) {
+		go view.forwardTo(evt, room)
+	})
+	view.parent.ShowModal(picker)
+}
+
+func (view *RoomView) forwardToRoomIdentifier(evt *muksevt.Event, target string) {
+	defer debug.Recover()
+	roomID := id.RoomID(target)
+	if target[0] == '#' {
+		resp, err := view.parent.matrix.Client().ResolveAlias(id.RoomAlias(target))
+		if err != nil {
+			view.AddServiceMessage(fmt.Sprintf("Failed to resolve %s: %v", target, err))
+			view.parent.parent.Render()
+			return
+		}
+		roomID = resp.RoomID
+	}
+	room := view.parent.matrix.GetRoom(roomID)
+	if room == nil || room.HasLeft {
+		view.AddServiceMessage(fmt.Sprintf("You're not in %s", target))
+		view.parent.parent.Render()
+		return
+	}
+	view.forwardTo(evt, room)
+}
+
+func (view *RoomView) forwardTo(evt *muksevt.Event, room *rooms.Room) {
+	defer debug.Recover()
+	debug.Print("Forwarding", evt.ID, "from", view.Room.ID, "to", room.ID)
+	forwarded, err := view.parent.matrix.PrepareForwardedMessage(room, evt)
+	if err == nil {
+		_, err = view.parent.matrix.SendEvent(forwarded)
+	}
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to forward message: %v", err))
+	} else {
+		view.AddServiceMessage(fmt.Sprintf("Message forwarded to %s", room.GetTitle()))
+	}
+	view.parent.parent.Render()
+}
+
+// markdownEscaper escapes the characters that could be interpreted as Markdown or HTML formatting.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`, "|", `\|`,
+	"[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "<", `\<`, ">", `\>`, "#", `\#`, "!", `\!`,
+)
+
+// Quote inserts the given message into the input as a markdown blockquote.
+// The display name of the sender is escaped so that it can't break out of the link or add formatting.
+func (view *RoomView) Quote(message *messages.UIMessage) {
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "> [%s](https://matrix.to/#/%s) wrote:\n", markdownEscaper.Replace(message.SenderName), message.SenderID)
+	for _, line := range strings.Split(strings.TrimSpace(message.Renderer.PlainText()), "\n") {
+		buf.WriteString(">")
+		if len(line) > 0 {
+			buf.WriteRune(' ')
+			buf.WriteString(line)
+		}
+		buf.WriteRune('\n')
+	}
+	buf.WriteRune('\n')
+	buf.WriteString(view.GetInputText())
+	view.SetInputText(buf.String())
+}
+
 func (view *RoomView) CopyToClipboard(text string, register string) {
 	if register == "clipboard" || register == "primary" {
 		err := clipboard.WriteAll(text, register)
@@ -823,6 +1080,7 @@ func (view *RoomView) SendMessageMedia(path string) {
 }
 
 func (view *RoomView) addLocalEcho(evt *muksevt.Event) {
+	view.parent.ReturnToLiveTimeline(view)
 	msg := view.parseEvent(evt.SomewhatDangerousCopy())
 	view.content.AddMessage(msg, AppendMessage)
 	view.ClearAllContext()
@@ -877,7 +1135,14 @@ func (view *RoomView) UpdateUserList() {
 	if plEvent := view.Room.GetStateEvent(event.StatePowerLevels, ""); plEvent != nil {
 		pls = plEvent.Content.AsPowerLevels()
 	}
-	view.userList.Update(view.Room.GetMembers(), pls)
+	var getTrust func(id.UserID) ifc.UserTrust
+	if view.Room.Encrypted {
+		getTrust = view.parent.matrix.UserTrust
+	}
+	view.userList.Update(view.Room.GetMembers(), pls, getTrust)
+	if getTrust != nil {
+		view.content.updateSenderTrust(getTrust)
+	}
 	view.userListLoaded = true
 }
 
@@ -897,6 +1162,10 @@ func (view *RoomView) AddHistoryEvent(evt *muksevt.Event) {
 
 func (view *RoomView) AddEvent(evt *muksevt.Event) ifc.Message {
 	if msg := view.parseEvent(evt); msg != nil {
+		if view.content.IsDetached() && view.content.getMessageByID(msg.EventID) == nil {
+			// New events are loaded from the history when returning to the live timeline.
+			return msg
+		}
 		view.content.AddMessage(msg, AppendMessage)
 		return msg
 	}
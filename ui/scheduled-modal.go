@@ -0,0 +1,278 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/debug"
+)
+
+const scheduleTimeFormat = "2006-01-02T15:04"
+
+var scheduleTimeFormats = []string{scheduleTimeFormat, "2006-01-02T15:04:05", time.RFC3339}
+
+// parseScheduleTime parses a relative duration like +1h30m or +2d, a time of day like 09:00
+// or an absolute timestamp like 2006-01-02T15:04.
+func parseScheduleTime(str string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(str, "+") {
+		str = str[1:]
+		var days int
+		if dayIndex := strings.IndexRune(str, 'd'); dayIndex > 0 {
+			var err error
+			days, err = strconv.Atoi(str[:dayIndex])
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid duration: %w", err)
+			}
+			str = str[dayIndex+1:]
+		}
+		var duration time.Duration
+		if len(str) > 0 {
+			var err error
+			duration, err = time.ParseDuration(str)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid duration: %w", err)
+			}
+		}
+		return now.AddDate(0, 0, days).Add(duration), nil
+	}
+	if timeOfDay, err := time.ParseInLocation("15:04", str, now.Location()); err == nil {
+		sendAt := time.Date(now.Year(), now.Month(), now.Day(), timeOfDay.Hour(), timeOfDay.Minute(), 0, 0, now.Location())
+		if !sendAt.After(now) {
+			sendAt = sendAt.AddDate(0, 0, 1)
+		}
+		return sendAt, nil
+	}
+	for _, format := range scheduleTimeFormats {
+		if sendAt, err := time.ParseInLocation(format, str, now.Location()); err == nil {
+			return sendAt, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use +duration, HH:MM or YYYY-MM-DDTHH:MM", str)
+}
+
+type ScheduledModal struct {
+	mauview.Component
+
+	container *mauview.Box
+	list      *mauview.TextView
+
+	messages []config.ScheduledMessage
+	selected int
+
+	parent *MainView
+}
+
+func NewScheduledModal(parent *MainView) *ScheduledModal {
+	sm := &ScheduledModal{parent: parent}
+
+	sm.list = mauview.NewTextView().SetRegions(true).SetScrollable(true).SetWrap(false)
+	help := mauview.NewTextField().SetText("Enter: edit, d: cancel message, Escape: close")
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(sm.list, 1).
+		AddFixedComponent(help, 1)
+
+	sm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle("Scheduled messages").
+		SetBlurCaptureFunc(func() bool {
+			sm.parent.HideModal()
+			return true
+		})
+	sm.container.Focus()
+	sm.Component = mauview.FractionalCenter(sm.container, 60, 10, 0.6, 0.5)
+	sm.Refresh()
+	return sm
+}
+
+// Refresh reloads the list of scheduled messages.
+func (sm *ScheduledModal) Refresh() {
+	sm.messages = sm.parent.matrix.ScheduledMessages()
+	sm.list.Clear()
+	if len(sm.messages) == 0 {
+		_, _ = fmt.Fprint(sm.list, "No scheduled messages")
+		return
+	}
+	for i, msg := range sm.messages {
+		roomName := string(msg.RoomID)
+		if room := sm.parent.matrix.GetRoom(msg.RoomID); room != nil {
+			roomName = room.GetTitle()
+		}
+		text := strings.ReplaceAll(msg.Text, "\n", " ")
+		_, _ = fmt.Fprintf(sm.list, `["%d"]%s  %s: %s`, i, msg.SendAt.Format("2006-01-02 15:04"), mauview.Escape(roomName), mauview.Escape(text))
+		if len(msg.LastError) > 0 {
+			_, _ = fmt.Fprintf(sm.list, " (failed: %s)", mauview.Escape(msg.LastError))
+		}
+		_, _ = fmt.Fprint(sm.list, "[\"\"]\n")
+	}
+	if sm.selected >= len(sm.messages) {
+		sm.selected = len(sm.messages) - 1
+	}
+	sm.list.Highlight(strconv.Itoa(sm.selected))
+	sm.list.ScrollToHighlight()
+}
+
+func (sm *ScheduledModal) Focus() {
+	sm.container.Focus()
+}
+
+func (sm *ScheduledModal) Blur() {
+	sm.container.Blur()
+}
+
+func (sm *ScheduledModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	switch sm.parent.config.Keybindings.Modal[kb] {
+	case "cancel":
+		sm.parent.HideModal()
+		return true
+	case "select_next":
+		if len(sm.messages) > 0 {
+			sm.selected = (sm.selected + 1) % len(sm.messages)
+			sm.list.Highlight(strconv.Itoa(sm.selected))
+			sm.list.ScrollToHighlight()
+		}
+		return true
+	case "select_prev":
+		if len(sm.messages) > 0 {
+			sm.selected = (sm.selected - 1 + len(sm.messages)) % len(sm.messages)
+			sm.list.Highlight(strconv.Itoa(sm.selected))
+			sm.list.ScrollToHighlight()
+		}
+		return true
+	case "confirm":
+		if len(sm.messages) > 0 {
+			sm.parent.ShowModal(NewScheduledEditModal(sm.parent, sm.messages[sm.selected]))
+		}
+		return true
+	}
+	// TODO unhardcode d and q
+	switch {
+	case event.Rune() == 'q':
+		sm.parent.HideModal()
+		return true
+	case event.Rune() == 'd' || event.Key() == tcell.KeyDelete:
+		if len(sm.messages) > 0 {
+			err := sm.parent.matrix.CancelScheduledMessage(sm.messages[sm.selected].ID)
+			if err != nil {
+				debug.Print("Failed to cancel scheduled message:", err)
+			}
+			sm.Refresh()
+		}
+		return true
+	}
+	return sm.container.OnKeyEvent(event)
+}
+
+type ScheduledEditModal struct {
+	mauview.Component
+
+	form *mauview.Form
+
+	timeInput *mauview.InputField
+	textInput *mauview.InputField
+	errorText *mauview.TextField
+
+	message config.ScheduledMessage
+
+	parent *MainView
+}
+
+func NewScheduledEditModal(parent *MainView, message config.ScheduledMessage) *ScheduledEditModal {
+	sem := &ScheduledEditModal{
+		parent:  parent,
+		form:    mauview.NewForm(),
+		message: message,
+	}
+
+	sem.form.
+		SetColumns([]int{1, 8, 1, 20, 1, 20, 1}).
+		SetRows([]int{1, 1, 1, 1, 1, 1, 1, 1})
+
+	sem.timeInput = mauview.NewInputField().SetText(message.SendAt.Format(scheduleTimeFormat))
+	sem.textInput = mauview.NewInputField().SetText(message.Text)
+	sem.errorText = mauview.NewTextField().SetTextColor(tcell.ColorRed)
+	if len(message.LastError) > 0 {
+		sem.errorText.SetText(fmt.Sprintf("Sending failed: %s", message.LastError))
+	}
+
+	sem.form.AddComponent(mauview.NewTextField().SetText("Time"), 1, 1, 1, 1)
+	sem.form.AddFormItem(sem.timeInput, 3, 1, 3, 1)
+	sem.form.AddComponent(mauview.NewTextField().SetText("Message"), 1, 3, 1, 1)
+	sem.form.AddFormItem(sem.textInput, 3, 3, 3, 1)
+	sem.form.AddComponent(sem.errorText, 1, 5, 5, 1)
+
+	sem.form.AddFormItem(mauview.NewButton("Save").SetOnClick(sem.ClickSave), 5, 6, 1, 1)
+	sem.form.AddFormItem(mauview.NewButton("Back").SetOnClick(sem.ClickBack), 3, 6, 1, 1)
+
+	box := mauview.NewBox(sem.form).SetTitle("Edit scheduled message")
+	center := mauview.Center(box, 55, 10).SetAlwaysFocusChild(true)
+	center.Focus()
+	sem.form.FocusNextItem()
+	sem.Component = center
+
+	return sem
+}
+
+func (sem *ScheduledEditModal) ClickBack() {
+	sem.parent.ShowModal(NewScheduledModal(sem.parent))
+}
+
+func (sem *ScheduledEditModal) ClickSave() {
+	sendAt, err := parseScheduleTime(sem.timeInput.GetText(), time.Now())
+	if err != nil {
+		sem.errorText.SetText(err.Error())
+		return
+	}
+	text := strings.TrimSpace(sem.textInput.GetText())
+	if len(text) == 0 {
+		sem.errorText.SetText("The message can't be empty")
+		return
+	}
+	err = sem.parent.matrix.EditScheduledMessage(sem.message.ID, text, sendAt)
+	if err != nil {
+		sem.errorText.SetText(err.Error())
+		return
+	}
+	sem.parent.ShowModal(NewScheduledModal(sem.parent))
+}
+
+func (sem *ScheduledEditModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	if sem.parent.config.Keybindings.Modal[kb] == "cancel" {
+		sem.ClickBack()
+		return true
+	}
+	return sem.Component.OnKeyEvent(event)
+}
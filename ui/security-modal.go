@@ -0,0 +1,151 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/mautrix/crypto"
+
+	"maunium.net/go/gomuks/config"
+)
+
+type SecurityModal struct {
+	mauview.Component
+
+	container *mauview.Box
+	list      *mauview.TextView
+
+	devices  []*crypto.DeviceIdentity
+	selected int
+
+	cmd    *Command
+	parent *MainView
+}
+
+func NewSecurityModal(cmd *Command, devices []*crypto.DeviceIdentity) *SecurityModal {
+	sm := &SecurityModal{
+		devices: devices,
+		cmd:     cmd,
+		parent:  cmd.MainView,
+	}
+
+	sm.list = mauview.NewTextView().
+		SetRegions(true).
+		SetScrollable(true).
+		SetWrap(false).
+		SetTextColor(tcell.ColorDefault)
+	help := mauview.NewTextView().
+		SetText("v: verify, b: blacklist, Esc: close").
+		SetTextColor(tcell.ColorDefault)
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(sm.list, 1).
+		AddFixedComponent(help, 1)
+
+	sm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle("Unverified devices of verified users").
+		SetBlurCaptureFunc(func() bool {
+			sm.parent.HideModal()
+			return true
+		})
+
+	sm.Component = mauview.Center(sm.container, 80, 20).SetAlwaysFocusChild(true)
+
+	sm.refresh()
+
+	return sm
+}
+
+func (sm *SecurityModal) refresh() {
+	sm.list.Clear()
+	for i, device := range sm.devices {
+		_, _ = fmt.Fprintf(sm.list, "[\"%d\"]%s %s (%s)\n    Fingerprint: %s[\"\"]\n",
+			i, device.UserID, device.DeviceID, device.Name, device.Fingerprint())
+	}
+	if sm.selected >= len(sm.devices) {
+		sm.selected = len(sm.devices) - 1
+	}
+	if sm.selected >= 0 {
+		sm.list.Highlight(strconv.Itoa(sm.selected))
+		sm.list.ScrollToHighlight()
+	}
+}
+
+func (sm *SecurityModal) act(fn func(cmd *Command, device *crypto.DeviceIdentity)) {
+	if sm.selected < 0 || sm.selected >= len(sm.devices) {
+		return
+	}
+	device := sm.devices[sm.selected]
+	sm.devices = append(sm.devices[:sm.selected], sm.devices[sm.selected+1:]...)
+	sm.refresh()
+	if len(sm.devices) == 0 {
+		sm.parent.HideModal()
+	}
+	go fn(sm.cmd, device)
+}
+
+func (sm *SecurityModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	kb := config.Keybind{
+		Key: event.Key(),
+		Ch:  event.Rune(),
+		Mod: event.Modifiers(),
+	}
+	switch sm.parent.config.Keybindings.Modal[kb] {
+	case "cancel":
+		sm.parent.HideModal()
+		return true
+	case "select_next":
+		if len(sm.devices) > 0 {
+			sm.selected = (sm.selected + 1) % len(sm.devices)
+			sm.refresh()
+		}
+		return true
+	case "select_prev":
+		if len(sm.devices) > 0 {
+			sm.selected = (sm.selected - 1 + len(sm.devices)) % len(sm.devices)
+			sm.refresh()
+		}
+		return true
+	}
+	// TODO unhardcode v and b
+	switch event.Rune() {
+	case 'v':
+		sm.act(markDeviceVerified)
+		return true
+	case 'b':
+		sm.act(markDeviceBlacklisted)
+		return true
+	}
+	return sm.list.OnKeyEvent(event)
+}
+
+func (sm *SecurityModal) Focus() {
+	sm.container.Focus()
+}
+
+func (sm *SecurityModal) Blur() {
+	sm.container.Blur()
+}
@@ -29,6 +29,11 @@ type SyncingModal struct {
 }
 
 func NewSyncingModal(parent *MainView) (mauview.Component, *SyncingModal) {
+	return NewProgressModal(parent, "Synchronizing")
+}
+
+// NewProgressModal creates a modal with a progress bar and a single line of status text.
+func NewProgressModal(parent *MainView, title string) (mauview.Component, *SyncingModal) {
 	sm := &SyncingModal{
 		parent:   parent,
 		progress: mauview.NewProgressBar(),
@@ -40,7 +45,7 @@ func NewSyncingModal(parent *MainView) (mauview.Component, *SyncingModal) {
 				SetDirection(mauview.FlexRow).
 				AddFixedComponent(sm.progress, 1).
 				AddFixedComponent(mauview.Center(sm.text, 40, 1), 1)).
-			SetTitle("Synchronizing"),
+			SetTitle(title),
 		42, 4).
 		SetAlwaysFocusChild(true), sm
 }
@@ -20,12 +20,15 @@ import (
 	"os"
 	"os/exec"
 
+	sync "github.com/sasha-s/go-deadlock"
 	"github.com/zyedidia/clipboard"
 
 	"go.mau.fi/mauview"
 	"go.mau.fi/tcell"
 
+	"maunium.net/go/gomuks/debug"
 	ifc "maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/lib/notification"
 )
 
 type View string
@@ -44,6 +47,9 @@ type GomuksUI struct {
 	loginView *LoginView
 
 	views map[View]mauview.Component
+
+	terminalOutput     []string
+	terminalOutputLock sync.Mutex
 }
 
 func init() {
@@ -70,6 +76,9 @@ func (ui *GomuksUI) Init() {
 	mauview.Backspace2RemovesWord = ui.gmx.Config().Backspace2RemovesWord
 	mauview.Backspace1RemovesWord = ui.gmx.Config().Backspace1RemovesWord
 	ui.app.SetAlwaysClear(ui.gmx.Config().AlwaysClearScreen)
+	notification.Backend = ui.gmx.Config().NotifyBackend
+	notification.TerminalProtocol = ui.gmx.Config().NotifyTerminalProtocol
+	notification.SetTerminalWriter(ui.queueTerminalOutput)
 	clipboard.Initialize()
 	ui.views = map[View]mauview.Component{
 		ViewLogin: ui.NewLoginView(),
@@ -83,6 +92,9 @@ func (ui *GomuksUI) Start() error {
 }
 
 func (ui *GomuksUI) Stop() {
+	if ui.mainView != nil {
+		ui.mainView.SaveDrafts()
+	}
 	ui.app.Stop()
 }
 
@@ -90,6 +102,30 @@ func (ui *GomuksUI) Finish() {
 	ui.app.ForceStop()
 }
 
+// queueTerminalOutput queues raw terminal output (e.g. notification escape sequences) to be written on the UI
+// goroutine, because writing it from other goroutines could corrupt screen updates.
+func (ui *GomuksUI) queueTerminalOutput(seq string) {
+	ui.terminalOutputLock.Lock()
+	ui.terminalOutput = append(ui.terminalOutput, seq)
+	ui.terminalOutputLock.Unlock()
+	ui.Render()
+}
+
+// flushTerminalOutput writes the queued raw terminal output. It must only be called while drawing,
+// as the screen is only written to after drawing.
+func (ui *GomuksUI) flushTerminalOutput() {
+	ui.terminalOutputLock.Lock()
+	output := ui.terminalOutput
+	ui.terminalOutput = nil
+	ui.terminalOutputLock.Unlock()
+	for _, seq := range output {
+		err := notification.WriteTerminal(seq)
+		if err != nil {
+			debug.Print("Failed to write terminal notification:", err)
+		}
+	}
+}
+
 func (ui *GomuksUI) Render() {
 	ui.app.Redraw()
 }
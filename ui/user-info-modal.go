@@ -0,0 +1,148 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mau.fi/mauview"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+type UserInfoModal struct {
+	mauview.Component
+
+	form *mauview.Form
+	text *mauview.TextView
+
+	close   *mauview.Button
+	message *mauview.Button
+
+	userID     id.UserID
+	directChat *rooms.Room
+
+	parent *MainView
+}
+
+// OpenUserInfo fetches the profile of the given user and shows it in a modal.
+func (view *MainView) OpenUserInfo(userID id.UserID) error {
+	_, _, err := userID.Parse()
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "User ID: %s\n", userID)
+	profile, err := view.matrix.Client().GetDisplayName(userID)
+	if err != nil {
+		debug.Printf("Failed to get displayname of %s: %v", userID, err)
+		buf.WriteString("Display name: unknown\n")
+	} else if len(profile.DisplayName) > 0 {
+		_, _ = fmt.Fprintf(&buf, "Display name: %s\n", profile.DisplayName)
+	}
+	if view.currentRoom != nil {
+		room := view.currentRoom.Room
+		if member := room.GetMember(userID); member != nil {
+			_, _ = fmt.Fprintf(&buf, "Name in %s: %s (%s)\n", room.GetTitle(), member.Displayname, member.Membership)
+		}
+	}
+	var directChat *rooms.Room
+	view.roomsLock.RLock()
+	for _, roomView := range view.rooms {
+		if roomView.Room.IsDirect && roomView.Room.OtherUser == userID {
+			directChat = roomView.Room
+			break
+		}
+	}
+	view.roomsLock.RUnlock()
+	if directChat != nil {
+		_, _ = fmt.Fprintf(&buf, "Direct chat: %s\n", directChat.GetTitle())
+	}
+
+	uim := NewUserInfoModal(view, userID, directChat, strings.TrimSpace(buf.String()))
+	view.ShowModal(uim)
+	view.parent.Render()
+	return nil
+}
+
+func NewUserInfoModal(parent *MainView, userID id.UserID, directChat *rooms.Room, text string) *UserInfoModal {
+	uim := &UserInfoModal{
+		parent:     parent,
+		form:       mauview.NewForm(),
+		userID:     userID,
+		directChat: directChat,
+	}
+
+	width := 60
+	textHeight := strings.Count(text, "\n") + 2
+
+	uim.form.
+		SetColumns([]int{1, 28, 1, 28, 1}).
+		SetRows([]int{1, textHeight, 1, 1, 1})
+
+	uim.text = mauview.NewTextView().SetWordWrap(true).SetText(text)
+	uim.form.AddComponent(uim.text, 1, 1, 3, 1)
+
+	messageLabel := "Start direct chat"
+	if directChat != nil {
+		messageLabel = "Open direct chat"
+	}
+	uim.close = mauview.NewButton("Close").SetOnClick(uim.ClickClose)
+	uim.message = mauview.NewButton(messageLabel).SetOnClick(uim.ClickMessage)
+
+	uim.form.AddFormItem(uim.message, 3, 3, 1, 1)
+	uim.form.AddFormItem(uim.close, 1, 3, 1, 1)
+
+	box := mauview.NewBox(uim.form).SetTitle(string(userID))
+	center := mauview.Center(box, width, textHeight+6).SetAlwaysFocusChild(true)
+	center.Focus()
+	uim.form.FocusNextItem()
+	uim.Component = center
+
+	return uim
+}
+
+func (uim *UserInfoModal) ClickClose() {
+	uim.parent.HideModal()
+}
+
+func (uim *UserInfoModal) ClickMessage() {
+	uim.parent.HideModal()
+	if uim.directChat != nil {
+		uim.parent.SwitchRoom("", uim.directChat)
+		return
+	}
+	go func() {
+		defer debug.Recover()
+		room, err := uim.parent.matrix.CreateRoom(&mautrix.ReqCreateRoom{
+			Preset:   "trusted_private_chat",
+			Invite:   []id.UserID{uim.userID},
+			IsDirect: true,
+		})
+		if err != nil {
+			uim.parent.reportError(fmt.Sprintf("Failed to create room: %v", err))
+			return
+		}
+		uim.parent.SwitchRoom("", room)
+		uim.parent.parent.Render()
+	}()
+}
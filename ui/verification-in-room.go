@@ -0,0 +1,740 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/muksevt"
+)
+
+// The in-room SAS verification in mautrix can only complete if our user ID happens to sort before the other user's
+// (otherwise the state of the other device is never filled), so the in-room flow is implemented here using the
+// lower-level crypto primitives instead.
+
+const inRoomVerificationTimeout = 10 * time.Minute
+
+var errVerificationFinished = errors.New("verification is already finished")
+
+type InRoomVerification struct {
+	lock sync.Mutex
+
+	parent *MainView
+	mach   *crypto.OlmMachine
+	hooks  crypto.VerificationHooks
+
+	RoomID        id.RoomID
+	TransactionID string
+	OtherUser     id.UserID
+	otherDevice   *crypto.DeviceIdentity
+	requestedByUs bool
+	requestedAt   time.Time
+	ready         bool
+
+	startedByUs    bool
+	started        bool
+	startCanonical []byte
+	commitment     string
+	method         crypto.VerificationMethod
+	sas            *olm.SAS
+	keyReceived    bool
+	sasConfirmed   bool
+	theirMAC       *event.VerificationMacEventContent
+	finished       bool
+
+	timeout *time.Timer
+}
+
+func (view *MainView) addVerification(verification *InRoomVerification) {
+	view.verificationsLock.Lock()
+	view.verifications[verification.TransactionID] = verification
+	view.verificationsLock.Unlock()
+}
+
+func (view *MainView) removeVerification(transactionID string) {
+	view.verificationsLock.Lock()
+	delete(view.verifications, transactionID)
+	view.verificationsLock.Unlock()
+}
+
+func (view *MainView) getVerification(transactionID string) *InRoomVerification {
+	view.verificationsLock.RLock()
+	defer view.verificationsLock.RUnlock()
+	return view.verifications[transactionID]
+}
+
+// GetPendingVerificationRequest returns the most recent incoming verification request in the given room
+// that hasn't been accepted yet.
+func (view *MainView) GetPendingVerificationRequest(roomID id.RoomID) *InRoomVerification {
+	view.verificationsLock.RLock()
+	verifications := make([]*InRoomVerification, 0, len(view.verifications))
+	for _, verification := range view.verifications {
+		if verification.RoomID == roomID {
+			verifications = append(verifications, verification)
+		}
+	}
+	view.verificationsLock.RUnlock()
+	// The verification locks are taken after releasing verificationsLock, as removeVerification is called
+	// while holding the lock of the verification.
+	var latest *InRoomVerification
+	for _, verification := range verifications {
+		verification.lock.Lock()
+		pending := !verification.requestedByUs && verification.hooks == nil
+		verification.lock.Unlock()
+		if pending && (latest == nil || verification.requestedAt.After(latest.requestedAt)) {
+			latest = verification
+		}
+	}
+	return latest
+}
+
+// StartInRoomVerification sends a verification request to the given user in the given room.
+func (view *MainView) StartInRoomVerification(roomID id.RoomID, userID id.UserID, hooks crypto.VerificationHooks) (*InRoomVerification, error) {
+	verification := &InRoomVerification{
+		parent:        view,
+		mach:          view.matrix.Crypto().(*crypto.OlmMachine),
+		hooks:         hooks,
+		RoomID:        roomID,
+		OtherUser:     userID,
+		requestedByUs: true,
+		requestedAt:   time.Now(),
+	}
+	eventID, err := verification.send(event.EventMessage, &event.MessageEventContent{
+		MsgType:    event.MsgVerificationRequest,
+		Body:       fmt.Sprintf("%s is requesting to verify your key, but your client does not support in-chat key verification.", verification.mach.Client.UserID),
+		FromDevice: verification.mach.Client.DeviceID,
+		Methods:    []event.VerificationMethod{event.VerificationMethodSAS},
+		To:         userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	verification.TransactionID = eventID.String()
+	verification.resetTimeout()
+	view.addVerification(verification)
+	return verification, nil
+}
+
+// HandleInRoomVerification processes a decrypted in-room verification event (or a verification request message).
+func (view *MainView) HandleInRoomVerification(evt *event.Event) {
+	mach, ok := view.matrix.Crypto().(*crypto.OlmMachine)
+	if !ok || mach == nil {
+		return
+	}
+	if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok {
+		if content.MsgType == event.MsgVerificationRequest {
+			view.handleVerificationRequest(mach, evt, content)
+		}
+		return
+	}
+	relatable, ok := evt.Content.Parsed.(event.Relatable)
+	if !ok || relatable.OptionalGetRelatesTo() == nil || len(relatable.OptionalGetRelatesTo().EventID) == 0 {
+		debug.Printf("[Crypto/Warn] In-room verification event %s doesn't have a relation", evt.ID)
+		return
+	}
+	verification := view.getVerification(relatable.OptionalGetRelatesTo().EventID.String())
+	if verification == nil {
+		return
+	}
+	verification.lock.Lock()
+	defer verification.lock.Unlock()
+	if verification.finished {
+		return
+	}
+	if evt.Sender == mach.Client.UserID {
+		verification.handleOwnEvent(evt)
+		return
+	} else if evt.Sender != verification.OtherUser {
+		return
+	}
+	verification.resetTimeout()
+	var err error
+	switch content := evt.Content.Parsed.(type) {
+	case *event.VerificationReadyEventContent:
+		err = verification.handleReady(content)
+	case *event.VerificationStartEventContent:
+		err = verification.handleStart(evt, content)
+	case *event.VerificationAcceptEventContent:
+		err = verification.handleAccept(content)
+	case *event.VerificationKeyEventContent:
+		err = verification.handleKey(content)
+	case *event.VerificationMacEventContent:
+		err = verification.handleMAC(content)
+	case *event.VerificationCancelEventContent:
+		verification.handleCancel(content)
+	case *muksevt.VerificationDoneEventContent:
+		debug.Printf("[Crypto/Debug] %s marked verification %s as done", evt.Sender, verification.TransactionID)
+	}
+	if err != nil {
+		debug.Printf("[Crypto/Error] Error handling %s in verification %s: %v", evt.Type.String(), verification.TransactionID, err)
+	}
+}
+
+func (view *MainView) handleVerificationRequest(mach *crypto.OlmMachine, evt *event.Event, content *event.MessageEventContent) {
+	if content.To != mach.Client.UserID || evt.Sender == mach.Client.UserID {
+		return
+	}
+	ts := time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*int64(time.Millisecond))
+	if time.Since(ts) > inRoomVerificationTimeout || time.Until(ts) > 5*time.Minute {
+		debug.Printf("[Crypto/Debug] Ignoring verification request %s with timestamp %s", evt.ID, ts)
+		return
+	}
+	verification := &InRoomVerification{
+		parent:        view,
+		mach:          mach,
+		RoomID:        evt.RoomID,
+		TransactionID: evt.ID.String(),
+		OtherUser:     evt.Sender,
+		requestedAt:   ts,
+	}
+	roomView := view.GetRoom(evt.RoomID)
+	hasSAS := false
+	for _, method := range content.Methods {
+		if method == event.VerificationMethodSAS {
+			hasSAS = true
+		}
+	}
+	if !hasSAS || len(content.FromDevice) == 0 {
+		_ = verification.sendCancel("Only SAS verification is supported", event.VerificationCancelUnknownMethod)
+		if roomView != nil {
+			roomView.AddServiceMessage(fmt.Sprintf("Rejected verification request from %s: no supported verification methods", evt.Sender))
+		}
+		return
+	}
+	device, err := mach.GetOrFetchDevice(evt.Sender, content.FromDevice)
+	if err != nil {
+		debug.Printf("[Crypto/Error] Failed to get device %s of %s for verification request: %v", content.FromDevice, evt.Sender, err)
+		return
+	}
+	verification.otherDevice = device
+	verification.resetTimeout()
+	view.addVerification(verification)
+	if roomView != nil {
+		roomView.AddServiceMessage(fmt.Sprintf("%s (device %s) wants to verify your identity. "+
+			"Use `/verify accept` to start the verification or `/verify decline` to decline it.", evt.Sender, content.FromDevice))
+		view.parent.Render()
+	}
+}
+
+// Accept accepts an incoming verification request and starts the SAS process.
+func (verification *InRoomVerification) Accept(hooks crypto.VerificationHooks) error {
+	verification.lock.Lock()
+	defer verification.lock.Unlock()
+	if verification.finished {
+		return errVerificationFinished
+	}
+	verification.hooks = hooks
+	verification.setOtherDevice(verification.otherDevice)
+	verification.ready = true
+	verification.resetTimeout()
+	_, err := verification.send(event.InRoomVerificationReady, &event.VerificationReadyEventContent{
+		FromDevice: verification.mach.Client.DeviceID,
+		Methods:    []event.VerificationMethod{event.VerificationMethodSAS},
+		RelatesTo:  verification.relatesTo(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send ready: %w", err)
+	}
+	return verification.sendStart()
+}
+
+// setOtherDevice sets the device that is being verified. The verification modal is updated too,
+// as it's created before the device is known when the verification is started by us.
+func (verification *InRoomVerification) setOtherDevice(device *crypto.DeviceIdentity) {
+	verification.otherDevice = device
+	if modal, ok := verification.hooks.(*VerificationModal); ok && device != nil {
+		modal.SetDevice(device)
+	}
+}
+
+// Cancel cancels the verification with the given reason and notifies the hooks (if any).
+func (verification *InRoomVerification) Cancel(reason string, code event.VerificationCancelCode) {
+	verification.lock.Lock()
+	defer verification.lock.Unlock()
+	if verification.finished {
+		return
+	}
+	verification.cancel(reason, code)
+}
+
+func (verification *InRoomVerification) cancel(reason string, code event.VerificationCancelCode) {
+	err := verification.sendCancel(reason, code)
+	if err != nil {
+		debug.Printf("[Crypto/Error] Failed to send cancellation of verification %s: %v", verification.TransactionID, err)
+	}
+	verification.finish()
+	if verification.hooks != nil {
+		go verification.hooks.OnCancel(true, reason, code)
+	}
+}
+
+func (verification *InRoomVerification) finish() {
+	verification.finished = true
+	if verification.timeout != nil {
+		verification.timeout.Stop()
+	}
+	verification.parent.removeVerification(verification.TransactionID)
+}
+
+func (verification *InRoomVerification) resetTimeout() {
+	if verification.timeout == nil {
+		verification.timeout = time.AfterFunc(inRoomVerificationTimeout, verification.onTimeout)
+	} else {
+		verification.timeout.Reset(inRoomVerificationTimeout)
+	}
+}
+
+func (verification *InRoomVerification) onTimeout() {
+	verification.lock.Lock()
+	defer verification.lock.Unlock()
+	if verification.finished {
+		return
+	}
+	debug.Printf("[Crypto/Warn] Verification %s with %s timed out", verification.TransactionID, verification.OtherUser)
+	verification.cancel("Timed out", event.VerificationCancelByTimeout)
+	if verification.hooks == nil {
+		verification.addServiceMessage("Verification request from %s timed out", verification.OtherUser)
+	}
+}
+
+func (verification *InRoomVerification) addServiceMessage(message string, args ...interface{}) {
+	roomView := verification.parent.GetRoom(verification.RoomID)
+	if roomView != nil {
+		roomView.AddServiceMessage(fmt.Sprintf(message, args...))
+		verification.parent.parent.Render()
+	}
+}
+
+func (verification *InRoomVerification) relatesTo() *event.RelatesTo {
+	return &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(verification.TransactionID)}
+}
+
+func (verification *InRoomVerification) send(evtType event.Type, content interface{}) (id.EventID, error) {
+	encrypted, err := verification.mach.EncryptMegolmEvent(verification.RoomID, evtType, content)
+	if errors.Is(err, crypto.SessionExpired) || errors.Is(err, crypto.SessionNotShared) || errors.Is(err, crypto.NoGroupSession) {
+		err = verification.parent.matrix.ShareGroupSession(verification.parent.matrix.GetRoom(verification.RoomID))
+		if err != nil {
+			return "", fmt.Errorf("failed to share group session: %w", err)
+		}
+		encrypted, err = verification.mach.EncryptMegolmEvent(verification.RoomID, evtType, content)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt: %w", err)
+	}
+	resp, err := verification.mach.Client.SendMessageEvent(verification.RoomID, event.EventEncrypted, encrypted)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+func (verification *InRoomVerification) sendCancel(reason string, code event.VerificationCancelCode) error {
+	_, err := verification.send(event.InRoomVerificationCancel, &event.VerificationCancelEventContent{
+		RelatesTo: verification.relatesTo(),
+		Reason:    reason,
+		Code:      code,
+	})
+	return err
+}
+
+func (verification *InRoomVerification) sendStart() error {
+	methods := verification.hooks.VerificationMethods()
+	sasMethods := make([]event.SASMethod, len(methods))
+	for i, method := range methods {
+		sasMethods[i] = method.Type()
+	}
+	content := &event.VerificationStartEventContent{
+		FromDevice:                 verification.mach.Client.DeviceID,
+		RelatesTo:                  verification.relatesTo(),
+		Method:                     event.VerificationMethodSAS,
+		KeyAgreementProtocols:      []event.KeyAgreementProtocol{event.KeyAgreementCurve25519HKDFSHA256},
+		Hashes:                     []event.VerificationHashMethod{event.VerificationHashSHA256},
+		MessageAuthenticationCodes: []event.MACMethod{event.HKDFHMACSHA256},
+		ShortAuthenticationString:  sasMethods,
+	}
+	payload, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	verification.startCanonical, err = canonicaljson.CanonicalJSON(payload)
+	if err != nil {
+		return err
+	}
+	verification.sas = olm.NewSAS()
+	verification.startedByUs = true
+	verification.started = true
+	_, err = verification.send(event.InRoomVerificationStart, content)
+	if err != nil {
+		return fmt.Errorf("failed to send start: %w", err)
+	}
+	return nil
+}
+
+func (verification *InRoomVerification) sendKey() error {
+	_, err := verification.send(event.InRoomVerificationKey, &event.VerificationKeyEventContent{
+		RelatesTo: verification.relatesTo(),
+		Key:       string(verification.sas.GetPubkey()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send key: %w", err)
+	}
+	return nil
+}
+
+func (verification *InRoomVerification) handleOwnEvent(evt *event.Event) {
+	switch content := evt.Content.Parsed.(type) {
+	case *event.VerificationReadyEventContent:
+		if !verification.requestedByUs && content.FromDevice != verification.mach.Client.DeviceID {
+			verification.finish()
+			verification.addServiceMessage("Verification request from %s was accepted on another device", verification.OtherUser)
+		}
+	case *event.VerificationCancelEventContent:
+		if !verification.requestedByUs && verification.hooks == nil {
+			verification.finish()
+			verification.addServiceMessage("Verification request from %s was declined on another device", verification.OtherUser)
+		}
+	}
+}
+
+func (verification *InRoomVerification) handleReady(content *event.VerificationReadyEventContent) error {
+	if !verification.requestedByUs || verification.ready {
+		verification.cancel("Unexpected ready message", event.VerificationCancelUnexpectedMessage)
+		return nil
+	}
+	device, err := verification.mach.GetOrFetchDevice(verification.OtherUser, content.FromDevice)
+	if err != nil {
+		verification.cancel("Failed to get device info", event.VerificationCancelUnknownMethod)
+		return fmt.Errorf("failed to get device %s: %w", content.FromDevice, err)
+	}
+	verification.setOtherDevice(device)
+	verification.ready = true
+	if verification.started {
+		// The other side already sent a start, no need to send our own
+		return nil
+	}
+	return verification.sendStart()
+}
+
+func (verification *InRoomVerification) commonSASMethods(otherMethods []event.SASMethod) []crypto.VerificationMethod {
+	var methods []crypto.VerificationMethod
+	for _, method := range verification.hooks.VerificationMethods() {
+		for _, otherMethod := range otherMethods {
+			if method.Type() == otherMethod {
+				methods = append(methods, method)
+				break
+			}
+		}
+	}
+	return methods
+}
+
+func (verification *InRoomVerification) handleStart(evt *event.Event, content *event.VerificationStartEventContent) error {
+	if verification.hooks == nil || verification.keyReceived {
+		verification.cancel("Unexpected start message", event.VerificationCancelUnexpectedMessage)
+		return nil
+	} else if verification.startedByUs {
+		// Both sides sent a start event: the one sent by the user with the lexicographically smaller user ID wins,
+		// or the one sent by the device with the smaller device ID when verifying our own devices.
+		ownUserID, ownDeviceID := verification.mach.Client.UserID, verification.mach.Client.DeviceID
+		if ownUserID < verification.OtherUser || (ownUserID == verification.OtherUser && ownDeviceID < content.FromDevice) {
+			debug.Printf("[Crypto/Debug] Ignoring start from %s in verification %s as our start takes precedence", evt.Sender, verification.TransactionID)
+			return nil
+		}
+		verification.startedByUs = false
+	}
+	if verification.otherDevice == nil || content.FromDevice != verification.otherDevice.DeviceID {
+		device, err := verification.mach.GetOrFetchDevice(verification.OtherUser, content.FromDevice)
+		if err != nil {
+			verification.cancel("Failed to get device info", event.VerificationCancelUnknownMethod)
+			return fmt.Errorf("failed to get device %s: %w", content.FromDevice, err)
+		}
+		verification.setOtherDevice(device)
+	}
+	sasMethods := verification.commonSASMethods(content.ShortAuthenticationString)
+	switch {
+	case content.Method != event.VerificationMethodSAS:
+		verification.cancel("Only SAS verification is supported", event.VerificationCancelUnknownMethod)
+		return nil
+	case !content.SupportsKeyAgreementProtocol(event.KeyAgreementCurve25519HKDFSHA256),
+		!content.SupportsHashMethod(event.VerificationHashSHA256),
+		!content.SupportsMACMethod(event.HKDFHMACSHA256),
+		len(sasMethods) == 0:
+		verification.cancel("No common verification parameters", event.VerificationCancelUnknownMethod)
+		return nil
+	}
+	canonical, err := canonicaljson.CanonicalJSON(evt.Content.VeryRaw)
+	if err != nil {
+		verification.cancel("Failed to canonicalize start event", event.VerificationCancelUnexpectedMessage)
+		return err
+	}
+	verification.sas = olm.NewSAS()
+	verification.started = true
+	verification.method = sasMethods[0]
+	sasMethodTypes := make([]event.SASMethod, len(sasMethods))
+	for i, method := range sasMethods {
+		sasMethodTypes[i] = method.Type()
+	}
+	_, err = verification.send(event.InRoomVerificationAccept, &event.VerificationAcceptEventContent{
+		RelatesTo:                 verification.relatesTo(),
+		Method:                    event.VerificationMethodSAS,
+		KeyAgreementProtocol:      event.KeyAgreementCurve25519HKDFSHA256,
+		Hash:                      event.VerificationHashSHA256,
+		MessageAuthenticationCode: event.HKDFHMACSHA256,
+		ShortAuthenticationString: sasMethodTypes,
+		Commitment:                olm.NewUtility().Sha256(string(verification.sas.GetPubkey()) + string(canonical)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send accept: %w", err)
+	}
+	return nil
+}
+
+func (verification *InRoomVerification) handleAccept(content *event.VerificationAcceptEventContent) error {
+	if !verification.startedByUs || verification.method != nil {
+		verification.cancel("Unexpected accept message", event.VerificationCancelUnexpectedMessage)
+		return nil
+	}
+	sasMethods := verification.commonSASMethods(content.ShortAuthenticationString)
+	if content.KeyAgreementProtocol != event.KeyAgreementCurve25519HKDFSHA256 ||
+		content.Hash != event.VerificationHashSHA256 ||
+		content.MessageAuthenticationCode != event.HKDFHMACSHA256 ||
+		len(sasMethods) == 0 {
+		verification.cancel("Verification uses unknown method", event.VerificationCancelUnknownMethod)
+		return nil
+	}
+	verification.commitment = content.Commitment
+	verification.method = sasMethods[0]
+	return verification.sendKey()
+}
+
+func (verification *InRoomVerification) handleKey(content *event.VerificationKeyEventContent) error {
+	if verification.method == nil || verification.keyReceived {
+		verification.cancel("Unexpected key message", event.VerificationCancelUnexpectedMessage)
+		return nil
+	}
+	err := verification.sas.SetTheirKey([]byte(content.Key))
+	if err != nil {
+		verification.cancel("Invalid key", event.VerificationCancelKeyMismatch)
+		return err
+	}
+	verification.keyReceived = true
+
+	ownUserID, ownDeviceID, ownKey := verification.mach.Client.UserID, verification.mach.Client.DeviceID, string(verification.sas.GetPubkey())
+	otherUserID, otherDeviceID, otherKey := verification.OtherUser, verification.otherDevice.DeviceID, content.Key
+	var sasData crypto.SASData
+	if verification.startedByUs {
+		expectedCommitment := olm.NewUtility().Sha256(content.Key + string(verification.startCanonical))
+		if expectedCommitment != verification.commitment {
+			verification.cancel("Commitment mismatch", event.VerificationCancelCommitmentMismatch)
+			return nil
+		}
+		sasData, err = verification.method.GetVerificationSAS(ownUserID, ownDeviceID, ownKey, otherUserID, otherDeviceID, otherKey, verification.TransactionID, verification.sas)
+	} else {
+		err = verification.sendKey()
+		if err != nil {
+			return err
+		}
+		sasData, err = verification.method.GetVerificationSAS(otherUserID, otherDeviceID, otherKey, ownUserID, ownDeviceID, ownKey, verification.TransactionID, verification.sas)
+	}
+	if err != nil {
+		verification.cancel("Failed to generate SAS", event.VerificationCancelUnknownMethod)
+		return err
+	}
+	go verification.compareSAS(sasData)
+	return nil
+}
+
+func (verification *InRoomVerification) compareSAS(sasData crypto.SASData) {
+	match := verification.hooks.VerifySASMatch(verification.otherDevice, sasData)
+
+	verification.lock.Lock()
+	defer verification.lock.Unlock()
+	if verification.finished {
+		return
+	} else if !match {
+		verification.cancel("SAS do not match", event.VerificationCancelSASMismatch)
+		return
+	}
+	verification.resetTimeout()
+	verification.sasConfirmed = true
+	err := verification.sendMAC()
+	if err != nil {
+		debug.Printf("[Crypto/Error] Failed to send MAC for verification %s: %v", verification.TransactionID, err)
+		verification.cancel("Failed to send MAC", event.VerificationCancelUnexpectedMessage)
+		return
+	}
+	if verification.theirMAC != nil {
+		verification.verifyMAC()
+	}
+}
+
+func (verification *InRoomVerification) macInfo(sender id.UserID, senderDevice id.DeviceID, receiver id.UserID, receiverDevice id.DeviceID) string {
+	return "MATRIX_KEY_VERIFICATION_MAC" +
+		sender.String() + senderDevice.String() +
+		receiver.String() + receiverDevice.String() +
+		verification.TransactionID
+}
+
+func (verification *InRoomVerification) calculateKeyIDsMAC(info string, keyIDs []string) (string, error) {
+	sort.Strings(keyIDs)
+	mac, err := verification.sas.CalculateMAC([]byte(strings.Join(keyIDs, ",")), []byte(info+"KEY_IDS"))
+	return string(mac), err
+}
+
+func (verification *InRoomVerification) sendMAC() error {
+	info := verification.macInfo(verification.mach.Client.UserID, verification.mach.Client.DeviceID, verification.OtherUser, verification.otherDevice.DeviceID)
+	keys := map[id.KeyID]string{
+		id.NewKeyID(id.KeyAlgorithmEd25519, verification.mach.Client.DeviceID.String()): verification.mach.OwnIdentity().SigningKey.String(),
+	}
+	if ownKeys := verification.mach.GetOwnCrossSigningPublicKeys(); ownKeys != nil {
+		keys[id.NewKeyID(id.KeyAlgorithmEd25519, ownKeys.MasterKey.String())] = ownKeys.MasterKey.String()
+	}
+	macs := make(map[id.KeyID]string, len(keys))
+	keyIDs := make([]string, 0, len(keys))
+	for keyID, key := range keys {
+		mac, err := verification.sas.CalculateMAC([]byte(key), []byte(info+keyID.String()))
+		if err != nil {
+			return err
+		}
+		macs[keyID] = string(mac)
+		keyIDs = append(keyIDs, keyID.String())
+	}
+	keyIDsMAC, err := verification.calculateKeyIDsMAC(info, keyIDs)
+	if err != nil {
+		return err
+	}
+	_, err = verification.send(event.InRoomVerificationMAC, &event.VerificationMacEventContent{
+		RelatesTo: verification.relatesTo(),
+		Keys:      keyIDsMAC,
+		Mac:       macs,
+	})
+	return err
+}
+
+func (verification *InRoomVerification) handleMAC(content *event.VerificationMacEventContent) error {
+	if !verification.keyReceived || verification.theirMAC != nil {
+		verification.cancel("Unexpected MAC message", event.VerificationCancelUnexpectedMessage)
+		return nil
+	}
+	verification.theirMAC = content
+	if verification.sasConfirmed {
+		verification.verifyMAC()
+	}
+	return nil
+}
+
+func (verification *InRoomVerification) verifyMAC() {
+	device := verification.otherDevice
+	content := verification.theirMAC
+	info := verification.macInfo(verification.OtherUser, device.DeviceID, verification.mach.Client.UserID, verification.mach.Client.DeviceID)
+
+	keyIDs := make([]string, 0, len(content.Mac))
+	for keyID := range content.Mac {
+		keyIDs = append(keyIDs, keyID.String())
+	}
+	if expectedKeyIDsMAC, err := verification.calculateKeyIDsMAC(info, keyIDs); err != nil || expectedKeyIDsMAC != content.Keys {
+		verification.cancel("Mismatched keys MAC", event.VerificationCancelKeyMismatch)
+		return
+	}
+
+	var masterKey id.Ed25519
+	if theirKeys, err := verification.mach.GetCrossSigningPublicKeys(verification.OtherUser); err != nil {
+		debug.Printf("[Crypto/Warn] Failed to get cross-signing keys of %s: %v", verification.OtherUser, err)
+	} else if theirKeys != nil {
+		masterKey = theirKeys.MasterKey
+	}
+	deviceVerified := false
+	masterKeyVerified := false
+	for keyID, mac := range content.Mac {
+		_, keyName := keyID.Parse()
+		var key string
+		if keyName == device.DeviceID.String() {
+			key = device.SigningKey.String()
+		} else if len(masterKey) > 0 && keyName == masterKey.String() {
+			key = masterKey.String()
+		} else {
+			debug.Printf("[Crypto/Debug] Ignoring MAC of unknown key %s in verification %s", keyID, verification.TransactionID)
+			continue
+		}
+		expectedMAC, err := verification.sas.CalculateMAC([]byte(key), []byte(info+keyID.String()))
+		if err != nil || string(expectedMAC) != mac {
+			verification.cancel("Mismatched key MAC", event.VerificationCancelKeyMismatch)
+			return
+		}
+		if key == device.SigningKey.String() {
+			deviceVerified = true
+		} else {
+			masterKeyVerified = true
+		}
+	}
+	if !deviceVerified {
+		verification.cancel("Device key MAC missing", event.VerificationCancelKeyMismatch)
+		return
+	}
+
+	device.Trust = crypto.TrustStateVerified
+	err := verification.mach.CryptoStore.PutDevice(device.UserID, device)
+	if err != nil {
+		debug.Printf("[Crypto/Warn] Failed to store device %s of %s after verifying: %v", device.DeviceID, device.UserID, err)
+	}
+	if !masterKeyVerified {
+		verification.addServiceMessage("Verified device %s of %s, but they didn't send their master key, so their identity couldn't be cross-signed", device.DeviceID, device.UserID)
+	} else if verification.mach.CrossSigningKeys == nil {
+		verification.addServiceMessage("Verified %s, but cross-signing keys are not cached, so their identity couldn't be cross-signed. "+
+			"Unlock your keys with `/cross-signing fetch` and verify again to share the verification with your other devices.", device.UserID)
+	} else if err = verification.mach.SignUser(device.UserID, masterKey); err != nil {
+		verification.addServiceMessage("Verified %s, but failed to cross-sign their master key: %v", device.UserID, err)
+	} else {
+		verification.addServiceMessage("Successfully verified %s and cross-signed their master key", device.UserID)
+	}
+
+	_, err = verification.send(muksevt.InRoomVerificationDone, &muksevt.VerificationDoneEventContent{
+		RelatesTo: verification.relatesTo(),
+	})
+	if err != nil {
+		debug.Printf("[Crypto/Warn] Failed to send done event for verification %s: %v", verification.TransactionID, err)
+	}
+	verification.finish()
+	go verification.parent.matrix.RefreshUserTrust(device.UserID)
+	go verification.hooks.OnSuccess()
+}
+
+func (verification *InRoomVerification) handleCancel(content *event.VerificationCancelEventContent) {
+	debug.Printf("[Crypto/Warn] Verification %s was cancelled by %s: %s (%s)", verification.TransactionID, verification.OtherUser, content.Reason, content.Code)
+	verification.finish()
+	if verification.hooks != nil {
+		go verification.hooks.OnCancel(false, content.Reason, content.Code)
+	} else {
+		verification.addServiceMessage("Verification request from %s was cancelled: %s", verification.OtherUser, content.Reason)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"strings"
 	"time"
 
+	sync "github.com/sasha-s/go-deadlock"
+
 	"go.mau.fi/mauview"
 	"go.mau.fi/tcell"
 
@@ -67,7 +69,8 @@ func (e *EmojiView) Draw(screen mauview.Screen) {
 type VerificationModal struct {
 	mauview.Component
 
-	device *crypto.DeviceIdentity
+	device     *crypto.DeviceIdentity
+	deviceLock sync.RWMutex
 
 	container *mauview.Box
 
@@ -79,9 +82,12 @@ type VerificationModal struct {
 	progress    int
 	progressMax int
 	stopWaiting chan struct{}
+	stopOnce    sync.Once
 	confirmChan chan bool
 	done        bool
 
+	cancelFunc func()
+
 	parent *MainView
 }
 
@@ -128,6 +134,19 @@ func NewVerificationModal(mainView *MainView, device *crypto.DeviceIdentity, tim
 	return vm
 }
 
+// SetCancelFunc sets the function that is called if the user closes the modal before the verification is done.
+func (vm *VerificationModal) SetCancelFunc(fn func()) *VerificationModal {
+	vm.cancelFunc = fn
+	return vm
+}
+
+func (vm *VerificationModal) finish() {
+	vm.stopOnce.Do(func() {
+		close(vm.stopWaiting)
+	})
+	vm.done = true
+}
+
 func (vm *VerificationModal) decrementWaitingBar() {
 	for {
 		select {
@@ -150,8 +169,21 @@ func (vm *VerificationModal) VerificationMethods() []crypto.VerificationMethod {
 	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
 }
 
-func (vm *VerificationModal) VerifySASMatch(device *crypto.DeviceIdentity, data crypto.SASData) bool {
+// SetDevice changes the device that is being verified.
+func (vm *VerificationModal) SetDevice(device *crypto.DeviceIdentity) {
+	vm.deviceLock.Lock()
 	vm.device = device
+	vm.deviceLock.Unlock()
+}
+
+func (vm *VerificationModal) getDevice() *crypto.DeviceIdentity {
+	vm.deviceLock.RLock()
+	defer vm.deviceLock.RUnlock()
+	return vm.device
+}
+
+func (vm *VerificationModal) VerifySASMatch(device *crypto.DeviceIdentity, data crypto.SASData) bool {
+	vm.SetDevice(device)
 	var typeName string
 	if data.Type() == event.SASDecimal {
 		typeName = "numbers"
@@ -172,10 +204,15 @@ func (vm *VerificationModal) VerifySASMatch(device *crypto.DeviceIdentity, data
 	vm.emojiText.Data = data
 	vm.parent.parent.Render()
 	vm.progress = vm.progressMax
-	confirm := <-vm.confirmChan
+	var confirm bool
+	select {
+	case confirm = <-vm.confirmChan:
+	case <-vm.stopWaiting:
+		return false
+	}
 	vm.progress = vm.progressMax
 	vm.emojiText.Data = nil
-	vm.infoText.SetText(fmt.Sprintf("Waiting for %s\nto confirm", vm.device.UserID))
+	vm.infoText.SetText(fmt.Sprintf("Waiting for %s\nto confirm", device.UserID))
 	vm.parent.parent.Render()
 	return confirm
 }
@@ -186,25 +223,46 @@ func (vm *VerificationModal) OnCancel(cancelledByUs bool, reason string, _ event
 	if cancelledByUs {
 		vm.infoText.SetText(fmt.Sprintf("Verification failed: %s", reason))
 	} else {
-		vm.infoText.SetText(fmt.Sprintf("Verification cancelled by %s: %s", vm.device.UserID, reason))
+		vm.infoText.SetText(fmt.Sprintf("Verification cancelled by %s: %s", vm.getDevice().UserID, reason))
 	}
 	vm.inputBar.SetPlaceholder("Press enter to close the dialog")
-	vm.stopWaiting <- struct{}{}
-	vm.done = true
+	vm.finish()
 	vm.parent.parent.Render()
 }
 
 func (vm *VerificationModal) OnSuccess() {
 	vm.waitingBar.SetIndeterminate(false).SetMax(100).SetProgress(100)
 	vm.parent.parent.app.SetRedrawTicker(1 * time.Minute)
-	vm.infoText.SetText(fmt.Sprintf("Successfully verified %s (%s) of %s", vm.device.Name, vm.device.DeviceID, vm.device.UserID))
+	device := vm.getDevice()
+	vm.infoText.SetText(fmt.Sprintf("Successfully verified %s (%s) of %s", device.Name, device.DeviceID, device.UserID))
 	vm.inputBar.SetPlaceholder("Press enter to close the dialog")
-	vm.stopWaiting <- struct{}{}
-	vm.done = true
+	vm.finish()
 	vm.parent.parent.Render()
+	mach := vm.parent.matrix.Crypto().(*crypto.OlmMachine)
 	if vm.parent.config.SendToVerifiedOnly {
 		// Hacky way to make new group sessions after verified
-		vm.parent.matrix.Crypto().(*crypto.OlmMachine).OnDevicesChanged(vm.device.UserID)
+		mach.OnDevicesChanged(device.UserID)
+	}
+	if device.UserID == vm.parent.config.UserID && mach.CrossSigningKeys == nil {
+		// Verifying another one of our devices is enough to get the cross-signing keys from it
+		go vm.requestSecrets()
+	}
+}
+
+func (vm *VerificationModal) requestSecrets() {
+	reply := func(message string, args ...interface{}) {
+		room := vm.parent.currentRoom
+		if room != nil {
+			room.AddServiceMessage(fmt.Sprintf(message, args...))
+			vm.parent.parent.Render()
+		}
+	}
+	deviceID := vm.getDevice().DeviceID
+	err := vm.parent.matrix.RequestSecrets(reply)
+	if err != nil {
+		reply("Failed to request cross-signing keys from %s: %v", deviceID, err)
+	} else {
+		reply("Requested cross-signing keys from your other devices. Confirm the request on %s.", deviceID)
 	}
 }
 
@@ -220,6 +278,9 @@ func (vm *VerificationModal) OnKeyEvent(event mauview.KeyEvent) bool {
 			return true
 		}
 		return false
+	} else if vm.parent.config.Keybindings.Modal[kb] == "cancel" && vm.cancelFunc != nil {
+		go vm.cancelFunc()
+		return true
 	} else if vm.emojiText.Data == nil {
 		debug.Print("Ignoring pre-emoji key event")
 		return false
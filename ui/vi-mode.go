@@ -0,0 +1,852 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/zyedidia/clipboard"
+
+	"go.mau.fi/mauview"
+	"go.mau.fi/tcell"
+
+	"maunium.net/go/gomuks/config"
+)
+
+type viState int
+
+const (
+	viInsert viState = iota
+	viNormal
+	viVisual
+	viVisualLine
+)
+
+func (state viState) String() string {
+	switch state {
+	case viNormal:
+		return "NORMAL"
+	case viVisual:
+		return "VISUAL"
+	case viVisualLine:
+		return "VISUAL LINE"
+	default:
+		return "INSERT"
+	}
+}
+
+// viMode contains the state of the vi-style editing mode of a room's input field.
+type viMode struct {
+	state viState
+
+	count         int
+	operator      string
+	operatorCount int
+	textObject    string
+	register      rune
+	readRegister  bool
+	visualStart   int
+
+	unnamed         string
+	unnamedLinewise bool
+}
+
+func (vi *viMode) clearPending() {
+	vi.count = 0
+	vi.operator = ""
+	vi.operatorCount = 0
+	vi.textObject = ""
+	vi.readRegister = false
+}
+
+func (vi *viMode) reset() {
+	vi.clearPending()
+	vi.register = 0
+}
+
+func (vi *viMode) hasPending() bool {
+	return vi.count > 0 || len(vi.operator) > 0 || len(vi.textObject) > 0 || vi.register != 0 || vi.readRegister
+}
+
+func (vi *viMode) effectiveCount() int {
+	count := vi.count
+	if count == 0 {
+		count = 1
+	}
+	if vi.operatorCount > 0 {
+		count *= vi.operatorCount
+	}
+	return count
+}
+
+// Status returns the mode indicator shown in the status bar.
+func (vi *viMode) Status() string {
+	var buf strings.Builder
+	buf.WriteString("-- ")
+	buf.WriteString(vi.state.String())
+	buf.WriteString(" --")
+	if vi.hasPending() {
+		buf.WriteRune(' ')
+		if vi.readRegister {
+			buf.WriteRune('"')
+		} else if vi.register != 0 {
+			buf.WriteRune('"')
+			buf.WriteRune(vi.register)
+		}
+		if vi.operatorCount > 0 {
+			buf.WriteString(strconv.Itoa(vi.operatorCount))
+		}
+		buf.WriteString(vi.operator)
+		if vi.count > 0 {
+			buf.WriteString(strconv.Itoa(vi.count))
+		}
+		buf.WriteString(vi.textObject)
+	}
+	return buf.String()
+}
+
+func viRuneWidth(ch rune) int {
+	if ch == '\n' {
+		return 1
+	}
+	return runewidth.RuneWidth(ch)
+}
+
+func viWidthOf(text []rune) (width int) {
+	for _, ch := range text {
+		width += viRuneWidth(ch)
+	}
+	return
+}
+
+func viIndexAt(text []rune, width int) int {
+	for i, ch := range text {
+		if width <= 0 {
+			return i
+		}
+		width -= viRuneWidth(ch)
+	}
+	return len(text)
+}
+
+func viLineStart(text []rune, pos int) int {
+	for pos > 0 && text[pos-1] != '\n' {
+		pos--
+	}
+	return pos
+}
+
+func viLineEnd(text []rune, pos int) int {
+	for pos < len(text) && text[pos] != '\n' {
+		pos++
+	}
+	return pos
+}
+
+func viFirstNonBlank(text []rune, pos int) int {
+	pos = viLineStart(text, pos)
+	end := viLineEnd(text, pos)
+	for pos < end && unicode.IsSpace(text[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// viClampNormal moves the cursor onto the last character of the line like vi does outside insert mode.
+func viClampNormal(text []rune, pos int) int {
+	if pos > len(text) {
+		pos = len(text)
+	}
+	if pos >= viLineEnd(text, pos) && pos > viLineStart(text, pos) {
+		pos--
+	}
+	return pos
+}
+
+func viCharClass(ch rune, bigWord bool) int {
+	switch {
+	case unicode.IsSpace(ch):
+		return 0
+	case bigWord, ch == '_', unicode.IsLetter(ch), unicode.IsDigit(ch):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func viWordForward(text []rune, pos int, bigWord bool) int {
+	if pos >= len(text) {
+		return len(text)
+	}
+	class := viCharClass(text[pos], bigWord)
+	for pos < len(text) && class != 0 && viCharClass(text[pos], bigWord) == class {
+		pos++
+	}
+	for pos < len(text) && viCharClass(text[pos], bigWord) == 0 {
+		pos++
+	}
+	return pos
+}
+
+func viWordEnd(text []rune, pos int, bigWord bool) int {
+	pos++
+	for pos < len(text) && viCharClass(text[pos], bigWord) == 0 {
+		pos++
+	}
+	if pos >= len(text) {
+		return len(text) - 1
+	}
+	class := viCharClass(text[pos], bigWord)
+	for pos+1 < len(text) && viCharClass(text[pos+1], bigWord) == class {
+		pos++
+	}
+	return pos
+}
+
+func viWordBackward(text []rune, pos int, bigWord bool) int {
+	if pos <= 0 {
+		return 0
+	}
+	pos--
+	for pos > 0 && viCharClass(text[pos], bigWord) == 0 {
+		pos--
+	}
+	class := viCharClass(text[pos], bigWord)
+	for pos > 0 && viCharClass(text[pos-1], bigWord) == class {
+		pos--
+	}
+	return pos
+}
+
+// viMotion finds where the given motion action moves the cursor. The returned flags tell operators whether the
+// target character is included in the range and whether the motion operates on whole lines.
+func viMotion(action string, text []rune, pos, count int) (target int, inclusive, linewise, ok bool) {
+	target = pos
+	ok = true
+	switch action {
+	case "left":
+		target = pos - count
+		if lineStart := viLineStart(text, pos); target < lineStart {
+			target = lineStart
+		}
+	case "right":
+		target = pos + count
+		if lineEnd := viLineEnd(text, pos); target > lineEnd {
+			target = lineEnd
+		}
+	case "up", "down":
+		linewise = true
+		column := pos - viLineStart(text, pos)
+		for i := 0; i < count; i++ {
+			if action == "up" {
+				lineStart := viLineStart(text, target)
+				if lineStart == 0 {
+					break
+				}
+				target = lineStart - 1
+			} else {
+				lineEnd := viLineEnd(text, target)
+				if lineEnd >= len(text) {
+					break
+				}
+				target = lineEnd + 1
+			}
+		}
+		target = viLineStart(text, target) + column
+		if lineEnd := viLineEnd(text, target-column); target > lineEnd {
+			target = lineEnd
+		}
+	case "word_forward", "bigword_forward":
+		for i := 0; i < count; i++ {
+			target = viWordForward(text, target, action == "bigword_forward")
+		}
+	case "word_end", "bigword_end":
+		inclusive = true
+		for i := 0; i < count; i++ {
+			target = viWordEnd(text, target, action == "bigword_end")
+		}
+	case "word_backward", "bigword_backward":
+		for i := 0; i < count; i++ {
+			target = viWordBackward(text, target, action == "bigword_backward")
+		}
+	case "line_start":
+		target = viLineStart(text, pos)
+	case "first_non_blank":
+		target = viFirstNonBlank(text, pos)
+	case "line_end":
+		for i := 1; i < count; i++ {
+			lineEnd := viLineEnd(text, target)
+			if lineEnd >= len(text) {
+				break
+			}
+			target = lineEnd + 1
+		}
+		target = viLineEnd(text, target)
+	case "first_line":
+		linewise = true
+		target = viFirstNonBlank(text, 0)
+	case "last_line":
+		linewise = true
+		target = viFirstNonBlank(text, len(text))
+	default:
+		ok = false
+	}
+	if target < 0 {
+		target = 0
+	}
+	return
+}
+
+var viBrackets = map[rune][2]rune{
+	'(': {'(', ')'}, ')': {'(', ')'}, 'b': {'(', ')'},
+	'[': {'[', ']'}, ']': {'[', ']'},
+	'{': {'{', '}'}, '}': {'{', '}'}, 'B': {'{', '}'},
+	'<': {'<', '>'}, '>': {'<', '>'},
+}
+
+// viTextObject finds the range of the text object identified by the given rune around the cursor.
+func viTextObject(text []rune, pos int, around bool, object rune) (start, end int, ok bool) {
+	if len(text) == 0 {
+		return
+	} else if pos >= len(text) {
+		pos = len(text) - 1
+	}
+	switch object {
+	case 'w', 'W':
+		bigWord := object == 'W'
+		class := viCharClass(text[pos], bigWord)
+		start, end = pos, pos+1
+		for start > 0 && viCharClass(text[start-1], bigWord) == class {
+			start--
+		}
+		for end < len(text) && viCharClass(text[end], bigWord) == class {
+			end++
+		}
+		if around && class != 0 {
+			trailing := end
+			for trailing < len(text) && text[trailing] != '\n' && unicode.IsSpace(text[trailing]) {
+				trailing++
+			}
+			if trailing > end {
+				end = trailing
+			} else {
+				for start > 0 && text[start-1] != '\n' && unicode.IsSpace(text[start-1]) {
+					start--
+				}
+			}
+		}
+		return start, end, true
+	case '"', '\'', '`':
+		var quotes []int
+		lineEnd := viLineEnd(text, pos)
+		for i := viLineStart(text, pos); i < lineEnd; i++ {
+			if text[i] == object {
+				quotes = append(quotes, i)
+			}
+		}
+		for i := 0; i+1 < len(quotes); i += 2 {
+			if pos <= quotes[i+1] {
+				start, end = quotes[i], quotes[i+1]+1
+				if !around {
+					start++
+					end--
+				}
+				return start, end, true
+			}
+		}
+		return
+	}
+	brackets, isBracket := viBrackets[object]
+	if !isBracket {
+		return
+	}
+	open, closing := brackets[0], brackets[1]
+	start = -1
+	depth := 0
+	for i := pos; i >= 0; i-- {
+		if text[i] == closing && i != pos {
+			depth++
+		} else if text[i] == open {
+			if depth == 0 {
+				start = i
+				break
+			}
+			depth--
+		}
+	}
+	if start < 0 {
+		return
+	}
+	end = -1
+	depth = 0
+	for i := start + 1; i < len(text); i++ {
+		if text[i] == open {
+			depth++
+		} else if text[i] == closing {
+			if depth == 0 {
+				end = i
+				break
+			}
+			depth--
+		}
+	}
+	if end < 0 {
+		return
+	}
+	if around {
+		return start, end + 1, true
+	}
+	return start + 1, end, true
+}
+
+func viLineRange(text []rune, a, b int) (start, end int) {
+	if a > b {
+		a, b = b, a
+	}
+	return viLineStart(text, a), viLineEnd(text, b)
+}
+
+func (view *RoomView) viText() ([]rune, int) {
+	text := []rune(view.input.GetText())
+	return text, viIndexAt(text, view.input.GetCursorOffset())
+}
+
+func (view *RoomView) viSetCursor(text []rune, pos int) {
+	if view.vi.state != viInsert {
+		pos = viClampNormal(text, pos)
+	}
+	view.input.SetCursorOffset(viWidthOf(text[:pos]))
+	view.viUpdateSelection(text, pos)
+}
+
+func (view *RoomView) viSetText(text []rune, pos int) {
+	view.input.SetText(string(text))
+	view.viSetCursor(text, pos)
+}
+
+func (view *RoomView) viUpdateSelection(text []rune, pos int) {
+	var start, end int
+	switch view.vi.state {
+	case viVisual:
+		start, end = view.vi.visualStart, pos
+		if start > end {
+			start, end = end, start
+		}
+		if end < len(text) {
+			end++
+		}
+	case viVisualLine:
+		start, end = viLineRange(text, view.vi.visualStart, pos)
+	default:
+		return
+	}
+	view.input.SetSelection(viWidthOf(text[:start]), viWidthOf(text[:end]))
+}
+
+func (view *RoomView) viEnterState(state viState) {
+	text, pos := view.viText()
+	if view.vi.state == viInsert && state != viInsert && pos > viLineStart(text, pos) {
+		pos--
+	}
+	view.vi.reset()
+	view.vi.state = state
+	view.vi.visualStart = pos
+	view.input.ClearSelection()
+	view.viSetCursor(text, pos)
+}
+
+func (view *RoomView) viInsertAt(text []rune, pos int, insert string) []rune {
+	return append(append(append([]rune{}, text[:pos]...), []rune(insert)...), text[pos:]...)
+}
+
+// viWriteRegister stores yanked or deleted text. The + and * registers are the clipboard and primary selection.
+func (view *RoomView) viWriteRegister(text string, linewise bool) {
+	switch view.vi.register {
+	case '+':
+		go view.CopyToClipboard(text, "clipboard")
+	case '*':
+		go view.CopyToClipboard(text, "primary")
+	case '_':
+		return
+	}
+	view.vi.unnamed = text
+	view.vi.unnamedLinewise = linewise
+}
+
+func (view *RoomView) viReadRegister() (string, bool) {
+	var register string
+	switch view.vi.register {
+	case '+':
+		register = "clipboard"
+	case '*':
+		register = "primary"
+	default:
+		return view.vi.unnamed, view.vi.unnamedLinewise
+	}
+	text, err := clipboard.ReadAll(register)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Clipboard unsupported: %v", err))
+		return "", false
+	}
+	return text, strings.HasSuffix(text, "\n")
+}
+
+// viApplyOperator applies the delete, change or yank operator to the given range. For linewise operations, start and
+// end are positions on the first and last line instead of an exact range.
+func (view *RoomView) viApplyOperator(operator string, text []rune, start, end, cursor int, linewise bool) {
+	defer func() {
+		view.vi.register = 0
+	}()
+	if linewise {
+		lineStart, lineEnd := viLineRange(text, start, end)
+		view.viWriteRegister(string(text[lineStart:lineEnd])+"\n", true)
+		switch operator {
+		case "yank":
+			view.viSetCursor(text, cursor)
+		case "change":
+			text = append(text[:lineStart:lineStart], text[lineEnd:]...)
+			view.vi.state = viInsert
+			view.viSetText(text, lineStart)
+		case "delete":
+			if lineEnd < len(text) {
+				lineEnd++
+			} else if lineStart > 0 {
+				lineStart--
+			}
+			text = append(text[:lineStart:lineStart], text[lineEnd:]...)
+			view.viSetText(text, viFirstNonBlank(text, lineStart))
+		}
+		return
+	}
+	if start > end {
+		start, end = end, start
+	}
+	view.viWriteRegister(string(text[start:end]), false)
+	switch operator {
+	case "yank":
+		view.viSetCursor(text, start)
+	case "change":
+		view.vi.state = viInsert
+		fallthrough
+	case "delete":
+		text = append(text[:start:start], text[end:]...)
+		view.viSetText(text, start)
+	}
+}
+
+func (view *RoomView) viPaste(before bool, count int) {
+	defer func() {
+		view.vi.register = 0
+	}()
+	content, linewise := view.viReadRegister()
+	if len(content) == 0 {
+		return
+	}
+	content = strings.Repeat(content, count)
+	text, pos := view.viText()
+	if linewise {
+		content = strings.TrimSuffix(content, "\n")
+		if before {
+			at := viLineStart(text, pos)
+			view.viSetText(view.viInsertAt(text, at, content+"\n"), at)
+		} else {
+			at := viLineEnd(text, pos)
+			view.viSetText(view.viInsertAt(text, at, "\n"+content), at+1)
+		}
+		return
+	}
+	at := pos
+	if !before && pos < viLineEnd(text, pos) {
+		at++
+	}
+	view.viSetText(view.viInsertAt(text, at, content), at+len([]rune(content))-1)
+}
+
+func (view *RoomView) viUndo(redo bool) {
+	if redo {
+		view.input.Redo()
+	} else {
+		view.input.Undo()
+	}
+	view.parent.InputChanged(view, view.input.GetText())
+	text, pos := view.viText()
+	view.viSetCursor(text, pos)
+}
+
+func (view *RoomView) viOnTextObject(around bool, object rune) {
+	text, pos := view.viText()
+	start, end, ok := viTextObject(text, pos, around, object)
+	if !ok || start >= end {
+		view.vi.reset()
+		return
+	}
+	if view.vi.state == viNormal {
+		operator := view.vi.operator
+		view.vi.clearPending()
+		view.viApplyOperator(operator, text, start, end, start, false)
+		return
+	}
+	view.vi.state = viVisual
+	view.vi.visualStart = start
+	view.viSetCursor(text, end-1)
+}
+
+func (view *RoomView) viOnMotion(action string) bool {
+	text, pos := view.viText()
+	count := view.vi.effectiveCount()
+	operator := view.vi.operator
+	if operator == "change" && (action == "word_forward" || action == "bigword_forward") &&
+		pos < len(text) && !unicode.IsSpace(text[pos]) {
+		// Like in vi, cw changes to the end of the word instead of the start of the next word.
+		action = strings.Replace(action, "forward", "end", 1)
+	}
+	target, inclusive, linewise, ok := viMotion(action, text, pos, count)
+	if !ok {
+		return false
+	}
+	view.vi.clearPending()
+	if len(operator) == 0 {
+		view.viSetCursor(text, target)
+		return true
+	}
+	if linewise {
+		view.viApplyOperator(operator, text, pos, target, pos, true)
+		return true
+	}
+	start, end := pos, target
+	if start > end {
+		start, end = end, start
+	}
+	if inclusive && end < len(text) {
+		end++
+	}
+	view.viApplyOperator(operator, text, start, end, start, false)
+	return true
+}
+
+func (view *RoomView) viOnOperator(operator string) {
+	vi := &view.vi
+	text, pos := view.viText()
+	if vi.state == viVisual || vi.state == viVisualLine {
+		linewise := vi.state == viVisualLine
+		start, end := vi.visualStart, pos
+		if start > end {
+			start, end = end, start
+		}
+		if !linewise && end < len(text) {
+			end++
+		}
+		vi.clearPending()
+		vi.state = viNormal
+		view.input.ClearSelection()
+		view.viApplyOperator(operator, text, start, end, start, linewise)
+		return
+	}
+	if vi.operator == operator {
+		// Doubled operators (dd, cc, yy) operate on whole lines.
+		target, _, _, _ := viMotion("down", text, pos, vi.effectiveCount()-1)
+		vi.clearPending()
+		view.viApplyOperator(operator, text, pos, target, pos, true)
+		return
+	} else if len(vi.operator) > 0 {
+		vi.reset()
+		return
+	}
+	vi.operator = operator
+	vi.operatorCount = vi.count
+	vi.count = 0
+}
+
+func (view *RoomView) viOnAction(action string) bool {
+	vi := &view.vi
+	visual := vi.state == viVisual || vi.state == viVisualLine
+	if (action == "insert" || action == "append") && (len(vi.operator) > 0 || visual) {
+		if action == "insert" {
+			vi.textObject = "i"
+		} else {
+			vi.textObject = "a"
+		}
+		return true
+	}
+	if visual {
+		// Like in vi, the single-character commands operate on the selection in visual mode.
+		switch action {
+		case "delete_char", "delete_to_end":
+			action = "delete"
+		case "substitute", "change_to_end":
+			action = "change"
+		case "yank_line":
+			action = "yank"
+		}
+	}
+	switch action {
+	case "delete", "change", "yank":
+		view.viOnOperator(action)
+		return true
+	}
+	if view.viOnMotion(action) {
+		return true
+	}
+
+	count := vi.effectiveCount()
+	text, pos := view.viText()
+	lineStart, lineEnd := viLineStart(text, pos), viLineEnd(text, pos)
+	vi.clearPending()
+	defer func() {
+		if !vi.readRegister {
+			vi.register = 0
+		}
+	}()
+
+	switch action {
+	case "normal_mode":
+		view.viEnterState(viNormal)
+	case "visual":
+		if vi.state == viVisual {
+			view.viEnterState(viNormal)
+		} else {
+			vi.state = viVisual
+			if !visual {
+				vi.visualStart = pos
+			}
+			view.viSetCursor(text, pos)
+		}
+	case "visual_line":
+		if vi.state == viVisualLine {
+			view.viEnterState(viNormal)
+		} else {
+			vi.state = viVisualLine
+			if !visual {
+				vi.visualStart = pos
+			}
+			view.viSetCursor(text, pos)
+		}
+	case "register":
+		vi.readRegister = true
+		return true
+	case "insert", "append", "insert_line_start", "append_line_end", "open_below", "open_above":
+		vi.state = viInsert
+		switch action {
+		case "append":
+			if pos < lineEnd {
+				pos++
+			}
+		case "insert_line_start":
+			pos = viFirstNonBlank(text, pos)
+		case "append_line_end":
+			pos = lineEnd
+		case "open_below":
+			text = view.viInsertAt(text, lineEnd, "\n")
+			view.viSetText(text, lineEnd+1)
+			return true
+		case "open_above":
+			text = view.viInsertAt(text, lineStart, "\n")
+			view.viSetText(text, lineStart)
+			return true
+		}
+		view.viSetCursor(text, pos)
+	case "delete_char", "substitute":
+		end := pos + count
+		if end > lineEnd {
+			end = lineEnd
+		}
+		operator := "delete"
+		if action == "substitute" {
+			operator = "change"
+		}
+		if end > pos || operator == "change" {
+			view.viApplyOperator(operator, text, pos, end, pos, false)
+		}
+	case "delete_char_before":
+		start := pos - count
+		if start < lineStart {
+			start = lineStart
+		}
+		if start < pos {
+			view.viApplyOperator("delete", text, start, pos, start, false)
+		}
+	case "delete_to_end", "change_to_end":
+		operator := strings.TrimSuffix(action, "_to_end")
+		view.viApplyOperator(operator, text, pos, lineEnd, pos, false)
+	case "yank_line":
+		target, _, _, _ := viMotion("down", text, pos, count-1)
+		view.viApplyOperator("yank", text, pos, target, pos, true)
+	case "paste_after", "paste_before":
+		view.viPaste(action == "paste_before", count)
+	case "undo", "redo":
+		for i := 0; i < count; i++ {
+			view.viUndo(action == "redo")
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// onViKeyEvent handles key events when vi mode is enabled. Keys that aren't used by vi mode fall through to the
+// normal room keybindings.
+func (view *RoomView) onViKeyEvent(event mauview.KeyEvent, kb config.Keybind) bool {
+	vi := &view.vi
+	action := view.config.Keybindings.Vi[kb]
+	if vi.state == viInsert {
+		if action == "normal_mode" {
+			view.viEnterState(viNormal)
+			return true
+		}
+		return false
+	}
+
+	isRune := event.Key() == tcell.KeyRune && event.Modifiers()&(tcell.ModCtrl|tcell.ModAlt) == 0
+	if vi.readRegister {
+		vi.readRegister = false
+		if isRune {
+			vi.register = event.Rune()
+		} else {
+			vi.reset()
+		}
+		return true
+	} else if len(vi.textObject) > 0 {
+		around := vi.textObject == "a"
+		vi.textObject = ""
+		if isRune {
+			view.viOnTextObject(around, event.Rune())
+		} else {
+			vi.reset()
+		}
+		return true
+	} else if isRune && event.Rune() >= '0' && event.Rune() <= '9' && (event.Rune() != '0' || vi.count > 0) {
+		vi.count = vi.count*10 + int(event.Rune()-'0')
+		return true
+	}
+
+	if action == "normal_mode" {
+		if vi.state == viVisual || vi.state == viVisualLine || vi.hasPending() {
+			view.viEnterState(viNormal)
+			return true
+		}
+		return false
+	} else if len(action) > 0 && view.viOnAction(action) {
+		return true
+	}
+	vi.reset()
+	// Other printable keys must not end up typed into the input outside insert mode.
+	return isRune
+}
@@ -53,8 +53,15 @@ type MainView struct {
 
 	modal mauview.Component
 
+	verifications     map[string]*InRoomVerification
+	verificationsLock sync.RWMutex
+
 	lastFocusTime time.Time
 
+	dirtyDrafts     map[id.RoomID]*RoomView
+	dirtyDraftsLock sync.Mutex
+	draftSaveTimer  *time.Timer
+
 	matrix ifc.MatrixContainer
 	gmx    ifc.Gomuks
 	config *config.Config
@@ -67,6 +74,10 @@ func (ui *GomuksUI) NewMainView() mauview.Component {
 		roomView: mauview.NewBox(nil).SetBorder(false),
 		rooms:    make(map[id.RoomID]*RoomView),
 
+		dirtyDrafts: make(map[id.RoomID]*RoomView),
+
+		verifications: make(map[string]*InRoomVerification),
+
 		matrix: ui.gmx.Matrix(),
 		gmx:    ui.gmx,
 		config: ui.gmx.Config(),
@@ -74,6 +85,7 @@ func (ui *GomuksUI) NewMainView() mauview.Component {
 	}
 	mainView.roomList = NewRoomList(mainView)
 	mainView.cmdProcessor = NewCommandProcessor(mainView)
+	notification.SetActionHandler(mainView)
 
 	mainView.flex.
 		AddFixedComponent(mainView.roomList, 25).
@@ -112,6 +124,7 @@ func (view *MainView) Draw(screen mauview.Screen) {
 	if view.modal != nil {
 		view.modal.Draw(screen)
 	}
+	view.parent.flushTerminalOutput()
 }
 
 func (view *MainView) BumpFocus(roomView *RoomView) {
@@ -134,11 +147,54 @@ func (view *MainView) MarkRead(roomView *RoomView) {
 }
 
 func (view *MainView) InputChanged(roomView *RoomView, text string) {
+	if roomView.restoringDraft {
+		return
+	}
+	view.queueDraftSave(roomView)
 	if !roomView.config.Preferences.DisableTypingNotifs {
 		view.matrix.SendTyping(roomView.Room.ID, len(text) > 0 && text[0] != '/')
 	}
 }
 
+const draftSaveDelay = 2 * time.Second
+
+// queueDraftSave marks the draft of the given room as changed and saves all changed drafts after a short delay.
+func (view *MainView) queueDraftSave(roomView *RoomView) {
+	view.dirtyDraftsLock.Lock()
+	view.dirtyDrafts[roomView.Room.ID] = roomView
+	if view.draftSaveTimer == nil {
+		view.draftSaveTimer = time.AfterFunc(draftSaveDelay, view.SaveDrafts)
+	}
+	view.dirtyDraftsLock.Unlock()
+}
+
+// SaveDrafts immediately saves the drafts of all rooms whose input changed since the last save.
+func (view *MainView) SaveDrafts() {
+	view.dirtyDraftsLock.Lock()
+	dirty := view.dirtyDrafts
+	view.dirtyDrafts = make(map[id.RoomID]*RoomView)
+	if view.draftSaveTimer != nil {
+		view.draftSaveTimer.Stop()
+		view.draftSaveTimer = nil
+	}
+	view.dirtyDraftsLock.Unlock()
+	for roomID, roomView := range dirty {
+		view.matrix.SaveDraft(roomID, roomView.Draft())
+	}
+}
+
+// UpdateDraft applies a draft synced from another device, unless the room already has different unsent input.
+func (view *MainView) UpdateDraft(roomID id.RoomID, draft *config.Draft) {
+	roomView, ok := view.getRoomView(roomID, true)
+	if !ok {
+		return
+	} else if current := roomView.Draft(); current != nil && current.Text != draft.Text && view.currentRoom == roomView {
+		return
+	}
+	roomView.RestoreDraft(draft)
+	view.parent.Render()
+}
+
 func (view *MainView) ShowBare(roomView *RoomView) {
 	if roomView == nil {
 		return
@@ -163,6 +219,12 @@ func (view *MainView) OpenSyncingModal() ifc.SyncingModal {
 	return modal
 }
 
+func (view *MainView) OpenProgressModal(title string) *SyncingModal {
+	component, modal := NewProgressModal(view, title)
+	view.ShowModal(component)
+	return modal
+}
+
 func (view *MainView) OnKeyEvent(event mauview.KeyEvent) bool {
 	view.BumpFocus(view.currentRoom)
 
@@ -299,6 +361,11 @@ func (view *MainView) GetRoom(roomID id.RoomID) ifc.RoomView {
 	return room
 }
 
+// WantsAllEvents returns false, as rooms are loaded when they're opened and their history is read from the database.
+func (view *MainView) WantsAllEvents() bool {
+	return false
+}
+
 func (view *MainView) getRoomView(roomID id.RoomID, lock bool) (room *RoomView, ok bool) {
 	if lock {
 		view.roomsLock.RLock()
@@ -387,12 +454,14 @@ func (view *MainView) SetTyping(roomID id.RoomID, users []id.UserID) {
 	}
 }
 
-func sendNotification(room *rooms.Room, sender, text string, critical, sound bool) {
-	if room.GetTitle() != sender {
-		sender = fmt.Sprintf("%s (%s)", sender, room.GetTitle())
+// NotifySecurityWarning sends a desktop notification about an encryption-related warning, such as a verified user
+// adding an unverified device.
+func (view *MainView) NotifySecurityWarning(message string) {
+	if view.config.Preferences.DisableNotifications {
+		return
 	}
-	debug.Printf("Sending notification with body \"%s\" from %s in room ID %s (critical=%v, sound=%v)", text, sender, room.ID, critical, sound)
-	notification.Send(sender, text, critical, sound)
+	debug.Printf("Sending security warning notification: %s", message)
+	notification.Send("gomuks security warning", message, true, view.config.NotifySound)
 }
 
 func (view *MainView) Bump(room *rooms.Room) {
@@ -423,7 +492,11 @@ func (view *MainView) NotifyMessage(room *rooms.Room, message ifc.Message, shoul
 		shouldPlaySound := should.PlaySound &&
 			should.SoundName == "default" &&
 			view.config.NotifySound
-		sendNotification(room, message.NotificationSenderName(), message.NotificationContent(), should.Highlight, shouldPlaySound)
+		var senderID id.UserID
+		if ok {
+			senderID = uiMsg.SenderID
+		}
+		view.sendNotification(room, senderID, message, should.Highlight, shouldPlaySound)
 	}
 
 	// TODO this should probably happen somewhere else
@@ -447,8 +520,16 @@ func (view *MainView) LoadHistory(roomID id.RoomID) {
 	// Update the "Loading more messages..." text
 	view.parent.Render()
 
+	if window := msgView.getDetached(); window != nil {
+		view.loadDetachedHistory(roomView, window)
+		return
+	}
+
 	history, newLoadPtr, err := view.matrix.GetHistory(roomView.Room, 50, msgView.historyLoadPtr)
-	if err != nil {
+	if msgView.IsDetached() {
+		// The view jumped to another event while loading.
+		return
+	} else if err != nil {
 		roomView.AddServiceMessage("Failed to fetch history")
 		debug.Print("Failed to fetch history for", roomView.Room.ID, err)
 		view.parent.Render()
@@ -461,3 +542,235 @@ func (view *MainView) LoadHistory(roomID id.RoomID) {
 	}
 	view.parent.Render()
 }
+
+// FillTimelineGap loads the messages missing from the given gap and shows them in its place.
+func (view *MainView) FillTimelineGap(roomID id.RoomID, gapMsg *messages.UIMessage) {
+	defer debug.Recover()
+	roomView, ok := view.getRoomView(roomID, true)
+	gap, isGap := gapMsg.Renderer.(*messages.TimelineGapMessage)
+	if !ok || !isGap {
+		return
+	}
+	msgView := roomView.MessageView()
+
+	if !atomic.CompareAndSwapInt32(&msgView.fillingGap, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&msgView.fillingGap, 0)
+	gap.SetState(messages.TimelineGapLoading)
+	view.parent.Render()
+
+	history, newGap, err := view.matrix.FillTimelineGap(roomView.Room, gapMsg.Event, 50)
+	if err != nil {
+		gap.SetState(messages.TimelineGapFailed)
+		debug.Print("Failed to fill timeline gap in", roomView.Room.ID, err)
+		view.parent.Render()
+		return
+	}
+	newMessages := make([]*messages.UIMessage, 0, len(history)+1)
+	if newGap != nil {
+		if msg := roomView.parseEvent(newGap); msg != nil {
+			newMessages = append(newMessages, msg)
+		}
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if msg := roomView.parseEvent(history[i]); msg != nil {
+			newMessages = append(newMessages, msg)
+		}
+	}
+	msgView.replaceGap(gapMsg, newMessages)
+	view.parent.Render()
+	// The remaining part of the gap might still be visible.
+	msgView.fillVisibleGaps()
+}
+
+const eventContextSize = 30
+
+// JumpToEvent switches to the given room and shows the given event. If the event isn't loaded in the live timeline,
+// the events around it are fetched from the server and shown in a detached window.
+func (view *MainView) JumpToEvent(roomID id.RoomID, eventID id.EventID) error {
+	roomView, ok := view.getRoomView(roomID, true)
+	if !ok {
+		return fmt.Errorf("room %s not found", roomID)
+	}
+	msgView := roomView.MessageView()
+	if msg := msgView.getMessageByID(eventID); msg != nil {
+		view.SwitchRoom("", roomView.Room)
+		msgView.ScrollToMessage(msg)
+		view.parent.Render()
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&msgView.loadingMessages, 0, 1) {
+		return fmt.Errorf("already loading messages")
+	}
+	// Don't load the live timeline when switching to the room.
+	historyWasLoaded := msgView.initialHistoryLoaded
+	msgView.initialHistoryLoaded = true
+	view.SwitchRoom("", roomView.Room)
+	view.parent.Render()
+
+	history, start, end, err := view.matrix.GetEventContext(roomView.Room, eventID, eventContextSize)
+	if err != nil {
+		atomic.StoreInt32(&msgView.loadingMessages, 0)
+		if !historyWasLoaded {
+			// Load the live timeline that was skipped when switching to the room.
+			go view.LoadHistory(roomID)
+		}
+		return err
+	}
+	defer atomic.StoreInt32(&msgView.loadingMessages, 0)
+	msgs := make([]*messages.UIMessage, 0, len(history))
+	for _, evt := range history {
+		if msg := roomView.parseEvent(evt); msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	msgView.setDetached(msgs, start, end)
+	if msg := msgView.getMessageByID(eventID); msg != nil {
+		msgView.ScrollToMessage(msg)
+	}
+	view.parent.Render()
+	return nil
+}
+
+// ReturnToLiveTimeline replaces the detached window in the given room with the live timeline.
+func (view *MainView) ReturnToLiveTimeline(roomView *RoomView) {
+	msgView := roomView.MessageView()
+	if !msgView.IsDetached() {
+		return
+	}
+	msgView.Unload()
+	msgView.initialHistoryLoaded = true
+	go view.LoadHistory(roomView.Room.ID)
+}
+
+func (view *MainView) loadDetachedHistory(roomView *RoomView, window *detachedWindow) {
+	if window.reachedStart {
+		return
+	}
+	history, start, err := view.matrix.PaginateEventContext(roomView.Room, window.start, true, 50)
+	if err != nil {
+		roomView.AddServiceMessage("Failed to fetch history")
+		debug.Print("Failed to fetch detached history for", roomView.Room.ID, err)
+		view.parent.Render()
+		return
+	} else if roomView.MessageView().getDetached() != window {
+		return
+	}
+	window.start = start
+	window.reachedStart = len(history) == 0
+	for _, evt := range history {
+		roomView.AddHistoryEvent(evt)
+	}
+	view.parent.Render()
+}
+
+// LoadDetachedFuture loads newer events into the detached window of the given room,
+// and returns to the live timeline once the window has caught up.
+func (view *MainView) LoadDetachedFuture(roomID id.RoomID) {
+	defer debug.Recover()
+	roomView, ok := view.getRoomView(roomID, true)
+	if !ok {
+		return
+	}
+	msgView := roomView.MessageView()
+	window := msgView.getDetached()
+	if window == nil || !atomic.CompareAndSwapInt32(&msgView.loadingMessages, 0, 1) {
+		return
+	}
+	history, end, err := view.matrix.PaginateEventContext(roomView.Room, window.end, false, 50)
+	atomic.StoreInt32(&msgView.loadingMessages, 0)
+	if err != nil {
+		roomView.AddServiceMessage("Failed to fetch newer messages")
+		debug.Print("Failed to fetch detached future for", roomView.Room.ID, err)
+		view.parent.Render()
+		return
+	} else if msgView.getDetached() != window {
+		return
+	} else if len(history) == 0 {
+		view.ReturnToLiveTimeline(roomView)
+		return
+	}
+	window.end = end
+	for _, evt := range history {
+		if msg := roomView.parseEvent(evt); msg != nil {
+			msgView.AddMessage(msg, AppendMessage)
+		}
+	}
+	view.parent.Render()
+}
+
+// OpenMatrixURI handles a matrix: URI or a matrix.to link inside gomuks.
+// Errors are shown in the current room.
+func (view *MainView) OpenMatrixURI(uri *id.MatrixURI) {
+	defer debug.Recover()
+	err := view.openMatrixURI(uri)
+	if err != nil {
+		view.reportError(fmt.Sprintf("Failed to open %s: %v", uri.MatrixToURL(), err))
+	}
+}
+
+func (view *MainView) openMatrixURI(uri *id.MatrixURI) error {
+	switch uri.Sigil1 {
+	case '@':
+		return view.OpenUserInfo(uri.UserID())
+	case '!', '#':
+	default:
+		return fmt.Errorf("unsupported link type")
+	}
+	room, err := view.joinLinkedRoom(uri)
+	if err != nil || room == nil {
+		return err
+	}
+	if uri.Sigil2 == '$' {
+		return view.JumpToEvent(room.ID, uri.EventID())
+	}
+	view.SwitchRoom("", room)
+	view.parent.Render()
+	return nil
+}
+
+// joinLinkedRoom returns the room the given URI points to, joining it first if necessary.
+// If the user declines joining the room, both return values are nil.
+func (view *MainView) joinLinkedRoom(uri *id.MatrixURI) (*rooms.Room, error) {
+	roomID := uri.RoomID()
+	if uri.Sigil1 == '#' {
+		resp, err := view.matrix.Client().ResolveAlias(uri.RoomAlias())
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", uri.RoomAlias(), err)
+		}
+		roomID = resp.RoomID
+	}
+	if room := view.matrix.GetRoom(roomID); room != nil && !room.HasLeft {
+		if _, ok := view.getRoomView(roomID, true); ok {
+			return room, nil
+		}
+	}
+	var server string
+	if len(uri.Via) > 0 {
+		server = uri.Via[0]
+	}
+	identifier := roomID
+	if uri.Sigil1 == '#' {
+		identifier = id.RoomID(uri.RoomAlias())
+	}
+	if !view.AskConfirmation("Join room", fmt.Sprintf("Join %s?", identifier), "Join", nil) {
+		return nil, nil
+	}
+	room, err := view.matrix.JoinRoom(identifier, server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join room: %w", err)
+	}
+	view.AddRoom(room)
+	return room, nil
+}
+
+// reportError shows the given error message in the current room, or in the debug log if no room is open.
+func (view *MainView) reportError(message string) {
+	if view.currentRoom == nil {
+		debug.Print(message)
+		return
+	}
+	view.currentRoom.AddServiceMessage(message)
+	view.parent.Render()
+}
@@ -0,0 +1,39 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2020 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package widget
+
+import (
+	"go.mau.fi/tcell"
+
+	ifc "maunium.net/go/gomuks/interface"
+)
+
+// GetTrustMarker returns the character and color that should be used to display the given cross-signing trust state.
+//
+// The returned character is zero if nothing should be displayed.
+func GetTrustMarker(trust ifc.UserTrust) (rune, tcell.Color) {
+	switch trust {
+	case ifc.UserTrustVerified:
+		return '✔', tcell.ColorGreen
+	case ifc.UserTrustUnverifiedDevices:
+		return '!', tcell.ColorRed
+	case ifc.UserTrustUnverified:
+		return '?', tcell.ColorGray
+	default:
+		return 0, tcell.ColorDefault
+	}
+}